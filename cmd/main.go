@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 
 	"github.com/mangudaigb/context-service/internal"
 	"github.com/mangudaigb/context-service/internal/consumer"
+	"github.com/mangudaigb/context-service/internal/encryption"
 	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
 	"github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
 	"github.com/mangudaigb/context-service/pkg"
 	"github.com/mangudaigb/dhauli-base/config"
 	consumer2 "github.com/mangudaigb/dhauli-base/consumer"
@@ -31,6 +35,22 @@ func main() {
 		panic(err)
 	}
 
+	set, err := settings.Load()
+	if err != nil {
+		log.Fatalf("Error reading the context service settings: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(RunMigrateCommand(context.Background(), cfg, log, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		os.Exit(RunRotateKeysCommand(context.Background(), cfg, set, log))
+	}
+
+	if err := MigrateOnStartup(context.Background(), cfg, log); err != nil {
+		log.Fatalf("Error migrating the database: %v", err)
+	}
+
 	tp := tracing.InitTracerProvider(cfg, log)
 	defer func() {
 		if err := tp.Shutdown(context.Background()); err != nil {
@@ -42,23 +62,29 @@ func main() {
 	registry := discover.NewRegistryInfo(cfg, log)
 	registry.Register(discover.SERVICE)
 
-	StartConsumer(context.Background(), cfg, tr, log)
+	StartConsumer(context.Background(), cfg, set, tr, log)
 
-	server := pkg.NewContextServer(cfg, tr, log)
+	server := pkg.NewContextServer(cfg, set, tr, log)
 	server.Start()
 
 }
 
-func StartConsumer(ctx context.Context, cfg *config.Config, tr trace.Tracer, log *logger.Logger) {
+func StartConsumer(ctx context.Context, cfg *config.Config, set *settings.Settings, tr trace.Tracer, log *logger.Logger) {
 	mongoClient, err := db.NewMongoClient(cfg, log)
 	if err != nil {
 		log.Fatalf("Error creating mongo client: %v", err)
 	}
 
-	var contextHistoryRepo = repo.NewContextHistoryRepository(cfg, log, *mongoClient.Client, "context_histories")
-	var contextRepo = repo.NewContextRepository(cfg, log, *mongoClient.Client, "contexts")
+	enc, err := encryption.LoadEncryptor(set.Encryption.KeyringFile)
+	if err != nil {
+		log.Fatalf("Error loading the keyring: %v", err)
+	}
+	var contextHistoryRepo = repo.NewContextHistoryRepository(cfg, log, *mongoClient.Client, repo.ContextHistoriesCollection, set.Storage.Histories, enc)
+	var contextRepo = repo.NewContextRepository(cfg, log, *mongoClient.Client, repo.ContextsCollection, set.Storage.Contexts, enc)
+	var transactor = repo.NewMongoTransactor(log, mongoClient.Client)
+	var schemaRepo = repo.NewSchemaRepository(cfg, log, *mongoClient.Client)
 	var contextHistorySvc = svc.NewContextHistoryService(log, contextHistoryRepo)
-	var contextSvc = svc.NewContextService(log, contextRepo, contextHistorySvc)
+	var contextSvc = svc.NewContextService(log, contextRepo, contextHistorySvc, transactor, schemaRepo, tokenizer.NewApproximate())
 	var contextMsgHandler = consumer.NewContextMsgHandler(tr, log, contextSvc)
 	var msgHandler = internal.NewMessageHandler(tr, log, contextMsgHandler)
 
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mangudaigb/context-service/internal/migrate"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/db"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+const migrateUsage = "usage: context-service migrate [up|status|dry-run]"
+
+func newMigrator(cfg *config.Config, log *logger.Logger) (*migrate.Migrator, *db.MongoClient, error) {
+	mongoClient, err := db.NewMongoClient(cfg, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	database := mongoClient.Client.Database(cfg.Mongo.Database)
+	m, err := migrate.NewMigrator(log, migrate.NewMongoStore(log, database), database, migrate.All())
+	if err != nil {
+		mongoClient.Close()
+		return nil, nil, err
+	}
+	return m, mongoClient, nil
+}
+
+// MigrateOnStartup applies the pending migrations before the service starts
+// serving. Concurrent instances wait on the migration lock. It refuses to
+// start while an offline migration is pending, since those are only applied
+// by the migrate command with every instance stopped.
+func MigrateOnStartup(ctx context.Context, cfg *config.Config, log *logger.Logger) error {
+	m, mongoClient, err := newMigrator(cfg, log)
+	if err != nil {
+		return err
+	}
+	defer mongoClient.Close()
+
+	applied, err := m.UpOnline(ctx)
+	if errors.Is(err, migrate.ErrOffline) {
+		return fmt.Errorf("%w: stop every instance and run \"context-service migrate up\"", err)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Applied %d migrations", len(applied))
+	return nil
+}
+
+// RunMigrateCommand implements the migrate subcommand and returns the process exit code.
+func RunMigrateCommand(ctx context.Context, cfg *config.Config, log *logger.Logger, args []string) int {
+	if len(args) != 1 {
+		fmt.Println(migrateUsage)
+		return 2
+	}
+	m, mongoClient, err := newMigrator(cfg, log)
+	if err != nil {
+		fmt.Println("Error creating the migrator:", err)
+		return 1
+	}
+	defer mongoClient.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, mig := range applied {
+			fmt.Printf("applied  %4d  %s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("nothing to migrate")
+		}
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02T15:04:05Z07:00")
+			} else if s.Offline {
+				state = "pending, offline"
+			}
+			fmt.Printf("%4d  %-30s  %s\n", s.Version, s.Name, state)
+		}
+	case "dry-run":
+		plans, err := m.DryRun(ctx)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		if len(plans) == 0 {
+			fmt.Println("nothing to migrate")
+		}
+		for _, s := range plans {
+			fmt.Printf("%4d  %-30s  %s\n", s.Version, s.Name, s.Plan)
+		}
+	default:
+		fmt.Println(migrateUsage)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mangudaigb/context-service/internal/encryption"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/db"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+// RunRotateKeysCommand implements the rotate-keys subcommand: once a tenant
+// key has been rotated in the keyring, it rewraps the data keys wrapped by the
+// previous key. It returns the process exit code.
+func RunRotateKeysCommand(ctx context.Context, cfg *config.Config, set *settings.Settings, log *logger.Logger) int {
+	enc, err := encryption.LoadEncryptor(set.Encryption.KeyringFile)
+	if err != nil {
+		fmt.Println("Error loading the keyring:", err)
+		return 1
+	}
+	if enc == nil {
+		fmt.Println("no keyring is configured")
+		return 2
+	}
+	mongoClient, err := db.NewMongoClient(cfg, log)
+	if err != nil {
+		fmt.Println("Error creating mongo client:", err)
+		return 1
+	}
+	defer mongoClient.Close()
+
+	n, err := repo.RewrapDataKeys(ctx, mongoClient.Client.Database(cfg.Mongo.Database), enc)
+	fmt.Printf("rewrapped %d data keys\n", n)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,68 @@
+// Package codec compresses the content stored by the repositories. The name of
+// the codec is stored next to the compressed bytes so that documents written
+// with different codecs, or none, can be read side by side.
+package codec
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Codec string
+
+const (
+	None   Codec = ""
+	Zstd   Codec = "zstd"
+	Snappy Codec = "snappy"
+)
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// The zstd encoder and decoder are safe for concurrent use through EncodeAll
+// and DecodeAll, and costly to create.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Parse returns the codec of the given name, "none" or the empty name being
+// no compression.
+func Parse(name string) (Codec, error) {
+	switch c := Codec(name); c {
+	case None, Zstd, Snappy:
+		return c, nil
+	case "none":
+		return None, nil
+	default:
+		return None, fmt.Errorf("%w %q", ErrUnknownCodec, name)
+	}
+}
+
+func (c Codec) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return data, nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case Snappy:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, string(c))
+	}
+}
+
+func (c Codec) Decompress(data []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return data, nil
+	case Zstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case Snappy:
+		return snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, string(c))
+	}
+}
@@ -0,0 +1,39 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	text := []byte(strings.Repeat("You are a helpful assistant. Answer briefly.\n", 200))
+	for _, c := range []Codec{None, Zstd, Snappy} {
+		compressed, err := c.Compress(text)
+		if err != nil {
+			t.Fatalf("%q compress: %v", c, err)
+		}
+		if c != None && len(compressed) >= len(text) {
+			t.Fatalf("%q did not compress: %d >= %d bytes", c, len(compressed), len(text))
+		}
+		got, err := c.Decompress(compressed)
+		if err != nil || !bytes.Equal(got, text) {
+			t.Fatalf("%q round trip failed: %v", c, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for name, want := range map[string]Codec{"": None, "none": None, "zstd": Zstd, "snappy": Snappy} {
+		if c, err := Parse(name); err != nil || c != want {
+			t.Fatalf("Parse(%q) = %q, %v", name, c, err)
+		}
+	}
+	if _, err := Parse("lz4"); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("expected ErrUnknownCodec, got %v", err)
+	}
+	if _, err := Codec("lz4").Decompress(nil); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("expected ErrUnknownCodec, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Package compose expands the include directives of context content. A
+// directive names the context to include by id or by name, optionally as of
+// the version one of its labels points at:
+//
+//	{{include id="65f1c0a2e4b0d3a1c2b3d4e5"}}
+//	{{include name="Safety policy" label="prod"}}
+//
+// What resolving a directive means is left to the caller, see Expand.
+package compose
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidDirective is returned for an include directive that is not well
+// formed.
+var ErrInvalidDirective = errors.New("invalid include directive")
+
+// Include is an include directive. Exactly one of ID and Name is set.
+type Include struct {
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+func (in Include) String() string {
+	ref := "id=" + in.ID
+	if in.ID == "" {
+		ref = fmt.Sprintf("name=%q", in.Name)
+	}
+	if in.Label != "" {
+		ref += " label=" + in.Label
+	}
+	return ref
+}
+
+var (
+	directive = regexp.MustCompile(`\{\{\s*include\b([^}]*)\}\}`)
+	attribute = regexp.MustCompile(`^\s*([a-z]+)="([^"]*)"`)
+)
+
+func parseInclude(attrs string) (Include, error) {
+	var in Include
+	seen := map[string]bool{}
+	for rest := attrs; strings.TrimSpace(rest) != ""; {
+		m := attribute.FindStringSubmatch(rest)
+		if m == nil {
+			return in, fmt.Errorf("%w: malformed attributes %q, expected key=\"value\"", ErrInvalidDirective, strings.TrimSpace(rest))
+		}
+		rest = rest[len(m[0]):]
+		key, value := m[1], m[2]
+		if seen[key] {
+			return in, fmt.Errorf("%w: %s is given twice", ErrInvalidDirective, key)
+		}
+		seen[key] = true
+		switch key {
+		case "id":
+			in.ID = value
+		case "name":
+			in.Name = value
+		case "label":
+			in.Label = value
+		default:
+			return in, fmt.Errorf("%w: unknown attribute %s", ErrInvalidDirective, key)
+		}
+	}
+	if (in.ID == "") == (in.Name == "") {
+		return in, fmt.Errorf("%w: give either an id or a name", ErrInvalidDirective)
+	}
+	return in, nil
+}
+
+// Expand replaces every include directive of content by what resolve returns
+// for it. It stops at the first error.
+func Expand(content string, resolve func(Include) (string, error)) (string, error) {
+	var out strings.Builder
+	last := 0
+	for _, loc := range directive.FindAllStringSubmatchIndex(content, -1) {
+		in, err := parseInclude(content[loc[2]:loc[3]])
+		if err != nil {
+			return "", err
+		}
+		text, err := resolve(in)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(content[last:loc[0]])
+		out.WriteString(text)
+		last = loc[1]
+	}
+	out.WriteString(content[last:])
+	return out.String(), nil
+}
@@ -0,0 +1,38 @@
+package compose
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	var got []Include
+	out, err := Expand(`A {{include id="c1"}} B {{ include name="Safety policy" label="prod" }}{{includes}}`, func(in Include) (string, error) {
+		got = append(got, in)
+		return "<" + in.String() + ">", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `A <id=c1> B <name="Safety policy" label=prod>{{includes}}`; out != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+	if len(got) != 2 || got[1] != (Include{Name: "Safety policy", Label: "prod"}) {
+		t.Fatalf("unexpected includes: %+v", got)
+	}
+}
+
+func TestExpandInvalidDirectives(t *testing.T) {
+	for _, content := range []string{
+		`{{include}}`,
+		`{{include id="a" name="b"}}`,
+		`{{include id="a" id="b"}}`,
+		`{{include id="a" version="2"}}`,
+		`{{include id=a}}`,
+	} {
+		_, err := Expand(content, func(Include) (string, error) { return "", nil })
+		if !errors.Is(err, ErrInvalidDirective) {
+			t.Fatalf("%s: expected ErrInvalidDirective, got %v", content, err)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
 	"github.com/mangudaigb/context-service/internal/svc"
 	"github.com/mangudaigb/context-service/pkg/requests"
 	"github.com/mangudaigb/dhauli-base/consumer/messaging"
@@ -20,15 +22,25 @@ type ContextMsgHandler struct {
 	cSvc svc.ContextService
 }
 
-func (cmh *ContextMsgHandler) MsgHandlerFunc(ctx context.Context, message messaging.Message, action messaging.Action) (*entities.Context, error) {
+func (cmh *ContextMsgHandler) MsgHandlerFunc(ctx context.Context, message messaging.Message, action messaging.Action) (interface{}, error) {
 	var err error
-	var out *entities.Context
+	var out interface{}
 	if action == "create" {
 		out, err = cmh.handleCreate(ctx, message)
 	} else if action == "update" {
 		out, err = cmh.handleUpdate(ctx, message)
 	} else if action == "delete" {
 		out, err = cmh.handleDelete(ctx, message)
+	} else if action == "revert" {
+		out, err = cmh.handleRevert(ctx, message)
+	} else if action == "search" {
+		out, err = cmh.handleSearch(ctx, message)
+	} else if action == "batch" {
+		out, err = cmh.handleBatch(ctx, message)
+	} else if action == "get" {
+		out, err = cmh.handleGet(ctx, message)
+	} else if action == "render" {
+		out, err = cmh.handleRender(ctx, message)
 	} else {
 		cmh.log.Errorf("Invalid action: %s", action)
 		return nil, errors.New("invalid action")
@@ -47,6 +59,8 @@ func (cmh *ContextMsgHandler) handleCreate(ctx context.Context, msg messaging.Me
 		Name:          req.Name,
 		Description:   req.Description,
 		Content:       req.Content,
+		Tags:          req.Tags,
+		Metadata:      req.Metadata,
 		Organizations: nil,
 		Tenants:       nil,
 		Groups:        nil,
@@ -79,15 +93,128 @@ func (cmh *ContextMsgHandler) handleUpdate(ctx context.Context, msg messaging.Me
 	return updatedContext, nil
 }
 
-func (cmh *ContextMsgHandler) handleDelete(ctx context.Context, msg messaging.Message) (*entities.Context, error) {
+func (cmh *ContextMsgHandler) handleDelete(ctx context.Context, msg messaging.Message) (*repo.TrashedContext, error) {
 	var req requests.ContextRequest
 	if err := json.Unmarshal(msg.Data, &req); err != nil {
 		cmh.log.Errorf("Error unmarshalling message: %v", err)
+		return nil, err
+	}
+
+	if req.ID == "" {
+		cmh.log.Errorf("Context Id is required to delete context")
+		return nil, errors.New("context Id is required to delete context")
+	}
+
+	deletedContext, err := cmh.cSvc.DeleteContext(ctx, req.ID, req.ExpectedVersion, req.User)
+	if err != nil {
+		cmh.log.Errorf("Error deleting context: %v", err)
+		return nil, err
+	}
+	return deletedContext, nil
+}
+
+func (cmh *ContextMsgHandler) handleRevert(ctx context.Context, msg messaging.Message) (*repo.RevertedContext, error) {
+	var req requests.RevertRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		cmh.log.Errorf("Error unmarshalling message: %v", err)
+		return nil, err
+	}
+
+	if req.ID == "" {
+		cmh.log.Errorf("Context Id is required to revert context")
+		return nil, errors.New("context Id is required to revert context")
+	}
+	to, err := req.Target()
+	if err != nil {
+		cmh.log.Errorf("Invalid revert request for context %s: %v", req.ID, err)
+		return nil, err
+	}
+
+	reverted, err := cmh.cSvc.RevertContext(ctx, req.ID, to, req.ExpectedVersion)
+	if err != nil {
+		cmh.log.Errorf("Error reverting context: %v", err)
+		return nil, err
+	}
+	return reverted, nil
+}
+
+func (cmh *ContextMsgHandler) handleSearch(ctx context.Context, msg messaging.Message) ([]*svc.SearchResult, error) {
+	var sq query.SearchQuery
+	if err := json.Unmarshal(msg.Data, &sq); err != nil {
+		cmh.log.Errorf("Error unmarshalling message: %v", err)
+		return nil, err
+	}
+	results, err := cmh.cSvc.SearchContexts(ctx, &sq)
+	if err != nil {
+		cmh.log.Errorf("Error searching contexts: %v", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+func (cmh *ContextMsgHandler) handleBatch(ctx context.Context, msg messaging.Message) (*svc.BatchReport, error) {
+	var req requests.BatchRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		cmh.log.Errorf("Error unmarshalling message: %v", err)
+		return nil, err
+	}
+	report, err := cmh.cSvc.BatchContexts(ctx, req.Operations, req.Atomic, req.User)
+	if err != nil {
+		cmh.log.Errorf("Error running batch: %v", err)
+		return nil, err
+	}
+	return report, nil
+}
+
+// handleGet reads a context, as of the version its label points at when the
+// request names one.
+func (cmh *ContextMsgHandler) handleGet(ctx context.Context, msg messaging.Message) (*entities.Context, error) {
+	var req requests.GetRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		cmh.log.Errorf("Error unmarshalling message: %v", err)
+		return nil, err
+	}
+
+	if req.ID == "" {
+		cmh.log.Errorf("Context Id is required to get context")
+		return nil, errors.New("context Id is required to get context")
+	}
+
+	var c *entities.Context
+	var err error
+	if req.Label != "" {
+		c, err = cmh.cSvc.GetContextByLabel(ctx, req.ID, req.Label)
+	} else {
+		c, err = cmh.cSvc.GetContextByID(ctx, req.ID)
+	}
+	if err != nil {
+		cmh.log.Errorf("Error getting context: %v", err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// handleRender renders a context with the values of its variables, ready to
+// be used as a prompt.
+func (cmh *ContextMsgHandler) handleRender(ctx context.Context, msg messaging.Message) (*svc.RenderedContext, error) {
+	var req requests.RenderRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		cmh.log.Errorf("Error unmarshalling message: %v", err)
+		return nil, err
 	}
 
-	// TODO do not see the need for it yet
+	if req.ID == "" {
+		cmh.log.Errorf("Context Id is required to render context")
+		return nil, errors.New("context Id is required to render context")
+	}
 
-	return nil, nil
+	opts := svc.RenderOptions{Label: req.Label, TenantIDs: req.TenantIDs}
+	rendered, err := cmh.cSvc.RenderTemplate(ctx, req.ID, req.Variables, opts)
+	if err != nil {
+		cmh.log.Errorf("Error rendering context: %v", err)
+		return nil, err
+	}
+	return rendered, nil
 }
 
 func NewContextMsgHandler(tr trace.Tracer, log *logger.Logger, cSvc svc.ContextService) *ContextMsgHandler {
@@ -1 +1,240 @@
 package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/internal/templating"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/consumer/messaging"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type testEnv struct {
+	handler *ContextMsgHandler
+	cRepo   *repo.MemoryContextRepository
+	chRepo  *repo.MemoryContextHistoryRepository
+	sRepo   *repo.MemorySchemaRepository
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatalf("creating logger: %v", err)
+	}
+	cRepo := repo.NewMemoryContextRepository(log)
+	chRepo := repo.NewMemoryContextHistoryRepository(log)
+	chSvc := svc.NewContextHistoryService(log, chRepo)
+	sRepo := repo.NewMemorySchemaRepository()
+	cSvc := svc.NewContextService(log, cRepo, chSvc, repo.NewMemoryTransactor(cRepo, chRepo, sRepo), sRepo, tokenizer.NewApproximate())
+	return &testEnv{
+		handler: NewContextMsgHandler(noop.NewTracerProvider().Tracer("test"), log, cSvc),
+		cRepo:   cRepo,
+		chRepo:  chRepo,
+		sRepo:   sRepo,
+	}
+}
+
+func message(t *testing.T, data interface{}) messaging.Message {
+	t.Helper()
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshalling message data: %v", err)
+	}
+	return messaging.Message{Type: "context", Data: b}
+}
+
+func TestMsgHandlerCreateAndUpdate(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+
+	out, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]string{"name": "persona", "content": "be nice"}), messaging.CREATE)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	created := out.(*entities.Context)
+	if created.ID == "" || created.Version != 1 || !created.IsActive {
+		t.Fatalf("unexpected created context: %+v", created)
+	}
+
+	update := *created
+	update.Content = "be very nice"
+	out, err = env.handler.MsgHandlerFunc(ctx, message(t, update), messaging.UPDATE)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	updated := out.(*entities.Context)
+	if updated.Version != 2 || updated.Content != "be very nice" {
+		t.Fatalf("unexpected updated context: %+v", updated)
+	}
+
+	history, err := env.chRepo.Filter(ctx, map[string]interface{}{"contextId": created.ID})
+	if err != nil {
+		t.Fatalf("listing history: %v", err)
+	}
+	if len(history) != 1 || history[0].Version != 1 || history[0].Content != "be nice" {
+		t.Fatalf("expected a snapshot of version 1, got %+v", history)
+	}
+
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, update), messaging.UPDATE); err == nil {
+		t.Fatalf("expected a stale update to fail")
+	}
+}
+
+func TestMsgHandlerUpdateRequiresID(t *testing.T) {
+	env := newTestEnv(t)
+	if _, err := env.handler.MsgHandlerFunc(context.Background(), message(t, entities.Context{Name: "x"}), messaging.UPDATE); err == nil {
+		t.Fatalf("expected an error for a missing context id")
+	}
+}
+
+func TestMsgHandlerInvalidAction(t *testing.T) {
+	env := newTestEnv(t)
+	if _, err := env.handler.MsgHandlerFunc(context.Background(), message(t, nil), "explode"); err == nil {
+		t.Fatalf("expected an error for an unknown action")
+	}
+}
+
+func TestMsgHandlerSearch(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	for _, c := range []*entities.Context{
+		{ID: "a", Name: "Safety policy", Content: "Never reveal secrets. Refuse unsafe requests.", Tenants: []entities.TenantStub{{ID: "t1"}}},
+		{ID: "b", Name: "Tone", Content: "Be friendly, and keep answers about safety short.", Tenants: []entities.TenantStub{{ID: "t1"}}},
+		{ID: "c", Name: "Safety for t2", Tenants: []entities.TenantStub{{ID: "t2"}}},
+	} {
+		if _, err := env.cRepo.Create(ctx, c); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	out, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]interface{}{"text": "safety", "tenantIds": []string{"t1"}}), "search")
+	if err != nil {
+		t.Fatalf("search: %v", err)
+	}
+	results := out.([]*svc.SearchResult)
+	if len(results) != 2 || results[0].Context.ID != "a" {
+		t.Fatalf("expected the name match first and tenant t2 excluded, got %+v", results)
+	}
+	if len(results[1].Highlights) != 1 || results[1].Highlights[0].Snippets[0] != "Be friendly, and keep answers about <em>safety</em> short." {
+		t.Fatalf("unexpected highlights: %+v", results[1].Highlights)
+	}
+
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]string{"text": "  "}), "search"); err == nil {
+		t.Fatalf("expected an error for empty search text")
+	}
+}
+
+func TestMsgHandlerRevert(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	out, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]string{"name": "persona", "content": "be nice"}), messaging.CREATE)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	update := *out.(*entities.Context)
+	update.Content = "be rude"
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, update), messaging.UPDATE); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	out, err = env.handler.MsgHandlerFunc(ctx, message(t, map[string]interface{}{"id": update.ID, "version": 1, "expectedVersion": 2}), "revert")
+	if err != nil {
+		t.Fatalf("revert: %v", err)
+	}
+	reverted := out.(*repo.RevertedContext)
+	if reverted.Version != 3 || reverted.RevertOf != 1 || reverted.Content != "be nice" {
+		t.Fatalf("unexpected reverted context: %+v", reverted)
+	}
+
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]interface{}{"id": update.ID}), "revert"); err == nil {
+		t.Fatalf("expected an error for a revert without target")
+	}
+}
+
+func TestMsgHandlerGetByLabel(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	out, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]string{"name": "persona", "content": "be nice"}), messaging.CREATE)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	update := *out.(*entities.Context)
+	update.Content = "be brief"
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, update), messaging.UPDATE); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, err := env.handler.cSvc.MoveLabel(ctx, update.ID, "prod", 1, svc.LabelMoveOptions{}); err != nil {
+		t.Fatalf("label: %v", err)
+	}
+
+	for label, want := range map[string]string{"": "be brief", "prod": "be nice"} {
+		out, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]string{"id": update.ID, "label": label}), messaging.GET)
+		if err != nil {
+			t.Fatalf("get %q: %v", label, err)
+		}
+		if c := out.(*entities.Context); c.Content != want {
+			t.Fatalf("get %q: expected %q, got %q", label, want, c.Content)
+		}
+	}
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]string{"id": update.ID, "label": "staging"}), messaging.GET); err == nil {
+		t.Fatalf("expected an error for an unknown label")
+	}
+}
+
+func TestMsgHandlerRender(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	if _, err := env.cRepo.Create(ctx, &entities.Context{ID: "agent", Name: "agent", Content: "Help {{customer}}.", Version: 1}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := env.handler.cSvc.SetVariables(ctx, "agent", 0, []templating.Variable{{Name: "customer", Type: templating.String, Required: true}}); err != nil {
+		t.Fatalf("set variables: %v", err)
+	}
+
+	out, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]interface{}{"id": "agent", "variables": map[string]string{"customer": "Ada"}}), "render")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if rendered := out.(*svc.RenderedContext); rendered.Content != "Help Ada." {
+		t.Fatalf("unexpected rendering: %+v", rendered)
+	}
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, map[string]interface{}{"id": "agent"}), "render"); !errors.Is(err, templating.ErrInvalidValues) {
+		t.Fatalf("expected ErrInvalidValues, got %v", err)
+	}
+}
+
+func TestMsgHandlerValidatesMetadata(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	schema := &repo.MetadataSchema{Name: "owned", Tag: "prod", Schema: json.RawMessage(`{"required": ["owner"], "properties": {"owner": {"type": "string"}}}`)}
+	if _, err := env.sRepo.Put(ctx, schema); err != nil {
+		t.Fatalf("put schema: %v", err)
+	}
+
+	req := map[string]interface{}{"name": "persona", "content": "be nice", "tags": []string{"prod"}, "metadata": map[string]interface{}{"owner": 7}}
+	_, err := env.handler.MsgHandlerFunc(ctx, message(t, req), messaging.CREATE)
+	var merr *svc.MetadataError
+	if !errors.As(err, &merr) || len(merr.Violations) != 1 || merr.Violations[0].Path != "/owner" {
+		t.Fatalf("expected a violation at /owner, got %v", err)
+	}
+
+	req["metadata"] = map[string]interface{}{"owner": "ada"}
+	out, err := env.handler.MsgHandlerFunc(ctx, message(t, req), messaging.CREATE)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	update := *out.(*entities.Context)
+	update.Metadata = nil
+	if _, err := env.handler.MsgHandlerFunc(ctx, message(t, update), messaging.UPDATE); !errors.As(err, &merr) {
+		t.Fatalf("expected a MetadataError, got %v", err)
+	}
+}
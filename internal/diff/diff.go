@@ -0,0 +1,220 @@
+// Package diff computes line-level differences between texts and renders
+// them in the unified format.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Op int
+
+const (
+	Equal Op = iota
+	Delete
+	Insert
+)
+
+// Edit is one line of the edit script turning a text into another. Lines keep
+// their trailing newline, the last line of a text may have none.
+type Edit struct {
+	Op   Op
+	Line string
+}
+
+// Lines returns the shortest edit script turning a into b.
+func Lines(a, b string) []Edit {
+	return Compute(SplitLines(a), SplitLines(b))
+}
+
+// SplitLines splits s after each newline.
+func SplitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Compute returns the shortest edit script turning a into b. The common
+// prefix and suffix are set aside before running the Myers algorithm, which
+// keeps the common case of a local edit in a long text cheap.
+func Compute(a, b []string) []Edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]Edit, 0, len(a)+len(b)-prefix-suffix)
+	for _, line := range a[:prefix] {
+		edits = append(edits, Edit{Op: Equal, Line: line})
+	}
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, Edit{Op: Equal, Line: line})
+	}
+	return edits
+}
+
+// myers finds the shortest edit script with the greedy algorithm of "An O(ND)
+// Difference Algorithm and Its Variations". The furthest reaching x of each
+// diagonal k is kept for every d, so that the path can be walked back.
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+	max := n + m
+	v := make([]int, 2*max+2)
+	off := max + 1
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		// trace[d] holds the diagonals -d..d as they were before round d
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(trace [][]int, a, b []string) []Edit {
+	x, y := len(a), len(b)
+	var edits []Edit
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, Edit{Op: Equal, Line: a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			edits = append(edits, Edit{Op: Insert, Line: b[y-1]})
+			y--
+		} else {
+			edits = append(edits, Edit{Op: Delete, Line: a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		edits = append(edits, Edit{Op: Equal, Line: a[x-1]})
+		x--
+		y--
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// Changed reports whether the script contains any insertion or deletion.
+func Changed(edits []Edit) bool {
+	for _, e := range edits {
+		if e.Op != Equal {
+			return true
+		}
+	}
+	return false
+}
+
+// Unified renders the edit script as a unified diff with the given number of
+// context lines around each change. It returns "" when nothing changed.
+func Unified(fromName, toName string, edits []Edit, context int) string {
+	if !Changed(edits) {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	// aAt and bAt are the number of lines of each text before edits[i]
+	aAt := make([]int, len(edits)+1)
+	bAt := make([]int, len(edits)+1)
+	for i, e := range edits {
+		aAt[i+1], bAt[i+1] = aAt[i], bAt[i]
+		if e.Op != Insert {
+			aAt[i+1]++
+		}
+		if e.Op != Delete {
+			bAt[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		// extend the hunk while the next change is close enough to share context
+		end, last := i, i
+		for end < len(edits) {
+			if edits[end].Op != Equal {
+				last = end
+			} else if end-last > 2*context {
+				break
+			}
+			end++
+		}
+		end = last + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aAt[start], aAt[end]), hunkRange(bAt[start], bAt[end]))
+		for _, e := range edits[start:end] {
+			sb.WriteByte(" -+"[e.Op])
+			sb.WriteString(e.Line)
+			if !strings.HasSuffix(e.Line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+func hunkRange(from, to int) string {
+	count := to - from
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", from)
+	case 1:
+		return fmt.Sprintf("%d", from+1)
+	default:
+		return fmt.Sprintf("%d,%d", from+1, count)
+	}
+}
@@ -0,0 +1,106 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+// apply replays the edit script, checking that it is consistent with a.
+func apply(t *testing.T, a string, edits []Edit) string {
+	t.Helper()
+	lines := SplitLines(a)
+	var out strings.Builder
+	for _, e := range edits {
+		switch e.Op {
+		case Equal, Delete:
+			if len(lines) == 0 || lines[0] != e.Line {
+				t.Fatalf("edit %v does not match the source at %q", e, lines)
+			}
+			lines = lines[1:]
+			if e.Op == Equal {
+				out.WriteString(e.Line)
+			}
+		case Insert:
+			out.WriteString(e.Line)
+		}
+	}
+	if len(lines) != 0 {
+		t.Fatalf("edit script leaves %q unconsumed", lines)
+	}
+	return out.String()
+}
+
+func TestLinesTransformsAIntoB(t *testing.T) {
+	cases := []struct{ a, b string }{
+		{"", ""},
+		{"", "a\nb\n"},
+		{"a\nb\n", ""},
+		{"a\nb\nc\n", "a\nb\nc\n"},
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n"},
+		{"a\nb\nc", "a\nx\nc"},
+		{"one\ntwo\n", "zero\none\ntwo\nthree\n"},
+	}
+	for _, tc := range cases {
+		edits := Lines(tc.a, tc.b)
+		if got := apply(t, tc.a, edits); got != tc.b {
+			t.Fatalf("diff of %q and %q yields %q", tc.a, tc.b, got)
+		}
+	}
+}
+
+func TestLinesIsMinimal(t *testing.T) {
+	edits := Lines("a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n")
+	changes := 0
+	for _, e := range edits {
+		if e.Op != Equal {
+			changes++
+		}
+	}
+	if changes != 5 {
+		t.Fatalf("expected 5 changes, got %d", changes)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	var a, b []string
+	for i := 1; i <= 12; i++ {
+		line := strings.Repeat("x", i) + "\n"
+		a = append(a, line)
+		switch i {
+		case 2:
+			b = append(b, "two\n")
+		case 11:
+		default:
+			b = append(b, line)
+		}
+	}
+	got := Unified("a", "b", Compute(a, b), 2)
+	want := `--- a
++++ b
+@@ -1,4 +1,4 @@
+ x
+-xx
++two
+ xxx
+ xxxx
+@@ -9,4 +9,3 @@
+ xxxxxxxxx
+ xxxxxxxxxx
+-xxxxxxxxxxx
+ xxxxxxxxxxxx
+`
+	if got != want {
+		t.Fatalf("unexpected unified diff:\n%s", got)
+	}
+	if Unified("a", "b", Compute(a, a), 2) != "" {
+		t.Fatal("expected no diff for equal texts")
+	}
+}
+
+func TestUnifiedMarksMissingNewline(t *testing.T) {
+	got := Unified("a", "b", Lines("", "only"), 3)
+	want := "--- a\n+++ b\n@@ -0,0 +1 @@\n+only\n\\ No newline at end of file\n"
+	if got != want {
+		t.Fatalf("unexpected unified diff:\n%q", got)
+	}
+}
@@ -0,0 +1,127 @@
+package diff
+
+import (
+	"strings"
+)
+
+// Conflict is a region changed differently on both sides of a three-way merge.
+// Line is the line of its opening marker in the merged text, counting from 1.
+type Conflict struct {
+	Line   int    `json:"line"`
+	Base   string `json:"base"`
+	Ours   string `json:"ours"`
+	Theirs string `json:"theirs"`
+}
+
+// Merge3 merges the changes turning base into ours and into theirs, the diff3
+// way: the lines of base kept on both sides split the texts into regions, and
+// a region changed on one side only takes that change. The regions changed
+// differently on both sides are conflicts, written with markers labelled
+// oursLabel and theirsLabel:
+//
+//	<<<<<<< oursLabel
+//	||||||| base
+//	=======
+//	>>>>>>> theirsLabel
+func Merge3(base, ours, theirs, oursLabel, theirsLabel string) (string, []Conflict) {
+	b, o, t := SplitLines(base), SplitLines(ours), SplitLines(theirs)
+	toOurs, toTheirs := matches(b, o), matches(b, t)
+
+	var sb strings.Builder
+	var conflicts []Conflict
+	lines := 0
+	write := func(ls []string) {
+		for _, l := range ls {
+			sb.WriteString(l)
+		}
+		lines += len(ls)
+	}
+	i, j, k := 0, 0, 0
+	for i < len(b) || j < len(o) || k < len(t) {
+		if i < len(b) && toOurs[i] == j && toTheirs[i] == k {
+			write(b[i : i+1])
+			i, j, k = i+1, j+1, k+1
+			continue
+		}
+		// the region ends at the next line of base kept on both sides
+		ni, nj, nk := i, len(o), len(t)
+		for ; ni < len(b); ni++ {
+			if toOurs[ni] >= 0 && toTheirs[ni] >= 0 {
+				nj, nk = toOurs[ni], toTheirs[ni]
+				break
+			}
+		}
+		rb, ro, rt := b[i:ni], o[j:nj], t[k:nk]
+		switch {
+		case equalLines(ro, rb):
+			write(rt)
+		case equalLines(rt, rb), equalLines(ro, rt):
+			write(ro)
+		default:
+			if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+				sb.WriteString("\n")
+			}
+			conflicts = append(conflicts, Conflict{
+				Line:   lines + 1,
+				Base:   strings.Join(rb, ""),
+				Ours:   strings.Join(ro, ""),
+				Theirs: strings.Join(rt, ""),
+			})
+			write([]string{"<<<<<<< " + oursLabel + "\n"})
+			writeSide(write, ro)
+			write([]string{"||||||| base\n"})
+			writeSide(write, rb)
+			write([]string{"=======\n"})
+			writeSide(write, rt)
+			write([]string{">>>>>>> " + theirsLabel + "\n"})
+		}
+		i, j, k = ni, nj, nk
+	}
+	return sb.String(), conflicts
+}
+
+// writeSide writes the lines of one side of a conflict, ending them with a
+// newline so that the next marker starts a line.
+func writeSide(write func([]string), ls []string) {
+	if len(ls) == 0 {
+		return
+	}
+	last := ls[len(ls)-1]
+	if strings.HasSuffix(last, "\n") {
+		write(ls)
+		return
+	}
+	write(append(append([]string(nil), ls[:len(ls)-1]...), last+"\n"))
+}
+
+// matches maps each line of a to the line of b it is kept as, -1 when it is
+// deleted.
+func matches(a, b []string) []int {
+	m := make([]int, len(a))
+	i, j := 0, 0
+	for _, e := range Compute(a, b) {
+		switch e.Op {
+		case Equal:
+			m[i] = j
+			i, j = i+1, j+1
+		case Delete:
+			m[i] = -1
+			i++
+		case Insert:
+			j++
+		}
+	}
+	return m
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package diff
+
+import (
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	cases := map[string]struct {
+		ours, theirs string
+		want         string
+		conflicts    int
+	}{
+		"one side":      {base, "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", 0},
+		"both sides":    {"A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", 0},
+		"same change":   {"a\nx\nc\nd\ne\n", "a\nx\nc\nd\ne\n", "a\nx\nc\nd\ne\n", 0},
+		"insert, drop":  {"a\nb\nc\nnew\nd\ne\n", "b\nc\nd\ne\n", "b\nc\nnew\nd\ne\n", 0},
+		"appends":       {base + "o\n", base, base + "o\n", 0},
+		"no final line": {"a\nb\nc\nd\ne", base, "a\nb\nc\nd\ne", 0},
+		"conflict": {"a\nours\nc\nd\ne\n", "a\ntheirs\nc\nd\ne\n",
+			"a\n<<<<<<< main\nours\n||||||| base\nb\n=======\ntheirs\n>>>>>>> draft\nc\nd\ne\n", 1},
+		"conflict without final newline": {"a\nb\nc\nd\nours", "a\nb\nc\nd\ntheirs",
+			"a\nb\nc\nd\n<<<<<<< main\nours\n||||||| base\ne\n=======\ntheirs\n>>>>>>> draft\n", 1},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, conflicts := Merge3(base, tc.ours, tc.theirs, "main", "draft")
+			if got != tc.want || len(conflicts) != tc.conflicts {
+				t.Fatalf("got %q with %d conflicts, want %q with %d", got, len(conflicts), tc.want, tc.conflicts)
+			}
+		})
+	}
+
+	_, conflicts := Merge3(base, "a\nours\nc\nd\ne\n", "a\ntheirs\nc\nd\ne\n", "main", "draft")
+	if c := conflicts[0]; c.Line != 2 || c.Base != "b\n" || c.Ours != "ours\n" || c.Theirs != "theirs\n" {
+		t.Fatalf("unexpected conflict: %+v", c)
+	}
+}
@@ -0,0 +1,124 @@
+package encryption
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Header is stored on every encrypted document. It carries the data key of the
+// document wrapped by the key of TenantID.
+type Header struct {
+	TenantID string     `bson:"tenant"`
+	Key      WrappedKey `bson:",inline"`
+}
+
+// DataKey encrypts the fields of one document.
+type DataKey struct {
+	Header Header
+	aead   cipher.AEAD
+}
+
+// Seal encrypts plaintext. aad binds the result to its place, typically the
+// document id and the field name, so that it cannot be moved elsewhere.
+func (dk *DataKey) Seal(plaintext, aad []byte) []byte {
+	return seal(dk.aead, plaintext, aad)
+}
+
+func (dk *DataKey) Open(sealed, aad []byte) ([]byte, error) {
+	plaintext, err := open(dk.aead, sealed, aad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with a data key of tenant %s: %w", dk.Header.TenantID, err)
+	}
+	return plaintext, nil
+}
+
+type Encryptor struct {
+	keys KeyProvider
+}
+
+func NewEncryptor(keys KeyProvider) *Encryptor {
+	return &Encryptor{keys: keys}
+}
+
+// LoadEncryptor returns the encryptor of the keyring file, nil when no file
+// is given and nothing is encrypted.
+func LoadEncryptor(keyringFile string) (*Encryptor, error) {
+	if keyringFile == "" {
+		return nil, nil
+	}
+	kr, err := LoadKeyring(keyringFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptor(kr), nil
+}
+
+// NewDataKey returns a fresh data key for a document of the tenant, or nil
+// when the tenant has no key and its documents are stored in the clear.
+func (e *Encryptor) NewDataKey(ctx context.Context, tenantID string) (*DataKey, error) {
+	if tenantID == "" {
+		return nil, nil
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	wk, err := e.keys.WrapKey(ctx, tenantID, dek)
+	if errors.Is(err, ErrNoTenantKey) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newDataKey(Header{TenantID: tenantID, Key: wk}, dek)
+}
+
+// Encrypts reports whether the documents of the tenant are encrypted.
+func (e *Encryptor) Encrypts(ctx context.Context, tenantID string) (bool, error) {
+	_, err := e.keys.CurrentKeyID(ctx, tenantID)
+	if errors.Is(err, ErrNoTenantKey) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// OpenDataKey unwraps the data key of a document.
+func (e *Encryptor) OpenDataKey(ctx context.Context, h Header) (*DataKey, error) {
+	dek, err := e.keys.UnwrapKey(ctx, h.TenantID, h.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping a data key of tenant %s: %w", h.TenantID, err)
+	}
+	return newDataKey(h, dek)
+}
+
+// Rewrap returns h with its data key wrapped by the current key of its tenant.
+// The boolean is false when it already was.
+func (e *Encryptor) Rewrap(ctx context.Context, h Header) (Header, bool, error) {
+	current, err := e.keys.CurrentKeyID(ctx, h.TenantID)
+	if err != nil {
+		return h, false, err
+	}
+	if current == h.Key.KeyID {
+		return h, false, nil
+	}
+	dek, err := e.keys.UnwrapKey(ctx, h.TenantID, h.Key)
+	if err != nil {
+		return h, false, err
+	}
+	wk, err := e.keys.WrapKey(ctx, h.TenantID, dek)
+	if err != nil {
+		return h, false, err
+	}
+	return Header{TenantID: h.TenantID, Key: wk}, true, nil
+}
+
+func newDataKey(h Header, dek []byte) (*DataKey, error) {
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{Header: h, aead: aead}, nil
+}
@@ -0,0 +1,76 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func testKeyring(t *testing.T, current string) *Keyring {
+	t.Helper()
+	kr, err := ParseKeyring([]byte(fmt.Sprintf(`{"tenants": {"acme": {"current": %q, "keys": {"k1": %q, "k2": %q}}}}`,
+		current, testKey(1), testKey(2))))
+	if err != nil {
+		t.Fatalf("parse keyring: %v", err)
+	}
+	return kr
+}
+
+func TestSealOpenAndRotate(t *testing.T) {
+	ctx := context.Background()
+	e := NewEncryptor(testKeyring(t, "k1"))
+	dk, err := e.NewDataKey(ctx, "acme")
+	if err != nil || dk == nil {
+		t.Fatalf("new data key: %v, %v", dk, err)
+	}
+	sealed := dk.Seal([]byte("secret instructions"), []byte("c1/content"))
+
+	rotated := NewEncryptor(testKeyring(t, "k2"))
+	h, changed, err := rotated.Rewrap(ctx, dk.Header)
+	if err != nil || !changed || h.Key.KeyID != "k2" {
+		t.Fatalf("rewrap: %+v, %v, %v", h, changed, err)
+	}
+	if _, changed, _ := rotated.Rewrap(ctx, h); changed {
+		t.Fatal("a data key wrapped by the current key must not be rewrapped")
+	}
+	opened, err := rotated.OpenDataKey(ctx, h)
+	if err != nil {
+		t.Fatalf("open data key: %v", err)
+	}
+	plain, err := opened.Open(sealed, []byte("c1/content"))
+	if err != nil || string(plain) != "secret instructions" {
+		t.Fatalf("open: %q, %v", plain, err)
+	}
+	if _, err := opened.Open(sealed, []byte("c2/content")); err == nil {
+		t.Fatal("sealed data must not open under another aad")
+	}
+}
+
+func TestTenantWithoutKey(t *testing.T) {
+	e := NewEncryptor(testKeyring(t, "k1"))
+	if dk, err := e.NewDataKey(context.Background(), "other"); dk != nil || err != nil {
+		t.Fatalf("expected no data key, got %v, %v", dk, err)
+	}
+	if _, err := e.OpenDataKey(context.Background(), Header{TenantID: "other"}); !errors.Is(err, ErrNoTenantKey) {
+		t.Fatalf("expected ErrNoTenantKey, got %v", err)
+	}
+}
+
+func TestParseKeyringErrors(t *testing.T) {
+	for name, file := range map[string]string{
+		"short key":       `{"tenants": {"acme": {"current": "k1", "keys": {"k1": "YWJj"}}}}`,
+		"missing current": fmt.Sprintf(`{"tenants": {"acme": {"current": "k9", "keys": {"k1": %q}}}}`, testKey(1)),
+		"not json":        `tenants`,
+	} {
+		if _, err := ParseKeyring([]byte(file)); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Package encryption encrypts document fields with AES-GCM. Each document
+// gets its own data key, stored next to the encrypted fields wrapped by the
+// key-encryption key of its tenant. The tenant keys come from a KeyProvider.
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrNoTenantKey is returned for the tenants whose content is not encrypted.
+	ErrNoTenantKey = errors.New("no key for tenant")
+	ErrUnknownKey  = errors.New("unknown key")
+)
+
+// WrappedKey is a data key encrypted by the tenant key KeyID.
+type WrappedKey struct {
+	KeyID string `json:"kid" bson:"kid"`
+	Key   []byte `json:"key" bson:"key"`
+}
+
+// KeyProvider holds the tenant keys. The local Keyring implements it; a KMS
+// can implement it without the tenant keys ever leaving it.
+type KeyProvider interface {
+	// WrapKey encrypts dek with the current key of the tenant. It returns
+	// ErrNoTenantKey when the tenant has no key.
+	WrapKey(ctx context.Context, tenantID string, dek []byte) (WrappedKey, error)
+	UnwrapKey(ctx context.Context, tenantID string, wk WrappedKey) ([]byte, error)
+	// CurrentKeyID returns the id of the key WrapKey uses for the tenant.
+	CurrentKeyID(ctx context.Context, tenantID string) (string, error)
+}
+
+// Keyring is a KeyProvider reading the tenant keys from a JSON file:
+//
+//	{"tenants": {"acme": {"current": "2024-06", "keys": {"2024-01": "<base64>", "2024-06": "<base64>"}}}}
+//
+// Keys are 32 bytes, base64 encoded. Rotating a tenant key means adding a key
+// and making it current; the previous keys stay until every data key wrapped
+// by them has been rewrapped.
+type Keyring struct {
+	tenants map[string]tenantKeys
+}
+
+type tenantKeys struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+type keyringFile struct {
+	Tenants map[string]struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	} `json:"tenants"`
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(b)
+}
+
+func ParseKeyring(b []byte) (*Keyring, error) {
+	var f keyringFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parsing the keyring: %w", err)
+	}
+	kr := &Keyring{tenants: make(map[string]tenantKeys, len(f.Tenants))}
+	for tenant, t := range f.Tenants {
+		tk := tenantKeys{current: t.Current, keys: make(map[string]cipher.AEAD, len(t.Keys))}
+		for kid, encoded := range t.Keys {
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("key %s of tenant %s must be 32 base64 encoded bytes", kid, tenant)
+			}
+			if tk.keys[kid], err = newAEAD(key); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := tk.keys[t.Current]; !ok {
+			return nil, fmt.Errorf("current key %q of tenant %s is not in its keys", t.Current, tenant)
+		}
+		kr.tenants[tenant] = tk
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) WrapKey(ctx context.Context, tenantID string, dek []byte) (WrappedKey, error) {
+	tk, ok := kr.tenants[tenantID]
+	if !ok {
+		return WrappedKey{}, ErrNoTenantKey
+	}
+	return WrappedKey{KeyID: tk.current, Key: seal(tk.keys[tk.current], dek, []byte(tenantID))}, nil
+}
+
+func (kr *Keyring) UnwrapKey(ctx context.Context, tenantID string, wk WrappedKey) ([]byte, error) {
+	tk, ok := kr.tenants[tenantID]
+	if !ok {
+		return nil, ErrNoTenantKey
+	}
+	kek, ok := tk.keys[wk.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s of tenant %s", ErrUnknownKey, wk.KeyID, tenantID)
+	}
+	return open(kek, wk.Key, []byte(tenantID))
+}
+
+func (kr *Keyring) CurrentKeyID(ctx context.Context, tenantID string) (string, error) {
+	tk, ok := kr.tenants[tenantID]
+	if !ok {
+		return "", ErrNoTenantKey
+	}
+	return tk.current, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which prefixes the result.
+func seal(aead cipher.AEAD, plaintext, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("reading random nonce: %v", err))
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad)
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
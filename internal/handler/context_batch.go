@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/pkg/requests"
+)
+
+// BatchContexts runs the create, update and delete operations of the body and
+// answers 200 with the status of each of them, even when some failed. An
+// atomic batch that was rolled back reports committed false.
+func (ch *ContextHandler) BatchContexts(c *gin.Context) {
+	var req requests.BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	report, err := ch.svc.BatchContexts(c.Request.Context(), req.Operations, req.Atomic, requestUser(c))
+	if err != nil {
+		if errors.Is(err, svc2.ErrInvalidInput) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run batch: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/pkg/requests"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func (ch *ContextHandler) ListBranches(c *gin.Context) {
+	branches, err := ch.svc.ListBranches(c.Request.Context(), c.Param("cid"))
+	if err != nil {
+		ch.respondBranchError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, branches)
+}
+
+// CreateBranch starts a branch from a version of the main line, the current
+// one by default.
+func (ch *ContextHandler) CreateBranch(c *gin.Context) {
+	var req requests.BranchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	b, err := ch.svc.CreateBranch(c.Request.Context(), c.Param("cid"), req.Name, req.Version, requestUser(c))
+	if err != nil {
+		ch.respondBranchError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, b)
+}
+
+// GetBranch returns the branch and the context as of its head, whose version
+// is the ETag.
+func (ch *ContextHandler) GetBranch(c *gin.Context) {
+	bc, err := ch.svc.GetBranch(c.Request.Context(), c.Param("cid"), c.Param("branch"))
+	if err != nil {
+		ch.respondBranchError(c, err)
+		return
+	}
+	respondContext(c, http.StatusOK, bc, bc.Branch.Head)
+}
+
+func (ch *ContextHandler) GetBranchVersions(c *gin.Context) {
+	page, err := query.ParsePage(c.Request.URL.Query(), query.HistorySortKeys, "-version")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	list, err := ch.svc.GetBranchVersions(c.Request.Context(), c.Param("cid"), c.Param("branch"), page)
+	if err != nil {
+		ch.respondBranchError(c, err)
+		return
+	}
+	items, ok := countHistoryTokens(c, ch.log, ch.svc, c.Param("branch"), list.Items)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, svc2.CountedHistoryPage{Items: items, NextCursor: list.NextCursor})
+}
+
+// CommitToBranch adds the context of the body as the next version of the
+// branch. Like a replacing update, it applies to the head named by If-Match or
+// by the version of the body.
+func (ch *ContextHandler) CommitToBranch(c *gin.Context) {
+	var commit entities.Context
+	if err := c.ShouldBindJSON(&commit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	head := commit.Version
+	if header := c.GetHeader(ifMatchHeader); header != "" {
+		tags, err := query.ParseETagList(header)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		bc, err := ch.svc.GetBranch(c.Request.Context(), c.Param("cid"), c.Param("branch"))
+		if err != nil {
+			ch.respondBranchError(c, err)
+			return
+		}
+		if !tags.MatchStrong(bc.Branch.Head) {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Branch has moved on", "current": bc})
+			return
+		}
+		head = bc.Branch.Head
+	}
+	if head == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "If-Match or the version of the head of the branch is required"})
+		return
+	}
+	bc, err := ch.svc.CommitToBranch(c.Request.Context(), c.Param("cid"), c.Param("branch"), &commit, head, requestUser(c))
+	if err != nil {
+		ch.respondBranchError(c, err)
+		return
+	}
+	respondContext(c, http.StatusCreated, bc, bc.Branch.Head)
+}
+
+// MergeBranch merges the branch into the main line. A merge with conflicts
+// writes nothing and answers 409 with them.
+func (ch *ContextHandler) MergeBranch(c *gin.Context) {
+	var req requests.MergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	result, err := ch.svc.MergeBranch(c.Request.Context(), c.Param("cid"), c.Param("branch"), req.ExpectedVersion, req.Resolution)
+	if err != nil {
+		ch.respondBranchError(c, err)
+		return
+	}
+	if !result.Merged {
+		c.JSON(http.StatusConflict, result)
+		return
+	}
+	respondContext(c, http.StatusOK, result, result.Context.Version)
+}
+
+func (ch *ContextHandler) DeleteBranch(c *gin.Context) {
+	if err := ch.svc.DeleteBranch(c.Request.Context(), c.Param("cid"), c.Param("branch")); err != nil {
+		ch.respondBranchError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (ch *ContextHandler) respondBranchError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, svc2.ErrInvalidInput):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, repo.ErrContextNotFound), errors.Is(err, repo.ErrContextHistoryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context version not found"})
+	case errors.Is(err, repo.ErrBranchNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Branch not found"})
+	case errors.Is(err, repo.ErrBranchExists), errors.Is(err, svc2.ErrNothingToMerge):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, repo.ErrContextVersionMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": "Branch or context changed meanwhile"})
+	default:
+		ch.log.Errorf("Error handling branch %s of context %s: %v", c.Param("branch"), c.Param("cid"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Branch Service error: " + err.Error()})
+	}
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+)
+
+// DiffContext compares two versions of a context. from and to take a version
+// number, a history id or "current", to defaults to the current version. The
+// diff is plain unified-diff text with format=text or Accept: text/plain.
+func (ch *ContextHandler) DiffContext(c *gin.Context) {
+	id := c.Param("cid")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
+		return
+	}
+	from, err := query.ParseVersionRef(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := query.ParseVersionRef(c.DefaultQuery("to", query.CurrentVersion))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	d, err := ch.svc.DiffContext(c.Request.Context(), id, from, to)
+	if err != nil {
+		if errors.Is(err, repo.ErrContextNotFound) || errors.Is(err, repo.ErrContextHistoryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context version not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to diff context: " + err.Error()})
+		return
+	}
+
+	if c.Query("format") == "text" || c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain) == gin.MIMEPlain {
+		c.String(http.StatusOK, d.Unified())
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
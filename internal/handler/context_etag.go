@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+const (
+	ifMatchHeader     = "If-Match"
+	ifNoneMatchHeader = "If-None-Match"
+)
+
+// respondContext writes a context with its ETag.
+func respondContext(c *gin.Context, status int, doc interface{}, version int) {
+	c.Header("ETag", query.ETag(version))
+	c.JSON(status, doc)
+}
+
+// ifMatchVersion evaluates the If-Match header against the stored context. It
+// returns the version a conditional write must apply to, 0 when the request
+// has no If-Match, and false when it has already answered the request.
+func (ch *ContextHandler) ifMatchVersion(c *gin.Context, id string) (int, bool) {
+	header := c.GetHeader(ifMatchHeader)
+	if header == "" {
+		return 0, true
+	}
+	tags, err := query.ParseETagList(header)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	current, ok := ch.currentContext(c, id)
+	if !ok {
+		return 0, false
+	}
+	if !tags.MatchStrong(current.Version) {
+		respondStale(c, http.StatusPreconditionFailed, current)
+		return 0, false
+	}
+	return current.Version, true
+}
+
+// respondConflict answers a write that lost against a concurrent one: 412 when
+// it was conditioned by If-Match, 409 otherwise. Either way the client gets the
+// current representation to retry against.
+func (ch *ContextHandler) respondConflict(c *gin.Context, id string, conditional bool) {
+	current, ok := ch.currentContext(c, id)
+	if !ok {
+		return
+	}
+	status := http.StatusConflict
+	if conditional {
+		status = http.StatusPreconditionFailed
+	}
+	respondStale(c, status, current)
+}
+
+func respondStale(c *gin.Context, status int, current *entities.Context) {
+	respondContext(c, status, gin.H{
+		"error":   "Context has changed, its current version is attached",
+		"current": current,
+	}, current.Version)
+}
+
+// currentContext reads the context, answering the request when it cannot.
+func (ch *ContextHandler) currentContext(c *gin.Context, id string) (*entities.Context, bool) {
+	current, err := ch.svc.GetContextByID(c.Request.Context(), id)
+	if errors.Is(err, repo.ErrContextNotFound) || (err == nil && current == nil) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+		return nil, false
+	}
+	if err != nil {
+		ch.log.Errorf("Error getting context %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return current, true
+}
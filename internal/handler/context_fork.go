@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/pkg/requests"
+)
+
+// ForkContext creates a context from a version of the context, the current
+// one when the body is empty, and answers 201 with the fork.
+func (ch *ContextHandler) ForkContext(c *gin.Context) {
+	id := c.Param("cid")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
+		return
+	}
+	var req requests.ForkRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	from, err := req.Source()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.User.ID == "" {
+		req.User = requestUser(c)
+	}
+
+	fork, err := ch.svc.ForkContext(c.Request.Context(), id, from, svc2.ForkOptions{Name: req.Name, Description: req.Description, User: req.User})
+	if err != nil {
+		if errors.Is(err, repo.ErrContextNotFound) || errors.Is(err, repo.ErrContextHistoryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context version not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fork context: " + err.Error()})
+		return
+	}
+	respondContext(c, http.StatusCreated, fork, fork.Version)
+}
+
+// ListForks lists the contexts forked from the context directly.
+func (ch *ContextHandler) ListForks(c *gin.Context) {
+	forks, err := ch.svc.ListForks(c.Request.Context(), c.Param("cid"))
+	if err != nil {
+		ch.respondLineageError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, forks)
+}
+
+// GetLineage returns the ancestors and the descendants of the context.
+func (ch *ContextHandler) GetLineage(c *gin.Context) {
+	lineage, err := ch.svc.GetLineage(c.Request.Context(), c.Param("cid"))
+	if err != nil {
+		ch.respondLineageError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, lineage)
+}
+
+func (ch *ContextHandler) respondLineageError(c *gin.Context, err error) {
+	if errors.Is(err, repo.ErrContextNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+		return
+	}
+	ch.log.Errorf("Error reading the lineage of context %s: %v", c.Param("cid"), err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read lineage: " + err.Error()})
+}
@@ -5,6 +5,9 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/patch"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
 	svc2 "github.com/mangudaigb/context-service/internal/svc"
 	"github.com/mangudaigb/context-service/pkg/requests"
 	"github.com/mangudaigb/dhauli-base/logger"
@@ -25,40 +28,91 @@ func NewContextHandler(log *logger.Logger, svc svc2.ContextService) *ContextHand
 }
 
 func (ch *ContextHandler) GetContextByFilter(c *gin.Context) {
-	var reqData requests.ContextRequest
-	if err := c.ShouldBindJSON(&reqData); err != nil {
+	values := c.Request.URL.Query()
+	page, err := query.ParsePage(values, query.ContextSortKeys, "-modifiedTime")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q, err := query.ParseContextQuery(values, query.PageParams...)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	list, err := ch.svc.FilterContexts(c.Request.Context(), reqData)
+	list, err := ch.svc.FilterContexts(c.Request.Context(), q, page)
 	if err != nil {
+		if errors.Is(err, query.ErrInvalidQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		ch.log.Errorf("Error filtering contexts: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-	c.JSON(http.StatusOK, list)
+	items, ok := ch.countTokens(c, list.Items)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, svc2.CountedPage{Items: items, NextCursor: list.NextCursor})
+}
+
+// SearchContexts runs a full-text search, best matches first.
+func (ch *ContextHandler) SearchContexts(c *gin.Context) {
+	sq, err := query.ParseSearchQuery(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	results, err := ch.svc.SearchContexts(c.Request.Context(), sq)
+	if errors.Is(err, query.ErrInvalidQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ch.log.Errorf("Error searching contexts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": results})
 }
 
+// GetContext answers 304 when If-None-Match holds the ETag of the current
+// version.
 func (ch *ContextHandler) GetContext(c *gin.Context) {
 	id := c.Param("cid")
 	if id == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
 		return
 	}
+	var notModified query.ETagList
+	if header := c.GetHeader(ifNoneMatchHeader); header != "" {
+		var err error
+		if notModified, err = query.ParseETagList(header); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
-	doc, err := ch.svc.GetContextByID(c.Request.Context(), id)
-	if err != nil {
-		ch.log.Errorf("Error getting context %s: %v", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	var doc *entities.Context
+	var ok bool
+	if label := c.Query("label"); label != "" {
+		doc, ok = ch.labelledContext(c, id, label)
+	} else {
+		doc, ok = ch.currentContext(c, id)
+	}
+	if !ok {
 		return
 	}
-
-	if doc == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+	if notModified.MatchWeak(doc.Version) {
+		c.Header("ETag", query.ETag(doc.Version))
+		c.Status(http.StatusNotModified)
 		return
 	}
-
-	c.JSON(http.StatusOK, doc)
+	counted, ok := ch.countTokens(c, []*entities.Context{doc})
+	if !ok {
+		return
+	}
+	respondContext(c, http.StatusOK, counted[0], doc.Version)
 }
 
 func (ch *ContextHandler) CreateContext(c *gin.Context) {
@@ -73,23 +127,37 @@ func (ch *ContextHandler) CreateContext(c *gin.Context) {
 		Name:        req.Name,
 		Description: req.Description,
 		Content:     req.Content,
+		Tags:        req.Tags,
+		Metadata:    req.Metadata,
 	}
 
 	createdDoc, err := ch.svc.CreateContext(c.Request.Context(), &context)
 	if err != nil {
+		if respondMetadataError(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create context: " + err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusCreated, createdDoc)
+	respondContext(c, http.StatusCreated, createdDoc, createdDoc.Version)
 }
 
+// UpdateContext applies a merge patch or a JSON patch, see patchContext, or
+// replaces the context with the one in the payload. A replacement applies to
+// the version named by If-Match, or else to the version in the payload. A
+// version that is no longer current gets 412 with If-Match and 409 without,
+// along with the current context.
 func (ch *ContextHandler) UpdateContext(c *gin.Context) {
 	id := c.Param("cid")
 	if id == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
 		return
 	}
+	if patch.IsPatchType(c.GetHeader("Content-Type")) {
+		ch.patchContext(c, id)
+		return
+	}
 
 	var updates entities.Context
 	if err := c.ShouldBindJSON(&updates); err != nil {
@@ -97,31 +165,46 @@ func (ch *ContextHandler) UpdateContext(c *gin.Context) {
 		return
 	}
 
-	if updates.Version == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Optimistic lock failed: 'version' field is required in the update payload"})
-		return
-	}
-
 	if updates.ID != id {
 		ch.log.Errorf("ID mismatch in update payload: %s != %s", updates.ID, id)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "ID mismatch in update payload"})
 		return
 	}
 
+	matched, ok := ch.ifMatchVersion(c, id)
+	if !ok {
+		return
+	}
+	if matched != 0 {
+		updates.Version = matched
+	}
+	if updates.Version == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Optimistic lock failed: an If-Match header or a 'version' field in the payload is required"})
+		return
+	}
+
 	updatedDoc, err := ch.svc.UpdateContext(c.Request.Context(), &updates)
 	if err != nil {
-		if errors.Is(err, errors.New("document update failed: document not found or version mismatch (Optimistic Lock failure)")) {
-			c.JSON(http.StatusConflict, gin.H{"error": "Update failed due to version mismatch or document not found."})
+		if respondMetadataError(c, err) {
+			return
+		}
+		if errors.Is(err, repo.ErrContextVersionMismatch) {
+			ch.respondConflict(c, id, matched != 0)
+			return
+		}
+		if errors.Is(err, repo.ErrContextNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
 			return
 		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update context: " + err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, updatedDoc)
+	respondContext(c, http.StatusOK, updatedDoc, updatedDoc.Version)
 }
 
-// DeleteContext deletes a document by ID.
+// DeleteContext moves a document to the trash, only when it is still at the
+// version named by If-Match if the request has one.
 func (ch *ContextHandler) DeleteContext(c *gin.Context) {
 	id := c.Param("cid")
 	if id == "" {
@@ -129,15 +212,73 @@ func (ch *ContextHandler) DeleteContext(c *gin.Context) {
 		return
 	}
 
-	_, err := ch.svc.DeleteContext(c.Request.Context(), id)
+	matched, ok := ch.ifMatchVersion(c, id)
+	if !ok {
+		return
+	}
+	_, err := ch.svc.DeleteContext(c.Request.Context(), id, matched, requestUser(c))
 	if err != nil {
-		if errors.Is(err, errors.New("document not found for deletion")) {
+		if errors.Is(err, repo.ErrContextNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
 			return
 		}
+		if errors.Is(err, repo.ErrContextVersionMismatch) {
+			ch.respondConflict(c, id, matched != 0)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete context: " + err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Context deleted successfully"})
 }
+
+// RestoreContext takes a document out of the trash.
+func (ch *ContextHandler) RestoreContext(c *gin.Context) {
+	id := c.Param("cid")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
+		return
+	}
+
+	restored, err := ch.svc.RestoreContext(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, repo.ErrContextNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context not found in trash"})
+			return
+		}
+		if errors.Is(err, repo.ErrContextVersionMismatch) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Context changed while restoring it"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore context: " + err.Error()})
+		return
+	}
+
+	respondContext(c, http.StatusOK, restored, restored.Version)
+}
+
+func (ch *ContextHandler) ListTrash(c *gin.Context) {
+	values := c.Request.URL.Query()
+	page, err := query.ParsePage(values, query.TrashSortKeys, "-deletedAt")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q, err := query.ParseContextQuery(values, query.PageParams...)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	list, err := ch.svc.ListTrash(c.Request.Context(), q, page)
+	if errors.Is(err, query.ErrInvalidQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ch.log.Errorf("Error listing the trash: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
@@ -1,53 +1,87 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
 	svc2 "github.com/mangudaigb/context-service/internal/svc"
 	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
 )
 
 type ContextHistoryHandler struct {
-	log *logger.Logger
-	svc svc2.ContextHistoryService
+	log      *logger.Logger
+	svc      svc2.ContextHistoryService
+	contexts svc2.ContextService
 }
 
-func NewContextHistoryHandler(log *logger.Logger, svc svc2.ContextHistoryService) *ContextHistoryHandler {
+// NewContextHistoryHandler serves the history of svc, with the token counts
+// contexts keeps of its versions.
+func NewContextHistoryHandler(log *logger.Logger, svc svc2.ContextHistoryService, contexts svc2.ContextService) *ContextHistoryHandler {
 	return &ContextHistoryHandler{
-		log: log,
-		svc: svc,
+		log:      log,
+		svc:      svc,
+		contexts: contexts,
 	}
 }
 
 func (chh *ContextHistoryHandler) GetContextHistoryItem(c *gin.Context) {
 	contextId := c.Param("cid")
 	historyId := c.Param("hid")
-	if contextId == "" && historyId == "" {
+	if contextId == "" || historyId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID and Context History ID is required"})
 		return
 	}
 
-	doc, err := chh.svc.GetContextHistoryByID(c.Request.Context(), contextId)
+	doc, err := chh.svc.GetContextHistoryByID(c.Request.Context(), historyId)
 	if err != nil {
+		if errors.Is(err, repo.ErrContextHistoryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context History not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Context History Service error"})
+		return
 	}
 
-	if doc == nil {
+	if doc == nil || doc.ContextID != contextId {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Context History not found"})
+		return
+	}
+	// the entry may be a version of a branch, numbered like those of the
+	// main line, whose count is not the one of the main line version
+	if main, err := chh.svc.GetContextHistoryByVersion(c.Request.Context(), contextId, doc.Version); err != nil || main.ID != doc.ID {
+		c.JSON(http.StatusOK, doc)
+		return
 	}
-	c.JSON(http.StatusOK, doc)
+	counted, ok := countHistoryTokens(c, chh.log, chh.contexts, "", []*entities.ContextHistory{doc})
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, counted[0])
 }
 
 func (chh *ContextHistoryHandler) GetContextHistoryForContextID(c *gin.Context) {
-	query, ok := c.GetQuery("cid")
-	if !ok {
+	contextId := c.Param("cid")
+	if contextId == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
 		return
 	}
-	doc, err := chh.svc.GetHistoryForContextId(c.Request.Context(), query)
+	page, err := query.ParsePage(c.Request.URL.Query(), query.HistorySortKeys, "-version")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	doc, err := chh.svc.GetHistoryForContextId(c.Request.Context(), contextId, page)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Context History Service error"})
+		return
+	}
+	items, ok := countHistoryTokens(c, chh.log, chh.contexts, "", doc.Items)
+	if !ok {
+		return
 	}
-	c.JSON(http.StatusOK, doc)
+	c.JSON(http.StatusOK, svc2.CountedHistoryPage{Items: items, NextCursor: doc.NextCursor})
 }
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/pkg/requests"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func (ch *ContextHandler) ListLabels(c *gin.Context) {
+	labels, err := ch.svc.ListLabels(c.Request.Context(), c.Param("cid"))
+	if err != nil {
+		ch.respondLabelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, labels)
+}
+
+// MoveLabel points the label at a version, setting it when it does not exist.
+func (ch *ContextHandler) MoveLabel(c *gin.Context) {
+	var req requests.LabelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	opts := svc2.LabelMoveOptions{Expected: req.From, Reason: req.Reason, User: requestUser(c)}
+	l, err := ch.svc.MoveLabel(c.Request.Context(), c.Param("cid"), c.Param("label"), req.Version, opts)
+	if err != nil {
+		ch.respondLabelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, l)
+}
+
+// RemoveLabel removes the label. The from and reason query parameters play
+// the part of those of a move.
+func (ch *ContextHandler) RemoveLabel(c *gin.Context) {
+	opts := svc2.LabelMoveOptions{Reason: c.Query("reason"), User: requestUser(c)}
+	if v := c.Query("from"); v != "" {
+		var err error
+		if opts.Expected, err = strconv.Atoi(v); err != nil || opts.Expected < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a positive version"})
+			return
+		}
+	}
+	if err := ch.svc.RemoveLabel(c.Request.Context(), c.Param("cid"), c.Param("label"), opts); err != nil {
+		ch.respondLabelError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListLabelMoves returns the moves of the label, of every label of the context
+// on /label-moves, newest first.
+func (ch *ContextHandler) ListLabelMoves(c *gin.Context) {
+	moves, err := ch.svc.ListLabelMoves(c.Request.Context(), c.Param("cid"), c.Param("label"))
+	if err != nil {
+		ch.respondLabelError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, moves)
+}
+
+// labelledContext is the currentContext of GET /contexts/:cid?label=.
+func (ch *ContextHandler) labelledContext(c *gin.Context, id, label string) (*entities.Context, bool) {
+	doc, err := ch.svc.GetContextByLabel(c.Request.Context(), id, label)
+	if err != nil {
+		ch.respondLabelError(c, err)
+		return nil, false
+	}
+	return doc, true
+}
+
+func (ch *ContextHandler) respondLabelError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, svc2.ErrInvalidInput):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, repo.ErrContextNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+	case errors.Is(err, repo.ErrContextHistoryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context version not found"})
+	case errors.Is(err, repo.ErrLabelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Label not found"})
+	case errors.Is(err, repo.ErrContextVersionMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": "Label moved meanwhile"})
+	default:
+		ch.log.Errorf("Error handling label %s of context %s: %v", c.Param("label"), c.Param("cid"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Label Service error: " + err.Error()})
+	}
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/patch"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+)
+
+// patchContext applies a JSON Merge Patch or a JSON Patch to the current
+// version of the context, or to the version named by If-Match.
+func (ch *ContextHandler) patchContext(c *gin.Context, id string) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := patch.Parse(c.GetHeader("Content-Type"), body)
+	if err != nil {
+		if errors.Is(err, patch.ErrUnsupportedType) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	matched, ok := ch.ifMatchVersion(c, id)
+	if !ok {
+		return
+	}
+	patched, err := ch.svc.PatchContext(c.Request.Context(), id, matched, p)
+	if err != nil {
+		if respondMetadataError(c, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, repo.ErrContextNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+		case errors.Is(err, repo.ErrContextVersionMismatch):
+			ch.respondConflict(c, id, matched != 0)
+		case errors.Is(err, patch.ErrCannotApply), errors.Is(err, svc2.ErrReadOnlyField):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to patch context: " + err.Error()})
+		}
+		return
+	}
+	respondContext(c, http.StatusOK, patched, patched.Version)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/compose"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/internal/templating"
+	"github.com/mangudaigb/context-service/pkg/requests"
+)
+
+// renderOptions reads the label and the tenantId query parameters, the latter
+// a comma separated list which may be repeated.
+func renderOptions(c *gin.Context) svc2.RenderOptions {
+	opts := svc2.RenderOptions{Label: c.Query("label")}
+	for _, v := range c.QueryArray("tenantId") {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				opts.TenantIDs = append(opts.TenantIDs, id)
+			}
+		}
+	}
+	return opts
+}
+
+// GetRenderedContext returns the content of the context with its includes
+// expanded, along with the versions of the contexts it used.
+func (ch *ContextHandler) GetRenderedContext(c *gin.Context) {
+	rendered, err := ch.svc.RenderContext(c.Request.Context(), c.Param("cid"), renderOptions(c))
+	if err != nil {
+		ch.respondRenderError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rendered)
+}
+
+// GetVariables returns the variables the current version of the context
+// declares, with the ETag of that version.
+func (ch *ContextHandler) GetVariables(c *gin.Context) {
+	vv, err := ch.svc.GetVariables(c.Request.Context(), c.Param("cid"))
+	if err != nil {
+		ch.respondRenderError(c, err)
+		return
+	}
+	respondContext(c, http.StatusOK, vv.Variables, vv.Version)
+}
+
+// SetVariables replaces the variables the context declares by those of the
+// body, a list of declarations, writing a new version of the context. Like
+// an update, it only applies to the version named by If-Match if the request
+// has one.
+func (ch *ContextHandler) SetVariables(c *gin.Context) {
+	id := c.Param("cid")
+	var vars []templating.Variable
+	if err := c.ShouldBindJSON(&vars); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	matched, ok := ch.ifMatchVersion(c, id)
+	if !ok {
+		return
+	}
+	vv, err := ch.svc.SetVariables(c.Request.Context(), id, matched, vars)
+	if errors.Is(err, repo.ErrContextVersionMismatch) {
+		ch.respondConflict(c, id, matched != 0)
+		return
+	}
+	if err != nil {
+		ch.respondRenderError(c, err)
+		return
+	}
+	respondContext(c, http.StatusOK, vv.Variables, vv.Version)
+}
+
+// RenderTemplate renders the context with the values of its variables given
+// in the body. Values that do not fit the declarations answer 400, naming the
+// variables missing, unknown or invalid.
+func (ch *ContextHandler) RenderTemplate(c *gin.Context) {
+	var req requests.RenderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	opts := svc2.RenderOptions{Label: req.Label, TenantIDs: req.TenantIDs}
+	rendered, err := ch.svc.RenderTemplate(c.Request.Context(), c.Param("cid"), req.Variables, opts)
+	if err != nil {
+		ch.respondRenderError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rendered)
+}
+
+// respondRenderError answers 422 when the stored content cannot be rendered,
+// 403 when it includes a context the tenants of the rendering may not see, and
+// 400 for variables or values that are not valid.
+func (ch *ContextHandler) respondRenderError(c *gin.Context, err error) {
+	var verr *templating.ValuesError
+	switch {
+	case errors.As(err, &verr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "missing": verr.Missing, "unknown": verr.Unknown, "invalid": verr.Invalid})
+	case errors.Is(err, templating.ErrInvalidDeclaration):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, svc2.ErrIncludeForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, compose.ErrInvalidDirective), errors.Is(err, svc2.ErrIncludeNotFound), errors.Is(err, svc2.ErrIncludeAmbiguous),
+		errors.Is(err, svc2.ErrIncludeCycle), errors.Is(err, svc2.ErrIncludeTooDeep), errors.Is(err, templating.ErrUndeclared):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, repo.ErrContextNotFound), errors.Is(err, repo.ErrContextHistoryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+	case errors.Is(err, repo.ErrLabelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Label not found"})
+	default:
+		ch.log.Errorf("Error rendering context %s: %v", c.Param("cid"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Render Service error: " + err.Error()})
+	}
+}
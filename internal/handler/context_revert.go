@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/pkg/requests"
+)
+
+func (ch *ContextHandler) RevertContext(c *gin.Context) {
+	id := c.Param("cid")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
+		return
+	}
+	var req requests.RevertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	to, err := req.Target()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reverted, err := ch.svc.RevertContext(c.Request.Context(), id, to, req.ExpectedVersion)
+	if err != nil {
+		switch {
+		case errors.Is(err, repo.ErrContextNotFound), errors.Is(err, repo.ErrContextHistoryNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context version not found"})
+		case errors.Is(err, repo.ErrContextVersionMismatch):
+			c.JSON(http.StatusConflict, gin.H{"error": "Context changed while reverting it"})
+		case errors.Is(err, svc2.ErrRevertToCurrent):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert context: " + err.Error()})
+		}
+		return
+	}
+	respondContext(c, http.StatusOK, reverted, reverted.Version)
+}
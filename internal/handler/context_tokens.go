@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
+	"github.com/mangudaigb/context-service/pkg/requests"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// countTokens adds their token counts to the contexts of a response, and
+// answers the request itself when it fails.
+func (ch *ContextHandler) countTokens(c *gin.Context, contexts []*entities.Context) ([]*svc2.CountedContext, bool) {
+	counted, err := ch.svc.CountTokens(c.Request.Context(), contexts)
+	if err != nil {
+		ch.log.Errorf("Error counting the tokens of %d contexts: %v", len(contexts), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return counted, true
+}
+
+// countHistoryTokens is countTokens for history entries of the main line or,
+// when branch is set, of the branch.
+func countHistoryTokens(c *gin.Context, log *logger.Logger, svc svc2.ContextService, branch string, entries []*entities.ContextHistory) ([]*svc2.CountedHistory, bool) {
+	counted, err := svc.CountHistoryTokens(c.Request.Context(), branch, entries)
+	if err != nil {
+		log.Errorf("Error counting the tokens of %d history entries: %v", len(entries), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return counted, true
+}
+
+// FitContext returns the content of the context cut down to the budget
+// parameter, a number of tokens, with the strategy, the label and the section
+// priorities of the body, which may be empty.
+func (ch *ContextHandler) FitContext(c *gin.Context) {
+	budget, err := strconv.Atoi(c.Query("budget"))
+	if err != nil || budget <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "budget must be a positive number of tokens"})
+		return
+	}
+	var req requests.FitRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+			return
+		}
+	}
+	opts := svc2.FitOptions{Strategy: req.Strategy, Label: req.Label, Priorities: req.Priorities}
+	fitted, err := ch.svc.FitContext(c.Request.Context(), c.Param("cid"), budget, opts)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, fitted)
+	case errors.Is(err, tokenizer.ErrInvalidFit):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, repo.ErrContextNotFound), errors.Is(err, repo.ErrContextHistoryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Context not found"})
+	case errors.Is(err, repo.ErrLabelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Label not found"})
+	default:
+		ch.log.Errorf("Error fitting context %s: %v", c.Param("cid"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Context Service error: " + err.Error()})
+	}
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/query"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+)
+
+const ndjsonType = "application/x-ndjson"
+
+// ContextsAction serves the custom methods of the context collection,
+// GET /contexts:export, POST /contexts:import and POST /contexts:batch. gin
+// only routes a literal colon when it runs the server itself, so they share a
+// parameter route.
+func (ch *ContextHandler) ContextsAction(c *gin.Context) {
+	switch c.Request.Method + " " + c.Param("action") {
+	case http.MethodGet + " :export":
+		ch.ExportContexts(c)
+	case http.MethodPost + " :import":
+		ch.ImportContexts(c)
+	case http.MethodPost + " :batch":
+		ch.BatchContexts(c)
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown action " + c.Param("action")})
+	}
+}
+
+// ExportContexts streams the contexts matching the filter as NDJSON, with
+// their history when history=true. The filter must name a tenant. A failure
+// after the stream started ends it with an error record.
+func (ch *ContextHandler) ExportContexts(c *gin.Context) {
+	values := c.Request.URL.Query()
+	withHistory, err := strconv.ParseBool(values.Get("history"))
+	if values.Get("history") == "" {
+		withHistory, err = false, nil
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "history must be true or false"})
+		return
+	}
+	q, err := query.ParseContextQuery(values, "history")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// an export outlasts the write timeout of the server
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	w := ndjsonWriter{c}
+	err = ch.svc.ExportContexts(c.Request.Context(), w, q, withHistory)
+	if err == nil {
+		w.start()
+		return
+	}
+	if errors.Is(err, svc2.ErrUnscopedTransfer) || errors.Is(err, query.ErrInvalidQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ch.log.Errorf("Error exporting contexts: %v", err)
+	if c.Writer.Written() {
+		_ = json.NewEncoder(w).Encode(svc2.TransferRecord{Kind: svc2.RecordError, Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export contexts: " + err.Error()})
+}
+
+// ImportContexts reads an export and reports on each context record. The
+// policy parameter handles the taken ids, see svc.ImportPolicy; the filter
+// must name a tenant and the records outside it are rejected.
+func (ch *ContextHandler) ImportContexts(c *gin.Context) {
+	values := c.Request.URL.Query()
+	policy, err := svc2.ParseImportPolicy(values.Get("policy"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q, err := query.ParseContextQuery(values, "policy")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_ = http.NewResponseController(c.Writer).SetReadDeadline(time.Time{})
+	report, err := ch.svc.ImportContexts(c.Request.Context(), c.Request.Body, q, policy)
+	if err != nil {
+		if errors.Is(err, svc2.ErrUnscopedTransfer) || errors.Is(err, query.ErrInvalidQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import contexts: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// ndjsonWriter streams an NDJSON response, flushing each record to the client.
+type ndjsonWriter struct {
+	c *gin.Context
+}
+
+// start sends the headers of the response, unless they are sent already.
+func (w ndjsonWriter) start() {
+	if !w.c.Writer.Written() {
+		w.c.Header("Content-Type", ndjsonType)
+		w.c.Status(http.StatusOK)
+		w.c.Writer.WriteHeaderNow()
+	}
+}
+
+func (w ndjsonWriter) Write(p []byte) (int, error) {
+	w.start()
+	n, err := w.c.Writer.Write(p)
+	w.c.Writer.Flush()
+	return n, err
+}
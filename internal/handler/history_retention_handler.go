@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+type HistoryRetentionHandler struct {
+	log *logger.Logger
+	svc svc2.HistoryRetentionService
+}
+
+func NewHistoryRetentionHandler(log *logger.Logger, svc svc2.HistoryRetentionService) *HistoryRetentionHandler {
+	return &HistoryRetentionHandler{
+		log: log,
+		svc: svc,
+	}
+}
+
+// PreviewContextRetention lists the versions of the context history the
+// compaction would remove, under the configured policy or the one given by
+// the keepLast, keepDays and dailySnapshots parameters.
+func (hrh *HistoryRetentionHandler) PreviewContextRetention(c *gin.Context) {
+	contextId := c.Param("cid")
+	if contextId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Context ID is required"})
+		return
+	}
+	policy, err := parseRetentionPolicy(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	preview, err := hrh.svc.PreviewContext(c.Request.Context(), contextId, policy)
+	if err != nil {
+		if errors.Is(err, repo.ErrContextHistoryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Context History not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Context History Service error"})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// PreviewRetention runs the compaction over every context history without
+// removing anything and reports what it would reclaim.
+func (hrh *HistoryRetentionHandler) PreviewRetention(c *gin.Context) {
+	policy, err := parseRetentionPolicy(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := hrh.svc.Compact(c.Request.Context(), policy, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Context History Service error"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// parseRetentionPolicy returns nil when no policy parameter is set.
+func parseRetentionPolicy(values url.Values) (*settings.RetentionPolicy, error) {
+	if !values.Has("keepLast") && !values.Has("keepDays") && !values.Has("dailySnapshots") {
+		return nil, nil
+	}
+	p := &settings.RetentionPolicy{}
+	var err error
+	if v := values.Get("keepLast"); v != "" {
+		if p.KeepLast, err = strconv.Atoi(v); err != nil || p.KeepLast < 0 {
+			return nil, fmt.Errorf("keepLast must be a non-negative integer, got %q", v)
+		}
+	}
+	if v := values.Get("keepDays"); v != "" {
+		if p.KeepDays, err = strconv.Atoi(v); err != nil || p.KeepDays < 0 {
+			return nil, fmt.Errorf("keepDays must be a non-negative integer, got %q", v)
+		}
+	}
+	if v := values.Get("dailySnapshots"); v != "" {
+		if p.DailySnapshots, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("dailySnapshots must be a boolean, got %q", v)
+		}
+	}
+	return p, nil
+}
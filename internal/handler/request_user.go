@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+const (
+	userIDHeader   = "X-User-Id"
+	userNameHeader = "X-User-Name"
+)
+
+// requestUser identifies the caller from the user headers set by the gateway.
+func requestUser(c *gin.Context) entities.UserStub {
+	return entities.UserStub{
+		ID:   c.GetHeader(userIDHeader),
+		Name: c.GetHeader(userNameHeader),
+	}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/jsonschema"
+	"github.com/mangudaigb/context-service/internal/repo"
+	svc2 "github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/pkg/requests"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+type SchemaHandler struct {
+	log *logger.Logger
+	svc svc2.SchemaService
+}
+
+func NewSchemaHandler(log *logger.Logger, svc svc2.SchemaService) *SchemaHandler {
+	return &SchemaHandler{
+		log: log,
+		svc: svc,
+	}
+}
+
+// respondMetadataError answers 400 with the violations when err is about
+// metadata that does not follow its schemas, and tells whether it did.
+func respondMetadataError(c *gin.Context, err error) bool {
+	var merr *svc2.MetadataError
+	if !errors.As(err, &merr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "violations": merr.Violations})
+	return true
+}
+
+func (sh *SchemaHandler) ListSchemas(c *gin.Context) {
+	schemas, err := sh.svc.ListSchemas(c.Request.Context())
+	if err != nil {
+		sh.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, schemas)
+}
+
+func (sh *SchemaHandler) GetSchema(c *gin.Context) {
+	s, err := sh.svc.GetSchema(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		sh.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// PutSchema registers the schema of the body under the name of the path, or
+// replaces the one registered under it.
+func (sh *SchemaHandler) PutSchema(c *gin.Context) {
+	var req requests.SchemaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: " + err.Error()})
+		return
+	}
+	s := &repo.MetadataSchema{
+		Name:        c.Param("name"),
+		Kind:        req.Kind,
+		Tag:         req.Tag,
+		Description: req.Description,
+		Schema:      json.RawMessage(req.Schema),
+		ModifiedBy:  requestUser(c),
+	}
+	s, err := sh.svc.PutSchema(c.Request.Context(), s)
+	if err != nil {
+		sh.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func (sh *SchemaHandler) DeleteSchema(c *gin.Context) {
+	if err := sh.svc.DeleteSchema(c.Request.Context(), c.Param("name")); err != nil {
+		sh.respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListViolations lists the contexts whose current metadata does not follow
+// the schema, up to the limit parameter, which is capped at
+// svc.MaxViolations. It is meant to be run after tightening a schema.
+func (sh *SchemaHandler) ListViolations(c *gin.Context) {
+	limit := 0
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+	}
+	report, err := sh.svc.Violations(c.Request.Context(), c.Param("name"), limit)
+	if err != nil {
+		sh.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (sh *SchemaHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repo.ErrSchemaNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schema not found"})
+	case errors.Is(err, repo.ErrSchemaConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, jsonschema.ErrInvalidSchema), errors.Is(err, svc2.ErrInvalidInput):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		sh.log.Errorf("Error handling schema %s: %v", c.Param("name"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Schema Service error: " + err.Error()})
+	}
+}
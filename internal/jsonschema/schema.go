@@ -0,0 +1,476 @@
+// Package jsonschema validates JSON values against a subset of JSON Schema
+// (draft 2020-12): type, enum, const, the object keywords properties,
+// required and additionalProperties, the array keywords items, minItems,
+// maxItems and uniqueItems, the string keywords minLength, maxLength and
+// pattern, the numeric keywords minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum and multipleOf, and the combinators allOf, anyOf, oneOf
+// and not. The annotations are ignored; any other keyword, $ref included, is
+// rejected when compiling, so that a schema never seems to check more than it
+// does.
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrInvalidSchema = errors.New("invalid schema")
+
+// Error is a value of the document not following the schema, at the JSON
+// Pointer Path, "" being the whole document.
+type Error struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e Error) String() string {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	return path + " " + e.Message
+}
+
+// Schema is a compiled schema.
+type Schema struct {
+	root *node
+}
+
+type node struct {
+	// always is the result of the boolean schemas true and false.
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant *interface{}
+
+	properties map[string]*node
+	required   []string
+	additional *node
+
+	items       *node
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*node
+	anyOf []*node
+	oneOf []*node
+	not   *node
+}
+
+var annotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+	"format": true,
+}
+
+var typeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true,
+}
+
+// Compile parses a schema.
+func Compile(raw []byte) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	root, err := compile(v, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+func invalid(at, format string, args ...interface{}) error {
+	if at == "" {
+		at = "/"
+	}
+	return fmt.Errorf("%w: at %s: %s", ErrInvalidSchema, at, fmt.Sprintf(format, args...))
+}
+
+func compile(v interface{}, at string) (*node, error) {
+	if b, ok := v.(bool); ok {
+		return &node{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, invalid(at, "a schema is an object or a boolean")
+	}
+	n := &node{}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := n.set(k, m[k], at+"/"+escape(k)); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *node) set(k string, v interface{}, at string) error {
+	var err error
+	switch k {
+	case "type":
+		n.types, err = typeList(v, at)
+	case "enum":
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			return invalid(at, "must be a non-empty array")
+		}
+		n.enum = list
+	case "const":
+		n.constant = &v
+	case "properties":
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return invalid(at, "must be an object")
+		}
+		n.properties = make(map[string]*node, len(props))
+		for name, sub := range props {
+			if n.properties[name], err = compile(sub, at+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	case "required":
+		n.required, err = stringList(v, at)
+	case "additionalProperties":
+		n.additional, err = compile(v, at)
+	case "items":
+		n.items, err = compile(v, at)
+	case "minItems":
+		n.minItems, err = count(v, at)
+	case "maxItems":
+		n.maxItems, err = count(v, at)
+	case "uniqueItems":
+		b, ok := v.(bool)
+		if !ok {
+			return invalid(at, "must be a boolean")
+		}
+		n.uniqueItems = b
+	case "minLength":
+		n.minLength, err = count(v, at)
+	case "maxLength":
+		n.maxLength, err = count(v, at)
+	case "pattern":
+		s, ok := v.(string)
+		if !ok {
+			return invalid(at, "must be a string")
+		}
+		if n.pattern, err = regexp.Compile(s); err != nil {
+			return invalid(at, "%v", err)
+		}
+	case "minimum":
+		n.minimum, err = number(v, at)
+	case "maximum":
+		n.maximum, err = number(v, at)
+	case "exclusiveMinimum":
+		n.exclusiveMinimum, err = number(v, at)
+	case "exclusiveMaximum":
+		n.exclusiveMaximum, err = number(v, at)
+	case "multipleOf":
+		if n.multipleOf, err = number(v, at); err == nil && *n.multipleOf <= 0 {
+			return invalid(at, "must be positive")
+		}
+	case "allOf":
+		n.allOf, err = schemaList(v, at)
+	case "anyOf":
+		n.anyOf, err = schemaList(v, at)
+	case "oneOf":
+		n.oneOf, err = schemaList(v, at)
+	case "not":
+		n.not, err = compile(v, at)
+	default:
+		if !annotations[k] {
+			return invalid(at, "keyword %s is not supported", k)
+		}
+	}
+	return err
+}
+
+func typeList(v interface{}, at string) ([]string, error) {
+	names := []string{}
+	switch t := v.(type) {
+	case string:
+		names = append(names, t)
+	case []interface{}:
+		list, err := stringList(t, at)
+		if err != nil {
+			return nil, err
+		}
+		names = list
+	default:
+		return nil, invalid(at, "must be a type name or an array of them")
+	}
+	for _, name := range names {
+		if !typeNames[name] {
+			return nil, invalid(at, "unknown type %q", name)
+		}
+	}
+	return names, nil
+}
+
+func stringList(v interface{}, at string) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, invalid(at, "must be an array of strings")
+	}
+	out := make([]string, 0, len(list))
+	for _, e := range list {
+		s, ok := e.(string)
+		if !ok {
+			return nil, invalid(at, "must be an array of strings")
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func schemaList(v interface{}, at string) ([]*node, error) {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, invalid(at, "must be a non-empty array of schemas")
+	}
+	out := make([]*node, 0, len(list))
+	for i, e := range list {
+		n, err := compile(e, at+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func number(v interface{}, at string) (*float64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, invalid(at, "must be a number")
+	}
+	return &f, nil
+}
+
+func count(v interface{}, at string) (*int, error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return nil, invalid(at, "must be a non-negative integer")
+	}
+	i := int(f)
+	return &i, nil
+}
+
+// escape escapes a property name as a JSON Pointer token.
+func escape(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// Validate returns the errors of doc against the schema, none when it follows
+// it. doc is a value as decoded by encoding/json into an interface{}.
+func (s *Schema) Validate(doc interface{}) []Error {
+	var errs []Error
+	s.root.validate(doc, "", &errs)
+	return errs
+}
+
+func (n *node) validate(v interface{}, at string, errs *[]Error) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, Error{Path: at, Message: fmt.Sprintf(format, args...)})
+	}
+	if n.always != nil {
+		if !*n.always {
+			fail("is not allowed")
+		}
+		return
+	}
+	if len(n.types) > 0 && !hasType(v, n.types) {
+		fail("must be of type %s", strings.Join(n.types, " or "))
+		return
+	}
+	if n.enum != nil && !containsValue(n.enum, v) {
+		fail("must be one of %s", describe(n.enum))
+	}
+	if n.constant != nil && !reflect.DeepEqual(*n.constant, v) {
+		fail("must be %s", describe(*n.constant))
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		n.validateObject(t, at, errs)
+	case []interface{}:
+		n.validateArray(t, at, errs)
+	case string:
+		length := utf8.RuneCountInString(t)
+		if n.minLength != nil && length < *n.minLength {
+			fail("must be at least %d characters long", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			fail("must be at most %d characters long", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(t) {
+			fail("must match %s", n.pattern)
+		}
+	case float64:
+		n.validateNumber(t, fail)
+	}
+	for _, sub := range n.allOf {
+		sub.validate(v, at, errs)
+	}
+	if n.anyOf != nil && matching(n.anyOf, v, at) == 0 {
+		fail("must match at least one schema of anyOf")
+	}
+	if n.oneOf != nil {
+		if matched := matching(n.oneOf, v, at); matched != 1 {
+			fail("must match exactly one schema of oneOf, matches %d", matched)
+		}
+	}
+	if n.not != nil && matching([]*node{n.not}, v, at) == 1 {
+		fail("must not match the schema of not")
+	}
+}
+
+func (n *node) validateObject(obj map[string]interface{}, at string, errs *[]Error) {
+	for _, name := range n.required {
+		if _, ok := obj[name]; !ok {
+			*errs = append(*errs, Error{Path: at + "/" + escape(name), Message: "is required"})
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sub, ok := n.properties[name]; ok {
+			sub.validate(obj[name], at+"/"+escape(name), errs)
+		} else if n.additional != nil {
+			n.additional.validate(obj[name], at+"/"+escape(name), errs)
+		}
+	}
+}
+
+func (n *node) validateArray(list []interface{}, at string, errs *[]Error) {
+	if n.minItems != nil && len(list) < *n.minItems {
+		*errs = append(*errs, Error{Path: at, Message: fmt.Sprintf("must have at least %d items", *n.minItems)})
+	}
+	if n.maxItems != nil && len(list) > *n.maxItems {
+		*errs = append(*errs, Error{Path: at, Message: fmt.Sprintf("must have at most %d items", *n.maxItems)})
+	}
+	if n.uniqueItems {
+		for i := 1; i < len(list); i++ {
+			if containsValue(list[:i], list[i]) {
+				*errs = append(*errs, Error{Path: at + "/" + strconv.Itoa(i), Message: "must not repeat an earlier item"})
+			}
+		}
+	}
+	if n.items != nil {
+		for i, e := range list {
+			n.items.validate(e, at+"/"+strconv.Itoa(i), errs)
+		}
+	}
+}
+
+func (n *node) validateNumber(f float64, fail func(string, ...interface{})) {
+	if n.minimum != nil && f < *n.minimum {
+		fail("must be at least %v", *n.minimum)
+	}
+	if n.maximum != nil && f > *n.maximum {
+		fail("must be at most %v", *n.maximum)
+	}
+	if n.exclusiveMinimum != nil && f <= *n.exclusiveMinimum {
+		fail("must be more than %v", *n.exclusiveMinimum)
+	}
+	if n.exclusiveMaximum != nil && f >= *n.exclusiveMaximum {
+		fail("must be less than %v", *n.exclusiveMaximum)
+	}
+	if n.multipleOf != nil {
+		if q := f / *n.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", *n.multipleOf)
+		}
+	}
+}
+
+// matching counts the schemas v follows.
+func matching(schemas []*node, v interface{}, at string) int {
+	matched := 0
+	for _, sub := range schemas {
+		var errs []Error
+		sub.validate(v, at, &errs)
+		if len(errs) == 0 {
+			matched++
+		}
+	}
+	return matched
+}
+
+func hasType(v interface{}, types []string) bool {
+	for _, t := range types {
+		switch t {
+		case "null":
+			if v == nil {
+				return true
+			}
+		case "boolean":
+			if _, ok := v.(bool); ok {
+				return true
+			}
+		case "object":
+			if _, ok := v.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := v.([]interface{}); ok {
+				return true
+			}
+		case "number":
+			if _, ok := v.(float64); ok {
+				return true
+			}
+		case "integer":
+			if f, ok := v.(float64); ok && f == math.Trunc(f) {
+				return true
+			}
+		case "string":
+			if _, ok := v.(string); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, e := range list {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func describe(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
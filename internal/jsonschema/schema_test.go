@@ -0,0 +1,111 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const persona = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "persona",
+	"type": "object",
+	"required": ["kind", "audience"],
+	"properties": {
+		"kind": {"const": "persona"},
+		"audience": {"enum": ["internal", "external"]},
+		"owner": {"type": "string", "pattern": "^[a-z]+@", "maxLength": 20},
+		"temperature": {"type": "number", "minimum": 0, "exclusiveMaximum": 2},
+		"retries": {"type": "integer", "multipleOf": 1},
+		"locales": {"type": "array", "items": {"type": "string", "minLength": 2}, "uniqueItems": true, "maxItems": 3},
+		"a/b": {"type": "boolean"}
+	},
+	"additionalProperties": false
+}`
+
+func decode(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	s, err := Compile([]byte(persona))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := `{"kind": "persona", "audience": "internal", "owner": "ada@x", "temperature": 0.5, "retries": 3, "locales": ["en", "fr"], "a/b": true}`
+	if errs := s.Validate(decode(t, valid)); len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	invalid := `{"kind": "agent", "owner": "Ada", "temperature": 2, "retries": 1.5, "locales": ["en", "x", "en", "de"], "a/b": 1, "colour": "red"}`
+	// required comes before the properties, which are sorted by name.
+	want := []Error{
+		{Path: "/audience", Message: "is required"},
+		{Path: "/a~1b", Message: "must be of type boolean"},
+		{Path: "/colour", Message: "is not allowed"},
+		{Path: "/kind", Message: `must be "persona"`},
+		{Path: "/locales", Message: "must have at most 3 items"},
+		{Path: "/locales/2", Message: "must not repeat an earlier item"},
+		{Path: "/locales/1", Message: "must be at least 2 characters long"},
+		{Path: "/owner", Message: "must match ^[a-z]+@"},
+		{Path: "/retries", Message: "must be of type integer"},
+		{Path: "/temperature", Message: "must be less than 2"},
+	}
+	if errs := s.Validate(decode(t, invalid)); !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %v\nwant %v", errs, want)
+	}
+	if errs := s.Validate(decode(t, `[]`)); len(errs) != 1 || errs[0].String() != "/ must be of type object" {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestCombinators(t *testing.T) {
+	s, err := Compile([]byte(`{
+		"anyOf": [{"type": "string"}, {"type": "number"}],
+		"oneOf": [{"type": "number"}, {"type": "integer"}, {"type": "string"}],
+		"not": {"const": "none"},
+		"allOf": [{"maxLength": 4}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for doc, want := range map[string][]Error{
+		`"abc"`:   nil,
+		`1.5`:     nil,
+		`true`:    {{Message: "must match at least one schema of anyOf"}, {Message: "must match exactly one schema of oneOf, matches 0"}},
+		`2`:       {{Message: "must match exactly one schema of oneOf, matches 2"}},
+		`"none"`:  {{Message: "must not match the schema of not"}},
+		`"abcde"`: {{Message: "must be at most 4 characters long"}},
+	} {
+		if got := s.Validate(decode(t, doc)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", doc, got, want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for name, raw := range map[string]string{
+		"not json":        `{`,
+		"not a schema":    `"object"`,
+		"unknown type":    `{"type": "date"}`,
+		"unsupported":     `{"$ref": "#/$defs/a"}`,
+		"bad pattern":     `{"properties": {"a": {"pattern": "("}}}`,
+		"negative length": `{"minLength": -1}`,
+		"empty enum":      `{"enum": []}`,
+		"zero multiple":   `{"multipleOf": 0}`,
+		"bad nested":      `{"anyOf": [{"items": 3}]}`,
+	} {
+		if _, err := Compile([]byte(raw)); !errors.Is(err, ErrInvalidSchema) {
+			t.Errorf("%s: expected ErrInvalidSchema, got %v", name, err)
+		}
+	}
+	if s, err := Compile([]byte(`false`)); err != nil || len(s.Validate(nil)) != 1 {
+		t.Fatalf("the false schema must reject everything: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// All returns the migrations of the service in version order. Never change or
+// renumber a migration once released; add a new one instead.
+func All() []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Name:        "merge_legacy_collections",
+			Description: "merge the " + legacyContextsCollection + " and " + legacyHistoriesCollection + " collections of the HTTP server into " + repo.ContextsCollection + " and " + repo.ContextHistoriesCollection,
+			Up:          mergeLegacyCollections,
+			Plan:        planMergeLegacyCollections,
+		},
+		{
+			Version:     2,
+			Name:        "contexts_indexes",
+			Description: "create the listing indexes on " + repo.ContextsCollection,
+			Up:          createIndexes(repo.ContextsCollection, repo.ContextIndexes()),
+		},
+		{
+			Version:     3,
+			Name:        "context_histories_indexes",
+			Description: "create the contextId indexes on " + repo.ContextHistoriesCollection,
+			Up:          createIndexes(repo.ContextHistoriesCollection, repo.ContextHistoryIndexes()),
+		},
+		{
+			Version:     4,
+			Name:        "contexts_text_index",
+			Description: "create the full-text search index on " + repo.ContextsCollection,
+			Up:          createIndexes(repo.ContextsCollection, []mongo.IndexModel{repo.SearchIndex()}),
+		},
+		{
+			Version: 5,
+			Name:    "backfill_modified_time",
+			Up:      backfillModifiedTime,
+			Plan:    planBackfillModifiedTime,
+		},
+		{
+			Version:     6,
+			Name:        "backfill_deleted_at",
+			Description: "move deactivated contexts to the trash",
+			Up:          backfillDeletedAt,
+			Plan:        planBackfillDeletedAt,
+		},
+		{
+			Version:     7,
+			Name:        "contexts_trash_index",
+			Description: "create the deletedAt index on " + repo.ContextsCollection,
+			Up:          createIndexes(repo.ContextsCollection, repo.TrashIndexes()),
+		},
+		{
+			Version:     8,
+			Name:        "context_histories_content_indexes",
+			Description: "create the content reference indexes on " + repo.ContextHistoriesCollection,
+			Up:          createIndexes(repo.ContextHistoriesCollection, repo.ContextHistoryContentIndexes()),
+		},
+		{
+			Version:     9,
+			Name:        "context_histories_content_blobs",
+			Description: "move the history content to " + repo.ContextHistoryBlobsCollection + " and deltas",
+			Up:          repo.MigrateHistoryContent,
+			Plan:        planHistoryContent,
+		},
+		{
+			Version:     10,
+			Name:        "content_file_indexes",
+			Description: "create the content file indexes on " + repo.ContextsCollection + " and " + repo.ContextHistoryBlobsCollection,
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				if err := createIndexes(repo.ContextsCollection, repo.ContentFileIndexes())(ctx, db); err != nil {
+					return err
+				}
+				return createIndexes(repo.ContextHistoryBlobsCollection, repo.ContextHistoryBlobFileIndexes())(ctx, db)
+			},
+		},
+		{
+			Version:     11,
+			Name:        "context_histories_content_file_indexes",
+			Description: "create the content file indexes on " + repo.ContextHistoriesCollection + ", whose encrypted entries store their own content",
+			Up:          createIndexes(repo.ContextHistoriesCollection, repo.ContentFileIndexes()),
+		},
+		{
+			Version:     12,
+			Name:        "contexts_fork_index",
+			Description: "create the forkedFrom index on " + repo.ContextsCollection,
+			Up:          createIndexes(repo.ContextsCollection, repo.ForkIndexes()),
+		},
+		{
+			Version:     13,
+			Name:        "context_histories_branch_index",
+			Description: "create the branch index on " + repo.ContextHistoriesCollection,
+			Up:          createIndexes(repo.ContextHistoriesCollection, repo.BranchHistoryIndexes()),
+		},
+		{
+			Version:     14,
+			Name:        "context_label_moves_indexes",
+			Description: "create the contextId indexes on " + repo.LabelMovesCollection,
+			Up:          createIndexes(repo.LabelMovesCollection, repo.LabelMoveIndexes()),
+		},
+		{
+			Version:     15,
+			Name:        "metadata_schemas_indexes",
+			Description: "create the kind and tag indexes on " + repo.SchemasCollection,
+			Up:          createIndexes(repo.SchemasCollection, repo.SchemaIndexes()),
+		},
+		{
+			Version:     16,
+			Name:        "context_token_counts_index",
+			Description: "create the contextId index on " + repo.TokenCountsCollection,
+			Up:          createIndexes(repo.TokenCountsCollection, repo.TokenCountIndexes()),
+		},
+		{
+			Version:     17,
+			Name:        "contexts_content_terms",
+			Description: "index the words of the compressed and offloaded content of " + repo.ContextsCollection,
+			Up:          contentTerms,
+			Plan:        planContentTerms,
+		},
+		{
+			Version:     18,
+			Name:        "context_history_blob_refs",
+			Description: "count the history entries referencing each blob of " + repo.ContextHistoryBlobsCollection + ", stop the service while it runs",
+			Offline:     true,
+			Up:          repo.CountBlobRefs,
+			Plan:        planBlobRefs,
+		},
+		{
+			Version:     19,
+			Name:        "context_history_variables",
+			Description: "record the variables of the contexts on their history entries",
+			Up:          repo.BackfillHistoryVariables,
+			Plan:        planHistoryVariables,
+		},
+		{
+			Version:     20,
+			Name:        "contexts_access_fields",
+			Description: "move the organizations, tenants and groups updates wrote under the wrong keys of " + repo.ContextsCollection,
+			Up:          repo.MigrateAccessFields,
+			Plan:        planAccessFields,
+		},
+	}
+}
+
+func createIndexes(collection string, models []mongo.IndexModel) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().CreateMany(ctx, models)
+		return err
+	}
+}
+
+// contexts written before modifiedTime was maintained cannot be paginated
+// by it, they get their creation time.
+var missingModifiedTime = bson.M{"modifiedTime": bson.M{"$exists": false}}
+
+func backfillModifiedTime(ctx context.Context, db *mongo.Database) error {
+	update := bson.A{bson.M{"$set": bson.M{"modifiedTime": "$createdTime"}}}
+	_, err := db.Collection(repo.ContextsCollection).UpdateMany(ctx, missingModifiedTime, update)
+	return err
+}
+
+func planBackfillModifiedTime(ctx context.Context, db *mongo.Database) (string, error) {
+	n, err := db.Collection(repo.ContextsCollection).CountDocuments(ctx, missingModifiedTime)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("set modifiedTime from createdTime on %d contexts", n), nil
+}
+
+// The HTTP server used to store the contexts in the context and
+// context_history collections, apart from the contexts and context_histories
+// of the Kafka consumer.
+const (
+	legacyContextsCollection  = "context"
+	legacyHistoriesCollection = "context_history"
+)
+
+// mergeLegacyCollections moves the documents of the legacy collections into
+// the current ones, then drops them. It must run before any other migration,
+// which only see the current collections. A context stored in both keeps its
+// latest version; a history entry stored in both keeps the current one.
+func mergeLegacyCollections(ctx context.Context, db *mongo.Database) error {
+	latest := bson.A{bson.M{"$replaceWith": bson.M{
+		"$cond": bson.A{bson.M{"$gt": bson.A{"$$new.version", "$version"}}, "$$new", "$$ROOT"},
+	}}}
+	for _, m := range []struct {
+		from, into  string
+		whenMatched interface{}
+	}{
+		{legacyContextsCollection, repo.ContextsCollection, latest},
+		{legacyHistoriesCollection, repo.ContextHistoriesCollection, "keepExisting"},
+	} {
+		merge := bson.M{"into": m.into, "on": "_id", "whenMatched": m.whenMatched, "whenNotMatched": "insert"}
+		cursor, err := db.Collection(m.from).Aggregate(ctx, mongo.Pipeline{{{Key: "$merge", Value: merge}}})
+		if err != nil {
+			return fmt.Errorf("merging %s into %s: %w", m.from, m.into, err)
+		}
+		cursor.Close(ctx)
+		if err := db.Collection(m.from).Drop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func planMergeLegacyCollections(ctx context.Context, db *mongo.Database) (string, error) {
+	counts := map[string]int64{}
+	for _, name := range []string{legacyContextsCollection, legacyHistoriesCollection} {
+		n, err := db.Collection(name).EstimatedDocumentCount(ctx)
+		if err != nil {
+			return "", err
+		}
+		counts[name] = n
+	}
+	return fmt.Sprintf("merge %d contexts of %s and %d history entries of %s", counts[legacyContextsCollection], legacyContextsCollection,
+		counts[legacyHistoriesCollection], legacyHistoriesCollection), nil
+}
+
+// contexts deleted before the trash existed were only deactivated, they move
+// to the trash as of the migration, so that they are kept for the whole
+// retention period rather than purged right away.
+var deactivatedContexts = bson.M{"isActive": bson.M{"$ne": true}, "deletedAt": bson.M{"$exists": false}}
+
+func backfillDeletedAt(ctx context.Context, db *mongo.Database) error {
+	update := bson.M{"$set": bson.M{"deletedAt": time.Now().UTC()}}
+	_, err := db.Collection(repo.ContextsCollection).UpdateMany(ctx, deactivatedContexts, update)
+	return err
+}
+
+func planBackfillDeletedAt(ctx context.Context, db *mongo.Database) (string, error) {
+	n, err := db.Collection(repo.ContextsCollection).CountDocuments(ctx, deactivatedContexts)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("move %d deactivated contexts to the trash", n), nil
+}
+
+func planHistoryContent(ctx context.Context, db *mongo.Database) (string, error) {
+	n, err := repo.CountInlineHistoryContent(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("move the inline content of %d history entries", n), nil
+}
+
+// the text index created by migration 4 before contentTerms existed does not
+// cover it, and a text index cannot be changed in place: it is dropped and
+// created again.
+func contentTerms(ctx context.Context, db *mongo.Database) error {
+	if err := repo.BackfillContentTerms(ctx, db); err != nil {
+		return err
+	}
+	indexes := db.Collection(repo.ContextsCollection).Indexes()
+	if _, err := indexes.DropOne(ctx, repo.SearchIndexName); err != nil {
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Name != "IndexNotFound" {
+			return err
+		}
+	}
+	_, err := indexes.CreateOne(ctx, repo.SearchIndex())
+	return err
+}
+
+func planContentTerms(ctx context.Context, db *mongo.Database) (string, error) {
+	n, err := repo.CountMissingContentTerms(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("set contentTerms on %d contexts and recreate the %s index", n, repo.SearchIndexName), nil
+}
+
+func planBlobRefs(ctx context.Context, db *mongo.Database) (string, error) {
+	n, err := repo.CountUncountedBlobs(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("count the references to %d blobs", n), nil
+}
+
+func planHistoryVariables(ctx context.Context, db *mongo.Database) (string, error) {
+	n, err := repo.CountDeclaringContexts(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("record the variables of %d contexts on their history entries", n), nil
+}
+
+func planAccessFields(ctx context.Context, db *mongo.Database) (string, error) {
+	n, err := repo.CountLegacyAccessFields(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("move the organizations, tenants and groups of %d contexts", n), nil
+}
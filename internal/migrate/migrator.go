@@ -0,0 +1,277 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrLockTimeout = errors.New("timed out waiting for the migration lock")
+	ErrLockLost    = errors.New("lost the migration lock")
+	ErrOffline     = errors.New("a pending migration must be applied with the service stopped")
+)
+
+const (
+	lockTTL          = 10 * time.Minute
+	lockPollInterval = 2 * time.Second
+	defaultLockWait  = 2 * time.Minute
+)
+
+// Migration is one versioned change to the database. Up must be safe to run
+// again after a partial failure, since a migration is only recorded once Up
+// returned without error. Plan, when set, describes what Up would change
+// without changing anything and is used for dry runs. An Offline migration
+// is not safe while the service writes and is never applied on startup.
+type Migration struct {
+	Version     int
+	Name        string
+	Description string
+	Offline     bool
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Plan        func(ctx context.Context, db *mongo.Database) (string, error)
+}
+
+type Record struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+	Duration  int64     `bson:"durationMs"`
+}
+
+// Store keeps track of the applied migrations and of the lock that keeps two
+// instances from migrating at the same time.
+type Store interface {
+	Applied(ctx context.Context) (map[int]Record, error)
+	Record(ctx context.Context, r Record) error
+	Lock(ctx context.Context, owner string, ttl time.Duration) (bool, error)
+	Unlock(ctx context.Context, owner string) error
+}
+
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	Offline   bool       `json:"offline,omitempty"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+	Plan      string     `json:"plan,omitempty"`
+}
+
+type Migrator struct {
+	log        *logger.Logger
+	store      Store
+	db         *mongo.Database
+	migrations []Migration
+	owner      string
+	lockWait   time.Duration
+	lockTTL    time.Duration
+}
+
+func NewMigrator(log *logger.Logger, store Store, db *mongo.Database, migrations []Migration) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	for i, m := range sorted {
+		if m.Version <= 0 || m.Up == nil || m.Name == "" {
+			return nil, fmt.Errorf("migration %d %q is incomplete", m.Version, m.Name)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+	}
+	host, _ := os.Hostname()
+	return &Migrator{
+		log:        log,
+		store:      store,
+		db:         db,
+		migrations: sorted,
+		owner:      host + "/" + uuid.NewString(),
+		lockWait:   defaultLockWait,
+		lockTTL:    lockTTL,
+	}, nil
+}
+
+// Up applies every pending migration in version order while holding the lock,
+// and returns the migrations it applied. It stops at the first failure. The
+// lock is renewed before each migration and on a heartbeat while one runs, so
+// a long migration keeps it; a migration whose lock is lost is cancelled.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.up(ctx, false)
+}
+
+// UpOnline is Up for a starting service: it stops before the first pending
+// offline migration and returns ErrOffline, leaving it and the migrations
+// after it to be applied with the service stopped.
+func (m *Migrator) UpOnline(ctx context.Context) ([]Migration, error) {
+	return m.up(ctx, true)
+}
+
+func (m *Migrator) up(ctx context.Context, online bool) ([]Migration, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := m.store.Unlock(context.Background(), m.owner); err != nil {
+			m.log.Errorf("Error releasing the migration lock: %v", err)
+		}
+	}()
+
+	pending, err := m.pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, mig := range pending {
+		if online && mig.Offline {
+			return applied, fmt.Errorf("%w: migration %d %s", ErrOffline, mig.Version, mig.Name)
+		}
+		if err := m.renew(ctx); err != nil {
+			return applied, err
+		}
+		m.log.Infof("Applying migration %d %s", mig.Version, mig.Name)
+		start := time.Now()
+		if err := m.run(ctx, mig); err != nil {
+			m.log.Errorf("Migration %d %s failed: %v", mig.Version, mig.Name, err)
+			return applied, fmt.Errorf("migration %d %s: %w", mig.Version, mig.Name, err)
+		}
+		r := Record{
+			Version:   mig.Version,
+			Name:      mig.Name,
+			AppliedAt: time.Now().UTC(),
+			Duration:  time.Since(start).Milliseconds(),
+		}
+		if err := m.store.Record(ctx, r); err != nil {
+			return applied, fmt.Errorf("recording migration %d: %w", mig.Version, err)
+		}
+		applied = append(applied, mig)
+	}
+	return applied, nil
+}
+
+// Status lists every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	done, err := m.store.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		s := Status{Version: mig.Version, Name: mig.Name, Offline: mig.Offline}
+		if r, ok := done[mig.Version]; ok {
+			s.Applied = true
+			at := r.AppliedAt
+			s.AppliedAt = &at
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// DryRun lists the pending migrations together with their plans, without
+// taking the lock or changing anything.
+func (m *Migrator) DryRun(ctx context.Context) ([]Status, error) {
+	pending, err := m.pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Status, 0, len(pending))
+	for _, mig := range pending {
+		s := Status{Version: mig.Version, Name: mig.Name, Offline: mig.Offline, Plan: mig.Description}
+		if mig.Plan != nil {
+			plan, err := mig.Plan(ctx, m.db)
+			if err != nil {
+				return nil, fmt.Errorf("planning migration %d: %w", mig.Version, err)
+			}
+			s.Plan = plan
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (m *Migrator) pending(ctx context.Context) ([]Migration, error) {
+	done, err := m.store.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range m.migrations {
+		if _, ok := done[mig.Version]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+func (m *Migrator) lock(ctx context.Context) error {
+	deadline := time.Now().Add(m.lockWait)
+	for {
+		ok, err := m.store.Lock(ctx, m.owner, lockTTL)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		m.log.Infof("Waiting for the migration lock")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// renew extends the lock held by this migrator.
+func (m *Migrator) renew(ctx context.Context) error {
+	ok, err := m.store.Lock(ctx, m.owner, m.lockTTL)
+	if err != nil {
+		return fmt.Errorf("renewing the migration lock: %w", err)
+	}
+	if !ok {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// run applies one migration while renewing the lock every third of its TTL.
+// The migration is cancelled as soon as a renewal fails.
+func (m *Migrator) run(ctx context.Context, mig Migration) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lost := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(m.lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := m.renew(runCtx); err != nil {
+					lost <- err
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	err := mig.Up(runCtx, m.db)
+	close(done)
+	select {
+	case lerr := <-lost:
+		return lerr
+	default:
+		return err
+	}
+}
@@ -0,0 +1,207 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type memStore struct {
+	mu      sync.Mutex
+	applied map[int]Record
+	owner   string
+	locks   int
+}
+
+func newMemStore() *memStore {
+	return &memStore{applied: map[int]Record{}}
+}
+
+func (s *memStore) Applied(ctx context.Context) (map[int]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[int]Record, len(s.applied))
+	for k, v := range s.applied {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *memStore) Record(ctx context.Context, r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied[r.Version] = r
+	return nil
+}
+
+func (s *memStore) Lock(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner != "" && s.owner != owner {
+		return false, nil
+	}
+	s.owner = owner
+	s.locks++
+	return true, nil
+}
+
+func (s *memStore) Unlock(ctx context.Context, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == owner {
+		s.owner = ""
+	}
+	return nil
+}
+
+func newTestMigrator(t *testing.T, store Store, migrations []Migration) *Migrator {
+	t.Helper()
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatalf("creating logger: %v", err)
+	}
+	m, err := NewMigrator(log, store, nil, migrations)
+	if err != nil {
+		t.Fatalf("creating migrator: %v", err)
+	}
+	return m
+}
+
+func TestMigratorUp(t *testing.T) {
+	ctx := context.Background()
+	var ran []int
+	step := func(v int, fail bool) Migration {
+		return Migration{Version: v, Name: "step", Up: func(ctx context.Context, db *mongo.Database) error {
+			if fail {
+				return errors.New("boom")
+			}
+			ran = append(ran, v)
+			return nil
+		}}
+	}
+	store := newMemStore()
+
+	m := newTestMigrator(t, store, []Migration{step(2, false), step(1, false), step(3, true)})
+	applied, err := m.Up(ctx)
+	if err == nil || len(applied) != 2 {
+		t.Fatalf("expected migration 3 to fail after applying 2, got %d applied and %v", len(applied), err)
+	}
+	if len(ran) != 2 || ran[0] != 1 || ran[1] != 2 {
+		t.Fatalf("migrations ran out of order: %v", ran)
+	}
+	if store.owner != "" {
+		t.Fatalf("lock was not released")
+	}
+
+	plans, err := m.DryRun(ctx)
+	if err != nil || len(plans) != 1 || plans[0].Version != 3 {
+		t.Fatalf("expected only migration 3 pending, got %+v, %v", plans, err)
+	}
+
+	m = newTestMigrator(t, store, []Migration{step(1, false), step(2, false), step(3, false)})
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 1 || applied[0].Version != 3 {
+		t.Fatalf("expected only migration 3 to run, got %+v, %v", applied, err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	for _, s := range statuses {
+		if !s.Applied {
+			t.Fatalf("migration %d not recorded", s.Version)
+		}
+	}
+}
+
+func TestMigratorWaitsForLock(t *testing.T) {
+	store := newMemStore()
+	store.owner = "someone-else"
+	m := newTestMigrator(t, store, []Migration{{Version: 1, Name: "x", Up: func(context.Context, *mongo.Database) error { return nil }}})
+	m.lockWait = 0
+	if _, err := m.Up(context.Background()); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("expected a lock timeout, got %v", err)
+	}
+}
+
+func TestMigratorUpOnlineStopsAtOfflineMigration(t *testing.T) {
+	ctx := context.Background()
+	var ran []int
+	step := func(v int, offline bool) Migration {
+		return Migration{Version: v, Name: "step", Offline: offline, Up: func(ctx context.Context, db *mongo.Database) error {
+			ran = append(ran, v)
+			return nil
+		}}
+	}
+	store := newMemStore()
+	m := newTestMigrator(t, store, []Migration{step(1, false), step(2, true), step(3, false)})
+	applied, err := m.UpOnline(ctx)
+	if !errors.Is(err, ErrOffline) || len(applied) != 1 || applied[0].Version != 1 {
+		t.Fatalf("expected to stop before the offline migration, got %+v, %v", applied, err)
+	}
+	if store.owner != "" {
+		t.Fatalf("lock was not released")
+	}
+
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 2 {
+		t.Fatalf("expected up to apply the offline migration and the next, got %+v, %v", applied, err)
+	}
+	if len(ran) != 3 || ran[1] != 2 || ran[2] != 3 {
+		t.Fatalf("migrations ran out of order: %v", ran)
+	}
+	if applied, err = m.UpOnline(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("expected nothing left to apply, got %+v, %v", applied, err)
+	}
+}
+
+func TestMigratorRenewsLock(t *testing.T) {
+	store := newMemStore()
+	slow := func(ctx context.Context, db *mongo.Database) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	m := newTestMigrator(t, store, []Migration{{Version: 1, Name: "a", Up: slow}, {Version: 2, Name: "b", Up: slow}})
+	m.lockTTL = 30 * time.Millisecond
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	// one lock, one renewal before each migration, and heartbeats while they run
+	if store.locks < 5 {
+		t.Fatalf("expected the lock to be renewed while migrating, got %d locks", store.locks)
+	}
+
+	store = newMemStore()
+	steal := func(ctx context.Context, db *mongo.Database) error {
+		store.mu.Lock()
+		store.owner = "someone-else"
+		store.mu.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	m = newTestMigrator(t, store, []Migration{{Version: 1, Name: "a", Up: steal}})
+	m.lockTTL = 30 * time.Millisecond
+	if _, err := m.Up(context.Background()); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected the migration to stop once the lock is lost, got %v", err)
+	}
+	if applied, _ := store.Applied(context.Background()); len(applied) != 0 {
+		t.Fatalf("a migration that lost the lock was recorded: %+v", applied)
+	}
+}
+
+func TestNewMigratorRejectsDuplicates(t *testing.T) {
+	log, _ := logger.NewLogger(&config.Config{})
+	up := func(context.Context, *mongo.Database) error { return nil }
+	if _, err := NewMigrator(log, newMemStore(), nil, []Migration{{Version: 1, Name: "a", Up: up}, {Version: 1, Name: "b", Up: up}}); err == nil {
+		t.Fatalf("expected duplicate versions to be rejected")
+	}
+	if _, err := NewMigrator(log, newMemStore(), nil, All()); err != nil {
+		t.Fatalf("the registered migrations are invalid: %v", err)
+	}
+}
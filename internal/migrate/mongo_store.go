@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	MigrationsCollection = "schema_migrations"
+	LockCollection       = "schema_migrations_lock"
+	lockID               = "migrations"
+)
+
+type MongoStore struct {
+	migrations *mongo.Collection
+	locks      repo.LeaseRepository
+}
+
+func NewMongoStore(log *logger.Logger, db *mongo.Database) Store {
+	return &MongoStore{
+		migrations: db.Collection(MigrationsCollection),
+		locks:      repo.NewCollectionLeaseRepository(log, db.Collection(LockCollection)),
+	}
+}
+
+func (ms *MongoStore) Applied(ctx context.Context) (map[int]Record, error) {
+	cursor, err := ms.migrations.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	out := make(map[int]Record, len(records))
+	for _, r := range records {
+		out[r.Version] = r
+	}
+	return out, nil
+}
+
+func (ms *MongoStore) Record(ctx context.Context, r Record) error {
+	_, err := ms.migrations.InsertOne(ctx, r)
+	return err
+}
+
+// Lock takes the lock when it is free, its previous owner let it expire or
+// owner holds it already, in which case it is renewed.
+func (ms *MongoStore) Lock(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	return ms.locks.Acquire(ctx, lockID, owner, ttl)
+}
+
+func (ms *MongoStore) Unlock(ctx context.Context, owner string) error {
+	return ms.locks.Release(ctx, lockID, owner)
+}
@@ -0,0 +1,310 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Operation is one operation of a JSON Patch.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+
+	value interface{}
+}
+
+// JSONPatch is an RFC 6902 JSON Patch. It applies atomically: either every
+// operation succeeds or the document is left as it was.
+type JSONPatch []Operation
+
+func ParseJSONPatch(body []byte) (JSONPatch, error) {
+	var ops JSONPatch
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	for i := range ops {
+		op := &ops[i]
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%w: operation %d: %s needs a value", ErrInvalidPatch, i, op.Op)
+			}
+			v, err := decode(op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+			}
+			op.value = v
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("%w: operation %d: unknown op %q", ErrInvalidPatch, i, op.Op)
+		}
+	}
+	return ops, nil
+}
+
+func (p JSONPatch) Apply(doc []byte) ([]byte, error) {
+	v, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range p {
+		if v, err = op.apply(v); err != nil {
+			return nil, fmt.Errorf("%w: operation %d (%s %s): %v", ErrCannotApply, i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(v)
+}
+
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	switch op.Op {
+	case "add":
+		return add(doc, path, copyValue(op.value))
+	case "remove":
+		return remove(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return copyValue(op.value), nil
+		}
+		doc, err := remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, copyValue(op.value))
+	case "test":
+		v, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(v, op.value) {
+			return nil, fmt.Errorf("value differs")
+		}
+		return doc, nil
+	}
+
+	from, _ := parsePointer(op.From)
+	v, err := get(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	if op.Op == "copy" {
+		return add(doc, path, copyValue(v))
+	}
+	if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+		return nil, fmt.Errorf("cannot move a value into itself")
+	}
+	if doc, err = remove(doc, from); err != nil {
+		return nil, err
+	}
+	return add(doc, path, v)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("path %q must start with /", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func index(token string, n int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || strconv.Itoa(i) != token {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	max := n - 1
+	if appending {
+		max = n
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[t]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := index(t, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot descend into a scalar at %q", t)
+		}
+	}
+	return doc, nil
+}
+
+// add returns doc with v added at path. Containers are changed in place, the
+// result differs from doc only when path is the root or an array grows.
+func add(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	t, rest := path[0], path[1:]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			node[t] = v
+			return node, nil
+		}
+		child, ok := node[t]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", t)
+		}
+		nc, err := add(child, rest, v)
+		if err != nil {
+			return nil, err
+		}
+		node[t] = nc
+		return node, nil
+	case []interface{}:
+		i, err := index(t, len(node), len(rest) == 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = v
+			return node, nil
+		}
+		nc, err := add(node[i], rest, v)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = nc
+		return node, nil
+	default:
+		return nil, fmt.Errorf("cannot descend into a scalar at %q", t)
+	}
+}
+
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	t, rest := path[0], path[1:]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[t]
+		if !ok {
+			return nil, fmt.Errorf("no member %q", t)
+		}
+		if len(rest) == 0 {
+			delete(node, t)
+			return node, nil
+		}
+		nc, err := remove(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		node[t] = nc
+		return node, nil
+	case []interface{}:
+		i, err := index(t, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return append(node[:i], node[i+1:]...), nil
+		}
+		nc, err := remove(node[i], rest)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = nc
+		return node, nil
+	default:
+		return nil, fmt.Errorf("cannot descend into a scalar at %q", t)
+	}
+}
+
+// equal compares JSON values, numbers by their value.
+func equal(a, b interface{}) bool {
+	switch av := a.(type) {
+	case json.Number:
+		bv, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		af, aerr := av.Float64()
+		bf, berr := bv.Float64()
+		return aerr == nil && berr == nil && af == bf
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			w, ok := bv[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = copyValue(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
@@ -0,0 +1,107 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to JSON documents.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported patch media type")
+	// ErrInvalidPatch is returned for a patch that is not well formed.
+	ErrInvalidPatch = errors.New("invalid patch")
+	// ErrCannotApply is returned for a well formed patch that does not apply
+	// to the document: a missing path, a failed test operation.
+	ErrCannotApply = errors.New("patch cannot be applied")
+)
+
+// Patch changes a JSON document.
+type Patch interface {
+	Apply(doc []byte) ([]byte, error)
+}
+
+// IsPatchType tells whether the Content-Type names a patch format.
+func IsPatchType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == MergePatchType || mediaType == JSONPatchType)
+}
+
+// Parse reads a patch of the media type given by contentType.
+func Parse(contentType string, body []byte) (Patch, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+	}
+	switch mediaType {
+	case MergePatchType:
+		return ParseMergePatch(body)
+	case JSONPatchType:
+		return ParseJSONPatch(body)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, mediaType)
+	}
+}
+
+// MergePatch is an RFC 7396 merge patch.
+type MergePatch struct {
+	value interface{}
+}
+
+func ParseMergePatch(body []byte) (*MergePatch, error) {
+	v, err := decode(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	return &MergePatch{value: v}, nil
+}
+
+func (p *MergePatch) Apply(doc []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(merge(target, p.value))
+}
+
+// merge is the MergePatch algorithm of RFC 7396.
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = merge(t[k], v)
+	}
+	return t
+}
+
+// decode reads a JSON value keeping its numbers as written.
+func decode(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after the JSON value")
+	}
+	return v, nil
+}
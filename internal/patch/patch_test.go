@@ -0,0 +1,111 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func assertJSON(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("%s: bad expectation: %v", name, err)
+	}
+	gb, _ := json.Marshal(g)
+	wb, _ := json.Marshal(w)
+	if string(gb) != string(wb) {
+		t.Fatalf("%s: got %s, want %s", name, gb, wb)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// Examples from appendix A of RFC 7396.
+	tests := []struct{ doc, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tc := range tests {
+		p, err := Parse(MergePatchType, []byte(tc.patch))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.patch, err)
+		}
+		got, err := p.Apply([]byte(tc.doc))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.patch, err)
+		}
+		assertJSON(t, tc.patch, got, tc.want)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	doc := `{"name":"n","tags":["a","b"],"metadata":{"owner":"x","n":1}}`
+	tests := map[string]struct{ patch, want string }{
+		"add member":    {`[{"op":"add","path":"/description","value":"d"}]`, `{"name":"n","description":"d","tags":["a","b"],"metadata":{"owner":"x","n":1}}`},
+		"insert":        {`[{"op":"add","path":"/tags/1","value":"z"}]`, `{"name":"n","tags":["a","z","b"],"metadata":{"owner":"x","n":1}}`},
+		"append":        {`[{"op":"add","path":"/tags/-","value":"z"}]`, `{"name":"n","tags":["a","b","z"],"metadata":{"owner":"x","n":1}}`},
+		"remove":        {`[{"op":"remove","path":"/tags/0"}]`, `{"name":"n","tags":["b"],"metadata":{"owner":"x","n":1}}`},
+		"replace":       {`[{"op":"replace","path":"/metadata/owner","value":"y"}]`, `{"name":"n","tags":["a","b"],"metadata":{"owner":"y","n":1}}`},
+		"move":          {`[{"op":"move","from":"/metadata/owner","path":"/owner"}]`, `{"name":"n","owner":"x","tags":["a","b"],"metadata":{"n":1}}`},
+		"copy":          {`[{"op":"copy","from":"/tags","path":"/labels"}]`, `{"name":"n","tags":["a","b"],"labels":["a","b"],"metadata":{"owner":"x","n":1}}`},
+		"test and set":  {`[{"op":"test","path":"/metadata/n","value":1.0},{"op":"replace","path":"/name","value":"m"}]`, `{"name":"m","tags":["a","b"],"metadata":{"owner":"x","n":1}}`},
+		"escaped":       {`[{"op":"add","path":"/metadata/a~1b~0c","value":null}]`, `{"name":"n","tags":["a","b"],"metadata":{"owner":"x","n":1,"a/b~c":null}}`},
+		"replace whole": {`[{"op":"replace","path":"","value":{"name":"x"}}]`, `{"name":"x"}`},
+	}
+	for name, tc := range tests {
+		p, err := Parse(JSONPatchType+"; charset=utf-8", []byte(tc.patch))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := p.Apply([]byte(doc))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		assertJSON(t, name, got, tc.want)
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	doc := []byte(`{"name":"n","tags":["a"]}`)
+	invalid := map[string]string{
+		"not a list":    `{"op":"add"}`,
+		"unknown op":    `[{"op":"merge","path":"/a"}]`,
+		"no value":      `[{"op":"add","path":"/a"}]`,
+		"relative path": `[{"op":"remove","path":"a"}]`,
+	}
+	for name, body := range invalid {
+		if _, err := ParseJSONPatch([]byte(body)); !errors.Is(err, ErrInvalidPatch) {
+			t.Fatalf("%s: expected ErrInvalidPatch, got %v", name, err)
+		}
+	}
+	cannot := map[string]string{
+		"missing member": `[{"op":"remove","path":"/description"}]`,
+		"missing parent": `[{"op":"add","path":"/metadata/owner","value":"x"}]`,
+		"out of range":   `[{"op":"add","path":"/tags/5","value":"x"}]`,
+		"failed test":    `[{"op":"replace","path":"/name","value":"m"},{"op":"test","path":"/name","value":"n"}]`,
+		"move into self": `[{"op":"move","from":"/tags","path":"/tags/0"}]`,
+	}
+	for name, body := range cannot {
+		p, err := ParseJSONPatch([]byte(body))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := p.Apply(doc); !errors.Is(err, ErrCannotApply) {
+			t.Fatalf("%s: expected ErrCannotApply, got %v", name, err)
+		}
+	}
+	if _, err := Parse("application/json", []byte(`{}`)); !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expected ErrUnsupportedType, got %v", err)
+	}
+}
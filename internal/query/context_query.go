@@ -0,0 +1,366 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+const (
+	maxListValues    = 50
+	maxMetadataTerms = 20
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_\-]+(\.[A-Za-z0-9_\-]+)*$`)
+
+type StringMatch string
+
+const (
+	MatchEq       StringMatch = "eq"
+	MatchPrefix   StringMatch = "prefix"
+	MatchContains StringMatch = "contains"
+)
+
+type MetadataOp string
+
+const (
+	MetadataEq     MetadataOp = "eq"
+	MetadataNe     MetadataOp = "ne"
+	MetadataIn     MetadataOp = "in"
+	MetadataExists MetadataOp = "exists"
+	MetadataGt     MetadataOp = "gt"
+	MetadataGte    MetadataOp = "gte"
+	MetadataLt     MetadataOp = "lt"
+	MetadataLte    MetadataOp = "lte"
+)
+
+type NamePredicate struct {
+	Match StringMatch `json:"match"`
+	Value string      `json:"value"`
+}
+
+type TimeRange struct {
+	Gt  *time.Time `json:"gt,omitempty"`
+	Gte *time.Time `json:"gte,omitempty"`
+	Lt  *time.Time `json:"lt,omitempty"`
+	Lte *time.Time `json:"lte,omitempty"`
+}
+
+func (tr TimeRange) IsZero() bool {
+	return tr.Gt == nil && tr.Gte == nil && tr.Lt == nil && tr.Lte == nil
+}
+
+// MetadataPredicate compares the metadata entry at Key, which may be a dotted
+// path into nested metadata. Values holds a single value for every operator
+// except in, and is empty for exists when the key must be present.
+type MetadataPredicate struct {
+	Key    string     `json:"key"`
+	Op     MetadataOp `json:"op"`
+	Values []string   `json:"values,omitempty"`
+}
+
+// ContextQuery is the typed filter for listing contexts. All the predicates
+// that are set must hold for a context to match.
+type ContextQuery struct {
+	Name            *NamePredicate      `json:"name,omitempty"`
+	TagsAny         []string            `json:"tagsAny,omitempty"`
+	TagsAll         []string            `json:"tagsAll,omitempty"`
+	TenantIDs       []string            `json:"tenantIds,omitempty"`
+	OrganizationIDs []string            `json:"organizationIds,omitempty"`
+	GroupIDs        []string            `json:"groupIds,omitempty"`
+	IsActive        *bool               `json:"isActive,omitempty"`
+	CreatedTime     TimeRange           `json:"createdTime,omitempty"`
+	ModifiedTime    TimeRange           `json:"modifiedTime,omitempty"`
+	Metadata        []MetadataPredicate `json:"metadata,omitempty"`
+}
+
+// ParseContextQuery reads a ContextQuery from url query parameters. Every
+// predicate is a clause field[op]=value, for example name[prefix]=sys,
+// tags[all]=a,b or metadata.kind[eq]=persona; the op defaults to eq. The same
+// clauses can be given in a compact form in the q parameter as
+// space-separated field:op:value terms, e.g. q=name:prefix:sys tags:all:a,b.
+// Parameters listed in skip are ignored.
+func ParseContextQuery(values url.Values, skip ...string) (*ContextQuery, error) {
+	q := &ContextQuery{}
+	for key, vals := range values {
+		if contains(skip, key) {
+			continue
+		}
+		for _, val := range vals {
+			if key == "q" {
+				clauses, err := splitCompact(val)
+				if err != nil {
+					return nil, err
+				}
+				for _, c := range clauses {
+					if err := q.apply(c); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			field, op, err := splitKey(key)
+			if err != nil {
+				return nil, err
+			}
+			if err := q.apply(clause{field: field, op: op, value: val}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+type clause struct {
+	field string
+	op    string
+	value string
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidQuery, fmt.Sprintf(format, args...))
+}
+
+func splitKey(key string) (string, string, error) {
+	open := strings.IndexByte(key, '[')
+	if open < 0 {
+		return key, "", nil
+	}
+	if !strings.HasSuffix(key, "]") || open == 0 {
+		return "", "", invalid("malformed parameter %q", key)
+	}
+	return key[:open], key[open+1 : len(key)-1], nil
+}
+
+// splitCompact splits the compact form into clauses. Values containing spaces
+// may be double-quoted, as in name:contains:"system prompt".
+func splitCompact(s string) ([]clause, error) {
+	var terms []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if cur.Len() > 0 {
+				terms = append(terms, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, invalid("unterminated quote in %q", s)
+	}
+	if cur.Len() > 0 {
+		terms = append(terms, cur.String())
+	}
+
+	clauses := make([]clause, 0, len(terms))
+	for _, term := range terms {
+		parts := strings.SplitN(term, ":", 3)
+		switch len(parts) {
+		case 2:
+			clauses = append(clauses, clause{field: parts[0], value: parts[1]})
+		case 3:
+			clauses = append(clauses, clause{field: parts[0], op: parts[1], value: parts[2]})
+		default:
+			return nil, invalid("malformed term %q, expected field:op:value", term)
+		}
+	}
+	return clauses, nil
+}
+
+func (q *ContextQuery) apply(c clause) error {
+	op := c.op
+	if op == "" {
+		op = "eq"
+	}
+	switch {
+	case c.field == "name":
+		switch StringMatch(op) {
+		case MatchEq, MatchPrefix, MatchContains:
+			q.Name = &NamePredicate{Match: StringMatch(op), Value: c.value}
+		default:
+			return invalid("unsupported operator %q for name", op)
+		}
+	case c.field == "tags":
+		switch op {
+		case "eq", "any":
+			q.TagsAny = append(q.TagsAny, splitList(c.value)...)
+		case "all":
+			q.TagsAll = append(q.TagsAll, splitList(c.value)...)
+		default:
+			return invalid("unsupported operator %q for tags", op)
+		}
+	case c.field == "tenantId" || c.field == "organizationId" || c.field == "groupId":
+		if op != "eq" && op != "in" {
+			return invalid("unsupported operator %q for %s", op, c.field)
+		}
+		ids := splitList(c.value)
+		switch c.field {
+		case "tenantId":
+			q.TenantIDs = append(q.TenantIDs, ids...)
+		case "organizationId":
+			q.OrganizationIDs = append(q.OrganizationIDs, ids...)
+		default:
+			q.GroupIDs = append(q.GroupIDs, ids...)
+		}
+	case c.field == "isActive":
+		if op != "eq" {
+			return invalid("unsupported operator %q for isActive", op)
+		}
+		b, err := strconv.ParseBool(c.value)
+		if err != nil {
+			return invalid("isActive must be true or false, got %q", c.value)
+		}
+		q.IsActive = &b
+	case c.field == "createdTime" || c.field == "modifiedTime":
+		t, err := time.Parse(time.RFC3339, c.value)
+		if err != nil {
+			return invalid("%s must be an RFC 3339 timestamp, got %q", c.field, c.value)
+		}
+		tr := &q.CreatedTime
+		if c.field == "modifiedTime" {
+			tr = &q.ModifiedTime
+		}
+		switch op {
+		case "gt":
+			tr.Gt = &t
+		case "gte":
+			tr.Gte = &t
+		case "lt":
+			tr.Lt = &t
+		case "lte":
+			tr.Lte = &t
+		default:
+			return invalid("unsupported operator %q for %s", op, c.field)
+		}
+	case strings.HasPrefix(c.field, "metadata."):
+		mp := MetadataPredicate{Key: strings.TrimPrefix(c.field, "metadata."), Op: MetadataOp(op)}
+		switch mp.Op {
+		case MetadataIn:
+			mp.Values = splitList(c.value)
+		case MetadataExists:
+			b, err := strconv.ParseBool(c.value)
+			if err != nil {
+				return invalid("exists on %s must be true or false, got %q", c.field, c.value)
+			}
+			if !b {
+				mp.Values = []string{"false"}
+			}
+		default:
+			mp.Values = []string{c.value}
+		}
+		q.Metadata = append(q.Metadata, mp)
+	default:
+		return invalid("unknown field %q", c.field)
+	}
+	return nil
+}
+
+// Validate checks a query built by hand or decoded from JSON. ParseContextQuery
+// already validates the queries it returns.
+func (q *ContextQuery) Validate() error {
+	if q.Name != nil {
+		switch q.Name.Match {
+		case MatchEq, MatchPrefix, MatchContains:
+		default:
+			return invalid("unsupported name match %q", q.Name.Match)
+		}
+		if q.Name.Value == "" {
+			return invalid("name must not be empty")
+		}
+	}
+	for field, list := range map[string][]string{
+		"tags":           append(append([]string{}, q.TagsAny...), q.TagsAll...),
+		"tenantId":       q.TenantIDs,
+		"organizationId": q.OrganizationIDs,
+		"groupId":        q.GroupIDs,
+	} {
+		if len(list) > maxListValues {
+			return invalid("too many values for %s, at most %d are allowed", field, maxListValues)
+		}
+		for _, v := range list {
+			if v == "" {
+				return invalid("empty value in %s", field)
+			}
+		}
+	}
+	if err := q.CreatedTime.validate("createdTime"); err != nil {
+		return err
+	}
+	if err := q.ModifiedTime.validate("modifiedTime"); err != nil {
+		return err
+	}
+	if len(q.Metadata) > maxMetadataTerms {
+		return invalid("too many metadata predicates, at most %d are allowed", maxMetadataTerms)
+	}
+	for _, mp := range q.Metadata {
+		if !metadataKeyPattern.MatchString(mp.Key) {
+			return invalid("invalid metadata key %q", mp.Key)
+		}
+		switch mp.Op {
+		case MetadataEq, MetadataNe, MetadataGt, MetadataGte, MetadataLt, MetadataLte:
+			if len(mp.Values) != 1 {
+				return invalid("%s on metadata.%s takes exactly one value", mp.Op, mp.Key)
+			}
+		case MetadataIn:
+			if len(mp.Values) == 0 || len(mp.Values) > maxListValues {
+				return invalid("in on metadata.%s takes between 1 and %d values", mp.Key, maxListValues)
+			}
+		case MetadataExists:
+			if len(mp.Values) > 1 {
+				return invalid("exists on metadata.%s takes at most one value", mp.Key)
+			}
+		default:
+			return invalid("unsupported operator %q for metadata.%s", mp.Op, mp.Key)
+		}
+	}
+	return nil
+}
+
+func (tr TimeRange) validate(field string) error {
+	lower, upper := tr.Gte, tr.Lte
+	if tr.Gt != nil {
+		lower = tr.Gt
+	}
+	if tr.Lt != nil {
+		upper = tr.Lt
+	}
+	if lower != nil && upper != nil && lower.After(*upper) {
+		return invalid("empty %s range", field)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		out = append(out, strings.TrimSpace(p))
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package query
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseContextQuery(t *testing.T) {
+	values := url.Values{
+		"name[prefix]":           {"sys"},
+		"tags[all]":              {"a,b"},
+		"tenantId":               {"t1"},
+		"isActive":               {"false"},
+		"createdTime[gte]":       {"2024-01-01T00:00:00Z"},
+		"metadata.kind[eq]":      {"persona"},
+		"metadata.owner[exists]": {"true"},
+		"limit":                  {"10"},
+	}
+	q, err := ParseContextQuery(values, "limit")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if q.Name == nil || q.Name.Match != MatchPrefix || q.Name.Value != "sys" {
+		t.Fatalf("unexpected name predicate: %+v", q.Name)
+	}
+	if len(q.TagsAll) != 2 || len(q.TenantIDs) != 1 || q.IsActive == nil || *q.IsActive {
+		t.Fatalf("unexpected query: %+v", q)
+	}
+	if q.CreatedTime.Gte == nil || q.CreatedTime.Gte.Year() != 2024 {
+		t.Fatalf("unexpected created range: %+v", q.CreatedTime)
+	}
+	if len(q.Metadata) != 2 {
+		t.Fatalf("expected 2 metadata predicates, got %+v", q.Metadata)
+	}
+}
+
+func TestParseCompactContextQuery(t *testing.T) {
+	q, err := ParseContextQuery(url.Values{"q": {`name:contains:"system prompt" tags:any:x,y metadata.priority:gt:3`}})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if q.Name == nil || q.Name.Value != "system prompt" || q.Name.Match != MatchContains {
+		t.Fatalf("unexpected name predicate: %+v", q.Name)
+	}
+	if len(q.TagsAny) != 2 {
+		t.Fatalf("unexpected tags: %v", q.TagsAny)
+	}
+	if len(q.Metadata) != 1 || q.Metadata[0].Op != MetadataGt || q.Metadata[0].Values[0] != "3" {
+		t.Fatalf("unexpected metadata predicate: %+v", q.Metadata)
+	}
+}
+
+func TestParseContextQueryErrors(t *testing.T) {
+	tests := map[string]url.Values{
+		"unknown field":       {"colour": {"red"}},
+		"bad operator":        {"name[gt]": {"x"}},
+		"bad bool":            {"isActive": {"maybe"}},
+		"bad time":            {"modifiedTime[lt]": {"yesterday"}},
+		"empty range":         {"createdTime[gt]": {"2024-02-01T00:00:00Z"}, "createdTime[lt]": {"2024-01-01T00:00:00Z"}},
+		"injected key":        {"metadata.$where[eq]": {"1"}},
+		"unterminated quote":  {"q": {`name:"x`}},
+		"malformed compact":   {"q": {"name"}},
+		"empty tag":           {"tags": {"a,,b"}},
+		"malformed parameter": {"name[prefix": {"x"}},
+	}
+	for name, values := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseContextQuery(values); !errors.Is(err, ErrInvalidQuery) {
+				t.Fatalf("expected ErrInvalidQuery, got %v", err)
+			}
+		})
+	}
+}
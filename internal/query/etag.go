@@ -0,0 +1,76 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ETag is the entity tag of a context at a version. Every write bumps the
+// version, so it identifies the representation on its own.
+func ETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ETagList is the value of an If-Match or If-None-Match header.
+type ETagList struct {
+	Any  bool
+	tags []etag
+}
+
+type etag struct {
+	version int
+	weak    bool
+}
+
+// ParseETagList reads "*" or a comma separated list of entity tags. Tags this
+// service did not issue are kept out of the list, they never match.
+func ParseETagList(header string) (ETagList, error) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return ETagList{Any: true}, nil
+	}
+	var l ETagList
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		weak := strings.HasPrefix(t, "W/")
+		t = strings.TrimPrefix(t, "W/")
+		if len(t) < 2 || t[0] != '"' || t[len(t)-1] != '"' {
+			return ETagList{}, invalid("malformed entity tag %q", t)
+		}
+		if v, err := strconv.Atoi(t[1 : len(t)-1]); err == nil {
+			l.tags = append(l.tags, etag{version: v, weak: weak})
+		}
+	}
+	return l, nil
+}
+
+// MatchStrong tells whether the list matches the version the way If-Match
+// compares tags: weak tags never match.
+func (l ETagList) MatchStrong(version int) bool {
+	if l.Any {
+		return true
+	}
+	for _, t := range l.tags {
+		if !t.weak && t.version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchWeak tells whether the list matches the version the way If-None-Match
+// compares tags.
+func (l ETagList) MatchWeak(version int) bool {
+	if l.Any {
+		return true
+	}
+	for _, t := range l.tags {
+		if t.version == version {
+			return true
+		}
+	}
+	return false
+}
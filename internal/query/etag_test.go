@@ -0,0 +1,39 @@
+package query
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestETagListMatch(t *testing.T) {
+	tests := map[string]struct {
+		header       string
+		version      int
+		strong, weak bool
+	}{
+		"same":         {ETag(3), 3, true, true},
+		"other":        {ETag(3), 4, false, false},
+		"weak":         {`W/"3"`, 3, false, true},
+		"any":          {"*", 9, true, true},
+		"list":         {`"1", W/"2", "4"`, 4, true, true},
+		"foreign tag":  {`"abc", "5"`, 5, true, true},
+		"foreign only": {`"abc"`, 5, false, false},
+	}
+	for name, tc := range tests {
+		l, err := ParseETagList(tc.header)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if l.MatchStrong(tc.version) != tc.strong || l.MatchWeak(tc.version) != tc.weak {
+			t.Fatalf("%s: strong %v, weak %v", name, l.MatchStrong(tc.version), l.MatchWeak(tc.version))
+		}
+	}
+}
+
+func TestParseETagListErrors(t *testing.T) {
+	for _, h := range []string{`3`, `"3`, `W/3`} {
+		if _, err := ParseETagList(h); !errors.Is(err, ErrInvalidQuery) {
+			t.Fatalf("%s: expected ErrInvalidQuery, got %v", h, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// PageParams are the query parameters consumed by ParsePage. They must be
+// skipped when the same parameters are parsed as a filter.
+var PageParams = []string{"sort", "limit", "cursor", "content"}
+
+type SortKey string
+
+const (
+	SortModifiedTime SortKey = "modifiedTime"
+	SortCreatedTime  SortKey = "createdTime"
+	SortName         SortKey = "name"
+	SortVersion      SortKey = "version"
+	SortDeletedAt    SortKey = "deletedAt"
+)
+
+var (
+	ContextSortKeys = []SortKey{SortModifiedTime, SortCreatedTime, SortName, SortVersion}
+	HistorySortKeys = []SortKey{SortVersion, SortCreatedTime}
+	TrashSortKeys   = []SortKey{SortDeletedAt, SortName}
+)
+
+// Page selects one page of a listing. Results are ordered by Sort and then by
+// id, so that the order is stable when sort values repeat. After, when set,
+// is the position of the last item of the previous page. OmitContent leaves
+// the content out of the items, sparing the load of large contents.
+type Page struct {
+	Sort        SortKey
+	Desc        bool
+	Limit       int
+	After       *Cursor
+	OmitContent bool
+}
+
+// Cursor is the keyset position of an item in a listing. It travels to
+// clients as the opaque string returned by Encode.
+type Cursor struct {
+	Sort  SortKey     `json:"s"`
+	Desc  bool        `json:"d,omitempty"`
+	Value interface{} `json:"v"`
+	ID    string      `json:"id"`
+}
+
+// ParsePage reads the sort, limit, cursor and content parameters. sort names
+// one of the allowed keys, prefixed with - for descending order; the default
+// is def. A cursor must come from a listing with the same sort. content=false
+// omits the content of the items.
+func ParsePage(values url.Values, allowed []SortKey, def string) (Page, error) {
+	p := Page{Limit: DefaultPageSize}
+
+	sort := values.Get("sort")
+	if sort == "" {
+		sort = def
+	}
+	if strings.HasPrefix(sort, "-") {
+		p.Desc = true
+		sort = sort[1:]
+	}
+	p.Sort = SortKey(sort)
+	if !containsSortKey(allowed, p.Sort) {
+		return Page{}, invalid("cannot sort by %q", sort)
+	}
+
+	if l := values.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > MaxPageSize {
+			return Page{}, invalid("limit must be between 1 and %d", MaxPageSize)
+		}
+		p.Limit = n
+	}
+
+	if c := values.Get("content"); c != "" {
+		include, err := strconv.ParseBool(c)
+		if err != nil {
+			return Page{}, invalid("content must be true or false")
+		}
+		p.OmitContent = !include
+	}
+
+	if token := values.Get("cursor"); token != "" {
+		c, err := DecodeCursor(token)
+		if err != nil {
+			return Page{}, err
+		}
+		if c.Sort != p.Sort || c.Desc != p.Desc {
+			return Page{}, invalid("cursor does not belong to this sort order")
+		}
+		p.After = c
+	}
+	return p, nil
+}
+
+// NewCursor returns the cursor positioned on an item with the given sort value and id.
+func (p Page) NewCursor(value interface{}, id string) *Cursor {
+	return &Cursor{Sort: p.Sort, Desc: p.Desc, Value: value, ID: id}
+}
+
+func (c *Cursor) Encode() string {
+	v := c.Value
+	if t, ok := v.(time.Time); ok {
+		v = t.UTC().Format(time.RFC3339Nano)
+	}
+	b, _ := json.Marshal(Cursor{Sort: c.Sort, Desc: c.Desc, Value: v, ID: c.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a token produced by Encode, restoring the sort value to
+// the type of its key.
+func DecodeCursor(token string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid("malformed cursor")
+	}
+	c := &Cursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.ID == "" {
+		return nil, invalid("malformed cursor")
+	}
+	switch c.Sort {
+	case SortModifiedTime, SortCreatedTime, SortDeletedAt:
+		s, _ := c.Value.(string)
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, invalid("malformed cursor")
+		}
+		c.Value = t
+	case SortVersion:
+		n, ok := c.Value.(float64)
+		if !ok {
+			return nil, invalid("malformed cursor")
+		}
+		c.Value = int(n)
+	case SortName:
+		if _, ok := c.Value.(string); !ok {
+			return nil, invalid("malformed cursor")
+		}
+	default:
+		return nil, invalid("malformed cursor")
+	}
+	return c, nil
+}
+
+func containsSortKey(keys []SortKey, k SortKey) bool {
+	for _, key := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
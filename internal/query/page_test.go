@@ -0,0 +1,52 @@
+package query
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 0, 0, 123000000, time.UTC)
+	p := Page{Sort: SortModifiedTime, Desc: true}
+	c, err := DecodeCursor(p.NewCursor(ts, "abc").Encode())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if v, ok := c.Value.(time.Time); !ok || !v.Equal(ts) || c.ID != "abc" || !c.Desc {
+		t.Fatalf("unexpected cursor: %+v", c)
+	}
+}
+
+func TestParsePageErrors(t *testing.T) {
+	versionCursor := Page{Sort: SortVersion}.NewCursor(3, "x").Encode()
+	tests := map[string]url.Values{
+		"unknown sort":   {"sort": {"content"}},
+		"limit too big":  {"limit": {"1000"}},
+		"limit not int":  {"limit": {"ten"}},
+		"garbage cursor": {"cursor": {"!!"}},
+		"other sort":     {"sort": {"name"}, "cursor": {versionCursor}},
+		"content flag":   {"content": {"maybe"}},
+	}
+	for name, values := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParsePage(values, ContextSortKeys, "-modifiedTime"); !errors.Is(err, ErrInvalidQuery) {
+				t.Fatalf("expected ErrInvalidQuery, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePageOmitContent(t *testing.T) {
+	p, err := ParsePage(url.Values{"content": {"false"}}, ContextSortKeys, "-modifiedTime")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if !p.OmitContent {
+		t.Fatal("content=false should omit the content")
+	}
+	if p, _ = ParsePage(url.Values{}, ContextSortKeys, "-modifiedTime"); p.OmitContent {
+		t.Fatal("content should be included by default")
+	}
+}
@@ -0,0 +1,87 @@
+package query
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+	maxSearchTextLen   = 512
+)
+
+// SearchQuery is a full-text search over the name, description, content and
+// tags of contexts, optionally scoped to tenants.
+type SearchQuery struct {
+	Text      string   `json:"text"`
+	TenantIDs []string `json:"tenantIds,omitempty"`
+	Limit     int      `json:"limit,omitempty"`
+}
+
+// ParseSearchQuery reads the text, tenantId and limit parameters.
+func ParseSearchQuery(values url.Values) (*SearchQuery, error) {
+	sq := &SearchQuery{Text: values.Get("text")}
+	for _, v := range values["tenantId"] {
+		sq.TenantIDs = append(sq.TenantIDs, splitList(v)...)
+	}
+	if l := values.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return nil, invalid("limit must be a number")
+		}
+		sq.Limit = n
+	}
+	if err := sq.Validate(); err != nil {
+		return nil, err
+	}
+	return sq, nil
+}
+
+// Validate checks the query and applies the default limit.
+func (sq *SearchQuery) Validate() error {
+	sq.Text = strings.TrimSpace(sq.Text)
+	if sq.Text == "" {
+		return invalid("search text is required")
+	}
+	if len(sq.Text) > maxSearchTextLen {
+		return invalid("search text is longer than %d characters", maxSearchTextLen)
+	}
+	if len(SearchTerms(sq.Text)) == 0 {
+		return invalid("search text has no searchable terms")
+	}
+	if sq.Limit == 0 {
+		sq.Limit = DefaultSearchLimit
+	}
+	if sq.Limit < 1 || sq.Limit > MaxSearchLimit {
+		return invalid("limit must be between 1 and %d", MaxSearchLimit)
+	}
+	if len(sq.TenantIDs) > maxListValues {
+		return invalid("too many values for tenantId, at most %d are allowed", maxListValues)
+	}
+	for _, id := range sq.TenantIDs {
+		if id == "" {
+			return invalid("empty value in tenantId")
+		}
+	}
+	return nil
+}
+
+// SearchTerms splits search text into lower-cased terms the way the text index
+// tokenizes it. Terms negated with a leading - are left out.
+func SearchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		if strings.HasPrefix(word, "-") {
+			continue
+		}
+		for _, t := range strings.FieldsFunc(word, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			terms = append(terms, strings.ToLower(t))
+		}
+	}
+	return terms
+}
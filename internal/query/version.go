@@ -0,0 +1,46 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CurrentVersion designates the live context rather than a history entry.
+const CurrentVersion = "current"
+
+// VersionRef designates one version of a context: the current one, a version
+// number, or a history entry by its id.
+type VersionRef struct {
+	Current   bool
+	Version   int
+	HistoryID string
+}
+
+// ParseVersionRef reads "current", a version number, or a history id.
+func ParseVersionRef(s string) (VersionRef, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return VersionRef{}, invalid("a version is required")
+	case s == CurrentVersion:
+		return VersionRef{Current: true}, nil
+	}
+	if v, err := strconv.Atoi(s); err == nil {
+		if v < 1 {
+			return VersionRef{}, invalid("version must be positive, got %d", v)
+		}
+		return VersionRef{Version: v}, nil
+	}
+	return VersionRef{HistoryID: s}, nil
+}
+
+func (r VersionRef) String() string {
+	switch {
+	case r.Current:
+		return CurrentVersion
+	case r.HistoryID != "":
+		return r.HistoryID
+	default:
+		return strconv.Itoa(r.Version)
+	}
+}
@@ -0,0 +1,264 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mangudaigb/context-service/internal/encryption"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The documents of a tenant with a key carry an encryption header holding
+// their data key. Their content is encrypted in contentData or its file, and
+// their metadata in metadataData. Neither the text index nor filters on the
+// metadata can match them, so such searches and filters are refused for the
+// tenants with a key, see CheckFilterable.
+const (
+	encryptionField   = "encryption"
+	metadataField     = "metadata"
+	metadataDataField = "metadataData"
+)
+
+var errNoKeyring = errors.New("document is encrypted but no keyring is configured")
+
+// ErrEncryptedFilter is returned for a search or a metadata filter that could
+// reach the encrypted contexts of a tenant.
+var ErrEncryptedFilter = fmt.Errorf("%w: the content and metadata of the tenants with a key are encrypted and cannot be searched or filtered, scope the query with tenantId to tenants without one", query.ErrInvalidQuery)
+
+// documentFields are the fields written by withDocumentFields; the ones a
+// document does not use are unset.
+var documentFields = []string{
+	contentField, contentDataField, contentCodecField, contentFileField, contentTermsField,
+	metadataField, metadataDataField, encryptionField,
+}
+
+// encryptionTenant is the tenant whose key encrypts a document, its first one.
+func encryptionTenant(tenants []entities.TenantStub) string {
+	if len(tenants) == 0 {
+		return ""
+	}
+	return tenants[0].ID
+}
+
+func fieldAAD(id, field string) []byte {
+	return []byte(id + "/" + field)
+}
+
+// newDataKey returns the data key of a new document of the tenants, nil when
+// it is stored in the clear.
+func (l contentLayout) newDataKey(ctx context.Context, tenants []entities.TenantStub) (*encryption.DataKey, error) {
+	if l.enc == nil {
+		return nil, nil
+	}
+	return l.enc.NewDataKey(ctx, encryptionTenant(tenants))
+}
+
+// checkFilterable returns ErrEncryptedFilter when any of the tenants has a
+// key, or when no tenant is given and some may have one. A document is
+// encrypted with the key of its first tenant, so the contexts shared with
+// such a tenant listed first are not matched either.
+func (l contentLayout) checkFilterable(ctx context.Context, tenantIDs []string) error {
+	if l.enc == nil {
+		return nil
+	}
+	if len(tenantIDs) == 0 {
+		return ErrEncryptedFilter
+	}
+	for _, id := range tenantIDs {
+		encrypted, err := l.enc.Encrypts(ctx, id)
+		if err != nil {
+			return err
+		}
+		if encrypted {
+			return ErrEncryptedFilter
+		}
+	}
+	return nil
+}
+
+func (l contentLayout) openDataKey(ctx context.Context, h *encryption.Header) (*encryption.DataKey, error) {
+	if h == nil {
+		return nil, nil
+	}
+	if l.enc == nil {
+		return nil, errNoKeyring
+	}
+	return l.enc.OpenDataKey(ctx, *h)
+}
+
+// documentFields returns the fields storing the content and the metadata of
+// the document id, encrypted with dk when it is not nil. Clear content stored
+// out of line gets its contentTerms.
+func (l contentLayout) documentFields(ctx context.Context, id, content string, metadata map[string]interface{}, dk *encryption.DataKey) (bson.M, error) {
+	sc, err := l.store(ctx, id, content, dk, fieldAAD(id, contentField))
+	if err != nil {
+		return nil, err
+	}
+	fields := sc.fields()
+	if dk == nil {
+		if sc.outOfLine() {
+			fields[contentTermsField] = contentTerms(content)
+		}
+		if len(metadata) > 0 {
+			fields[metadataField] = metadata
+		}
+		return fields, nil
+	}
+	fields[encryptionField] = dk.Header
+	if len(metadata) > 0 {
+		plain, err := bson.Marshal(metadata)
+		if err != nil {
+			return nil, err
+		}
+		fields[metadataDataField] = dk.Seal(plain, fieldAAD(id, metadataField))
+	}
+	return fields, nil
+}
+
+// withDocumentFields makes an update write fields, unsetting the document
+// fields it leaves out.
+func withDocumentFields(update bson.M, fields bson.M) bson.M {
+	set := update["$set"].(bson.M)
+	unset, ok := update["$unset"].(bson.M)
+	if !ok {
+		unset = bson.M{}
+		update["$unset"] = unset
+	}
+	for _, f := range documentFields {
+		if v, ok := fields[f]; ok {
+			set[f] = v
+			delete(unset, f)
+			continue
+		}
+		delete(set, f)
+		unset[f] = ""
+	}
+	return update
+}
+
+// openContext sets the content and the metadata of c from the document raw
+// when they are not stored inline.
+func (l contentLayout) openContext(ctx context.Context, raw bson.Raw, c *entities.Context) error {
+	var h *encryption.Header
+	if v, err := raw.LookupErr(encryptionField); err == nil {
+		h = &encryption.Header{}
+		if err := v.Unmarshal(h); err != nil {
+			return err
+		}
+	}
+	dk, err := l.openDataKey(ctx, h)
+	if err != nil {
+		return fmt.Errorf("reading context %s: %w", c.ID, err)
+	}
+	if sc := storedContentOf(raw); sc.outOfLine() {
+		if c.Content, err = l.load(ctx, sc, dk, fieldAAD(c.ID, contentField)); err != nil {
+			return fmt.Errorf("reading the content of context %s: %w", c.ID, err)
+		}
+	}
+	if _, sealed, ok := raw.Lookup(metadataDataField).BinaryOK(); ok && dk != nil {
+		if c.Metadata, err = openMetadata(dk, c.ID, sealed); err != nil {
+			return fmt.Errorf("reading the metadata of context %s: %w", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// docDataKey opens the data key of a decoded document, nil when it has none.
+func (l contentLayout) docDataKey(ctx context.Context, doc bson.M) (*encryption.DataKey, error) {
+	raw, ok := doc[encryptionField].(bson.M)
+	if !ok {
+		return nil, nil
+	}
+	h := &encryption.Header{}
+	if err := fromBsonM(raw, h); err != nil {
+		return nil, err
+	}
+	return l.openDataKey(ctx, h)
+}
+
+// openHistoryMetadata sets the metadata of ch from its document when it is
+// encrypted. The content is read by resolveContents.
+func (l contentLayout) openHistoryMetadata(ctx context.Context, doc bson.M, ch *entities.ContextHistory) error {
+	sealed, ok := doc[metadataDataField].(primitive.Binary)
+	if !ok {
+		return nil
+	}
+	dk, err := l.docDataKey(ctx, doc)
+	if err != nil || dk == nil {
+		return err
+	}
+	if ch.Metadata, err = openMetadata(dk, ch.ID, sealed.Data); err != nil {
+		return fmt.Errorf("reading the metadata of context history %s: %w", ch.ID, err)
+	}
+	return nil
+}
+
+func openMetadata(dk *encryption.DataKey, id string, sealed []byte) (map[string]interface{}, error) {
+	plain, err := dk.Open(sealed, fieldAAD(id, metadataField))
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]interface{}
+	if err := bson.Unmarshal(plain, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+const rewrapBatch = 500
+
+// RewrapDataKeys wraps the data keys of the encrypted contexts and history
+// entries with the current key of their tenant, once a tenant key has been
+// rotated, and returns how many it rewrapped. The retired tenant keys can be
+// dropped from the keyring afterwards. A document updated meanwhile is left
+// alone, its new data key is wrapped by the current key already.
+func RewrapDataKeys(ctx context.Context, db *mongo.Database, enc *encryption.Encryptor) (int, error) {
+	rewrapped := 0
+	for _, collection := range []string{ContextsCollection, ContextHistoriesCollection} {
+		col := db.Collection(collection)
+		after := ""
+		for {
+			opts := options.Find().
+				SetProjection(bson.M{encryptionField: 1}).
+				SetSort(bson.D{{Key: "_id", Value: 1}}).
+				SetLimit(rewrapBatch)
+			cursor, err := col.Find(ctx, bson.M{"_id": bson.M{"$gt": after}, encryptionField: bson.M{"$exists": true}}, opts)
+			if err != nil {
+				return rewrapped, err
+			}
+			var docs []struct {
+				ID     string            `bson:"_id"`
+				Header encryption.Header `bson:"encryption"`
+			}
+			if err := cursor.All(ctx, &docs); err != nil {
+				return rewrapped, err
+			}
+			if len(docs) == 0 {
+				break
+			}
+			after = docs[len(docs)-1].ID
+			for _, d := range docs {
+				h, changed, err := enc.Rewrap(ctx, d.Header)
+				if err != nil {
+					return rewrapped, fmt.Errorf("rewrapping the data key of %s %s: %w", collection, d.ID, err)
+				}
+				if !changed {
+					continue
+				}
+				filter := bson.M{"_id": d.ID, encryptionField + ".key": d.Header.Key.Key}
+				res, err := col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{encryptionField: h}})
+				if err != nil {
+					return rewrapped, err
+				}
+				rewrapped += int(res.ModifiedCount)
+			}
+		}
+	}
+	return rewrapped, nil
+}
@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ContentFilesBucket is the GridFS bucket holding the content too large to be
+// kept in the documents.
+const ContentFilesBucket = "context_content"
+
+const (
+	contentFileField = "contentFile"
+	blobFileField    = "file"
+
+	// contentFileGrace is how long a file may stay unreferenced before it is
+	// swept. Files are uploaded before the document referencing them is
+	// written, possibly in a transaction that has not committed yet.
+	contentFileGrace = time.Hour
+	sweepBatch       = 500
+)
+
+// contentFiles stores the content offloaded from the documents. Files are
+// immutable: a new version of the content gets a new file, and the files
+// nothing references any more are removed by SweepContentFiles.
+type contentFiles interface {
+	upload(ctx context.Context, name string, data []byte) (primitive.ObjectID, error)
+	download(ctx context.Context, id primitive.ObjectID) ([]byte, error)
+}
+
+type gridFSFiles struct {
+	db *mongo.Database
+}
+
+// bucket returns a bucket for one operation. GridFS operations do not take a
+// context, the deadline of ctx is set on the bucket instead.
+func (cf gridFSFiles) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	b, err := gridfs.NewBucket(cf.db, options.GridFSBucket().SetName(ContentFilesBucket))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := b.SetWriteDeadline(deadline); err != nil {
+			return nil, err
+		}
+		if err := b.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (cf gridFSFiles) upload(ctx context.Context, name string, data []byte) (primitive.ObjectID, error) {
+	b, err := cf.bucket(ctx)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return b.UploadFromStream(name, bytes.NewReader(data))
+}
+
+func (cf gridFSFiles) download(ctx context.Context, id primitive.ObjectID) ([]byte, error) {
+	b, err := cf.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := b.DownloadToStream(id, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sizes returns the length of each of the files found among ids.
+func (cf gridFSFiles) sizes(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	sizes := make(map[primitive.ObjectID]int64, len(ids))
+	if len(ids) == 0 {
+		return sizes, nil
+	}
+	b, err := cf.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := b.FindContext(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var files []struct {
+		ID     primitive.ObjectID `bson:"_id"`
+		Length int64              `bson:"length"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		sizes[f.ID] = f.Length
+	}
+	return sizes, nil
+}
+
+// sweep removes the files older than the grace period that no context,
+// history entry or history blob references.
+func (cf gridFSFiles) sweep(ctx context.Context) (int, error) {
+	b, err := cf.bucket(ctx)
+	if err != nil {
+		return 0, err
+	}
+	before := time.Now().Add(-contentFileGrace)
+	removed := 0
+	after := primitive.NilObjectID
+	for {
+		opts := options.GridFSFind().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(sweepBatch)
+		cursor, err := b.FindContext(ctx, bson.M{"_id": bson.M{"$gt": after}, "uploadDate": bson.M{"$lt": before}}, opts)
+		if err != nil {
+			return removed, err
+		}
+		var files []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &files); err != nil {
+			return removed, err
+		}
+		if len(files) == 0 {
+			return removed, nil
+		}
+		ids := make([]primitive.ObjectID, 0, len(files))
+		for _, f := range files {
+			ids = append(ids, f.ID)
+		}
+		after = ids[len(ids)-1]
+
+		used, err := cf.referenced(ctx, ids)
+		if err != nil {
+			return removed, err
+		}
+		for _, id := range ids {
+			if used[id] {
+				continue
+			}
+			if err := b.DeleteContext(ctx, id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+				return removed, err
+			}
+			removed++
+		}
+	}
+}
+
+func (cf gridFSFiles) referenced(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	used := make(map[primitive.ObjectID]bool)
+	for collection, field := range map[string]string{
+		ContextsCollection:            contentFileField,
+		ContextHistoriesCollection:    contentFileField,
+		ContextHistoryBlobsCollection: blobFileField,
+	} {
+		opts := options.Find().SetProjection(bson.M{field: 1})
+		cursor, err := cf.db.Collection(collection).Find(ctx, bson.M{field: bson.M{"$in": ids}}, opts)
+		if err != nil {
+			return nil, err
+		}
+		var docs []bson.M
+		if err := cursor.All(ctx, &docs); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if id, ok := doc[field].(primitive.ObjectID); ok {
+				used[id] = true
+			}
+		}
+	}
+	return used, nil
+}
@@ -0,0 +1,87 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type fakeContentFiles map[primitive.ObjectID][]byte
+
+func (f fakeContentFiles) upload(ctx context.Context, name string, data []byte) (primitive.ObjectID, error) {
+	id := primitive.NewObjectID()
+	f[id] = data
+	return id, nil
+}
+
+func (f fakeContentFiles) download(ctx context.Context, id primitive.ObjectID) ([]byte, error) {
+	data, ok := f[id]
+	if !ok {
+		return nil, errors.New("no such file")
+	}
+	return data, nil
+}
+
+func TestContentOffloadRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	files := fakeContentFiles{}
+	big := &entities.Context{ID: "c1", Content: strings.Repeat("x", 64), Version: 2}
+	offload := func(threshold int) storedContent {
+		t.Helper()
+		l := contentLayout{files: files, storage: settings.CollectionStorage{OffloadThreshold: threshold}}
+		sc, err := l.store(ctx, big.ID, big.Content, nil, nil)
+		if err != nil {
+			t.Fatalf("store: %v", err)
+		}
+		return sc
+	}
+
+	if sc := offload(0); sc.File != nil || sc.Inline != big.Content {
+		t.Fatalf("a zero threshold must keep the content inline, got %+v", sc)
+	}
+	if sc := offload(64); sc.File != nil || sc.Inline != big.Content {
+		t.Fatalf("content at the threshold must stay inline, got %+v", sc)
+	}
+	sc := offload(16)
+	if sc.File == nil {
+		t.Fatalf("expected the content to be offloaded, got %+v", sc)
+	}
+
+	update := withDocumentFields(contextUpdate(big), sc.fields())
+	set, unset := update["$set"].(bson.M), update["$unset"].(bson.M)
+	if _, ok := set[contentField]; ok {
+		t.Fatal("offloaded content must not be set inline")
+	}
+	if _, ok := unset[contentField]; !ok || set[contentFileField] != *sc.File {
+		t.Fatalf("unexpected update: %v", update)
+	}
+
+	doc, err := toBsonM(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyErr := applyUpdate(doc, update)
+	raw, err := bson.Marshal(doc)
+	if applyErr != nil || err != nil {
+		t.Fatalf("apply: %v, marshal: %v", applyErr, err)
+	}
+	got := &entities.Context{}
+	if err := bson.Unmarshal(raw, got); err != nil || got.Content != "" {
+		t.Fatalf("the document should carry no content, got %q, %v", got.Content, err)
+	}
+	l := contentLayout{files: files}
+	if err := l.openContext(ctx, raw, got); err != nil || got.Content != big.Content {
+		t.Fatalf("expected the content to be loaded from its file, got %q, %v", got.Content, err)
+	}
+
+	delete(files, *sc.File)
+	if err := l.openContext(ctx, raw, &entities.Context{ID: big.ID}); err == nil {
+		t.Fatal("a missing file must fail the load")
+	}
+}
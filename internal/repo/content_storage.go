@@ -0,0 +1,191 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/mangudaigb/context-service/internal/codec"
+	"github.com/mangudaigb/context-service/internal/encryption"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The content of a document is stored in one of three ways: inline in
+// content, compressed or encrypted in contentData, or in a GridFS file
+// referenced by contentFile. contentCodec names the codec of contentData or of
+// the file, and is absent for uncompressed content. The content of a document
+// carrying an encryption header is always encrypted, see contextFields.
+//
+// The text index cannot read the content out of line, so a clear document
+// storing it that way also carries contentTerms, the distinct words of its
+// content, which the text index covers instead.
+const (
+	contentDataField  = "contentData"
+	contentCodecField = "contentCodec"
+	contentTermsField = "contentTerms"
+
+	// maxContentTermsSize bounds the size of contentTerms; the words past it
+	// are not searchable.
+	maxContentTermsSize = 1 << 20
+)
+
+// storedContent is content the way it is written to a document.
+type storedContent struct {
+	Inline string
+	Data   []byte
+	Codec  codec.Codec
+	File   *primitive.ObjectID
+}
+
+// contentLayout stores content as the settings of a collection say: compressed
+// with their codec, encrypted when the document has a data key, and offloaded
+// to files when still larger than their threshold.
+type contentLayout struct {
+	files   contentFiles
+	storage settings.CollectionStorage
+	enc     *encryption.Encryptor
+}
+
+// store compresses content when it is above the compress threshold, seals it
+// with dk when dk is not nil, then uploads it when it is still above the
+// offload threshold. Compression that does not make the content smaller is
+// dropped. aad binds the sealed content to its document.
+func (l contentLayout) store(ctx context.Context, name, content string, dk *encryption.DataKey, aad []byte) (storedContent, error) {
+	c, err := codec.Parse(l.storage.Compression)
+	if err != nil {
+		return storedContent{}, err
+	}
+	sc := storedContent{Inline: content}
+	data := []byte(content)
+	if c != codec.None && len(content) > l.storage.CompressThreshold {
+		compressed, err := c.Compress(data)
+		if err != nil {
+			return storedContent{}, fmt.Errorf("compressing the content of %s: %w", name, err)
+		}
+		if len(compressed) < len(data) {
+			sc = storedContent{Data: compressed, Codec: c}
+			data = compressed
+		}
+	}
+	if dk != nil {
+		data = dk.Seal(data, aad)
+		sc = storedContent{Data: data, Codec: sc.Codec}
+	}
+	if l.storage.OffloadThreshold > 0 && len(data) > l.storage.OffloadThreshold {
+		id, err := l.files.upload(ctx, name, data)
+		if err != nil {
+			return storedContent{}, fmt.Errorf("offloading the content of %s: %w", name, err)
+		}
+		sc = storedContent{File: &id, Codec: sc.Codec}
+	}
+	return sc, nil
+}
+
+// load returns the content of sc, downloading, opening and decompressing it
+// as needed. dk must be the data key of the document when it has one.
+func (l contentLayout) load(ctx context.Context, sc storedContent, dk *encryption.DataKey, aad []byte) (string, error) {
+	data := sc.Data
+	if sc.File != nil {
+		var err error
+		if data, err = l.files.download(ctx, *sc.File); err != nil {
+			return "", err
+		}
+	} else if sc.Data == nil {
+		return sc.Inline, nil
+	}
+	if dk != nil {
+		var err error
+		if data, err = dk.Open(data, aad); err != nil {
+			return "", err
+		}
+	}
+	content, err := sc.Codec.Decompress(data)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// outOfLine reports whether the content is not stored inline.
+func (sc storedContent) outOfLine() bool {
+	return sc.File != nil || sc.Data != nil
+}
+
+// fields returns the content fields of a context document.
+func (sc storedContent) fields() bson.M {
+	fields := bson.M{}
+	switch {
+	case sc.File != nil:
+		fields[contentFileField] = *sc.File
+	case sc.Data != nil:
+		fields[contentDataField] = sc.Data
+	default:
+		fields[contentField] = sc.Inline
+	}
+	if sc.Codec != codec.None {
+		fields[contentCodecField] = string(sc.Codec)
+	}
+	return fields
+}
+
+// omitContentProjection leaves the content out of the context documents read.
+func omitContentProjection() bson.M {
+	return bson.M{contentField: 0, contentDataField: 0, contentFileField: 0, contentTermsField: 0}
+}
+
+// contentTerms returns the distinct lower-cased words of content, in the
+// order they first occur, as the text index tokenizes them.
+func contentTerms(content string) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+	size := 0
+	for _, w := range strings.FieldsFunc(content, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		w = strings.ToLower(w)
+		if seen[w] {
+			continue
+		}
+		if size += len(w); size > maxContentTermsSize {
+			break
+		}
+		seen[w] = true
+		terms = append(terms, w)
+	}
+	return terms
+}
+
+// storedContentOf reads the content fields of a document.
+func storedContentOf(raw bson.Raw) storedContent {
+	sc := storedContent{}
+	sc.Inline, _ = raw.Lookup(contentField).StringValueOK()
+	if codecName, ok := raw.Lookup(contentCodecField).StringValueOK(); ok {
+		sc.Codec = codec.Codec(codecName)
+	}
+	if id, ok := raw.Lookup(contentFileField).ObjectIDOK(); ok {
+		sc.File = &id
+	}
+	if _, data, ok := raw.Lookup(contentDataField).BinaryOK(); ok {
+		sc.Data = data
+	}
+	return sc
+}
+
+// storedContentOfDoc is storedContentOf for a decoded document.
+func storedContentOfDoc(doc bson.M) storedContent {
+	sc := storedContent{}
+	sc.Inline, _ = doc[contentField].(string)
+	if codecName, ok := doc[contentCodecField].(string); ok {
+		sc.Codec = codec.Codec(codecName)
+	}
+	if id, ok := doc[contentFileField].(primitive.ObjectID); ok {
+		sc.File = &id
+	}
+	if data, ok := doc[contentDataField].(primitive.Binary); ok {
+		sc.Data = data.Data
+	}
+	return sc
+}
@@ -0,0 +1,272 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/codec"
+	"github.com/mangudaigb/context-service/internal/encryption"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// storeAndRead writes c through an update the way the mongo repository does,
+// and reads it back from the resulting document.
+func storeAndRead(t *testing.T, l contentLayout, c *entities.Context) (bson.M, *entities.Context) {
+	t.Helper()
+	ctx := context.Background()
+	dk, err := l.newDataKey(ctx, c.Tenants)
+	if err != nil {
+		t.Fatalf("data key: %v", err)
+	}
+	fields, err := l.documentFields(ctx, c.ID, c.Content, c.Metadata, dk)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	doc, err := toBsonM(&entities.Context{ID: c.ID, Content: "previous"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyUpdate(doc, withDocumentFields(contextUpdate(c), fields)); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &entities.Context{}
+	if err := bson.Unmarshal(raw, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.openContext(ctx, raw, got); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return doc, got
+}
+
+func TestContentStorageRoundTrip(t *testing.T) {
+	prompt := strings.Repeat("Answer politely and cite your sources.\n", 100)
+	tests := map[string]struct {
+		storage settings.CollectionStorage
+		content string
+		fields  []string
+	}{
+		"inline":                 {settings.CollectionStorage{}, prompt, []string{contentField}},
+		"below compress":         {settings.CollectionStorage{Compression: "zstd", CompressThreshold: 1 << 20}, prompt, []string{contentField}},
+		"zstd":                   {settings.CollectionStorage{Compression: "zstd"}, prompt, []string{contentDataField, contentCodecField, contentTermsField}},
+		"snappy":                 {settings.CollectionStorage{Compression: "snappy"}, prompt, []string{contentDataField, contentCodecField, contentTermsField}},
+		"incompressible":         {settings.CollectionStorage{Compression: "zstd"}, "ab", []string{contentField}},
+		"offloaded":              {settings.CollectionStorage{OffloadThreshold: 64}, prompt, []string{contentFileField, contentTermsField}},
+		"compressed, offloaded":  {settings.CollectionStorage{Compression: "snappy", OffloadThreshold: 64}, prompt, []string{contentCodecField, contentFileField, contentTermsField}},
+		"compressed under limit": {settings.CollectionStorage{Compression: "zstd", OffloadThreshold: 1000}, prompt, []string{contentDataField, contentCodecField, contentTermsField}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := contentLayout{files: fakeContentFiles{}, storage: tc.storage}
+			doc, got := storeAndRead(t, l, &entities.Context{ID: "c1", Content: tc.content})
+			if got.Content != tc.content {
+				t.Fatalf("content does not round trip, got %d bytes", len(got.Content))
+			}
+			var present []string
+			for _, f := range documentFields {
+				if _, ok := doc[f]; ok {
+					present = append(present, f)
+				}
+			}
+			if strings.Join(present, ",") != strings.Join(tc.fields, ",") {
+				t.Fatalf("stored as %v, want %v", present, tc.fields)
+			}
+		})
+	}
+}
+
+func TestStoreContentUnknownCodec(t *testing.T) {
+	l := contentLayout{files: fakeContentFiles{}, storage: settings.CollectionStorage{Compression: "lz4"}}
+	_, err := l.store(context.Background(), "c1", "x", nil, nil)
+	if !errors.Is(err, codec.ErrUnknownCodec) {
+		t.Fatalf("expected ErrUnknownCodec, got %v", err)
+	}
+}
+
+func TestContextUpdateDropsStaleFields(t *testing.T) {
+	c := &entities.Context{ID: "c1", Content: "small"}
+	update := withDocumentFields(contextUpdate(c), storedContent{Inline: c.Content}.fields())
+	unset := update["$unset"].(bson.M)
+	if _, ok := unset[contentFileField]; !ok {
+		t.Fatalf("inline content must drop the file reference: %v", update)
+	}
+	if _, ok := unset[revertOfField]; !ok {
+		t.Fatalf("an update must drop the revert marker: %v", update)
+	}
+	if update["$set"].(bson.M)[contentField] != "small" {
+		t.Fatalf("inline content must be set: %v", update)
+	}
+}
+
+func TestEncryptedContextRoundTrip(t *testing.T) {
+	kr, err := encryption.ParseKeyring([]byte(`{"tenants": {"acme": {"current": "k1", "keys": {"k1": "` +
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)) + `"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := strings.Repeat("Answer politely and cite your sources.\n", 100)
+	for name, storage := range map[string]settings.CollectionStorage{
+		"sealed":                {},
+		"compressed, offloaded": {Compression: "zstd", OffloadThreshold: 64},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l := contentLayout{files: fakeContentFiles{}, storage: storage, enc: encryption.NewEncryptor(kr)}
+			c := &entities.Context{
+				ID:       "c1",
+				Content:  prompt,
+				Metadata: map[string]interface{}{"owner": "support"},
+				Tenants:  []entities.TenantStub{{ID: "acme"}},
+			}
+			doc, got := storeAndRead(t, l, c)
+			for _, f := range []string{contentField, contentTermsField, metadataField} {
+				if _, ok := doc[f]; ok {
+					t.Fatalf("%s must not be stored in the clear", f)
+				}
+			}
+			for _, f := range []string{encryptionField, metadataDataField} {
+				if _, ok := doc[f]; !ok {
+					t.Fatalf("%s is missing", f)
+				}
+			}
+			if got.Content != prompt || got.Metadata["owner"] != "support" {
+				t.Fatalf("context does not round trip: %d bytes, %v", len(got.Content), got.Metadata)
+			}
+
+			if err := (contentLayout{files: l.files}).openContext(context.Background(), mustMarshal(t, doc), &entities.Context{ID: "c1"}); !errors.Is(err, errNoKeyring) {
+				t.Fatalf("expected errNoKeyring, got %v", err)
+			}
+		})
+	}
+}
+
+func TestContextOfTenantWithoutKeyIsClear(t *testing.T) {
+	kr, err := encryption.ParseKeyring([]byte(`{"tenants": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := contentLayout{files: fakeContentFiles{}, enc: encryption.NewEncryptor(kr)}
+	doc, _ := storeAndRead(t, l, &entities.Context{ID: "c1", Content: "hi", Tenants: []entities.TenantStub{{ID: "other"}}})
+	if doc[contentField] != "hi" || doc[encryptionField] != nil {
+		t.Fatalf("expected a clear document, got %v", doc)
+	}
+}
+
+func mustMarshal(t *testing.T, doc bson.M) bson.Raw {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestPatchUpdateTouchesOnlyChangedFields(t *testing.T) {
+	nc := &entities.Context{ID: "c1", Name: "n", Version: 2, Tags: []string{"a"}}
+	update, err := patchUpdate(nc, []string{"tags", contentField})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := contentLayout{files: fakeContentFiles{}, storage: settings.CollectionStorage{Compression: "zstd"}}
+	fields, err := l.documentFields(context.Background(), nc.ID, strings.Repeat("patched ", 200), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update = withDocumentFields(update, fields)
+	set, unset := update["$set"].(bson.M), update["$unset"].(bson.M)
+	if _, ok := set["name"]; ok {
+		t.Fatalf("an unchanged field must not be written: %v", update)
+	}
+	if _, ok := set["tags"]; !ok {
+		t.Fatalf("a changed field must be written: %v", update)
+	}
+	for f := range set {
+		if _, ok := unset[f]; ok {
+			t.Fatalf("%s is both set and unset: %v", f, update)
+		}
+	}
+	if _, ok := unset[contentField]; !ok {
+		t.Fatalf("compressed content must drop the inline content: %v", update)
+	}
+}
+
+func TestSearchMatchesCompressedContent(t *testing.T) {
+	ctx := context.Background()
+	prompt := strings.Repeat("Answer politely and cite your sources.\n", 100) + "Escalate refunds to billing."
+	r := NewMemoryContextRepository(newTestLogger(t))
+	for name, storage := range map[string]settings.CollectionStorage{
+		"compressed": {Compression: "snappy"},
+		"offloaded":  {OffloadThreshold: 64},
+	} {
+		l := contentLayout{files: fakeContentFiles{}, storage: storage}
+		doc, _ := storeAndRead(t, l, &entities.Context{ID: name, Name: name, Content: prompt})
+		if _, ok := doc[contentField]; ok {
+			t.Fatalf("%s: content must not be stored inline", name)
+		}
+		if err := r.collection.insertOne(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.collection.insertOne(&entities.Context{ID: "other", Content: "unrelated"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := r.Search(ctx, &query.SearchQuery{Text: "refunds", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, h := range hits {
+		ids = append(ids, h.Context.ID)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "compressed,offloaded" {
+		t.Fatalf("expected both contexts to match, got %v", ids)
+	}
+
+	l := contentLayout{files: fakeContentFiles{}, storage: settings.CollectionStorage{Compression: "zstd"}}
+	doc, _ := storeAndRead(t, l, &entities.Context{ID: "c1", Content: "short"})
+	if _, ok := doc[contentTermsField]; ok {
+		t.Fatalf("inline content must drop its terms: %v", doc)
+	}
+}
+
+func TestCheckFilterableRefusesEncryptedTenants(t *testing.T) {
+	kr, err := encryption.ParseKeyring([]byte(`{"tenants": {"acme": {"current": "k1", "keys": {"k1": "` +
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)) + `"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	r := &MongoContextRepository{layout: contentLayout{enc: encryption.NewEncryptor(kr)}}
+	for name, tc := range map[string]struct {
+		tenants []string
+		refused bool
+	}{
+		"clear tenant":     {[]string{"other"}, false},
+		"encrypted tenant": {[]string{"other", "acme"}, true},
+		"every tenant":     {nil, true},
+	} {
+		err := r.CheckFilterable(ctx, tc.tenants)
+		if tc.refused != errors.Is(err, ErrEncryptedFilter) {
+			t.Fatalf("%s: got %v", name, err)
+		}
+		if tc.refused && !errors.Is(err, query.ErrInvalidQuery) {
+			t.Fatalf("%s: a refused filter must be an invalid query, got %v", name, err)
+		}
+	}
+	if err := (&MongoContextRepository{}).CheckFilterable(ctx, nil); err != nil {
+		t.Fatalf("nothing is refused without a keyring, got %v", err)
+	}
+}
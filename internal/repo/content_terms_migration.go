@@ -0,0 +1,64 @@
+package repo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// missingContentTerms matches the clear contexts written before their content
+// stored out of line got its contentTerms.
+var missingContentTerms = bson.M{
+	encryptionField:   bson.M{"$exists": false},
+	contentTermsField: bson.M{"$exists": false},
+	"$or": bson.A{
+		bson.M{contentDataField: bson.M{"$exists": true}},
+		bson.M{contentFileField: bson.M{"$exists": true}},
+	},
+}
+
+const contentTermsBatch = 100
+
+// BackfillContentTerms sets the contentTerms of the contexts whose content is
+// compressed or offloaded, so that the text index matches it. It can be
+// interrupted and run again.
+func BackfillContentTerms(ctx context.Context, db *mongo.Database) error {
+	col := db.Collection(ContextsCollection)
+	l := contentLayout{files: gridFSFiles{db: db}}
+	after := ""
+	for {
+		filter := bson.M{"$and": bson.A{missingContentTerms, bson.M{"_id": bson.M{"$gt": after}}}}
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(contentTermsBatch)
+		cursor, err := col.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		var raws []bson.Raw
+		if err := cursor.All(ctx, &raws); err != nil {
+			return err
+		}
+		if len(raws) == 0 {
+			return nil
+		}
+		for _, raw := range raws {
+			id, _ := raw.Lookup("_id").StringValueOK()
+			after = id
+			content, err := l.load(ctx, storedContentOf(raw), nil, nil)
+			if err != nil {
+				return err
+			}
+			update := bson.M{"$set": bson.M{contentTermsField: contentTerms(content)}}
+			if _, err := col.UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// CountMissingContentTerms counts the contexts BackfillContentTerms still has
+// to update.
+func CountMissingContentTerms(ctx context.Context, db *mongo.Database) (int64, error) {
+	return db.Collection(ContextsCollection).CountDocuments(ctx, missingContentTerms)
+}
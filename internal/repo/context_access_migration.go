@@ -0,0 +1,51 @@
+package repo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// legacyAccessFields maps the keys updates used to write the organizations,
+// tenants and groups of a context under to the keys the context is read from.
+// An update leaves the latest values under the legacy key and those of the
+// creation under the current one.
+var legacyAccessFields = map[string]string{
+	"organizations": "organization",
+	"tenants":       "tenant",
+	"groups":        "group",
+}
+
+// legacyAccess matches the contexts still holding a legacy key.
+func legacyAccess() bson.M {
+	or := make(bson.A, 0, len(legacyAccessFields))
+	for legacy := range legacyAccessFields {
+		or = append(or, bson.M{legacy: bson.M{"$exists": true}})
+	}
+	return bson.M{"$or": or}
+}
+
+// MigrateAccessFields moves the values under the legacy keys to the current
+// ones. contextUpdate unsets the legacy keys, so a context updated meanwhile
+// no longer matches and keeps its new values; it is safe while the service
+// runs and can be run again.
+func MigrateAccessFields(ctx context.Context, db *mongo.Database) error {
+	set := bson.M{}
+	unset := make(bson.A, 0, len(legacyAccessFields))
+	for legacy, current := range legacyAccessFields {
+		set[current] = bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$type": "$" + legacy}, "missing"}}, "$" + current, "$" + legacy,
+		}}
+		unset = append(unset, legacy)
+	}
+	update := bson.A{bson.M{"$set": set}, bson.M{"$unset": unset}}
+	_, err := db.Collection(ContextsCollection).UpdateMany(ctx, legacyAccess(), update)
+	return err
+}
+
+// CountLegacyAccessFields counts the contexts MigrateAccessFields still has
+// to migrate.
+func CountLegacyAccessFields(ctx context.Context, db *mongo.Database) (int64, error) {
+	return db.Collection(ContextsCollection).CountDocuments(ctx, legacyAccess())
+}
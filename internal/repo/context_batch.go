@@ -0,0 +1,187 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StoredContext is a context as stored, DeletedAt is set when it is in the
+// trash.
+type StoredContext struct {
+	RevertedContext `bson:",inline"`
+	DeletedAt       *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+}
+
+type WriteKind string
+
+const (
+	WriteCreate WriteKind = "create"
+	WriteUpdate WriteKind = "update"
+	WriteTrash  WriteKind = "trash"
+)
+
+// ContextWrite is one write of a BulkWrite. The Context of an update or a
+// trash carries the version it applies to, like for Update and Trash, and
+// both get the bumped version and modified time; By is who trashes it.
+type ContextWrite struct {
+	Kind    WriteKind
+	Context *entities.Context
+	By      entities.UserStub
+}
+
+const duplicateKeyCode = 11000
+
+// bulkWriteField holds the token of the last bulk write that updated a
+// context.
+const bulkWriteField = "bulkWrite"
+
+func (mcr *MongoContextRepository) FindByIDs(ctx context.Context, ids []string) ([]*StoredContext, error) {
+	cursor, err := mcr.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var out []*StoredContext
+	for cursor.Next(ctx) {
+		sc := &StoredContext{}
+		if err := mcr.decode(ctx, cursor.Current, sc, &sc.Context); err != nil {
+			return nil, err
+		}
+		out = append(out, sc)
+	}
+	return out, cursor.Err()
+}
+
+// BulkWrite sends the writes as one unordered bulk write. Mongo only reports
+// how many updates matched in total, so every update and trash also writes a
+// token unique to the bulk write, which tells the ones that applied from the
+// writes of others.
+func (mcr *MongoContextRepository) BulkWrite(ctx context.Context, writes []ContextWrite) ([]error, error) {
+	now := time.Now().UTC()
+	token := primitive.NewObjectID()
+	models := make([]mongo.WriteModel, len(writes))
+	for i, w := range writes {
+		c := w.Context
+		if w.Kind == WriteCreate {
+			doc, err := mcr.document(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			models[i] = mongo.NewInsertOneModel().SetDocument(doc)
+			continue
+		}
+		filter := notTrashed(bson.M{"_id": c.ID, "version": c.Version})
+		c.Version++
+		c.ModifiedTime = now
+		var update bson.M
+		switch w.Kind {
+		case WriteUpdate:
+			fields, err := mcr.fields(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			update = withDocumentFields(contextUpdate(c), fields)
+		case WriteTrash:
+			update = trashUpdate(c, now, w.By)
+		default:
+			return nil, fmt.Errorf("unknown write %q", w.Kind)
+		}
+		update["$set"].(bson.M)[bulkWriteField] = token
+		models[i] = mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update)
+	}
+
+	errs := make([]error, len(writes))
+	_, err := mcr.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+		for _, we := range bwe.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				errs[we.Index] = ErrContextExists
+			} else {
+				errs[we.Index] = we
+			}
+		}
+	} else if err != nil {
+		mcr.log.Errorf("Error writing %d contexts: %v", len(writes), err)
+		return nil, err
+	}
+
+	var ids []string
+	for i, w := range writes {
+		if w.Kind != WriteCreate && errs[i] == nil {
+			ids = append(ids, w.Context.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return errs, nil
+	}
+	cursor, err := mcr.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"version": 1, bulkWriteField: 1}))
+	if err != nil {
+		return nil, err
+	}
+	var written []struct {
+		ID        string             `bson:"_id"`
+		Version   int                `bson:"version"`
+		BulkWrite primitive.ObjectID `bson:"bulkWrite"`
+	}
+	if err := cursor.All(ctx, &written); err != nil {
+		return nil, err
+	}
+	applied := map[string]bool{}
+	for _, d := range written {
+		applied[d.ID+"@"+fmt.Sprint(d.Version)] = d.BulkWrite == token
+	}
+	for i, w := range writes {
+		if w.Kind != WriteCreate && errs[i] == nil && !applied[w.Context.ID+"@"+fmt.Sprint(w.Context.Version)] {
+			errs[i] = ErrContextVersionMismatch
+		}
+	}
+	return errs, nil
+}
+
+func (mcr *MemoryContextRepository) FindByIDs(ctx context.Context, ids []string) ([]*StoredContext, error) {
+	docs, err := mcr.collection.find(bson.M{"_id": bson.M{"$in": ids}}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*StoredContext, 0, len(docs))
+	for _, doc := range docs {
+		sc := &StoredContext{}
+		if err := fromBsonM(doc, sc); err != nil {
+			return nil, err
+		}
+		out = append(out, sc)
+	}
+	return out, nil
+}
+
+func (mcr *MemoryContextRepository) BulkWrite(ctx context.Context, writes []ContextWrite) ([]error, error) {
+	errs := make([]error, len(writes))
+	for i, w := range writes {
+		var err error
+		switch w.Kind {
+		case WriteCreate:
+			_, err = mcr.Create(ctx, w.Context)
+			if errors.Is(err, errMemDuplicateKey) {
+				err = ErrContextExists
+			}
+		case WriteUpdate:
+			_, err = mcr.Update(ctx, w.Context)
+		case WriteTrash:
+			_, err = mcr.Trash(ctx, w.Context, w.By)
+		default:
+			return nil, fmt.Errorf("unknown write %q", w.Kind)
+		}
+		errs[i] = err
+	}
+	return errs, nil
+}
@@ -0,0 +1,242 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrBranchNotFound = errors.New("branch not found")
+	ErrBranchExists   = errors.New("branch already exists")
+)
+
+// Branch is a line of versions of a context apart from its main line. It
+// shares the main line up to BaseVersion, and its own versions, stored in the
+// history, number on from there up to Head. MergedHead is the version of the
+// branch last merged into the main line, as MergedVersion of it.
+type Branch struct {
+	Name          string            `json:"name" bson:"name"`
+	BaseVersion   int               `json:"baseVersion" bson:"baseVersion"`
+	Head          int               `json:"head" bson:"head"`
+	MergedHead    int               `json:"mergedHead,omitempty" bson:"mergedHead,omitempty"`
+	MergedVersion int               `json:"mergedVersion,omitempty" bson:"mergedVersion,omitempty"`
+	User          entities.UserStub `json:"user,omitempty" bson:"user,omitempty"`
+	CreatedTime   time.Time         `json:"createdTime" bson:"createdTime"`
+	ModifiedTime  time.Time         `json:"modifiedTime" bson:"modifiedTime"`
+}
+
+// The branches of a context are kept on its document by name, which callers
+// must restrict to characters valid in a field path. Their versions are
+// history entries carrying the branch name.
+const (
+	branchesField = "branches"
+	branchField   = "branch"
+)
+
+// MainLine restricts a filter on the history to the versions of the main line.
+func MainLine(filter bson.M) bson.M {
+	filter[branchField] = bson.M{"$exists": false}
+	return filter
+}
+
+// historyLine matches the versions of the branch of the context, of its main
+// line when branch is empty.
+func historyLine(cid, branch string) bson.M {
+	if branch == "" {
+		return MainLine(bson.M{"contextId": cid})
+	}
+	return bson.M{"contextId": cid, branchField: branch}
+}
+
+func branchPath(name string) string {
+	return branchesField + "." + name
+}
+
+type branchesDoc struct {
+	Branches map[string]*Branch `bson:"branches"`
+}
+
+func sortedBranches(bd branchesDoc) []*Branch {
+	branches := make([]*Branch, 0, len(bd.Branches))
+	for _, b := range bd.Branches {
+		branches = append(branches, b)
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Name < branches[j].Name })
+	return branches
+}
+
+func (mcr *MongoContextRepository) ListBranches(ctx context.Context, cid string) ([]*Branch, error) {
+	var bd branchesDoc
+	opts := options.FindOne().SetProjection(bson.M{branchesField: 1})
+	err := mcr.collection.FindOne(ctx, notTrashed(bson.M{"_id": cid}), opts).Decode(&bd)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextNotFound
+	}
+	if err != nil {
+		mcr.log.Errorf("Error listing the branches of context %s: %v", cid, err)
+		return nil, err
+	}
+	return sortedBranches(bd), nil
+}
+
+func (mcr *MongoContextRepository) CreateBranch(ctx context.Context, cid string, b *Branch) error {
+	filter := notTrashed(bson.M{"_id": cid, branchPath(b.Name): bson.M{"$exists": false}})
+	res, err := mcr.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{branchPath(b.Name): b}})
+	if err != nil {
+		mcr.log.Errorf("Error creating branch %s of context %s: %v", b.Name, cid, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mcr.contextMiss(ctx, cid, ErrBranchExists)
+	}
+	return nil
+}
+
+func (mcr *MongoContextRepository) UpdateBranch(ctx context.Context, cid string, b *Branch, head int) error {
+	filter := notTrashed(bson.M{"_id": cid, branchPath(b.Name) + ".head": head})
+	res, err := mcr.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{branchPath(b.Name): b}})
+	if err != nil {
+		mcr.log.Errorf("Error updating branch %s of context %s: %v", b.Name, cid, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mcr.contextMiss(ctx, cid, ErrContextVersionMismatch)
+	}
+	return nil
+}
+
+func (mcr *MongoContextRepository) DeleteBranch(ctx context.Context, cid, name string) error {
+	filter := notTrashed(bson.M{"_id": cid, branchPath(name): bson.M{"$exists": true}})
+	res, err := mcr.collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{branchPath(name): ""}})
+	if err != nil {
+		mcr.log.Errorf("Error deleting branch %s of context %s: %v", name, cid, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mcr.contextMiss(ctx, cid, ErrBranchNotFound)
+	}
+	if _, err := mcr.tokenCounts.DeleteMany(ctx, branchTokenCounts(cid, name)); err != nil {
+		mcr.log.Errorf("Error deleting the token counts of branch %s of context %s: %v", name, cid, err)
+		return err
+	}
+	return nil
+}
+
+// contextMiss tells why a write to a field of a context matched nothing: the
+// context is gone, or else err.
+func (mcr *MongoContextRepository) contextMiss(ctx context.Context, cid string, err error) error {
+	n, cerr := mcr.collection.CountDocuments(ctx, notTrashed(bson.M{"_id": cid}))
+	if cerr != nil {
+		return cerr
+	}
+	if n == 0 {
+		return ErrContextNotFound
+	}
+	return err
+}
+
+func (mcr *MemoryContextRepository) ListBranches(ctx context.Context, cid string) ([]*Branch, error) {
+	doc, err := mcr.collection.findOne(notTrashed(bson.M{"_id": cid}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextNotFound
+	}
+	var bd branchesDoc
+	if err := fromBsonM(doc, &bd); err != nil {
+		return nil, err
+	}
+	return sortedBranches(bd), nil
+}
+
+func (mcr *MemoryContextRepository) CreateBranch(ctx context.Context, cid string, b *Branch) error {
+	filter := notTrashed(bson.M{"_id": cid, branchPath(b.Name): bson.M{"$exists": false}})
+	return mcr.updateContextField(cid, filter, bson.M{"$set": bson.M{branchPath(b.Name): b}}, ErrBranchExists)
+}
+
+func (mcr *MemoryContextRepository) UpdateBranch(ctx context.Context, cid string, b *Branch, head int) error {
+	filter := notTrashed(bson.M{"_id": cid, branchPath(b.Name) + ".head": head})
+	return mcr.updateContextField(cid, filter, bson.M{"$set": bson.M{branchPath(b.Name): b}}, ErrContextVersionMismatch)
+}
+
+func (mcr *MemoryContextRepository) DeleteBranch(ctx context.Context, cid, name string) error {
+	filter := notTrashed(bson.M{"_id": cid, branchPath(name): bson.M{"$exists": true}})
+	if err := mcr.updateContextField(cid, filter, bson.M{"$unset": bson.M{branchPath(name): ""}}, ErrBranchNotFound); err != nil {
+		return err
+	}
+	_, err := mcr.tokenCounts.deleteMany(branchTokenCounts(cid, name))
+	return err
+}
+
+func (mcr *MemoryContextRepository) updateContextField(cid string, filter, update bson.M, miss error) error {
+	doc, err := mcr.collection.updateOne(filter, update)
+	if err != nil || doc != nil {
+		return err
+	}
+	if doc, err = mcr.collection.findOne(notTrashed(bson.M{"_id": cid})); err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrContextNotFound
+	}
+	return miss
+}
+
+func (m MongoContextHistoryRepository) CreateOnBranch(ctx context.Context, branch string, ch *entities.ContextHistory) (*entities.ContextHistory, error) {
+	return m.create(ctx, ch, branch)
+}
+
+func (m MongoContextHistoryRepository) GetBranchVersion(ctx context.Context, cid, branch string, version int) (*entities.ContextHistory, error) {
+	line := historyLine(cid, branch)
+	line["version"] = version
+	return m.findOne(ctx, line)
+}
+
+func (m MongoContextHistoryRepository) ListBranchVersions(ctx context.Context, cid, branch string, page query.Page) (*ContextHistoryPage, error) {
+	opts := options.Find().SetSort(pageSort(page)).SetLimit(int64(page.Limit + 1))
+	histories, err := m.find(ctx, pageFilter(historyLine(cid, branch), page), page.OmitContent, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newContextHistoryPage(histories, page), nil
+}
+
+func (m MongoContextHistoryRepository) DeleteBranch(ctx context.Context, cid, branch string) (int64, error) {
+	n, err := deleteHistories(ctx, m.store, historyLine(cid, branch))
+	if err != nil {
+		m.log.Errorf("Error deleting the versions of branch %s of context %s: %v", branch, cid, err)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (m *MemoryContextHistoryRepository) CreateOnBranch(ctx context.Context, branch string, ch *entities.ContextHistory) (*entities.ContextHistory, error) {
+	return m.create(ctx, ch, branch)
+}
+
+func (m *MemoryContextHistoryRepository) GetBranchVersion(ctx context.Context, cid, branch string, version int) (*entities.ContextHistory, error) {
+	line := historyLine(cid, branch)
+	line["version"] = version
+	return m.findOne(ctx, line)
+}
+
+func (m *MemoryContextHistoryRepository) ListBranchVersions(ctx context.Context, cid, branch string, page query.Page) (*ContextHistoryPage, error) {
+	histories, err := m.find(ctx, pageFilter(historyLine(cid, branch), page), pageSort(page), page.Limit+1, page.OmitContent)
+	if err != nil {
+		return nil, err
+	}
+	return newContextHistoryPage(histories, page), nil
+}
+
+func (m *MemoryContextHistoryRepository) DeleteBranch(ctx context.Context, cid, branch string) (int64, error) {
+	return deleteHistories(ctx, m.store, historyLine(cid, branch))
+}
@@ -0,0 +1,131 @@
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ForkOrigin is the context and the version of it a context was forked from.
+type ForkOrigin struct {
+	ContextID string `json:"contextId" bson:"contextId"`
+	Version   int    `json:"version" bson:"version"`
+}
+
+// ForkedContext is a context together with its origin, nil when it was not
+// forked. Unlike the revert marker, the origin stays for the life of the
+// context.
+type ForkedContext struct {
+	entities.Context `bson:",inline"`
+	ForkedFrom       *ForkOrigin `json:"forkedFrom,omitempty" bson:"forkedFrom,omitempty"`
+}
+
+const forkedFromField = "forkedFrom"
+
+// forksOf matches the contexts forked from any of the contexts ids.
+func forksOf(ids []string) bson.M {
+	return notTrashed(bson.M{forkedFromField + ".contextId": bson.M{"$in": ids}})
+}
+
+var forkSort = bson.D{{Key: "createdTime", Value: 1}, {Key: "_id", Value: 1}}
+
+func (mcr *MongoContextRepository) Fork(ctx context.Context, c *entities.Context, from ForkOrigin) (*ForkedContext, error) {
+	doc, err := mcr.document(ctx, c)
+	if err != nil {
+		mcr.log.Errorf("Error forking context %s: %v", from.ContextID, err)
+		return nil, err
+	}
+	doc[forkedFromField] = from
+	if _, err := mcr.collection.InsertOne(ctx, doc); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrContextExists
+		}
+		mcr.log.Errorf("Error forking context %s: %v", from.ContextID, err)
+		return nil, err
+	}
+	return mcr.GetForkedByID(ctx, c.ID)
+}
+
+func (mcr *MongoContextRepository) GetForkedByID(ctx context.Context, id string) (*ForkedContext, error) {
+	var fc ForkedContext
+	raw, err := mcr.collection.FindOne(ctx, notTrashed(bson.M{"_id": id})).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextNotFound
+	}
+	if err == nil {
+		err = mcr.decode(ctx, raw, &fc, &fc.Context)
+	}
+	if err != nil {
+		mcr.log.Errorf("Error getting context %s: %v", id, err)
+		return nil, err
+	}
+	return &fc, nil
+}
+
+func (mcr *MongoContextRepository) ListForks(ctx context.Context, ids []string) ([]*ForkedContext, error) {
+	opts := options.Find().SetSort(forkSort).SetProjection(omitContentProjection())
+	cursor, err := mcr.collection.Find(ctx, forksOf(ids), opts)
+	if err != nil {
+		mcr.log.Errorf("Error listing the forks of %v: %v", ids, err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var forks []*ForkedContext
+	for cursor.Next(ctx) {
+		fc := &ForkedContext{}
+		if err := mcr.decode(ctx, cursor.Current, fc, &fc.Context); err != nil {
+			mcr.log.Errorf("Error decoding documents: %v", err)
+			return nil, err
+		}
+		forks = append(forks, fc)
+	}
+	return forks, cursor.Err()
+}
+
+func (mcr *MemoryContextRepository) Fork(ctx context.Context, c *entities.Context, from ForkOrigin) (*ForkedContext, error) {
+	err := mcr.collection.insertOne(&ForkedContext{Context: *c, ForkedFrom: &from})
+	if errors.Is(err, errMemDuplicateKey) {
+		return nil, ErrContextExists
+	}
+	if err != nil {
+		mcr.log.Errorf("Error forking context %s: %v", from.ContextID, err)
+		return nil, err
+	}
+	return mcr.GetForkedByID(ctx, c.ID)
+}
+
+func (mcr *MemoryContextRepository) GetForkedByID(ctx context.Context, id string) (*ForkedContext, error) {
+	doc, err := mcr.collection.findOne(notTrashed(bson.M{"_id": id}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextNotFound
+	}
+	fc := &ForkedContext{}
+	if err := fromBsonM(doc, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+func (mcr *MemoryContextRepository) ListForks(ctx context.Context, ids []string) ([]*ForkedContext, error) {
+	docs, err := mcr.collection.find(forksOf(ids), forkSort, 0)
+	if err != nil {
+		return nil, err
+	}
+	forks := make([]*ForkedContext, 0, len(docs))
+	for _, doc := range docs {
+		fc := &ForkedContext{}
+		if err := fromBsonM(doc, fc); err != nil {
+			return nil, err
+		}
+		fc.Content = ""
+		forks = append(forks, fc)
+	}
+	return forks, nil
+}
@@ -5,11 +5,16 @@ import (
 	"errors"
 	"time"
 
+	"github.com/mangudaigb/context-service/internal/encryption"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/context-service/internal/templating"
 	"github.com/mangudaigb/dhauli-base/config"
 	"github.com/mangudaigb/dhauli-base/logger"
 	"github.com/mangudaigb/dhauli-base/types/entities"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
@@ -19,40 +24,94 @@ var (
 
 type ContextHistoryRepository interface {
 	GetByID(ctx context.Context, id string) (*entities.ContextHistory, error)
+	GetByVersion(ctx context.Context, cid string, version int) (*entities.ContextHistory, error)
+	// Create stores a history entry, stamped with the current time unless it
+	// carries its creation time already.
 	Create(ctx context.Context, c *entities.ContextHistory) (*entities.ContextHistory, error)
+	// CreateMany stores the entries of distinct contexts in one round trip.
+	CreateMany(ctx context.Context, chs []*entities.ContextHistory) error
 	Update(ctx context.Context, newContext *entities.ContextHistory) (*entities.ContextHistory, error)
 	Delete(ctx context.Context, id string) error
 	Filter(ctx context.Context, filter interface{}) ([]*entities.ContextHistory, error)
+	ListByContextID(ctx context.Context, cid string, page query.Page) (*ContextHistoryPage, error)
+	DeleteByContextIDs(ctx context.Context, cids []string) (int64, error)
+	DeleteByIDs(ctx context.Context, ids []string) (int64, error)
+	// SetRevertOf records that the version of the history entry was a revert.
+	SetRevertOf(ctx context.Context, id string, of int) error
+	// GetVariables returns the variables version of the context cid declared.
+	GetVariables(ctx context.Context, cid string, version int) ([]templating.Variable, error)
+	// SetVariables records the variables the version of the history entry
+	// declared.
+	SetVariables(ctx context.Context, id string, vars []templating.Variable) error
+	// CreateOnBranch stores ch as a version of the branch of its context.
+	// The versions of a branch are a line of history of their own, which the
+	// other methods reading versions by context leave out.
+	CreateOnBranch(ctx context.Context, branch string, ch *entities.ContextHistory) (*entities.ContextHistory, error)
+	GetBranchVersion(ctx context.Context, cid, branch string, version int) (*entities.ContextHistory, error)
+	ListBranchVersions(ctx context.Context, cid, branch string, page query.Page) (*ContextHistoryPage, error)
+	// DeleteBranch deletes the versions of the branch.
+	DeleteBranch(ctx context.Context, cid, branch string) (int64, error)
+	// ContextIDs lists, in ascending order, up to limit distinct ids of the
+	// contexts having history, starting after the given id.
+	ContextIDs(ctx context.Context, after string, limit int) ([]string, error)
+	// StoredSizes returns the bytes the entries ids take as stored, which is
+	// what deleting them reclaims, by id.
+	StoredSizes(ctx context.Context, ids []string) (map[string]int64, error)
 	Close()
 }
 
+// MongoContextHistoryRepository stores the history content apart from the
+// entries, see encodeHistory. Filters on content are therefore not supported.
+// The content of the blobs is compressed and offloaded as storage says, the
+// entries of the tenants with a key in enc are encrypted.
 type MongoContextHistoryRepository struct {
 	log        *logger.Logger
 	collection *mongo.Collection
+	store      mongoHistoryStore
 }
 
-func NewContextHistoryRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) ContextHistoryRepository {
-	col := client.Database(cfg.Mongo.Database).Collection(collection)
+func NewContextHistoryRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string, storage settings.CollectionStorage, enc *encryption.Encryptor) ContextHistoryRepository {
+	store := newMongoHistoryStore(client.Database(cfg.Mongo.Database), collection, storage, enc)
 	return &MongoContextHistoryRepository{
-		collection: col,
+		collection: store.histories,
 		log:        log,
+		store:      store,
 	}
 }
 
 func (m MongoContextHistoryRepository) GetByID(ctx context.Context, id string) (*entities.ContextHistory, error) {
-	contextHistoryDoc := &entities.ContextHistory{}
-	filter := bson.M{"_id": id}
-	err := m.collection.FindOne(ctx, filter).Decode(&contextHistoryDoc)
-	if errors.Is(err, mongo.ErrNoDocuments) {
+	return m.findOne(ctx, bson.M{"_id": id})
+}
+
+func (m MongoContextHistoryRepository) GetByVersion(ctx context.Context, cid string, version int) (*entities.ContextHistory, error) {
+	return m.findOne(ctx, MainLine(bson.M{"contextId": cid, "version": version}))
+}
+
+func (m MongoContextHistoryRepository) findOne(ctx context.Context, filter bson.M) (*entities.ContextHistory, error) {
+	histories, err := m.find(ctx, filter, false, options.Find().SetLimit(1))
+	if err != nil {
+		return nil, err
+	}
+	if len(histories) == 0 {
 		return nil, ErrContextHistoryNotFound
 	}
-	return contextHistoryDoc, nil
+	return histories[0], nil
 }
 
 func (m MongoContextHistoryRepository) Create(ctx context.Context, ch *entities.ContextHistory) (*entities.ContextHistory, error) {
-	now := time.Now()
-	ch.CreatedTime = now
-	_, err := m.collection.InsertOne(ctx, ch)
+	return m.create(ctx, ch, "")
+}
+
+func (m MongoContextHistoryRepository) create(ctx context.Context, ch *entities.ContextHistory, branch string) (*entities.ContextHistory, error) {
+	if ch.CreatedTime.IsZero() {
+		ch.CreatedTime = time.Now()
+	}
+	doc, err := encodeHistory(ctx, m.store, ch, branch)
+	if err != nil {
+		m.log.Errorf("Error storing the content of context history: %v", err)
+		return nil, err
+	}
+	_, err = m.collection.InsertOne(ctx, doc)
 	if err != nil {
 		m.log.Errorf("Error inserting context history: %v", err)
 		return nil, err
@@ -60,6 +119,27 @@ func (m MongoContextHistoryRepository) Create(ctx context.Context, ch *entities.
 	return ch, nil
 }
 
+func (m MongoContextHistoryRepository) CreateMany(ctx context.Context, chs []*entities.ContextHistory) error {
+	now := time.Now()
+	docs := make([]interface{}, len(chs))
+	for i, ch := range chs {
+		if ch.CreatedTime.IsZero() {
+			ch.CreatedTime = now
+		}
+		doc, err := encodeHistory(ctx, m.store, ch, "")
+		if err != nil {
+			m.log.Errorf("Error storing the content of context history: %v", err)
+			return err
+		}
+		docs[i] = doc
+	}
+	if _, err := m.collection.InsertMany(ctx, docs); err != nil {
+		m.log.Errorf("Error inserting %d context histories: %v", len(chs), err)
+		return err
+	}
+	return nil
+}
+
 func (m MongoContextHistoryRepository) Update(ctx context.Context, newContext *entities.ContextHistory) (*entities.ContextHistory, error) {
 	//TODO implement me
 	panic("no need for this")
@@ -70,8 +150,65 @@ func (m MongoContextHistoryRepository) Delete(ctx context.Context, id string) er
 	panic("no need for this")
 }
 
+func (m MongoContextHistoryRepository) DeleteByContextIDs(ctx context.Context, cids []string) (int64, error) {
+	n, err := deleteHistories(ctx, m.store, bson.M{"contextId": bson.M{"$in": cids}})
+	if err != nil {
+		m.log.Errorf("Error deleting context histories: %v", err)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (m MongoContextHistoryRepository) DeleteByIDs(ctx context.Context, ids []string) (int64, error) {
+	n, err := deleteHistories(ctx, m.store, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		m.log.Errorf("Error deleting context histories: %v", err)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (m MongoContextHistoryRepository) ContextIDs(ctx context.Context, after string, limit int) ([]string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"contextId": bson.M{"$gt": after}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$contextId"}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := m.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		m.log.Errorf("Error listing context ids of the history: %v", err)
+		return nil, err
+	}
+	var groups []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		m.log.Errorf("Error decoding context ids of the history: %v", err)
+		return nil, err
+	}
+	ids := make([]string, 0, len(groups))
+	for _, g := range groups {
+		ids = append(ids, g.ID)
+	}
+	return ids, nil
+}
+
 func (m MongoContextHistoryRepository) Filter(ctx context.Context, filter interface{}) ([]*entities.ContextHistory, error) {
-	cursor, err := m.collection.Find(ctx, filter)
+	return m.find(ctx, filter, false)
+}
+
+func (m MongoContextHistoryRepository) ListByContextID(ctx context.Context, cid string, page query.Page) (*ContextHistoryPage, error) {
+	opts := options.Find().SetSort(pageSort(page)).SetLimit(int64(page.Limit + 1))
+	histories, err := m.find(ctx, pageFilter(MainLine(bson.M{"contextId": cid}), page), page.OmitContent, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newContextHistoryPage(histories, page), nil
+}
+
+func (m MongoContextHistoryRepository) find(ctx context.Context, filter interface{}, omitContent bool, opts ...*options.FindOptions) ([]*entities.ContextHistory, error) {
+	cursor, err := m.collection.Find(ctx, filter, opts...)
 	if err != nil {
 		m.log.Errorf("Error finding documents: %v", err)
 		return nil, err
@@ -81,11 +218,8 @@ func (m MongoContextHistoryRepository) Filter(ctx context.Context, filter interf
 			m.log.Errorf("Error closing context history cursor: %v", closeErr)
 		}
 	}()
-	var contextHistories []*entities.ContextHistory
-	if err = cursor.All(ctx, &contextHistories); err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return []*entities.ContextHistory{}, nil
-		}
+	var docs []bson.M
+	if err = cursor.All(ctx, &docs); err != nil {
 		m.log.Errorf("Error decoding documents: %v", err)
 		return nil, err
 	}
@@ -93,6 +227,11 @@ func (m MongoContextHistoryRepository) Filter(ctx context.Context, filter interf
 		m.log.Errorf("Error iterating cursor: %v", err)
 		return nil, err
 	}
+	contextHistories, err := decodeHistories(ctx, m.store, docs, omitContent)
+	if err != nil {
+		m.log.Errorf("Error reading the content of context histories: %v", err)
+		return nil, err
+	}
 	return contextHistories, nil
 }
 
@@ -103,3 +242,7 @@ func (m MongoContextHistoryRepository) Close() {
 		return
 	}
 }
+
+func (m MongoContextHistoryRepository) StoredSizes(ctx context.Context, ids []string) (map[string]int64, error) {
+	return storedSizes(ctx, m.store, ids)
+}
@@ -0,0 +1,217 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrLabelNotFound = errors.New("label not found")
+
+// Label names a version of a context, prod pointing at the version in
+// production say. The versions labels point at are kept by the retention.
+type Label struct {
+	Name      string            `json:"name" bson:"name"`
+	Version   int               `json:"version" bson:"version"`
+	MovedBy   entities.UserStub `json:"movedBy,omitempty" bson:"movedBy,omitempty"`
+	MovedTime time.Time         `json:"movedTime" bson:"movedTime"`
+}
+
+// LabelMove records a label being set, moved or removed. From is 0 when the
+// label was set, To when it was removed.
+type LabelMove struct {
+	ID        string            `json:"id" bson:"_id"`
+	ContextID string            `json:"contextId" bson:"contextId"`
+	Label     string            `json:"label" bson:"label"`
+	From      int               `json:"from,omitempty" bson:"from,omitempty"`
+	To        int               `json:"to,omitempty" bson:"to,omitempty"`
+	Reason    string            `json:"reason,omitempty" bson:"reason,omitempty"`
+	By        entities.UserStub `json:"by,omitempty" bson:"by,omitempty"`
+	Time      time.Time         `json:"time" bson:"time"`
+}
+
+// Like the branches, the labels of a context are kept on its document by
+// name, which callers must restrict to characters valid in a field path.
+const labelsField = "labels"
+
+func labelPath(name string) string {
+	return labelsField + "." + name
+}
+
+// labelAt matches the context whose label points at version, or which has no
+// such label when version is 0.
+func labelAt(cid, name string, version int) bson.M {
+	if version == 0 {
+		return notTrashed(bson.M{"_id": cid, labelPath(name): bson.M{"$exists": false}})
+	}
+	return notTrashed(bson.M{"_id": cid, labelPath(name) + ".version": version})
+}
+
+type labelsDoc struct {
+	ID     string            `bson:"_id"`
+	Labels map[string]*Label `bson:"labels"`
+}
+
+func sortedLabels(ld labelsDoc) []*Label {
+	labels := make([]*Label, 0, len(ld.Labels))
+	for _, l := range ld.Labels {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+func labelledVersions(docs []labelsDoc) map[string][]int {
+	versions := make(map[string][]int, len(docs))
+	for _, ld := range docs {
+		for _, l := range sortedLabels(ld) {
+			versions[ld.ID] = append(versions[ld.ID], l.Version)
+		}
+	}
+	return versions
+}
+
+func labelMovesOf(cid, name string) bson.M {
+	filter := bson.M{"contextId": cid}
+	if name != "" {
+		filter["label"] = name
+	}
+	return filter
+}
+
+var labelMoveSort = bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}
+
+func (mcr *MongoContextRepository) ListLabels(ctx context.Context, cid string) ([]*Label, error) {
+	var ld labelsDoc
+	opts := options.FindOne().SetProjection(bson.M{labelsField: 1})
+	err := mcr.collection.FindOne(ctx, notTrashed(bson.M{"_id": cid}), opts).Decode(&ld)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextNotFound
+	}
+	if err != nil {
+		mcr.log.Errorf("Error listing the labels of context %s: %v", cid, err)
+		return nil, err
+	}
+	return sortedLabels(ld), nil
+}
+
+func (mcr *MongoContextRepository) MoveLabel(ctx context.Context, cid string, l *Label, from int) error {
+	res, err := mcr.collection.UpdateOne(ctx, labelAt(cid, l.Name, from), bson.M{"$set": bson.M{labelPath(l.Name): l}})
+	if err != nil {
+		mcr.log.Errorf("Error moving label %s of context %s: %v", l.Name, cid, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mcr.contextMiss(ctx, cid, ErrContextVersionMismatch)
+	}
+	return nil
+}
+
+func (mcr *MongoContextRepository) RemoveLabel(ctx context.Context, cid, name string, from int) error {
+	res, err := mcr.collection.UpdateOne(ctx, labelAt(cid, name, from), bson.M{"$unset": bson.M{labelPath(name): ""}})
+	if err != nil {
+		mcr.log.Errorf("Error removing label %s of context %s: %v", name, cid, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mcr.contextMiss(ctx, cid, ErrContextVersionMismatch)
+	}
+	return nil
+}
+
+func (mcr *MongoContextRepository) LabelledVersions(ctx context.Context, ids []string) (map[string][]int, error) {
+	filter := bson.M{"_id": bson.M{"$in": ids}, labelsField: bson.M{"$exists": true}}
+	cursor, err := mcr.collection.Find(ctx, filter, options.Find().SetProjection(bson.M{labelsField: 1}))
+	if err != nil {
+		mcr.log.Errorf("Error listing the labelled versions of %d contexts: %v", len(ids), err)
+		return nil, err
+	}
+	var docs []labelsDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return labelledVersions(docs), nil
+}
+
+func (mcr *MongoContextRepository) AddLabelMove(ctx context.Context, m *LabelMove) error {
+	if _, err := mcr.labelMoves.InsertOne(ctx, m); err != nil {
+		mcr.log.Errorf("Error recording the move of label %s of context %s: %v", m.Label, m.ContextID, err)
+		return err
+	}
+	return nil
+}
+
+func (mcr *MongoContextRepository) ListLabelMoves(ctx context.Context, cid, name string) ([]*LabelMove, error) {
+	cursor, err := mcr.labelMoves.Find(ctx, labelMovesOf(cid, name), options.Find().SetSort(labelMoveSort))
+	if err != nil {
+		mcr.log.Errorf("Error listing the label moves of context %s: %v", cid, err)
+		return nil, err
+	}
+	moves := []*LabelMove{}
+	if err := cursor.All(ctx, &moves); err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
+func (mcr *MemoryContextRepository) ListLabels(ctx context.Context, cid string) ([]*Label, error) {
+	doc, err := mcr.collection.findOne(notTrashed(bson.M{"_id": cid}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextNotFound
+	}
+	var ld labelsDoc
+	if err := fromBsonM(doc, &ld); err != nil {
+		return nil, err
+	}
+	return sortedLabels(ld), nil
+}
+
+func (mcr *MemoryContextRepository) MoveLabel(ctx context.Context, cid string, l *Label, from int) error {
+	return mcr.updateContextField(cid, labelAt(cid, l.Name, from), bson.M{"$set": bson.M{labelPath(l.Name): l}}, ErrContextVersionMismatch)
+}
+
+func (mcr *MemoryContextRepository) RemoveLabel(ctx context.Context, cid, name string, from int) error {
+	return mcr.updateContextField(cid, labelAt(cid, name, from), bson.M{"$unset": bson.M{labelPath(name): ""}}, ErrContextVersionMismatch)
+}
+
+func (mcr *MemoryContextRepository) LabelledVersions(ctx context.Context, ids []string) (map[string][]int, error) {
+	found, err := mcr.collection.find(bson.M{"_id": bson.M{"$in": ids}, labelsField: bson.M{"$exists": true}}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]labelsDoc, len(found))
+	for i, doc := range found {
+		if err := fromBsonM(doc, &docs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return labelledVersions(docs), nil
+}
+
+func (mcr *MemoryContextRepository) AddLabelMove(ctx context.Context, m *LabelMove) error {
+	return mcr.labelMoves.insertOne(m)
+}
+
+func (mcr *MemoryContextRepository) ListLabelMoves(ctx context.Context, cid, name string) ([]*LabelMove, error) {
+	docs, err := mcr.labelMoves.find(labelMovesOf(cid, name), labelMoveSort, 0)
+	if err != nil {
+		return nil, err
+	}
+	moves := make([]*LabelMove, len(docs))
+	for i, doc := range docs {
+		moves[i] = &LabelMove{}
+		if err := fromBsonM(doc, moves[i]); err != nil {
+			return nil, err
+		}
+	}
+	return moves, nil
+}
@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// patchUpdate is the update writing only the given fields of nc, by their
+// bson names. Like contextUpdate, nc must already carry the bumped version and
+// modified time. A field left empty is unset, as the entity omits it.
+func patchUpdate(nc *entities.Context, fields []string) (bson.M, error) {
+	doc, err := toBsonM(nc)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{"version": nc.Version, "modifiedTime": nc.ModifiedTime}
+	unset := bson.M{revertOfField: ""}
+	for _, f := range fields {
+		if v, ok := doc[f]; ok {
+			set[f] = v
+		} else {
+			unset[f] = ""
+		}
+	}
+	return bson.M{"$set": set, "$unset": unset}, nil
+}
+
+// rewritesDocumentFields tells whether a patch of fields changes what the
+// document fields store: the content, the metadata, or the tenant whose key
+// encrypts them.
+func rewritesDocumentFields(fields []string) bool {
+	for _, f := range fields {
+		if f == contentField || f == metadataField || f == "tenant" {
+			return true
+		}
+	}
+	return false
+}
+
+func (mcr *MongoContextRepository) Patch(ctx context.Context, nc *entities.Context, fields []string) (*entities.Context, error) {
+	filter := notTrashed(bson.M{"_id": nc.ID, "version": nc.Version})
+	nc.Version++
+	nc.ModifiedTime = time.Now().UTC()
+	update, err := patchUpdate(nc, fields)
+	if err == nil && rewritesDocumentFields(fields) {
+		var docFields bson.M
+		if docFields, err = mcr.fields(ctx, nc); err == nil {
+			update = withDocumentFields(update, docFields)
+		}
+	}
+	if err != nil {
+		mcr.log.Errorf("Error patching context %s: %v", nc.ID, err)
+		return nil, err
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var patched entities.Context
+	raw, err := mcr.collection.FindOneAndUpdate(ctx, filter, update, opts).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextVersionMismatch
+	}
+	if err == nil {
+		err = mcr.decode(ctx, raw, &patched, &patched)
+	}
+	if err != nil {
+		mcr.log.Errorf("Error patching context %s: %v", nc.ID, err)
+		return nil, err
+	}
+	return &patched, nil
+}
+
+func (mcr *MemoryContextRepository) Patch(ctx context.Context, nc *entities.Context, fields []string) (*entities.Context, error) {
+	filter := notTrashed(bson.M{"_id": nc.ID, "version": nc.Version})
+	nc.Version++
+	nc.ModifiedTime = time.Now().UTC()
+	update, err := patchUpdate(nc, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := mcr.collection.updateOne(filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextVersionMismatch
+	}
+	return decodeContext(doc)
+}
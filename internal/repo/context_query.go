@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// compileContextQuery turns a validated query into a mongo filter document.
+func compileContextQuery(q *query.ContextQuery) bson.M {
+	if q == nil {
+		return bson.M{}
+	}
+	var and bson.A
+	if q.Name != nil {
+		switch q.Name.Match {
+		case query.MatchPrefix:
+			and = append(and, bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(q.Name.Value)}})
+		case query.MatchContains:
+			and = append(and, bson.M{"name": bson.M{"$regex": regexp.QuoteMeta(q.Name.Value), "$options": "i"}})
+		default:
+			and = append(and, bson.M{"name": q.Name.Value})
+		}
+	}
+	if len(q.TagsAny) > 0 {
+		and = append(and, bson.M{"tags": bson.M{"$in": q.TagsAny}})
+	}
+	if len(q.TagsAll) > 0 {
+		and = append(and, bson.M{"tags": bson.M{"$all": q.TagsAll}})
+	}
+	if len(q.TenantIDs) > 0 {
+		and = append(and, bson.M{"tenant._id": bson.M{"$in": q.TenantIDs}})
+	}
+	if len(q.OrganizationIDs) > 0 {
+		and = append(and, bson.M{"organization._id": bson.M{"$in": q.OrganizationIDs}})
+	}
+	if len(q.GroupIDs) > 0 {
+		and = append(and, bson.M{"group._id": bson.M{"$in": q.GroupIDs}})
+	}
+	if q.IsActive != nil {
+		// isActive is omitted from the document when false
+		if *q.IsActive {
+			and = append(and, bson.M{"isActive": true})
+		} else {
+			and = append(and, bson.M{"isActive": bson.M{"$ne": true}})
+		}
+	}
+	if r := compileTimeRange(q.CreatedTime); r != nil {
+		and = append(and, bson.M{"createdTime": r})
+	}
+	if r := compileTimeRange(q.ModifiedTime); r != nil {
+		and = append(and, bson.M{"modifiedTime": r})
+	}
+	for _, mp := range q.Metadata {
+		and = append(and, bson.M{"metadata." + mp.Key: compileMetadataPredicate(mp)})
+	}
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+// MatchContextQuery tells whether c matches q, evaluating the compiled filter
+// the way the memory repositories do.
+func MatchContextQuery(q *query.ContextQuery, c *entities.Context) (bool, error) {
+	doc, err := toBsonM(c)
+	if err != nil {
+		return false, err
+	}
+	filter, err := toBsonM(compileContextQuery(q))
+	if err != nil {
+		return false, err
+	}
+	return matchDoc(doc, filter), nil
+}
+
+func compileTimeRange(tr query.TimeRange) bson.M {
+	if tr.IsZero() {
+		return nil
+	}
+	r := bson.M{}
+	if tr.Gt != nil {
+		r["$gt"] = *tr.Gt
+	}
+	if tr.Gte != nil {
+		r["$gte"] = *tr.Gte
+	}
+	if tr.Lt != nil {
+		r["$lt"] = *tr.Lt
+	}
+	if tr.Lte != nil {
+		r["$lte"] = *tr.Lte
+	}
+	return r
+}
+
+func compileMetadataPredicate(mp query.MetadataPredicate) bson.M {
+	switch mp.Op {
+	case query.MetadataExists:
+		return bson.M{"$exists": len(mp.Values) == 0 || mp.Values[0] != "false"}
+	case query.MetadataIn:
+		var in bson.A
+		for _, v := range mp.Values {
+			in = append(in, metadataEqualCandidates(v)...)
+		}
+		return bson.M{"$in": in}
+	case query.MetadataNe:
+		return bson.M{"$nin": metadataEqualCandidates(mp.Values[0])}
+	case query.MetadataGt, query.MetadataGte, query.MetadataLt, query.MetadataLte:
+		return bson.M{"$" + string(mp.Op): metadataOrderedValue(mp.Values[0])}
+	default:
+		return bson.M{"$in": metadataEqualCandidates(mp.Values[0])}
+	}
+}
+
+// metadataEqualCandidates lists the typed values a query string may stand for,
+// since metadata is schemaless and "3" may have been stored as a number.
+func metadataEqualCandidates(v string) bson.A {
+	out := bson.A{v}
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		out = append(out, n)
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		out = append(out, b)
+	}
+	return out
+}
+
+func metadataOrderedValue(v string) interface{} {
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		return n
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t
+	}
+	return v
+}
@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestQueryContexts(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextRepository(newTestLogger(t))
+	now := time.Now().UTC()
+	for _, c := range []*entities.Context{
+		{ID: "a", Name: "system-base", Tags: []string{"x", "y"}, IsActive: true, CreatedTime: now.Add(-48 * time.Hour),
+			Tenants: []entities.TenantStub{{ID: "t1"}}, Metadata: map[string]interface{}{"kind": "persona", "priority": 3}},
+		{ID: "b", Name: "System Tone", Tags: []string{"y"}, CreatedTime: now,
+			Tenants: []entities.TenantStub{{ID: "t2"}}, Metadata: map[string]interface{}{"priority": "7"}},
+		{ID: "c", Name: "other", IsActive: true, CreatedTime: now, Groups: []entities.GroupStub{{ID: "g1"}}},
+	} {
+		if _, err := r.Create(ctx, c); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	active, inactive := true, false
+	yesterday := now.Add(-24 * time.Hour)
+
+	tests := []struct {
+		name string
+		q    query.ContextQuery
+		want []string
+	}{
+		{"empty", query.ContextQuery{}, []string{"a", "b", "c"}},
+		{"name prefix", query.ContextQuery{Name: &query.NamePredicate{Match: query.MatchPrefix, Value: "system"}}, []string{"a"}},
+		{"name contains", query.ContextQuery{Name: &query.NamePredicate{Match: query.MatchContains, Value: "SYSTEM"}}, []string{"a", "b"}},
+		{"name with regex characters", query.ContextQuery{Name: &query.NamePredicate{Match: query.MatchContains, Value: ".*"}}, nil},
+		{"tags all", query.ContextQuery{TagsAll: []string{"x", "y"}}, []string{"a"}},
+		{"tags any", query.ContextQuery{TagsAny: []string{"y"}}, []string{"a", "b"}},
+		{"tenant", query.ContextQuery{TenantIDs: []string{"t2"}}, []string{"b"}},
+		{"group", query.ContextQuery{GroupIDs: []string{"g1"}}, []string{"c"}},
+		{"active", query.ContextQuery{IsActive: &active}, []string{"a", "c"}},
+		{"inactive", query.ContextQuery{IsActive: &inactive}, []string{"b"}},
+		{"created before", query.ContextQuery{CreatedTime: query.TimeRange{Lt: &yesterday}}, []string{"a"}},
+		{"metadata eq", query.ContextQuery{Metadata: []query.MetadataPredicate{{Key: "kind", Op: query.MetadataEq, Values: []string{"persona"}}}}, []string{"a"}},
+		{"metadata number as string", query.ContextQuery{Metadata: []query.MetadataPredicate{{Key: "priority", Op: query.MetadataEq, Values: []string{"3"}}}}, []string{"a"}},
+		{"metadata gt", query.ContextQuery{Metadata: []query.MetadataPredicate{{Key: "priority", Op: query.MetadataGt, Values: []string{"1"}}}}, []string{"a"}},
+		{"metadata missing", query.ContextQuery{Metadata: []query.MetadataPredicate{{Key: "priority", Op: query.MetadataExists, Values: []string{"false"}}}}, []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := r.Query(ctx, &tt.q, query.Page{Sort: query.SortVersion, Limit: 10})
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			list := page.Items
+			if len(list) != len(tt.want) {
+				t.Fatalf("got %d contexts, want %v", len(list), tt.want)
+			}
+			for i, c := range list {
+				if c.ID != tt.want[i] {
+					t.Fatalf("got %s at %d, want %v", c.ID, i, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -5,6 +5,10 @@ import (
 	"errors"
 	"time"
 
+	"github.com/mangudaigb/context-service/internal/encryption"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/context-service/internal/templating"
 	"github.com/mangudaigb/dhauli-base/config"
 	"github.com/mangudaigb/dhauli-base/logger"
 	"github.com/mangudaigb/dhauli-base/types/entities"
@@ -16,42 +20,174 @@ import (
 var (
 	ErrContextNotFound        = errors.New("context not found")
 	ErrContextVersionMismatch = errors.New("version conflict")
+	ErrContextExists          = errors.New("context already exists")
 )
 
 type ContextRepository interface {
 	GetByID(ctx context.Context, id string) (*entities.Context, error)
 	Create(ctx context.Context, c *entities.Context) (*entities.Context, error)
 	Update(ctx context.Context, newContext *entities.Context) (*entities.Context, error)
+	// Delete removes the context for good, along with its token counts.
 	Delete(ctx context.Context, id string) error
 	Filter(ctx context.Context, filter interface{}) ([]*entities.Context, error)
+	Query(ctx context.Context, q *query.ContextQuery, page query.Page) (*ContextPage, error)
+	Search(ctx context.Context, sq *query.SearchQuery) ([]*SearchHit, error)
+	// CheckFilterable returns ErrEncryptedFilter when the contexts of the
+	// tenants, of every tenant when none is given, may be encrypted, so that
+	// a search or a metadata filter over them would miss them.
+	CheckFilterable(ctx context.Context, tenantIDs []string) error
+	Trash(ctx context.Context, c *entities.Context, by entities.UserStub) (*TrashedContext, error)
+	Restore(ctx context.Context, c *entities.Context) (*entities.Context, error)
+	GetTrashedByID(ctx context.Context, id string) (*TrashedContext, error)
+	ListTrash(ctx context.Context, q *query.ContextQuery, page query.Page) (*TrashPage, error)
+	PurgeTrashed(ctx context.Context, before time.Time, limit int) ([]string, error)
+	// SetRevertOf records that the given version of the context id, its
+	// current one, is a revert of the version of.
+	SetRevertOf(ctx context.Context, id string, version, of int) error
+	GetRevertedByID(ctx context.Context, id string) (*RevertedContext, error)
+	// Fork creates c as a fork of the context version from.
+	Fork(ctx context.Context, c *entities.Context, from ForkOrigin) (*ForkedContext, error)
+	GetForkedByID(ctx context.Context, id string) (*ForkedContext, error)
+	// ListForks returns the contexts forked from any of the ids, oldest
+	// first and without their content.
+	ListForks(ctx context.Context, ids []string) ([]*ForkedContext, error)
+	// ListBranches returns the branches of the context cid by name.
+	ListBranches(ctx context.Context, cid string) ([]*Branch, error)
+	CreateBranch(ctx context.Context, cid string, b *Branch) error
+	// UpdateBranch replaces the branch b as long as its stored head is head.
+	UpdateBranch(ctx context.Context, cid string, b *Branch, head int) error
+	// DeleteBranch removes the branch name of cid and the token counts of its
+	// versions.
+	DeleteBranch(ctx context.Context, cid, name string) error
+	// ListLabels returns the labels of the context cid by name.
+	ListLabels(ctx context.Context, cid string) ([]*Label, error)
+	// MoveLabel sets the label l as long as it points at from, or does not
+	// exist when from is 0.
+	MoveLabel(ctx context.Context, cid string, l *Label, from int) error
+	RemoveLabel(ctx context.Context, cid, name string, from int) error
+	// LabelledVersions returns the versions labelled of each of the contexts
+	// ids which has labels, in the trash or not.
+	LabelledVersions(ctx context.Context, ids []string) (map[string][]int, error)
+	AddLabelMove(ctx context.Context, m *LabelMove) error
+	// ListLabelMoves returns the moves of the label of the context cid, of
+	// every label when name is empty, newest first.
+	ListLabelMoves(ctx context.Context, cid, name string) ([]*LabelMove, error)
+	// GetTokenCounts returns the token counts of tokenizer stored for the
+	// versions of the contexts, by context id. Missing counts are left out.
+	GetTokenCounts(ctx context.Context, tokenizer string, versions map[string]int) (map[string]*TokenCount, error)
+	// GetVersionTokenCounts returns the token counts of tokenizer stored for
+	// versions of cid, of its main line when branch is empty, by version.
+	GetVersionTokenCounts(ctx context.Context, tokenizer, cid, branch string, versions []int) (map[int]*TokenCount, error)
+	PutTokenCounts(ctx context.Context, counts []*TokenCount) error
+	// GetVariables returns the variables the current version of the context
+	// cid declares.
+	GetVariables(ctx context.Context, cid string) (*VersionVariables, error)
+	// SetVariables replaces the variables the context cid declares, when it
+	// is still at version.
+	SetVariables(ctx context.Context, cid string, version int, vars []templating.Variable) error
+	// FindByIDs returns the contexts stored under the ids, in the trash or
+	// not. Missing ids are left out.
+	FindByIDs(ctx context.Context, ids []string) ([]*StoredContext, error)
+	// BulkWrite applies the writes in one round trip, in no particular order,
+	// and returns the error of each write, nil when it applied.
+	BulkWrite(ctx context.Context, writes []ContextWrite) ([]error, error)
+	// Patch writes nc as a new version, changing only the given fields,
+	// named as stored, of the stored context.
+	Patch(ctx context.Context, nc *entities.Context, fields []string) (*entities.Context, error)
+	// SweepContentFiles removes the offloaded content files that no context
+	// or history entry references any more, and returns how many it removed.
+	SweepContentFiles(ctx context.Context) (int, error)
 	Close()
 }
 
+// MongoContextRepository compresses, encrypts and offloads the content to
+// GridFS as its storage settings and the tenant keys of enc say, see
+// contentLayout. Compressed and offloaded content stays searchable through its
+// contentTerms; encrypted content is not searchable. enc may be nil, when no
+// keyring is configured.
 type MongoContextRepository struct {
-	log        *logger.Logger
-	collection *mongo.Collection
+	log         *logger.Logger
+	collection  *mongo.Collection
+	labelMoves  *mongo.Collection
+	tokenCounts *mongo.Collection
+	files       gridFSFiles
+	layout      contentLayout
 }
 
-func NewContextRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string) ContextRepository {
-	col := client.Database(cfg.Mongo.Database).Collection(collection)
+func NewContextRepository(cfg *config.Config, log *logger.Logger, client mongo.Client, collection string, storage settings.CollectionStorage, enc *encryption.Encryptor) ContextRepository {
+	db := client.Database(cfg.Mongo.Database)
+	files := gridFSFiles{db: db}
 	return &MongoContextRepository{
-		collection: col,
-		log:        log,
+		collection:  db.Collection(collection),
+		labelMoves:  db.Collection(LabelMovesCollection),
+		tokenCounts: db.Collection(TokenCountsCollection),
+		log:         log,
+		files:       files,
+		layout:      contentLayout{files: files, storage: storage, enc: enc},
 	}
 }
 
 func (mcr *MongoContextRepository) GetByID(ctx context.Context, id string) (*entities.Context, error) {
 	contextDoc := &entities.Context{}
-	filter := bson.M{"_id": id}
-	err := mcr.collection.FindOne(ctx, filter).Decode(&contextDoc)
+	filter := notTrashed(bson.M{"_id": id})
+	raw, err := mcr.collection.FindOne(ctx, filter).Raw()
 	if errors.Is(err, mongo.ErrNoDocuments) {
 		return nil, ErrContextNotFound
 	}
+	if err == nil {
+		err = mcr.decode(ctx, raw, contextDoc, contextDoc)
+	}
+	if err != nil {
+		mcr.log.Errorf("Error getting context %s: %v", id, err)
+		return nil, err
+	}
 	return contextDoc, nil
 }
 
+// decode unmarshals raw into out and reads the content and metadata stored out
+// of line or encrypted into c, the context embedded in out.
+func (mcr *MongoContextRepository) decode(ctx context.Context, raw bson.Raw, out interface{}, c *entities.Context) error {
+	if err := bson.Unmarshal(raw, out); err != nil {
+		return err
+	}
+	return mcr.layout.openContext(ctx, raw, c)
+}
+
+// fields returns the document fields storing the content and metadata of c.
+func (mcr *MongoContextRepository) fields(ctx context.Context, c *entities.Context) (bson.M, error) {
+	dk, err := mcr.layout.newDataKey(ctx, c.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	return mcr.layout.documentFields(ctx, c.ID, c.Content, c.Metadata, dk)
+}
+
+// document returns the document inserted for c.
+func (mcr *MongoContextRepository) document(ctx context.Context, c *entities.Context) (bson.M, error) {
+	doc, err := toBsonM(c)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := mcr.fields(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range documentFields {
+		delete(doc, f)
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	return doc, nil
+}
+
 func (mcr *MongoContextRepository) Create(ctx context.Context, c *entities.Context) (*entities.Context, error) {
-	_, err := mcr.collection.InsertOne(ctx, c)
+	doc, err := mcr.document(ctx, c)
+	if err != nil {
+		mcr.log.Errorf("Error inserting context: %v", err)
+		return nil, err
+	}
+	_, err = mcr.collection.InsertOne(ctx, doc)
 	if err != nil {
 		mcr.log.Errorf("Error inserting context: %v", err)
 		return nil, err
@@ -60,39 +196,62 @@ func (mcr *MongoContextRepository) Create(ctx context.Context, c *entities.Conte
 }
 
 func (mcr *MongoContextRepository) Update(ctx context.Context, nc *entities.Context) (*entities.Context, error) {
-	filter := bson.M{
+	filter := notTrashed(bson.M{
 		"_id":     nc.ID,
 		"version": nc.Version,
-	}
+	})
 	nc.Version++
 	nc.ModifiedTime = time.Now().UTC()
-	update := bson.M{
-		"$set": bson.M{
-			"name":          nc.Name,
-			"description":   nc.Description,
-			"content":       nc.Content,
-			"organizations": nc.Organizations,
-			"tenants":       nc.Tenants,
-			"groups":        nc.Groups,
-			"user":          nc.User,
-			"modifiedTime":  nc.ModifiedTime,
-			"isActive":      nc.IsActive,
-			"version":       nc.Version,
-			"tags":          nc.Tags,
-			"metadata":      nc.Metadata,
-		},
+	fields, err := mcr.fields(ctx, nc)
+	if err != nil {
+		mcr.log.Errorf("Error updating context in mongo: %v", err)
+		return nil, err
 	}
+	update := withDocumentFields(contextUpdate(nc), fields)
 
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 	var updatedContext entities.Context
-	err := mcr.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedContext)
+	raw, err := mcr.collection.FindOneAndUpdate(ctx, filter, update, opts).Raw()
 	if errors.Is(err, mongo.ErrNoDocuments) {
 		mcr.log.Errorf("Error updating context in mongo: %v", err)
 		return nil, ErrContextVersionMismatch
 	}
+	if err == nil {
+		err = mcr.decode(ctx, raw, &updatedContext, &updatedContext)
+	}
+	if err != nil {
+		mcr.log.Errorf("Error updating context in mongo: %v", err)
+		return nil, err
+	}
 	return &updatedContext, nil
 }
 
+// contextUpdate builds the update document written by a version-checked update.
+// nc must already carry the bumped version and modified time.
+func contextUpdate(nc *entities.Context) bson.M {
+	unset := bson.M{revertOfField: ""}
+	for legacy := range legacyAccessFields {
+		unset[legacy] = ""
+	}
+	return bson.M{
+		"$set": bson.M{
+			"name":         nc.Name,
+			"description":  nc.Description,
+			"content":      nc.Content,
+			"organization": nc.Organizations,
+			"tenant":       nc.Tenants,
+			"group":        nc.Groups,
+			"user":         nc.User,
+			"modifiedTime": nc.ModifiedTime,
+			"isActive":     nc.IsActive,
+			"version":      nc.Version,
+			"tags":         nc.Tags,
+			"metadata":     nc.Metadata,
+		},
+		"$unset": unset,
+	}
+}
+
 func (mcr *MongoContextRepository) Delete(ctx context.Context, id string) error {
 	res, err := mcr.collection.DeleteOne(ctx, bson.M{"_id": id})
 	if err != nil {
@@ -101,11 +260,24 @@ func (mcr *MongoContextRepository) Delete(ctx context.Context, id string) error
 	if res.DeletedCount == 0 {
 		return ErrContextNotFound
 	}
+	if _, err := mcr.tokenCounts.DeleteMany(ctx, bson.M{"contextId": id}); err != nil {
+		mcr.log.Errorf("Error deleting the token counts of context %s: %v", id, err)
+		return err
+	}
 	return nil
 }
 
 func (mcr *MongoContextRepository) Filter(ctx context.Context, filter interface{}) ([]*entities.Context, error) {
-	cursor, err := mcr.collection.Find(ctx, filter)
+	return mcr.find(ctx, filter, false)
+}
+
+// find returns the contexts matching filter, without their content when
+// omitContent is set.
+func (mcr *MongoContextRepository) find(ctx context.Context, filter interface{}, omitContent bool, opts ...*options.FindOptions) ([]*entities.Context, error) {
+	if omitContent {
+		opts = append(opts, options.Find().SetProjection(omitContentProjection()))
+	}
+	cursor, err := mcr.collection.Find(ctx, filter, opts...)
 	if err != nil {
 		mcr.log.Errorf("Error finding documents: %v", err)
 		return nil, err
@@ -116,8 +288,8 @@ func (mcr *MongoContextRepository) Filter(ctx context.Context, filter interface{
 		}
 	}()
 
-	var contexts []*entities.Context
-	if err = cursor.All(ctx, &contexts); err != nil {
+	var raws []bson.Raw
+	if err = cursor.All(ctx, &raws); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return []*entities.Context{}, nil
 		}
@@ -129,9 +301,39 @@ func (mcr *MongoContextRepository) Filter(ctx context.Context, filter interface{
 		return nil, err
 	}
 
+	var contexts []*entities.Context
+	for _, raw := range raws {
+		c := &entities.Context{}
+		if err := mcr.decode(ctx, raw, c, c); err != nil {
+			mcr.log.Errorf("Error decoding documents: %v", err)
+			return nil, err
+		}
+		contexts = append(contexts, c)
+	}
 	return contexts, nil
 }
 
+func (mcr *MongoContextRepository) Query(ctx context.Context, q *query.ContextQuery, page query.Page) (*ContextPage, error) {
+	opts := options.Find().SetSort(pageSort(page)).SetLimit(int64(page.Limit + 1))
+	contexts, err := mcr.find(ctx, pageFilter(notTrashed(compileContextQuery(q)), page), page.OmitContent, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newContextPage(contexts, page), nil
+}
+
+func (mcr *MongoContextRepository) CheckFilterable(ctx context.Context, tenantIDs []string) error {
+	return mcr.layout.checkFilterable(ctx, tenantIDs)
+}
+
+func (mcr *MongoContextRepository) SweepContentFiles(ctx context.Context) (int, error) {
+	n, err := mcr.files.sweep(ctx)
+	if err != nil {
+		mcr.log.Errorf("Error sweeping the content files: %v", err)
+	}
+	return n, err
+}
+
 func (mcr *MongoContextRepository) Close() {
 	err := mcr.collection.Database().Client().Disconnect(context.Background())
 	if err != nil {
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/context-service/internal/templating"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RevertedContext is a context together with its revert marker. RevertOf is
+// the version the current version was reverted to, zero when the current
+// version is not a revert. Any later change of the context clears it, the
+// history entry of the reverted version keeps it. Variables are the variables
+// the version declares.
+type RevertedContext struct {
+	entities.Context `bson:",inline"`
+	RevertOf         int                   `json:"revertOf,omitempty" bson:"revertOf,omitempty"`
+	Variables        []templating.Variable `json:"-" bson:"variables,omitempty"`
+}
+
+const revertOfField = "revertOf"
+
+func (mcr *MongoContextRepository) SetRevertOf(ctx context.Context, id string, version, of int) error {
+	filter := notTrashed(bson.M{"_id": id, "version": version})
+	res, err := mcr.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{revertOfField: of}})
+	if err != nil {
+		mcr.log.Errorf("Error marking context %s as a revert: %v", id, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrContextVersionMismatch
+	}
+	return nil
+}
+
+func (mcr *MongoContextRepository) GetRevertedByID(ctx context.Context, id string) (*RevertedContext, error) {
+	var rc RevertedContext
+	raw, err := mcr.collection.FindOne(ctx, notTrashed(bson.M{"_id": id})).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextNotFound
+	}
+	if err == nil {
+		err = mcr.decode(ctx, raw, &rc, &rc.Context)
+	}
+	if err != nil {
+		mcr.log.Errorf("Error getting context %s: %v", id, err)
+		return nil, err
+	}
+	return &rc, nil
+}
+
+func (mcr *MemoryContextRepository) SetRevertOf(ctx context.Context, id string, version, of int) error {
+	doc, err := mcr.collection.updateOne(notTrashed(bson.M{"_id": id, "version": version}), bson.M{"$set": bson.M{revertOfField: of}})
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrContextVersionMismatch
+	}
+	return nil
+}
+
+func (mcr *MemoryContextRepository) GetRevertedByID(ctx context.Context, id string) (*RevertedContext, error) {
+	doc, err := mcr.collection.findOne(notTrashed(bson.M{"_id": id}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextNotFound
+	}
+	return decodeRevertedContext(doc)
+}
+
+func decodeRevertedContext(doc bson.M) (*RevertedContext, error) {
+	rc := &RevertedContext{}
+	if err := fromBsonM(doc, rc); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (m MongoContextHistoryRepository) SetRevertOf(ctx context.Context, id string, of int) error {
+	res, err := m.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{revertOfField: of}})
+	if err != nil {
+		m.log.Errorf("Error marking context history %s as a revert: %v", id, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrContextHistoryNotFound
+	}
+	return nil
+}
+
+func (m *MemoryContextHistoryRepository) SetRevertOf(ctx context.Context, id string, of int) error {
+	doc, err := m.collection.updateOne(bson.M{"_id": id}, bson.M{"$set": bson.M{revertOfField: of}})
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrContextHistoryNotFound
+	}
+	return nil
+}
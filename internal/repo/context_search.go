@@ -0,0 +1,153 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SearchIndexName is the name of the text index on the contexts collection.
+const SearchIndexName = "contexts_text"
+
+// searchWeights are the weights of the text index. The in-memory repository
+// scores its matches with the same weights. contentTerms stands in for the
+// content when it is not stored inline; since it holds each word once, a word
+// repeated in such content scores as if it occurred once.
+var searchWeights = bson.D{
+	{Key: "name", Value: 10},
+	{Key: "tags", Value: 5},
+	{Key: "description", Value: 3},
+	{Key: contentField, Value: 1},
+	{Key: contentTermsField, Value: 1},
+}
+
+type SearchHit struct {
+	Context *entities.Context
+	Score   float64
+}
+
+type scoredContext struct {
+	entities.Context `bson:",inline"`
+	Score            float64 `bson:"score"`
+}
+
+// SearchIndex is the text index backing Search on the contexts collection.
+func SearchIndex() mongo.IndexModel {
+	keys := bson.D{}
+	weights := bson.M{}
+	for _, w := range searchWeights {
+		keys = append(keys, bson.E{Key: w.Key, Value: "text"})
+		weights[w.Key] = w.Value
+	}
+	return mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetName(SearchIndexName).SetWeights(weights),
+	}
+}
+
+func searchTenantFilter(sq *query.SearchQuery) bson.M {
+	if len(sq.TenantIDs) == 0 {
+		return notTrashed(bson.M{})
+	}
+	return notTrashed(bson.M{"tenant._id": bson.M{"$in": sq.TenantIDs}})
+}
+
+func (mcr *MongoContextRepository) Search(ctx context.Context, sq *query.SearchQuery) ([]*SearchHit, error) {
+	filter := searchTenantFilter(sq)
+	filter["$text"] = bson.M{"$search": sq.Text}
+	opts := options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}}).
+		SetLimit(int64(sq.Limit))
+
+	cursor, err := mcr.collection.Find(ctx, filter, opts)
+	if err != nil {
+		mcr.log.Errorf("Error searching contexts: %v", err)
+		return nil, err
+	}
+	defer func() {
+		if closeErr := cursor.Close(ctx); closeErr != nil {
+			mcr.log.Errorf("Error closing context search cursor: %v", closeErr)
+		}
+	}()
+
+	var raws []bson.Raw
+	if err = cursor.All(ctx, &raws); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		mcr.log.Errorf("Error decoding search results: %v", err)
+		return nil, err
+	}
+	hits := make([]*SearchHit, 0, len(raws))
+	for _, raw := range raws {
+		d := &scoredContext{}
+		if err := mcr.decode(ctx, raw, d, &d.Context); err != nil {
+			mcr.log.Errorf("Error decoding search results: %v", err)
+			return nil, err
+		}
+		hits = append(hits, &SearchHit{Context: &d.Context, Score: d.Score})
+	}
+	return hits, nil
+}
+
+func (mcr *MemoryContextRepository) Search(ctx context.Context, sq *query.SearchQuery) ([]*SearchHit, error) {
+	docs, err := mcr.collection.find(searchTenantFilter(sq), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	terms := query.SearchTerms(sq.Text)
+	var hits []*SearchHit
+	for _, doc := range docs {
+		score := memoryTextScore(doc, terms)
+		if score == 0 {
+			continue
+		}
+		c, err := decodeContext(doc)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, &SearchHit{Context: c, Score: score})
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	if len(hits) > sq.Limit {
+		hits = hits[:sq.Limit]
+	}
+	return hits, nil
+}
+
+// memoryTextScore approximates the text index score of a stored document: the
+// weighted number of times the terms occur as whole words in each indexed
+// field.
+func memoryTextScore(doc bson.M, terms []string) float64 {
+	var score float64
+	for _, w := range searchWeights {
+		var text []string
+		switch v := doc[w.Key].(type) {
+		case string:
+			text = append(text, v)
+		case bson.A:
+			for _, el := range v {
+				if s, ok := el.(string); ok {
+					text = append(text, s)
+				}
+			}
+		}
+		words := query.SearchTerms(strings.Join(text, " "))
+		weight := float64(w.Value.(int))
+		for _, term := range terms {
+			for _, word := range words {
+				if word == term {
+					score += weight
+				}
+			}
+		}
+	}
+	return score
+}
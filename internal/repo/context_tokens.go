@@ -0,0 +1,172 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TokenCount is the size of the content of a version of a context in the
+// tokens of Tokenizer. The counts are kept apart from the contexts and their
+// histories, one per version and tokenizer, those of the versions of a branch
+// apart from those of the main line, until the context, or the branch, is
+// deleted.
+type TokenCount struct {
+	ID        string `json:"-" bson:"_id"`
+	ContextID string `json:"-" bson:"contextId"`
+	Branch    string `json:"-" bson:"branch,omitempty"`
+	Version   int    `json:"-" bson:"version"`
+	Tokenizer string `json:"tokenizer" bson:"tokenizer"`
+	Tokens    int    `json:"tokens" bson:"tokens"`
+}
+
+// tokenCountID names the count of a version of the main line of cid when
+// branch is empty, of a version of the branch otherwise, whose versions
+// number on from the main line.
+func tokenCountID(cid, branch string, version int, tokenizer string) string {
+	if branch == "" {
+		return fmt.Sprintf("%s@%d@%s", cid, version, tokenizer)
+	}
+	return fmt.Sprintf("%s@%s@%d@%s", cid, branch, version, tokenizer)
+}
+
+// NewTokenCount returns the count of tokens of the version of cid, of its
+// branch when branch is set.
+func NewTokenCount(cid, branch string, version int, tokenizer string, tokens int) *TokenCount {
+	return &TokenCount{ID: tokenCountID(cid, branch, version, tokenizer), ContextID: cid, Branch: branch, Version: version, Tokenizer: tokenizer, Tokens: tokens}
+}
+
+func tokenCountsOf(tokenizer string, versions map[string]int) bson.M {
+	ids := make([]string, 0, len(versions))
+	for cid, v := range versions {
+		ids = append(ids, tokenCountID(cid, "", v, tokenizer))
+	}
+	return bson.M{"_id": bson.M{"$in": ids}}
+}
+
+func versionTokenCountsOf(tokenizer, cid, branch string, versions []int) bson.M {
+	ids := make([]string, 0, len(versions))
+	for _, v := range versions {
+		ids = append(ids, tokenCountID(cid, branch, v, tokenizer))
+	}
+	return bson.M{"_id": bson.M{"$in": ids}}
+}
+
+func tokenCountsByVersion(counts []*TokenCount) map[int]*TokenCount {
+	byVersion := make(map[int]*TokenCount, len(counts))
+	for _, tc := range counts {
+		byVersion[tc.Version] = tc
+	}
+	return byVersion
+}
+
+// branchTokenCounts are the counts of the versions of a branch.
+func branchTokenCounts(cid, branch string) bson.M {
+	return bson.M{"contextId": cid, "branch": branch}
+}
+
+func tokenCountsByContext(counts []*TokenCount) map[string]*TokenCount {
+	byContext := make(map[string]*TokenCount, len(counts))
+	for _, tc := range counts {
+		byContext[tc.ContextID] = tc
+	}
+	return byContext
+}
+
+func (mcr *MongoContextRepository) GetTokenCounts(ctx context.Context, tokenizer string, versions map[string]int) (map[string]*TokenCount, error) {
+	if len(versions) == 0 {
+		return map[string]*TokenCount{}, nil
+	}
+	cursor, err := mcr.tokenCounts.Find(ctx, tokenCountsOf(tokenizer, versions))
+	if err != nil {
+		mcr.log.Errorf("Error getting token counts: %v", err)
+		return nil, err
+	}
+	var counts []*TokenCount
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return tokenCountsByContext(counts), nil
+}
+
+func (mcr *MongoContextRepository) GetVersionTokenCounts(ctx context.Context, tokenizer, cid, branch string, versions []int) (map[int]*TokenCount, error) {
+	if len(versions) == 0 {
+		return map[int]*TokenCount{}, nil
+	}
+	cursor, err := mcr.tokenCounts.Find(ctx, versionTokenCountsOf(tokenizer, cid, branch, versions))
+	if err != nil {
+		mcr.log.Errorf("Error getting the token counts of context %s: %v", cid, err)
+		return nil, err
+	}
+	var counts []*TokenCount
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, err
+	}
+	return tokenCountsByVersion(counts), nil
+}
+
+func (mcr *MongoContextRepository) PutTokenCounts(ctx context.Context, counts []*TokenCount) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(counts))
+	for i, tc := range counts {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": tc.ID}).SetReplacement(tc).SetUpsert(true)
+	}
+	if _, err := mcr.tokenCounts.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		mcr.log.Errorf("Error putting token counts: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (mcr *MemoryContextRepository) GetTokenCounts(ctx context.Context, tokenizer string, versions map[string]int) (map[string]*TokenCount, error) {
+	if len(versions) == 0 {
+		return map[string]*TokenCount{}, nil
+	}
+	counts, err := mcr.findTokenCounts(tokenCountsOf(tokenizer, versions))
+	if err != nil {
+		return nil, err
+	}
+	return tokenCountsByContext(counts), nil
+}
+
+func (mcr *MemoryContextRepository) GetVersionTokenCounts(ctx context.Context, tokenizer, cid, branch string, versions []int) (map[int]*TokenCount, error) {
+	if len(versions) == 0 {
+		return map[int]*TokenCount{}, nil
+	}
+	counts, err := mcr.findTokenCounts(versionTokenCountsOf(tokenizer, cid, branch, versions))
+	if err != nil {
+		return nil, err
+	}
+	return tokenCountsByVersion(counts), nil
+}
+
+func (mcr *MemoryContextRepository) findTokenCounts(filter bson.M) ([]*TokenCount, error) {
+	docs, err := mcr.tokenCounts.find(filter, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]*TokenCount, 0, len(docs))
+	for _, doc := range docs {
+		tc := &TokenCount{}
+		if err := fromBsonM(doc, tc); err != nil {
+			return nil, err
+		}
+		counts = append(counts, tc)
+	}
+	return counts, nil
+}
+
+func (mcr *MemoryContextRepository) PutTokenCounts(ctx context.Context, counts []*TokenCount) error {
+	for _, tc := range counts {
+		mcr.tokenCounts.deleteOne(tc.ID)
+		if err := mcr.tokenCounts.insertOne(tc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
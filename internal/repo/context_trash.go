@@ -0,0 +1,280 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/templating"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TrashedContext is a context in the trash. Trashed contexts are hidden from
+// every other read and cannot be updated until they are restored. Variables
+// are the variables the trashed version declares.
+type TrashedContext struct {
+	entities.Context `bson:",inline"`
+	DeletedAt        time.Time             `json:"deletedAt" bson:"deletedAt"`
+	DeletedBy        entities.UserStub     `json:"deletedBy,omitempty" bson:"deletedBy,omitempty"`
+	Variables        []templating.Variable `json:"-" bson:"variables,omitempty"`
+}
+
+type TrashPage struct {
+	Items      []*TrashedContext `json:"items"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+// notTrashed restricts filter to the contexts that are not in the trash.
+func notTrashed(filter bson.M) bson.M {
+	filter["deletedAt"] = bson.M{"$exists": false}
+	return filter
+}
+
+func trashed(filter bson.M) bson.M {
+	filter["deletedAt"] = bson.M{"$exists": true}
+	return filter
+}
+
+// trashUpdate moves c to the trash. Like contextUpdate, c must already carry
+// the bumped version and modified time.
+func trashUpdate(c *entities.Context, deletedAt time.Time, by entities.UserStub) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"isActive":     false,
+			"version":      c.Version,
+			"modifiedTime": c.ModifiedTime,
+			"deletedAt":    deletedAt,
+			"deletedBy":    by,
+		},
+		"$unset": bson.M{revertOfField: ""},
+	}
+}
+
+func restoreUpdate(c *entities.Context) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"isActive":     true,
+			"version":      c.Version,
+			"modifiedTime": c.ModifiedTime,
+		},
+		"$unset": bson.M{
+			"deletedAt":   "",
+			"deletedBy":   "",
+			revertOfField: "",
+		},
+	}
+}
+
+func newTrashPage(items []*TrashedContext, p query.Page) *TrashPage {
+	page := &TrashPage{}
+	page.Items, page.NextCursor = trimPage(items, p, func(tc *TrashedContext) (interface{}, string) {
+		if p.Sort == query.SortName {
+			return tc.Name, tc.ID
+		}
+		return tc.DeletedAt, tc.ID
+	})
+	return page
+}
+
+func (mcr *MongoContextRepository) Trash(ctx context.Context, c *entities.Context, by entities.UserStub) (*TrashedContext, error) {
+	filter := notTrashed(bson.M{"_id": c.ID, "version": c.Version})
+	c.Version++
+	c.ModifiedTime = time.Now().UTC()
+	return mcr.findOneAndUpdateTrash(ctx, filter, trashUpdate(c, c.ModifiedTime, by))
+}
+
+func (mcr *MongoContextRepository) Restore(ctx context.Context, c *entities.Context) (*entities.Context, error) {
+	filter := trashed(bson.M{"_id": c.ID, "version": c.Version})
+	c.Version++
+	c.ModifiedTime = time.Now().UTC()
+	tc, err := mcr.findOneAndUpdateTrash(ctx, filter, restoreUpdate(c))
+	if err != nil {
+		return nil, err
+	}
+	return &tc.Context, nil
+}
+
+func (mcr *MongoContextRepository) findOneAndUpdateTrash(ctx context.Context, filter, update bson.M) (*TrashedContext, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var tc TrashedContext
+	raw, err := mcr.collection.FindOneAndUpdate(ctx, filter, update, opts).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextVersionMismatch
+	}
+	if err == nil {
+		err = mcr.decode(ctx, raw, &tc, &tc.Context)
+	}
+	if err != nil {
+		mcr.log.Errorf("Error updating the trash state of context %v: %v", filter["_id"], err)
+		return nil, err
+	}
+	return &tc, nil
+}
+
+func (mcr *MongoContextRepository) GetTrashedByID(ctx context.Context, id string) (*TrashedContext, error) {
+	var tc TrashedContext
+	raw, err := mcr.collection.FindOne(ctx, trashed(bson.M{"_id": id})).Raw()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextNotFound
+	}
+	if err == nil {
+		err = mcr.decode(ctx, raw, &tc, &tc.Context)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tc, nil
+}
+
+func (mcr *MongoContextRepository) ListTrash(ctx context.Context, q *query.ContextQuery, page query.Page) (*TrashPage, error) {
+	opts := options.Find().SetSort(pageSort(page)).SetLimit(int64(page.Limit + 1))
+	if page.OmitContent {
+		opts.SetProjection(omitContentProjection())
+	}
+	cursor, err := mcr.collection.Find(ctx, pageFilter(trashed(compileContextQuery(q)), page), opts)
+	if err != nil {
+		mcr.log.Errorf("Error listing trashed contexts: %v", err)
+		return nil, err
+	}
+	var raws []bson.Raw
+	if err := cursor.All(ctx, &raws); err != nil {
+		mcr.log.Errorf("Error decoding trashed contexts: %v", err)
+		return nil, err
+	}
+	items := make([]*TrashedContext, 0, len(raws))
+	for _, raw := range raws {
+		tc := &TrashedContext{}
+		if err := mcr.decode(ctx, raw, tc, &tc.Context); err != nil {
+			mcr.log.Errorf("Error decoding trashed contexts: %v", err)
+			return nil, err
+		}
+		items = append(items, tc)
+	}
+	return newTrashPage(items, page), nil
+}
+
+func (mcr *MongoContextRepository) PurgeTrashed(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	filter := bson.M{"deletedAt": bson.M{"$lt": before}}
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1}).
+		SetSort(bson.D{{Key: "deletedAt", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := mcr.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	filter["_id"] = bson.M{"$in": ids}
+	if _, err := mcr.collection.DeleteMany(ctx, filter); err != nil {
+		mcr.log.Errorf("Error purging trashed contexts: %v", err)
+		return nil, err
+	}
+	if _, err := mcr.tokenCounts.DeleteMany(ctx, bson.M{"contextId": bson.M{"$in": ids}}); err != nil {
+		mcr.log.Errorf("Error purging the token counts of trashed contexts: %v", err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (mcr *MemoryContextRepository) Trash(ctx context.Context, c *entities.Context, by entities.UserStub) (*TrashedContext, error) {
+	filter := notTrashed(bson.M{"_id": c.ID, "version": c.Version})
+	c.Version++
+	c.ModifiedTime = time.Now().UTC()
+	return mcr.updateTrash(filter, trashUpdate(c, c.ModifiedTime, by))
+}
+
+func (mcr *MemoryContextRepository) Restore(ctx context.Context, c *entities.Context) (*entities.Context, error) {
+	filter := trashed(bson.M{"_id": c.ID, "version": c.Version})
+	c.Version++
+	c.ModifiedTime = time.Now().UTC()
+	tc, err := mcr.updateTrash(filter, restoreUpdate(c))
+	if err != nil {
+		return nil, err
+	}
+	return &tc.Context, nil
+}
+
+func (mcr *MemoryContextRepository) updateTrash(filter, update bson.M) (*TrashedContext, error) {
+	doc, err := mcr.collection.updateOne(filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextVersionMismatch
+	}
+	return decodeTrashedContext(doc)
+}
+
+func (mcr *MemoryContextRepository) GetTrashedByID(ctx context.Context, id string) (*TrashedContext, error) {
+	doc, err := mcr.collection.findOne(trashed(bson.M{"_id": id}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextNotFound
+	}
+	return decodeTrashedContext(doc)
+}
+
+func (mcr *MemoryContextRepository) ListTrash(ctx context.Context, q *query.ContextQuery, page query.Page) (*TrashPage, error) {
+	docs, err := mcr.collection.find(pageFilter(trashed(compileContextQuery(q)), page), pageSort(page), page.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*TrashedContext, 0, len(docs))
+	for _, doc := range docs {
+		tc, err := decodeTrashedContext(doc)
+		if err != nil {
+			return nil, err
+		}
+		if page.OmitContent {
+			tc.Content = ""
+		}
+		items = append(items, tc)
+	}
+	return newTrashPage(items, page), nil
+}
+
+func (mcr *MemoryContextRepository) PurgeTrashed(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	filter := bson.M{"deletedAt": bson.M{"$lt": before}}
+	docs, err := mcr.collection.find(filter, bson.D{{Key: "deletedAt", Value: 1}}, limit)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	ids := make([]string, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d["_id"].(string))
+	}
+	filter["_id"] = bson.M{"$in": ids}
+	if _, err := mcr.collection.deleteMany(filter); err != nil {
+		return nil, err
+	}
+	if _, err := mcr.tokenCounts.deleteMany(bson.M{"contextId": bson.M{"$in": ids}}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func decodeTrashedContext(doc bson.M) (*TrashedContext, error) {
+	tc := &TrashedContext{}
+	if err := fromBsonM(doc, tc); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,163 @@
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/context-service/internal/templating"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The variables the content of a context declares belong to its versions.
+// The current declarations are kept on the context document and carried over
+// by the updates that leave them alone; the history entry of a version keeps
+// those it was written with.
+const variablesField = "variables"
+
+// VersionVariables are the variables a version of a context declares.
+type VersionVariables struct {
+	Version   int                   `json:"version" bson:"version"`
+	Variables []templating.Variable `json:"variables" bson:"variables"`
+}
+
+func variablesUpdate(vars []templating.Variable) bson.M {
+	if len(vars) == 0 {
+		return bson.M{"$unset": bson.M{variablesField: ""}}
+	}
+	return bson.M{"$set": bson.M{variablesField: vars}}
+}
+
+func (mcr *MongoContextRepository) GetVariables(ctx context.Context, cid string) (*VersionVariables, error) {
+	var vv VersionVariables
+	opts := options.FindOne().SetProjection(bson.M{variablesField: 1, "version": 1})
+	err := mcr.collection.FindOne(ctx, notTrashed(bson.M{"_id": cid}), opts).Decode(&vv)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextNotFound
+	}
+	if err != nil {
+		mcr.log.Errorf("Error getting the variables of context %s: %v", cid, err)
+		return nil, err
+	}
+	return &vv, nil
+}
+
+func (mcr *MongoContextRepository) SetVariables(ctx context.Context, cid string, version int, vars []templating.Variable) error {
+	filter := notTrashed(bson.M{"_id": cid, "version": version})
+	res, err := mcr.collection.UpdateOne(ctx, filter, variablesUpdate(vars))
+	if err != nil {
+		mcr.log.Errorf("Error setting the variables of context %s: %v", cid, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrContextVersionMismatch
+	}
+	return nil
+}
+
+func (mcr *MemoryContextRepository) GetVariables(ctx context.Context, cid string) (*VersionVariables, error) {
+	doc, err := mcr.collection.findOne(notTrashed(bson.M{"_id": cid}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextNotFound
+	}
+	var vv VersionVariables
+	if err := fromBsonM(doc, &vv); err != nil {
+		return nil, err
+	}
+	return &vv, nil
+}
+
+func (mcr *MemoryContextRepository) SetVariables(ctx context.Context, cid string, version int, vars []templating.Variable) error {
+	filter := notTrashed(bson.M{"_id": cid, "version": version})
+	return mcr.updateContextField(cid, filter, variablesUpdate(vars), ErrContextVersionMismatch)
+}
+
+func (m MongoContextHistoryRepository) GetVariables(ctx context.Context, cid string, version int) ([]templating.Variable, error) {
+	var vv VersionVariables
+	opts := options.FindOne().SetProjection(bson.M{variablesField: 1, "version": 1})
+	err := m.collection.FindOne(ctx, MainLine(bson.M{"contextId": cid, "version": version}), opts).Decode(&vv)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrContextHistoryNotFound
+	}
+	if err != nil {
+		m.log.Errorf("Error getting the variables of version %d of context %s: %v", version, cid, err)
+		return nil, err
+	}
+	return vv.Variables, nil
+}
+
+func (m MongoContextHistoryRepository) SetVariables(ctx context.Context, id string, vars []templating.Variable) error {
+	res, err := m.collection.UpdateOne(ctx, bson.M{"_id": id}, variablesUpdate(vars))
+	if err != nil {
+		m.log.Errorf("Error setting the variables of context history %s: %v", id, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrContextHistoryNotFound
+	}
+	return nil
+}
+
+func (m *MemoryContextHistoryRepository) GetVariables(ctx context.Context, cid string, version int) ([]templating.Variable, error) {
+	doc, err := m.collection.findOne(MainLine(bson.M{"contextId": cid, "version": version}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextHistoryNotFound
+	}
+	var vv VersionVariables
+	if err := fromBsonM(doc, &vv); err != nil {
+		return nil, err
+	}
+	return vv.Variables, nil
+}
+
+func (m *MemoryContextHistoryRepository) SetVariables(ctx context.Context, id string, vars []templating.Variable) error {
+	doc, err := m.collection.updateOne(bson.M{"_id": id}, variablesUpdate(vars))
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrContextHistoryNotFound
+	}
+	return nil
+}
+
+// declaringContexts matches the contexts declaring variables.
+var declaringContexts = bson.M{variablesField: bson.M{"$exists": true}}
+
+// BackfillHistoryVariables gives the history entries of the contexts declaring
+// variables, recorded before the declarations were versioned, the current
+// declarations of their context, which they rendered with until then.
+func BackfillHistoryVariables(ctx context.Context, db *mongo.Database) error {
+	opts := options.Find().SetProjection(bson.M{variablesField: 1})
+	cursor, err := db.Collection(ContextsCollection).Find(ctx, declaringContexts, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	histories := db.Collection(ContextHistoriesCollection)
+	for cursor.Next(ctx) {
+		var c struct {
+			ID        string                `bson:"_id"`
+			Variables []templating.Variable `bson:"variables"`
+		}
+		if err := cursor.Decode(&c); err != nil {
+			return err
+		}
+		filter := bson.M{"contextId": c.ID, variablesField: bson.M{"$exists": false}}
+		if _, err := histories.UpdateMany(ctx, filter, bson.M{"$set": bson.M{variablesField: c.Variables}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func CountDeclaringContexts(ctx context.Context, db *mongo.Database) (int64, error) {
+	return db.Collection(ContextsCollection).CountDocuments(ctx, declaringContexts)
+}
@@ -0,0 +1,494 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/codec"
+	"github.com/mangudaigb/context-service/internal/diff"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// History entries do not store their content inline. It is either a blob of
+// the blobs collection, shared by every entry with the same content and keyed
+// by its SHA-256 (contentRef), or a line delta against the content of the
+// previous version of the same context (contentDelta). Entries written before
+// this layout keep their inline content and are read as they are. Entries of
+// the tenants with a key are encrypted with their own data key and store their
+// content the way contexts do, see contentLayout; they are never delta bases.
+const (
+	contentField      = "content"
+	contentRefField   = "contentRef"
+	contentDeltaField = "contentDelta"
+
+	// maxDeltaDepth bounds the number of deltas applied to read a version.
+	maxDeltaDepth = 16
+)
+
+type contentDelta struct {
+	// Base is the id of the history entry the delta applies to.
+	Base  string    `bson:"base"`
+	Depth int       `bson:"depth"`
+	Ops   []deltaOp `bson:"ops"`
+}
+
+// deltaOp copies or skips lines of the base, or inserts text. Exactly one of
+// its fields is set.
+type deltaOp struct {
+	Copy   int    `bson:"c,omitempty"`
+	Skip   int    `bson:"s,omitempty"`
+	Insert string `bson:"i,omitempty"`
+}
+
+// contentBlob holds its content inline, compressed in Data, or in GridFS when
+// File is set. Codec is the codec of Data or of the file. Size is the size of
+// the content before compression. Refs counts the history entries referencing
+// the blob; it is only ever changed by $inc, so that it is left out of the
+// blobs written.
+type contentBlob struct {
+	Hash        string              `bson:"_id"`
+	Content     string              `bson:"content,omitempty"`
+	Data        []byte              `bson:"data,omitempty"`
+	Codec       codec.Codec         `bson:"codec,omitempty"`
+	File        *primitive.ObjectID `bson:"file,omitempty"`
+	Size        int                 `bson:"size"`
+	Refs        int                 `bson:"refs,omitempty"`
+	CreatedTime time.Time           `bson:"createdTime"`
+}
+
+// blobRefsField is the reference count of a blob.
+const blobRefsField = "refs"
+
+func (b *contentBlob) stored() storedContent {
+	return storedContent{Inline: b.Content, Data: b.Data, Codec: b.Codec, File: b.File}
+}
+
+// historyStore is the storage the history content layout is built on, so that
+// the mongo and the in-memory repositories share it.
+type historyStore interface {
+	findHistoryDocs(ctx context.Context, filter bson.M, sort bson.D, limit int) ([]bson.M, error)
+	updateHistoryDoc(ctx context.Context, id string, update bson.M) error
+	deleteHistoryDocs(ctx context.Context, filter bson.M) (int64, error)
+	// putBlob adds a reference to the blob, storing it first when it is not
+	// there yet. The reference must be added before the entry referencing
+	// the blob is written, in the same transaction when there is one.
+	putBlob(ctx context.Context, blob *contentBlob) error
+	findBlobs(ctx context.Context, hashes []string) (map[string]string, error)
+	// releaseBlobs removes the given number of references to each blob, and
+	// deletes the blobs left unreferenced. The count and the delete are
+	// writes to the blob itself, so that a concurrent putBlob either sees the
+	// blob deleted and stores it again, or keeps it referenced.
+	releaseBlobs(ctx context.Context, refs map[string]int) error
+	findBlobDocs(ctx context.Context, hashes []string) ([]bson.M, error)
+	// fileSizes returns the length of each of the offloaded files found.
+	fileSizes(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]int64, error)
+	// layout stores the content of the encrypted entries, which are neither
+	// blobs nor deltas, and of the blobs.
+	layout() contentLayout
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func makeDelta(base, content string) []deltaOp {
+	var ops []deltaOp
+	for _, e := range diff.Lines(base, content) {
+		var last *deltaOp
+		if len(ops) > 0 {
+			last = &ops[len(ops)-1]
+		}
+		switch {
+		case e.Op == diff.Equal && last != nil && last.Copy > 0:
+			last.Copy++
+		case e.Op == diff.Equal:
+			ops = append(ops, deltaOp{Copy: 1})
+		case e.Op == diff.Delete && last != nil && last.Skip > 0:
+			last.Skip++
+		case e.Op == diff.Delete:
+			ops = append(ops, deltaOp{Skip: 1})
+		case last != nil && last.Insert != "":
+			last.Insert += e.Line
+		default:
+			ops = append(ops, deltaOp{Insert: e.Line})
+		}
+	}
+	return ops
+}
+
+func applyDelta(base string, ops []deltaOp) (string, error) {
+	lines := diff.SplitLines(base)
+	var sb strings.Builder
+	for _, op := range ops {
+		n := op.Copy + op.Skip
+		if n > len(lines) {
+			return "", fmt.Errorf("delta runs past the end of its base")
+		}
+		for _, line := range lines[:op.Copy] {
+			sb.WriteString(line)
+		}
+		lines = lines[n:]
+		sb.WriteString(op.Insert)
+	}
+	if len(lines) != 0 {
+		return "", fmt.Errorf("delta leaves %d lines of its base", len(lines))
+	}
+	return sb.String(), nil
+}
+
+// deltaSize estimates the stored size of a delta.
+func deltaSize(ops []deltaOp) int {
+	size := 0
+	for _, op := range ops {
+		size += 8 + len(op.Insert)
+	}
+	return size
+}
+
+// encodeHistory returns the document storing ch as a version of the main line
+// of its context, or of the branch when one is given. Its content is replaced
+// by a delta against the previous version of the same line when that is worth
+// it, by a blob reference otherwise.
+func encodeHistory(ctx context.Context, s historyStore, ch *entities.ContextHistory, branch string) (bson.M, error) {
+	doc, err := toBsonM(ch)
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, contentField)
+	if branch != "" {
+		doc[branchField] = branch
+	}
+	dk, err := s.layout().newDataKey(ctx, ch.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	if dk != nil {
+		fields, err := s.layout().documentFields(ctx, ch.ID, ch.Content, ch.Metadata, dk)
+		if err != nil {
+			return nil, err
+		}
+		delete(doc, metadataField)
+		for k, v := range fields {
+			doc[k] = v
+		}
+		return doc, nil
+	}
+	if ch.Content == "" {
+		return doc, nil
+	}
+	storage, err := encodeContent(ctx, s, historyLine(ch.ContextID, branch), ch.Version, ch.Content)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range storage {
+		doc[k] = v
+	}
+	return doc, nil
+}
+
+// encodeContent returns the contentRef or contentDelta field storing the
+// content of the given version of the line of history.
+func encodeContent(ctx context.Context, s historyStore, line bson.M, version int, content string) (bson.M, error) {
+	line["version"] = bson.M{"$lt": version}
+	prevs, err := s.findHistoryDocs(ctx, line, bson.D{{Key: "version", Value: -1}}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(prevs) == 1 && historyDepth(prevs[0]) < maxDeltaDepth && prevs[0][encryptionField] == nil {
+		prev := prevs[0]
+		contents, err := resolveContents(ctx, s, []bson.M{prev})
+		if err != nil {
+			return nil, err
+		}
+		ops := makeDelta(contents[docID(prev)], content)
+		if deltaSize(ops) < len(content)/2 {
+			return bson.M{contentDeltaField: contentDelta{Base: docID(prev), Depth: historyDepth(prev) + 1, Ops: ops}}, nil
+		}
+	}
+	blob := &contentBlob{Hash: contentHash(content), Content: content, Size: len(content), CreatedTime: time.Now().UTC()}
+	if err := s.putBlob(ctx, blob); err != nil {
+		return nil, err
+	}
+	return bson.M{contentRefField: blob.Hash}, nil
+}
+
+// decodeHistories rebuilds the entries of docs with their content, or
+// without any content when omitContent is set.
+func decodeHistories(ctx context.Context, s historyStore, docs []bson.M, omitContent bool) ([]*entities.ContextHistory, error) {
+	contents := map[string]string{}
+	if !omitContent {
+		var err error
+		if contents, err = resolveContents(ctx, s, docs); err != nil {
+			return nil, err
+		}
+	}
+	histories := make([]*entities.ContextHistory, 0, len(docs))
+	for _, doc := range docs {
+		ch, err := decodeContextHistory(doc)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.layout().openHistoryMetadata(ctx, doc, ch); err != nil {
+			return nil, err
+		}
+		ch.Content = contents[ch.ID]
+		histories = append(histories, ch)
+	}
+	return histories, nil
+}
+
+// resolveContents returns the content of each of docs by id. The bases of the
+// deltas are loaded one level of the chains at a time, then all the blobs at
+// once.
+func resolveContents(ctx context.Context, s historyStore, docs []bson.M) (map[string]string, error) {
+	known := make(map[string]bson.M)
+	for _, doc := range docs {
+		known[docID(doc)] = doc
+	}
+	pending := docs
+	for len(pending) > 0 {
+		var missing []string
+		for _, doc := range pending {
+			if d, ok := historyDelta(doc); ok {
+				if _, ok := known[d.Base]; !ok {
+					missing = append(missing, d.Base)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		bases, err := s.findHistoryDocs(ctx, bson.M{"_id": bson.M{"$in": missing}}, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(bases) != len(uniqueStrings(missing)) {
+			return nil, fmt.Errorf("context history is missing delta bases among %v", missing)
+		}
+		for _, doc := range bases {
+			known[docID(doc)] = doc
+		}
+		pending = bases
+	}
+
+	var hashes []string
+	for _, doc := range known {
+		if ref, ok := doc[contentRefField].(string); ok {
+			hashes = append(hashes, ref)
+		}
+	}
+	blobs := map[string]string{}
+	if len(hashes) > 0 {
+		var err error
+		if blobs, err = s.findBlobs(ctx, uniqueStrings(hashes)); err != nil {
+			return nil, err
+		}
+	}
+
+	contents := make(map[string]string, len(known))
+	var resolve func(id string) (string, error)
+	resolve = func(id string) (string, error) {
+		if c, ok := contents[id]; ok {
+			return c, nil
+		}
+		doc := known[id]
+		var c string
+		if inline, ok := doc[contentField].(string); ok {
+			c = inline
+		} else if ref, ok := doc[contentRefField].(string); ok {
+			if c, ok = blobs[ref]; !ok {
+				return "", fmt.Errorf("context history %s references a missing blob %s", id, ref)
+			}
+		} else if sc := storedContentOfDoc(doc); sc.outOfLine() {
+			dk, err := s.layout().docDataKey(ctx, doc)
+			if err != nil {
+				return "", fmt.Errorf("context history %s: %w", id, err)
+			}
+			if c, err = s.layout().load(ctx, sc, dk, fieldAAD(id, contentField)); err != nil {
+				return "", fmt.Errorf("context history %s: %w", id, err)
+			}
+		} else if d, ok := historyDelta(doc); ok {
+			base, err := resolve(d.Base)
+			if err != nil {
+				return "", err
+			}
+			if c, err = applyDelta(base, d.Ops); err != nil {
+				return "", fmt.Errorf("context history %s: %w", id, err)
+			}
+		}
+		contents[id] = c
+		return c, nil
+	}
+	for _, doc := range docs {
+		if _, err := resolve(docID(doc)); err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// deleteHistories deletes the entries matching filter. The entries left whose
+// delta is based on a deleted one are first rewritten to a blob reference, and
+// the references of the deleted entries are released afterwards.
+func deleteHistories(ctx context.Context, s historyStore, filter bson.M) (int64, error) {
+	doomed, err := s.findHistoryDocs(ctx, filter, nil, 0)
+	if err != nil || len(doomed) == 0 {
+		return 0, err
+	}
+	ids := make([]string, 0, len(doomed))
+	refs := map[string]int{}
+	for _, doc := range doomed {
+		ids = append(ids, docID(doc))
+		if ref, ok := doc[contentRefField].(string); ok {
+			refs[ref]++
+		}
+	}
+
+	dependents, err := s.findHistoryDocs(ctx, bson.M{
+		"_id":                       bson.M{"$nin": ids},
+		contentDeltaField + ".base": bson.M{"$in": ids},
+	}, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(dependents) > 0 {
+		contents, err := resolveContents(ctx, s, dependents)
+		if err != nil {
+			return 0, err
+		}
+		for _, doc := range dependents {
+			content := contents[docID(doc)]
+			blob := &contentBlob{Hash: contentHash(content), Content: content, Size: len(content), CreatedTime: time.Now().UTC()}
+			if err := s.putBlob(ctx, blob); err != nil {
+				return 0, err
+			}
+			update := bson.M{"$set": bson.M{contentRefField: blob.Hash}, "$unset": bson.M{contentDeltaField: ""}}
+			if err := s.updateHistoryDoc(ctx, docID(doc), update); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := s.deleteHistoryDocs(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return n, s.releaseBlobs(ctx, refs)
+}
+
+// storedSizes returns the bytes each of the entries ids takes as stored: its
+// document, its offloaded content, and the blob it references with the file
+// of the blob when no other entry references it. The blob of several of the
+// entries counts towards the first. The blobs the deltas based on the entries
+// would be rewritten to are not accounted for.
+func storedSizes(ctx context.Context, s historyStore, ids []string) (map[string]int64, error) {
+	sizes := make(map[string]int64, len(ids))
+	if len(ids) == 0 {
+		return sizes, nil
+	}
+	docs, err := s.findHistoryDocs(ctx, bson.M{"_id": bson.M{"$in": ids}}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	referencing := map[string][]string{}
+	fileOwners := map[primitive.ObjectID]string{}
+	for _, doc := range docs {
+		id := docID(doc)
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		sizes[id] = int64(len(raw))
+		if ref, ok := doc[contentRefField].(string); ok {
+			referencing[ref] = append(referencing[ref], id)
+		}
+		if sc := storedContentOfDoc(doc); sc.File != nil {
+			fileOwners[*sc.File] = id
+		}
+	}
+	if len(referencing) > 0 {
+		hashes := make([]string, 0, len(referencing))
+		for h := range referencing {
+			hashes = append(hashes, h)
+		}
+		blobs, err := s.findBlobDocs(ctx, hashes)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range blobs {
+			owners := referencing[docID(blob)]
+			// a blob without a count may be shared
+			refs, ok := toFloat(blob[blobRefsField])
+			if !ok || int(refs) > len(owners) {
+				continue
+			}
+			raw, err := bson.Marshal(blob)
+			if err != nil {
+				return nil, err
+			}
+			sizes[owners[0]] += int64(len(raw))
+			if file, ok := blob[blobFileField].(primitive.ObjectID); ok {
+				fileOwners[file] = owners[0]
+			}
+		}
+	}
+	if len(fileOwners) > 0 {
+		files := make([]primitive.ObjectID, 0, len(fileOwners))
+		for f := range fileOwners {
+			files = append(files, f)
+		}
+		lengths, err := s.fileSizes(ctx, files)
+		if err != nil {
+			return nil, err
+		}
+		for f, n := range lengths {
+			sizes[fileOwners[f]] += n
+		}
+	}
+	return sizes, nil
+}
+
+func docID(doc bson.M) string {
+	id, _ := doc["_id"].(string)
+	return id
+}
+
+func historyDelta(doc bson.M) (*contentDelta, bool) {
+	raw, ok := doc[contentDeltaField]
+	if !ok {
+		return nil, false
+	}
+	var wrapper struct {
+		Delta contentDelta `bson:"delta"`
+	}
+	if err := fromBsonM(bson.M{"delta": raw}, &wrapper); err != nil {
+		return nil, false
+	}
+	return &wrapper.Delta, true
+}
+
+func historyDepth(doc bson.M) int {
+	if d, ok := historyDelta(doc); ok {
+		return d.Depth
+	}
+	return 0
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	out := values[:0:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
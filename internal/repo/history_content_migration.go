@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/mangudaigb/context-service/internal/settings"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// inlineHistoryContent matches the history entries written before their
+// content was moved out of them.
+var inlineHistoryContent = bson.M{contentField: bson.M{"$exists": true}}
+
+const historyMigrationBatch = 100
+
+// MigrateHistoryContent moves the inline content of the history entries to
+// blobs and deltas, the same way Create stores it. Entries are migrated by
+// context, oldest version first, so that each can be stored as a delta
+// against the previous one. Blobs are kept inline, as the content was. It can
+// be interrupted and run again.
+func MigrateHistoryContent(ctx context.Context, db *mongo.Database) error {
+	s := newMongoHistoryStore(db, ContextHistoriesCollection, settings.CollectionStorage{}, nil)
+	sort := bson.D{{Key: "contextId", Value: 1}, {Key: "version", Value: 1}}
+	for {
+		docs, err := s.findHistoryDocs(ctx, inlineHistoryContent, sort, historyMigrationBatch)
+		if err != nil || len(docs) == 0 {
+			return err
+		}
+		for _, doc := range docs {
+			ch, err := decodeContextHistory(doc)
+			if err != nil {
+				return err
+			}
+			update := bson.M{"$unset": bson.M{contentField: ""}}
+			if ch.Content != "" {
+				storage, err := encodeContent(ctx, s, MainLine(bson.M{"contextId": ch.ContextID}), ch.Version, ch.Content)
+				if err != nil {
+					return err
+				}
+				update["$set"] = storage
+			}
+			if err := s.updateHistoryDoc(ctx, ch.ID, update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// CountInlineHistoryContent counts the history entries MigrateHistoryContent
+// still has to migrate.
+func CountInlineHistoryContent(ctx context.Context, db *mongo.Database) (int64, error) {
+	return db.Collection(ContextHistoriesCollection).CountDocuments(ctx, inlineHistoryContent)
+}
+
+// uncountedBlobs matches the blobs written before their references were
+// counted.
+var uncountedBlobs = bson.M{blobRefsField: bson.M{"$exists": false}}
+
+// CountBlobRefs sets the reference count of the blobs from the history
+// entries referencing them, and of the blobs no entry references to 0, for
+// the next deletion of history to remove them. Entries must not be written
+// meanwhile; it can be run again.
+func CountBlobRefs(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection(ContextHistoriesCollection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{contentRefField: bson.M{"$exists": true}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$" + contentRefField, "refs": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	blobs := db.Collection(ContextHistoryBlobsCollection)
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := blobs.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+	for cursor.Next(ctx) {
+		var count struct {
+			Hash string `bson:"_id"`
+			Refs int    `bson:"refs"`
+		}
+		if err := cursor.Decode(&count); err != nil {
+			return err
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": count.Hash}).SetUpdate(bson.M{"$set": bson.M{blobRefsField: count.Refs}}))
+		if len(models) == historyMigrationBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	_, err = blobs.UpdateMany(ctx, uncountedBlobs, bson.M{"$set": bson.M{blobRefsField: 0}})
+	return err
+}
+
+// CountUncountedBlobs counts the blobs without a reference count.
+func CountUncountedBlobs(ctx context.Context, db *mongo.Database) (int64, error) {
+	return db.Collection(ContextHistoryBlobsCollection).CountDocuments(ctx, uncountedBlobs)
+}
@@ -0,0 +1,184 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func longPrompt(changed string) string {
+	var sb strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&sb, "rule %d: answer politely and cite sources\n", i)
+	}
+	sb.WriteString(changed + "\n")
+	return sb.String()
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	for _, tc := range []struct{ base, content string }{
+		{"", "a\nb"},
+		{"a\nb\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\nd"},
+		{longPrompt("v1"), longPrompt("v2")},
+	} {
+		got, err := applyDelta(tc.base, makeDelta(tc.base, tc.content))
+		if err != nil || got != tc.content {
+			t.Fatalf("delta from %q to %q yields %q, %v", tc.base, tc.content, got, err)
+		}
+	}
+}
+
+func TestHistoryContentIsStoredOnceAndAsDeltas(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextHistoryRepository(newTestLogger(t))
+	contents := []string{longPrompt("v1"), longPrompt("v2"), "short", longPrompt("v1")}
+	for i, content := range contents {
+		if _, err := r.Create(ctx, &entities.ContextHistory{ID: fmt.Sprintf("h%d", i+1), ContextID: "c1", Version: i + 1, Content: content}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	// the same prompt in another context shares the blob of h1
+	if _, err := r.Create(ctx, &entities.ContextHistory{ID: "o1", ContextID: "c2", Version: 1, Content: longPrompt("v1")}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	raw, _ := r.collection.find(bson.M{}, bson.D{{Key: "_id", Value: 1}}, 0)
+	layout := map[string]string{}
+	for _, doc := range raw {
+		switch {
+		case doc[contentField] != nil:
+			layout[docID(doc)] = "inline"
+		case doc[contentRefField] != nil:
+			layout[docID(doc)] = "blob"
+		case doc[contentDeltaField] != nil:
+			layout[docID(doc)] = "delta"
+		}
+	}
+	want := map[string]string{"h1": "blob", "h2": "delta", "h3": "blob", "h4": "blob", "o1": "blob"}
+	for id, l := range want {
+		if layout[id] != l {
+			t.Fatalf("expected %s to be stored as a %s, got %v", id, l, layout)
+		}
+	}
+	if blobs, _ := r.store.blobs.find(bson.M{}, nil, 0); len(blobs) != 2 {
+		t.Fatalf("expected 2 distinct blobs, got %d", len(blobs))
+	}
+
+	histories, err := r.Filter(ctx, bson.M{"contextId": "c1"})
+	if err != nil {
+		t.Fatalf("filter: %v", err)
+	}
+	for i, ch := range histories {
+		if ch.Content != contents[i] {
+			t.Fatalf("unexpected content of version %d: %q", ch.Version, ch.Content)
+		}
+	}
+
+	// deleting the base of h2 rewrites it to a blob, deleting h4 keeps the
+	// blob shared with o1
+	if _, err := r.DeleteByIDs(ctx, []string{"h1", "h4"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	h2, err := r.GetByID(ctx, "h2")
+	if err != nil || h2.Content != contents[1] {
+		t.Fatalf("expected h2 to survive the deletion of its base, got %+v, %v", h2, err)
+	}
+	o1, err := r.GetByID(ctx, "o1")
+	if err != nil || o1.Content != contents[0] {
+		t.Fatalf("expected the shared blob to survive, got %+v, %v", o1, err)
+	}
+
+	if _, err := r.DeleteByContextIDs(ctx, []string{"c1", "c2"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if blobs, _ := r.store.blobs.find(bson.M{}, nil, 0); len(blobs) != 0 {
+		t.Fatalf("expected the orphan blobs to be deleted, %d left", len(blobs))
+	}
+}
+
+func TestHistoryWithInlineContentIsReadAsIs(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextHistoryRepository(newTestLogger(t))
+	if err := r.collection.insertOne(&entities.ContextHistory{ID: "h1", ContextID: "c1", Version: 1, Content: longPrompt("v1")}); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := r.Create(ctx, &entities.ContextHistory{ID: "h2", ContextID: "c1", Version: 2, Content: longPrompt("v2")}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	h2, err := r.GetByVersion(ctx, "c1", 2)
+	if err != nil || h2.Content != longPrompt("v2") {
+		t.Fatalf("unexpected h2: %+v, %v", h2, err)
+	}
+}
+
+func TestBlobReferencedDuringDeletionSurvives(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextHistoryRepository(newTestLogger(t))
+	content := longPrompt("v1")
+	if _, err := r.Create(ctx, &entities.ContextHistory{ID: "h1", ContextID: "c1", Version: 1, Content: content}); err != nil {
+		t.Fatal(err)
+	}
+	// a writer of c2 references the blob of h1, then h1 is deleted before
+	// the entry of the writer is stored
+	hash := contentHash(content)
+	if err := r.store.putBlob(ctx, &contentBlob{Hash: hash, Content: content, Size: len(content)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.DeleteByIDs(ctx, []string{"h1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.collection.insertOne(bson.M{"_id": "o1", "contextId": "c2", "version": 1, contentRefField: hash}); err != nil {
+		t.Fatal(err)
+	}
+	o1, err := r.GetByID(ctx, "o1")
+	if err != nil || o1.Content != content {
+		t.Fatalf("expected the blob to survive, got %+v, %v", o1, err)
+	}
+	if _, err := r.DeleteByIDs(ctx, []string{"o1"}); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, _ := r.store.blobs.find(bson.M{}, nil, 0); len(blobs) != 0 {
+		t.Fatalf("expected the blob to go with its last reference, %d left", len(blobs))
+	}
+}
+
+func TestStoredSizes(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextHistoryRepository(newTestLogger(t))
+	for _, ch := range []*entities.ContextHistory{
+		{ID: "h1", ContextID: "c1", Version: 1, Content: longPrompt("v1")},
+		{ID: "h2", ContextID: "c1", Version: 2, Content: longPrompt("v2")},
+		{ID: "o1", ContextID: "c2", Version: 1, Content: longPrompt("v2") + "shared\n"},
+		{ID: "o2", ContextID: "c3", Version: 1, Content: longPrompt("v2") + "shared\n"},
+	} {
+		if _, err := r.Create(ctx, ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizes, err := r.StoredSizes(ctx, []string{"h1", "h2", "o1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := int64(len(longPrompt("v1")))
+	if sizes["h1"] <= content {
+		t.Fatalf("the only entry referencing a blob must count it, got %d bytes", sizes["h1"])
+	}
+	if sizes["h2"] == 0 || sizes["h2"] >= content/2 {
+		t.Fatalf("a delta must count as stored, got %d bytes", sizes["h2"])
+	}
+	if sizes["o1"] == 0 || sizes["o1"] >= content {
+		t.Fatalf("a blob shared with an entry kept must not count, got %d bytes", sizes["o1"])
+	}
+	both, err := r.StoredSizes(ctx, []string{"o1", "o2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if both["o1"]+both["o2"] <= content {
+		t.Fatalf("a blob only the entries reference must count, got %v", both)
+	}
+}
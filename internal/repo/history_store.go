@@ -0,0 +1,226 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mangudaigb/context-service/internal/encryption"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoHistoryStore is the historyStore of MongoContextHistoryRepository.
+type mongoHistoryStore struct {
+	histories *mongo.Collection
+	blobs     *mongo.Collection
+	files     gridFSFiles
+	content   contentLayout
+}
+
+func newMongoHistoryStore(db *mongo.Database, collection string, storage settings.CollectionStorage, enc *encryption.Encryptor) mongoHistoryStore {
+	files := gridFSFiles{db: db}
+	return mongoHistoryStore{
+		histories: db.Collection(collection),
+		blobs:     db.Collection(ContextHistoryBlobsCollection),
+		files:     files,
+		content:   contentLayout{files: files, storage: storage, enc: enc},
+	}
+}
+
+func (s mongoHistoryStore) layout() contentLayout {
+	return s.content
+}
+
+func (s mongoHistoryStore) findHistoryDocs(ctx context.Context, filter bson.M, sort bson.D, limit int) ([]bson.M, error) {
+	opts := options.Find()
+	if len(sort) > 0 {
+		opts.SetSort(sort)
+	}
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cursor, err := s.histories.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (s mongoHistoryStore) updateHistoryDoc(ctx context.Context, id string, update bson.M) error {
+	res, err := s.histories.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrContextHistoryNotFound
+	}
+	return nil
+}
+
+func (s mongoHistoryStore) deleteHistoryDocs(ctx context.Context, filter bson.M) (int64, error) {
+	res, err := s.histories.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+// putBlob references the blob with the same hash, and therefore the same
+// content, when there is one, so that large contents are not uploaded again.
+// Otherwise it stores the blob; a file uploaded by a concurrent put that loses
+// the upsert is left to SweepContentFiles.
+func (s mongoHistoryStore) putBlob(ctx context.Context, blob *contentBlob) error {
+	addRef := bson.M{"$inc": bson.M{blobRefsField: 1}}
+	res, err := s.blobs.UpdateOne(ctx, bson.M{"_id": blob.Hash}, addRef)
+	if err != nil || res.MatchedCount > 0 {
+		return err
+	}
+	sc, err := s.content.store(ctx, blob.Hash, blob.Content, nil, nil)
+	if err != nil {
+		return err
+	}
+	stored := *blob
+	stored.Content, stored.Data, stored.Codec, stored.File = sc.Inline, sc.Data, sc.Codec, sc.File
+	stored.Refs = 0
+	addRef["$setOnInsert"] = stored
+	_, err = s.blobs.UpdateOne(ctx, bson.M{"_id": blob.Hash}, addRef, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s mongoHistoryStore) findBlobs(ctx context.Context, hashes []string) (map[string]string, error) {
+	cursor, err := s.blobs.Find(ctx, bson.M{"_id": bson.M{"$in": hashes}})
+	if err != nil {
+		return nil, err
+	}
+	var blobs []contentBlob
+	if err := cursor.All(ctx, &blobs); err != nil {
+		return nil, err
+	}
+	contents := make(map[string]string, len(blobs))
+	for _, b := range blobs {
+		if contents[b.Hash], err = s.content.load(ctx, b.stored(), nil, nil); err != nil {
+			return nil, fmt.Errorf("loading the content of blob %s: %w", b.Hash, err)
+		}
+	}
+	return contents, nil
+}
+
+func (s mongoHistoryStore) findBlobDocs(ctx context.Context, hashes []string) ([]bson.M, error) {
+	cursor, err := s.blobs.Find(ctx, bson.M{"_id": bson.M{"$in": hashes}})
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func (s mongoHistoryStore) fileSizes(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	return s.files.sizes(ctx, ids)
+}
+
+func (s mongoHistoryStore) releaseBlobs(ctx context.Context, refs map[string]int) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	hashes := make([]string, 0, len(refs))
+	models := make([]mongo.WriteModel, 0, len(refs))
+	for hash, n := range refs {
+		hashes = append(hashes, hash)
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": hash}).SetUpdate(bson.M{"$inc": bson.M{blobRefsField: -n}}))
+	}
+	if _, err := s.blobs.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return err
+	}
+	_, err := s.blobs.DeleteMany(ctx, unreferencedBlobs(hashes))
+	return err
+}
+
+// memHistoryStore is the historyStore of MemoryContextHistoryRepository.
+type memHistoryStore struct {
+	histories *memCollection
+	blobs     *memCollection
+}
+
+// layout keeps the content inline and in the clear.
+func (s memHistoryStore) layout() contentLayout {
+	return contentLayout{}
+}
+
+func (s memHistoryStore) findHistoryDocs(ctx context.Context, filter bson.M, sort bson.D, limit int) ([]bson.M, error) {
+	return s.histories.find(filter, sort, limit)
+}
+
+func (s memHistoryStore) updateHistoryDoc(ctx context.Context, id string, update bson.M) error {
+	doc, err := s.histories.updateOne(bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrContextHistoryNotFound
+	}
+	return nil
+}
+
+func (s memHistoryStore) deleteHistoryDocs(ctx context.Context, filter bson.M) (int64, error) {
+	n, err := s.histories.deleteMany(filter)
+	return int64(n), err
+}
+
+func (s memHistoryStore) putBlob(ctx context.Context, blob *contentBlob) error {
+	doc, err := s.blobs.updateOne(bson.M{"_id": blob.Hash}, bson.M{"$inc": bson.M{blobRefsField: 1}})
+	if err != nil || doc != nil {
+		return err
+	}
+	stored := *blob
+	stored.Refs = 1
+	return s.blobs.insertOne(&stored)
+}
+
+func (s memHistoryStore) findBlobs(ctx context.Context, hashes []string) (map[string]string, error) {
+	docs, err := s.blobs.find(bson.M{"_id": bson.M{"$in": hashes}}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	contents := make(map[string]string, len(docs))
+	for _, doc := range docs {
+		contents[docID(doc)], _ = doc["content"].(string)
+	}
+	return contents, nil
+}
+
+func (s memHistoryStore) findBlobDocs(ctx context.Context, hashes []string) ([]bson.M, error) {
+	return s.blobs.find(bson.M{"_id": bson.M{"$in": hashes}}, nil, 0)
+}
+
+// fileSizes finds no file, the memory store keeps its content inline.
+func (s memHistoryStore) fileSizes(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	return map[primitive.ObjectID]int64{}, nil
+}
+
+func (s memHistoryStore) releaseBlobs(ctx context.Context, refs map[string]int) error {
+	hashes := make([]string, 0, len(refs))
+	for hash, n := range refs {
+		hashes = append(hashes, hash)
+		if _, err := s.blobs.updateOne(bson.M{"_id": hash}, bson.M{"$inc": bson.M{blobRefsField: -n}}); err != nil {
+			return err
+		}
+	}
+	_, err := s.blobs.deleteMany(unreferencedBlobs(hashes))
+	return err
+}
+
+// unreferencedBlobs are the blobs among hashes no entry references. A blob
+// without a count, written before the counts, is never one of them.
+func unreferencedBlobs(hashes []string) bson.M {
+	return bson.M{"_id": bson.M{"$in": hashes}, blobRefsField: bson.M{"$lte": 0}}
+}
@@ -0,0 +1,173 @@
+package repo
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ContextsCollection         = "contexts"
+	ContextHistoriesCollection = "context_histories"
+	// ContextHistoryBlobsCollection holds the content of the history entries,
+	// see encodeHistory.
+	ContextHistoryBlobsCollection = "context_history_blobs"
+	// LabelMovesCollection audits the moves of the context labels.
+	LabelMovesCollection = "context_label_moves"
+	// TokenCountsCollection holds the token counts of the context versions.
+	TokenCountsCollection = "context_token_counts"
+	// SchemasCollection holds the schemas of the context metadata.
+	SchemasCollection = "metadata_schemas"
+	// JobLeasesCollection holds the leases of the periodic jobs.
+	JobLeasesCollection = "job_leases"
+)
+
+// ContextIndexes are the indexes serving the filters and sort orders of
+// MongoContextRepository.Query.
+func ContextIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant._id", Value: 1}, {Key: "modifiedTime", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("tenant_modifiedTime"),
+		},
+		{
+			Keys:    bson.D{{Key: "modifiedTime", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("modifiedTime"),
+		},
+		{
+			Keys:    bson.D{{Key: "createdTime", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("createdTime"),
+		},
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("name"),
+		},
+		{
+			Keys:    bson.D{{Key: "tags", Value: 1}},
+			Options: options.Index().SetName("tags"),
+		},
+	}
+}
+
+// TrashIndexes serve the trash listing and the purge. The index is sparse
+// since only trashed contexts carry deletedAt.
+func TrashIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "deletedAt", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("deletedAt").SetSparse(true),
+		},
+	}
+}
+
+// ContextHistoryIndexes serve the history listing of a context.
+func ContextHistoryIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "contextId", Value: 1}, {Key: "version", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("contextId_version"),
+		},
+		{
+			Keys:    bson.D{{Key: "contextId", Value: 1}, {Key: "createdTime", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("contextId_createdTime"),
+		},
+	}
+}
+
+// BranchHistoryIndexes serve the lookups of the versions of a branch. The
+// index is sparse since only the versions of branches carry branch.
+func BranchHistoryIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "contextId", Value: 1}, {Key: branchField, Value: 1}, {Key: "version", Value: -1}},
+			Options: options.Index().SetName("contextId_branch_version").SetSparse(true),
+		},
+	}
+}
+
+// ContextHistoryContentIndexes serve the lookups done when history entries are
+// deleted: the entries whose delta is based on a deleted one, and the entries
+// still referencing a blob.
+func ContextHistoryContentIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "contentDelta.base", Value: 1}},
+			Options: options.Index().SetName("contentDelta_base").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "contentRef", Value: 1}},
+			Options: options.Index().SetName("contentRef").SetSparse(true),
+		},
+	}
+}
+
+// ContentFileIndexes serve the lookup of the GridFS files still referenced,
+// done by SweepContentFiles, on the contexts and the history collections.
+func ContentFileIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: contentFileField, Value: 1}},
+			Options: options.Index().SetName(contentFileField).SetSparse(true),
+		},
+	}
+}
+
+// ContextHistoryBlobFileIndexes are the ContentFileIndexes of the history blobs.
+func ContextHistoryBlobFileIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: blobFileField, Value: 1}},
+			Options: options.Index().SetName(blobFileField).SetSparse(true),
+		},
+	}
+}
+
+// ForkIndexes serve the listing of the forks of a context. The index is sparse
+// since only forks carry forkedFrom.
+func ForkIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: forkedFromField + ".contextId", Value: 1}, {Key: "createdTime", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("forkedFrom_contextId").SetSparse(true),
+		},
+	}
+}
+
+// LabelMoveIndexes serve the listing of the label moves of a context.
+func LabelMoveIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "contextId", Value: 1}, {Key: "label", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetName("contextId_label_time"),
+		},
+		{
+			Keys:    bson.D{{Key: "contextId", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetName("contextId_time"),
+		},
+	}
+}
+
+// SchemaIndexes keep a kind or a tag to one schema. They are sparse since a
+// schema may be for neither.
+func SchemaIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "kind", Value: 1}},
+			Options: options.Index().SetName("kind").SetUnique(true).SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "tag", Value: 1}},
+			Options: options.Index().SetName("tag").SetUnique(true).SetSparse(true),
+		},
+	}
+}
+
+// TokenCountIndexes serve the purge of the token counts of a context.
+func TokenCountIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "contextId", Value: 1}},
+			Options: options.Index().SetName("contextId"),
+		},
+	}
+}
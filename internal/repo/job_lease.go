@@ -0,0 +1,108 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LeaseRepository hands out the leases that keep a periodic job to one
+// replica of the service at a time. A lease is held until it expires or its
+// owner releases it.
+type LeaseRepository interface {
+	// Acquire takes the lease of the job for ttl when it is free, expired or
+	// held by owner already, and reports whether owner holds it.
+	Acquire(ctx context.Context, job, owner string, ttl time.Duration) (bool, error)
+	// Release gives up the lease of the job when owner holds it.
+	Release(ctx context.Context, job, owner string) error
+}
+
+// leaseDoc is the lease of a job as stored.
+type leaseDoc struct {
+	Job        string    `bson:"_id"`
+	Owner      string    `bson:"owner"`
+	AcquiredAt time.Time `bson:"acquiredAt"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
+
+// availableLease matches the lease of the job owner may take.
+func availableLease(job, owner string, now time.Time) bson.M {
+	return bson.M{
+		"_id": job,
+		"$or": bson.A{
+			bson.M{"owner": owner},
+			bson.M{"expiresAt": bson.M{"$lt": now}},
+		},
+	}
+}
+
+type MongoLeaseRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+}
+
+func NewLeaseRepository(cfg *config.Config, log *logger.Logger, client mongo.Client) LeaseRepository {
+	return NewCollectionLeaseRepository(log, client.Database(cfg.Mongo.Database).Collection(JobLeasesCollection))
+}
+
+// NewCollectionLeaseRepository keeps the leases in collection, for the locks
+// kept apart from the job leases such as the migration lock.
+func NewCollectionLeaseRepository(log *logger.Logger, collection *mongo.Collection) LeaseRepository {
+	return &MongoLeaseRepository{log: log, collection: collection}
+}
+
+// Acquire upserts the lease. A competing upsert losing the race fails with a
+// duplicate key error, which means the lease is held.
+func (mlr *MongoLeaseRepository) Acquire(ctx context.Context, job, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	update := bson.M{"$set": bson.M{"owner": owner, "acquiredAt": now, "expiresAt": now.Add(ttl)}}
+	_, err := mlr.collection.UpdateOne(ctx, availableLease(job, owner, now), update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		mlr.log.Errorf("Error acquiring the lease of job %s: %v", job, err)
+		return false, err
+	}
+	return true, nil
+}
+
+func (mlr *MongoLeaseRepository) Release(ctx context.Context, job, owner string) error {
+	if _, err := mlr.collection.DeleteOne(ctx, bson.M{"_id": job, "owner": owner}); err != nil {
+		mlr.log.Errorf("Error releasing the lease of job %s: %v", job, err)
+		return err
+	}
+	return nil
+}
+
+type MemoryLeaseRepository struct {
+	collection *memCollection
+}
+
+func NewMemoryLeaseRepository() *MemoryLeaseRepository {
+	return &MemoryLeaseRepository{collection: newMemCollection()}
+}
+
+func (m *MemoryLeaseRepository) Acquire(ctx context.Context, job, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	doc, err := m.collection.updateOne(availableLease(job, owner, now), bson.M{"$set": bson.M{"owner": owner, "acquiredAt": now, "expiresAt": now.Add(ttl)}})
+	if err != nil || doc != nil {
+		return doc != nil, err
+	}
+	err = m.collection.insertOne(&leaseDoc{Job: job, Owner: owner, AcquiredAt: now, ExpiresAt: now.Add(ttl)})
+	if errors.Is(err, errMemDuplicateKey) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *MemoryLeaseRepository) Release(ctx context.Context, job, owner string) error {
+	_, err := m.collection.deleteMany(bson.M{"_id": job, "owner": owner})
+	return err
+}
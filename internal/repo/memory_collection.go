@@ -0,0 +1,639 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errMemDuplicateKey = errors.New("duplicate key")
+	errMemMissingID    = errors.New("document has no _id")
+)
+
+// memCollection is a tiny in-memory stand-in for a mongo collection. Documents
+// are kept in their bson form so that the bson tags of the entities, the
+// filter documents and the update documents built for mongo can be reused as-is.
+// Only a subset of the query and update operators is supported, see matchDoc
+// and applyUpdate.
+type memCollection struct {
+	mu    sync.RWMutex
+	docs  map[string]bson.M
+	order []string
+}
+
+func newMemCollection() *memCollection {
+	return &memCollection{
+		docs: make(map[string]bson.M),
+	}
+}
+
+func (mc *memCollection) insertOne(v interface{}) error {
+	doc, err := toBsonM(v)
+	if err != nil {
+		return err
+	}
+	id, ok := doc["_id"].(string)
+	if !ok || id == "" {
+		return errMemMissingID
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if _, exists := mc.docs[id]; exists {
+		return errMemDuplicateKey
+	}
+	mc.docs[id] = doc
+	mc.order = append(mc.order, id)
+	return nil
+}
+
+// find returns copies of the documents matching filter in insertion order,
+// sorted by sortSpec when it is not empty. A limit of 0 means no limit.
+func (mc *memCollection) find(filter interface{}, sortSpec bson.D, limit int) ([]bson.M, error) {
+	f, err := toBsonM(filter)
+	if err != nil {
+		return nil, err
+	}
+	mc.mu.RLock()
+	var out []bson.M
+	for _, id := range mc.order {
+		doc := mc.docs[id]
+		if matchDoc(doc, f) {
+			out = append(out, copyDoc(doc))
+		}
+	}
+	mc.mu.RUnlock()
+
+	if len(sortSpec) > 0 {
+		sort.SliceStable(out, func(i, j int) bool {
+			return compareBySpec(out[i], out[j], sortSpec) < 0
+		})
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (mc *memCollection) findOne(filter interface{}) (bson.M, error) {
+	docs, err := mc.find(filter, nil, 1)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// updateOne applies update to the first document matching filter and returns
+// a copy of the updated document, or nil when nothing matched.
+func (mc *memCollection) updateOne(filter interface{}, update interface{}) (bson.M, error) {
+	f, err := toBsonM(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := toBsonM(update)
+	if err != nil {
+		return nil, err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, id := range mc.order {
+		doc := mc.docs[id]
+		if !matchDoc(doc, f) {
+			continue
+		}
+		updated := copyDoc(doc)
+		if err := applyUpdate(updated, u); err != nil {
+			return nil, err
+		}
+		mc.docs[id] = updated
+		return copyDoc(updated), nil
+	}
+	return nil, nil
+}
+
+// deleteMany removes every document matching filter and returns how many were removed.
+func (mc *memCollection) deleteMany(filter interface{}) (int, error) {
+	f, err := toBsonM(filter)
+	if err != nil {
+		return 0, err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	kept := mc.order[:0]
+	deleted := 0
+	for _, id := range mc.order {
+		if matchDoc(mc.docs[id], f) {
+			delete(mc.docs, id)
+			deleted++
+			continue
+		}
+		kept = append(kept, id)
+	}
+	mc.order = kept
+	return deleted, nil
+}
+
+func (mc *memCollection) deleteOne(id string) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if _, ok := mc.docs[id]; !ok {
+		return false
+	}
+	delete(mc.docs, id)
+	for i, oid := range mc.order {
+		if oid == id {
+			mc.order = append(mc.order[:i], mc.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func toBsonM(v interface{}) (bson.M, error) {
+	if v == nil {
+		return bson.M{}, nil
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling document: %w", err)
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("unmarshalling document: %w", err)
+	}
+	return doc, nil
+}
+
+func fromBsonM(doc bson.M, out interface{}) error {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, out)
+}
+
+func copyDoc(doc bson.M) bson.M {
+	return copyValue(doc).(bson.M)
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.M:
+		out := make(bson.M, len(t))
+		for k, val := range t {
+			out[k] = copyValue(val)
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(t))
+		for i, val := range t {
+			out[i] = copyValue(val)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// lookup resolves a dotted path against doc. Arrays met along the way are
+// traversed element by element, the way mongo does for "tenant._id" style paths.
+func lookup(v interface{}, path []string) ([]interface{}, bool) {
+	if len(path) == 0 {
+		return []interface{}{v}, true
+	}
+	switch t := v.(type) {
+	case bson.M:
+		next, ok := t[path[0]]
+		if !ok {
+			return nil, false
+		}
+		return lookup(next, path[1:])
+	case bson.A:
+		var out []interface{}
+		found := false
+		for _, el := range t {
+			if vals, ok := lookup(el, path); ok {
+				out = append(out, vals...)
+				found = true
+			}
+		}
+		return out, found
+	default:
+		return nil, false
+	}
+}
+
+func matchDoc(doc bson.M, filter bson.M) bool {
+	for key, cond := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			subs, _ := cond.(bson.A)
+			if !matchLogical(doc, key, subs) {
+				return false
+			}
+		default:
+			if !matchField(doc, key, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchLogical(doc bson.M, op string, subs bson.A) bool {
+	switch op {
+	case "$and":
+		for _, s := range subs {
+			if f, ok := s.(bson.M); !ok || !matchDoc(doc, f) {
+				return false
+			}
+		}
+		return true
+	case "$or":
+		for _, s := range subs {
+			if f, ok := s.(bson.M); ok && matchDoc(doc, f) {
+				return true
+			}
+		}
+		return false
+	default:
+		for _, s := range subs {
+			if f, ok := s.(bson.M); ok && matchDoc(doc, f) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func isOperatorDoc(v interface{}) (bson.M, bool) {
+	m, ok := v.(bson.M)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func matchField(doc bson.M, key string, cond interface{}) bool {
+	values, exists := lookup(doc, strings.Split(key, "."))
+	ops, isOps := isOperatorDoc(cond)
+	if !isOps {
+		return matchEq(values, exists, cond)
+	}
+	for op, arg := range ops {
+		if !matchOperator(values, exists, op, arg, ops) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchOperator(values []interface{}, exists bool, op string, arg interface{}, ops bson.M) bool {
+	switch op {
+	case "$eq":
+		return matchEq(values, exists, arg)
+	case "$ne":
+		return !matchEq(values, exists, arg)
+	case "$gt", "$gte", "$lt", "$lte":
+		return anyElement(values, func(v interface{}) bool {
+			c, ok := compareValues(v, arg)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			default:
+				return c <= 0
+			}
+		})
+	case "$in":
+		list, _ := arg.(bson.A)
+		for _, a := range list {
+			if matchEq(values, exists, a) {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		list, _ := arg.(bson.A)
+		for _, a := range list {
+			if matchEq(values, exists, a) {
+				return false
+			}
+		}
+		return true
+	case "$all":
+		list, _ := arg.(bson.A)
+		if len(list) == 0 {
+			return false
+		}
+		for _, a := range list {
+			if !matchEq(values, exists, a) {
+				return false
+			}
+		}
+		return true
+	case "$exists":
+		want, _ := arg.(bool)
+		return exists == want
+	case "$size":
+		n, ok := toFloat(arg)
+		if !ok || len(values) != 1 {
+			return false
+		}
+		arr, isArr := values[0].(bson.A)
+		return isArr && float64(len(arr)) == n
+	case "$regex":
+		pattern, flags := regexArgs(arg, ops)
+		re, err := regexp.Compile(flags + pattern)
+		if err != nil {
+			return false
+		}
+		return anyElement(values, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		})
+	case "$options":
+		// consumed together with $regex
+		return true
+	case "$not":
+		sub, ok := isOperatorDoc(arg)
+		if !ok {
+			return false
+		}
+		for subOp, subArg := range sub {
+			if !matchOperator(values, exists, subOp, subArg, sub) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+func regexArgs(arg interface{}, ops bson.M) (string, string) {
+	var pattern, options string
+	switch t := arg.(type) {
+	case primitive.Regex:
+		pattern, options = t.Pattern, t.Options
+	case string:
+		pattern = t
+	}
+	if o, ok := ops["$options"].(string); ok {
+		options = o
+	}
+	var flags string
+	for _, f := range options {
+		if strings.ContainsRune("imsU", f) {
+			flags += string(f)
+		}
+	}
+	if flags != "" {
+		flags = "(?" + flags + ")"
+	}
+	return pattern, flags
+}
+
+// anyElement reports whether fn holds for any value, descending one level into arrays.
+func anyElement(values []interface{}, fn func(v interface{}) bool) bool {
+	for _, v := range values {
+		if arr, ok := v.(bson.A); ok {
+			for _, el := range arr {
+				if fn(el) {
+					return true
+				}
+			}
+			continue
+		}
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchEq(values []interface{}, exists bool, want interface{}) bool {
+	if !exists {
+		return want == nil
+	}
+	for _, v := range values {
+		if valuesEqual(v, want) {
+			return true
+		}
+	}
+	return anyElement(values, func(v interface{}) bool {
+		return valuesEqual(v, want)
+	})
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// compareValues orders two scalar bson values of the same kind. The boolean
+// result is false when the values are not comparable.
+func compareValues(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		return compareOrdered(fa, fb), true
+	}
+	switch ta := a.(type) {
+	case string:
+		tb, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(ta, tb), true
+	case primitive.DateTime:
+		tb, ok := b.(primitive.DateTime)
+		if !ok {
+			return 0, false
+		}
+		return compareOrdered(ta, tb), true
+	case bool:
+		tb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if ta == tb {
+			return 0, true
+		}
+		if !ta {
+			return -1, true
+		}
+		return 1, true
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
+}
+
+func compareOrdered[T int64 | float64 | primitive.DateTime](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortRank mirrors the mongo comparison order between bson types.
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int32, int64, int, float64:
+		return 1
+	case string:
+		return 2
+	case bson.M:
+		return 3
+	case bson.A:
+		return 4
+	case bool:
+		return 5
+	case primitive.DateTime:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func compareForSort(a, b interface{}) int {
+	ra, rb := sortRank(a), sortRank(b)
+	if ra != rb {
+		return compareOrdered(int64(ra), int64(rb))
+	}
+	if c, ok := compareValues(a, b); ok {
+		return c
+	}
+	return 0
+}
+
+func compareBySpec(a, b bson.M, spec bson.D) int {
+	for _, e := range spec {
+		path := strings.Split(e.Key, ".")
+		va, _ := lookup(a, path)
+		vb, _ := lookup(b, path)
+		c := compareForSort(firstValue(va), firstValue(vb))
+		if c == 0 {
+			continue
+		}
+		if dir, _ := toFloat(e.Value); dir < 0 {
+			return -c
+		}
+		return c
+	}
+	return 0
+}
+
+func firstValue(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// applyUpdate supports the $set, $unset and $inc update operators.
+func applyUpdate(doc bson.M, update bson.M) error {
+	for op, arg := range update {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return fmt.Errorf("update operator %s expects a document", op)
+		}
+		for path, val := range fields {
+			keys := strings.Split(path, ".")
+			switch op {
+			case "$set":
+				setPath(doc, keys, copyValue(val))
+			case "$unset":
+				unsetPath(doc, keys)
+			case "$inc":
+				cur, _ := lookup(doc, keys)
+				base, _ := toFloat(firstValue(cur))
+				delta, ok := toFloat(val)
+				if !ok {
+					return fmt.Errorf("$inc on %s expects a number", path)
+				}
+				if _, isFloat := val.(float64); isFloat {
+					setPath(doc, keys, base+delta)
+				} else {
+					setPath(doc, keys, int64(base+delta))
+				}
+			default:
+				return fmt.Errorf("unsupported update operator %s", op)
+			}
+		}
+	}
+	return nil
+}
+
+func setPath(doc bson.M, keys []string, val interface{}) {
+	cur := doc
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := cur[k].(bson.M)
+		if !ok {
+			next = bson.M{}
+			cur[k] = next
+		}
+		cur = next
+	}
+	cur[keys[len(keys)-1]] = val
+}
+
+func unsetPath(doc bson.M, keys []string) {
+	cur := doc
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := cur[k].(bson.M)
+		if !ok {
+			return
+		}
+		cur = next
+	}
+	delete(cur, keys[len(keys)-1])
+}
@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMemCollectionMatch(t *testing.T) {
+	now := time.Now().UTC()
+	mc := newMemCollection()
+	docs := []entities.Context{
+		{ID: "a", Name: "alpha", Tags: []string{"x", "y"}, Version: 1, CreatedTime: now.Add(-time.Hour),
+			Tenants: []entities.TenantStub{{ID: "t1"}}, Metadata: map[string]interface{}{"kind": "persona"}},
+		{ID: "b", Name: "beta", Tags: []string{"y"}, Version: 3, CreatedTime: now, IsActive: true,
+			Tenants: []entities.TenantStub{{ID: "t2"}}},
+	}
+	for i := range docs {
+		if err := mc.insertOne(&docs[i]); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter bson.M
+		want   []string
+	}{
+		{"empty", bson.M{}, []string{"a", "b"}},
+		{"eq", bson.M{"name": "beta"}, []string{"b"}},
+		{"array element", bson.M{"tags": "x"}, []string{"a"}},
+		{"in", bson.M{"tags": bson.M{"$in": bson.A{"x", "z"}}}, []string{"a"}},
+		{"all", bson.M{"tags": bson.M{"$all": bson.A{"x", "y"}}}, []string{"a"}},
+		{"range", bson.M{"version": bson.M{"$gte": 2, "$lt": 10}}, []string{"b"}},
+		{"time", bson.M{"createdTime": bson.M{"$lt": now.Add(-time.Minute)}}, []string{"a"}},
+		{"nested array path", bson.M{"tenant._id": "t2"}, []string{"b"}},
+		{"metadata", bson.M{"metadata.kind": "persona"}, []string{"a"}},
+		{"exists", bson.M{"metadata": bson.M{"$exists": false}}, []string{"b"}},
+		{"ne on omitted bool", bson.M{"isActive": bson.M{"$ne": true}}, []string{"a"}},
+		{"regex", bson.M{"name": bson.M{"$regex": "^AL", "$options": "i"}}, []string{"a"}},
+		{"or", bson.M{"$or": bson.A{bson.M{"name": "alpha"}, bson.M{"version": 3}}}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mc.find(tt.filter, nil, 0)
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+			var ids []string
+			for _, d := range got {
+				ids = append(ids, d["_id"].(string))
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("got %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", ids, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemCollectionSortAndLimit(t *testing.T) {
+	mc := newMemCollection()
+	for _, c := range []entities.Context{{ID: "a", Version: 2}, {ID: "b", Version: 5}, {ID: "c", Version: 1}} {
+		if err := mc.insertOne(c); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	got, err := mc.find(bson.M{}, bson.D{{Key: "version", Value: -1}}, 2)
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if len(got) != 2 || got[0]["_id"] != "b" || got[1]["_id"] != "a" {
+		t.Fatalf("unexpected order: %v", got)
+	}
+}
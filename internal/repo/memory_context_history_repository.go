@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryContextHistoryRepository is the in-memory counterpart of
+// MongoContextHistoryRepository, meant for unit tests.
+type MemoryContextHistoryRepository struct {
+	log        *logger.Logger
+	collection *memCollection
+	store      memHistoryStore
+}
+
+func NewMemoryContextHistoryRepository(log *logger.Logger) *MemoryContextHistoryRepository {
+	store := memHistoryStore{histories: newMemCollection(), blobs: newMemCollection()}
+	return &MemoryContextHistoryRepository{
+		log:        log,
+		collection: store.histories,
+		store:      store,
+	}
+}
+
+func (m *MemoryContextHistoryRepository) GetByID(ctx context.Context, id string) (*entities.ContextHistory, error) {
+	return m.findOne(ctx, bson.M{"_id": id})
+}
+
+func (m *MemoryContextHistoryRepository) GetByVersion(ctx context.Context, cid string, version int) (*entities.ContextHistory, error) {
+	return m.findOne(ctx, MainLine(bson.M{"contextId": cid, "version": version}))
+}
+
+func (m *MemoryContextHistoryRepository) findOne(ctx context.Context, filter bson.M) (*entities.ContextHistory, error) {
+	histories, err := m.find(ctx, filter, nil, 1, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(histories) == 0 {
+		return nil, ErrContextHistoryNotFound
+	}
+	return histories[0], nil
+}
+
+func (m *MemoryContextHistoryRepository) Create(ctx context.Context, ch *entities.ContextHistory) (*entities.ContextHistory, error) {
+	return m.create(ctx, ch, "")
+}
+
+func (m *MemoryContextHistoryRepository) create(ctx context.Context, ch *entities.ContextHistory, branch string) (*entities.ContextHistory, error) {
+	if ch.CreatedTime.IsZero() {
+		ch.CreatedTime = time.Now()
+	}
+	doc, err := encodeHistory(ctx, m.store, ch, branch)
+	if err != nil {
+		m.log.Errorf("Error storing the content of context history: %v", err)
+		return nil, err
+	}
+	if err := m.collection.insertOne(doc); err != nil {
+		m.log.Errorf("Error inserting context history: %v", err)
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (m *MemoryContextHistoryRepository) CreateMany(ctx context.Context, chs []*entities.ContextHistory) error {
+	for _, ch := range chs {
+		if _, err := m.Create(ctx, ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update replaces a history entry as long as its stored version still matches.
+// The content is left as is, since later versions may be stored as deltas
+// against it. The mongo repository does not support updating history entries.
+func (m *MemoryContextHistoryRepository) Update(ctx context.Context, ch *entities.ContextHistory) (*entities.ContextHistory, error) {
+	doc, err := toBsonM(ch)
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, "_id")
+	delete(doc, contentField)
+	updated, err := m.collection.updateOne(bson.M{"_id": ch.ID, "version": ch.Version}, bson.M{"$set": doc})
+	if err != nil {
+		return nil, err
+	}
+	if updated == nil {
+		return nil, ErrContextHistoryVersionMismatch
+	}
+	histories, err := decodeHistories(ctx, m.store, []bson.M{updated}, false)
+	if err != nil {
+		return nil, err
+	}
+	return histories[0], nil
+}
+
+func (m *MemoryContextHistoryRepository) Delete(ctx context.Context, id string) error {
+	n, err := deleteHistories(ctx, m.store, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrContextHistoryNotFound
+	}
+	return nil
+}
+
+func (m *MemoryContextHistoryRepository) DeleteByContextIDs(ctx context.Context, cids []string) (int64, error) {
+	return deleteHistories(ctx, m.store, bson.M{"contextId": bson.M{"$in": cids}})
+}
+
+func (m *MemoryContextHistoryRepository) DeleteByIDs(ctx context.Context, ids []string) (int64, error) {
+	return deleteHistories(ctx, m.store, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (m *MemoryContextHistoryRepository) ContextIDs(ctx context.Context, after string, limit int) ([]string, error) {
+	docs, err := m.collection.find(bson.M{"contextId": bson.M{"$gt": after}}, bson.D{{Key: "contextId", Value: 1}}, 0)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, doc := range docs {
+		cid, _ := doc["contextId"].(string)
+		if len(ids) > 0 && ids[len(ids)-1] == cid {
+			continue
+		}
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, cid)
+	}
+	return ids, nil
+}
+
+func (m *MemoryContextHistoryRepository) Filter(ctx context.Context, filter interface{}) ([]*entities.ContextHistory, error) {
+	return m.find(ctx, filter, nil, 0, false)
+}
+
+func (m *MemoryContextHistoryRepository) ListByContextID(ctx context.Context, cid string, page query.Page) (*ContextHistoryPage, error) {
+	histories, err := m.find(ctx, pageFilter(MainLine(bson.M{"contextId": cid}), page), pageSort(page), page.Limit+1, page.OmitContent)
+	if err != nil {
+		return nil, err
+	}
+	return newContextHistoryPage(histories, page), nil
+}
+
+func (m *MemoryContextHistoryRepository) find(ctx context.Context, filter interface{}, sort bson.D, limit int, omitContent bool) ([]*entities.ContextHistory, error) {
+	docs, err := m.collection.find(filter, sort, limit)
+	if err != nil {
+		m.log.Errorf("Error finding documents: %v", err)
+		return nil, err
+	}
+	histories, err := decodeHistories(ctx, m.store, docs, omitContent)
+	if err != nil {
+		m.log.Errorf("Error decoding documents: %v", err)
+		return nil, err
+	}
+	return histories, nil
+}
+
+func (m *MemoryContextHistoryRepository) Close() {}
+
+func decodeContextHistory(doc bson.M) (*entities.ContextHistory, error) {
+	ch := &entities.ContextHistory{}
+	if err := fromBsonM(doc, ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (m *MemoryContextHistoryRepository) StoredSizes(ctx context.Context, ids []string) (map[string]int64, error) {
+	return storedSizes(ctx, m.store, ids)
+}
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryContextRepository is a ContextRepository kept entirely in memory. It
+// mirrors MongoContextRepository, including the version-checked Update, and is
+// meant for unit tests that should not need a running mongo.
+type MemoryContextRepository struct {
+	log         *logger.Logger
+	collection  *memCollection
+	labelMoves  *memCollection
+	tokenCounts *memCollection
+}
+
+func NewMemoryContextRepository(log *logger.Logger) *MemoryContextRepository {
+	return &MemoryContextRepository{
+		log:         log,
+		collection:  newMemCollection(),
+		labelMoves:  newMemCollection(),
+		tokenCounts: newMemCollection(),
+	}
+}
+
+func (mcr *MemoryContextRepository) GetByID(ctx context.Context, id string) (*entities.Context, error) {
+	doc, err := mcr.collection.findOne(notTrashed(bson.M{"_id": id}))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrContextNotFound
+	}
+	return decodeContext(doc)
+}
+
+func (mcr *MemoryContextRepository) Create(ctx context.Context, c *entities.Context) (*entities.Context, error) {
+	if err := mcr.collection.insertOne(c); err != nil {
+		mcr.log.Errorf("Error inserting context: %v", err)
+		return nil, err
+	}
+	return mcr.GetByID(ctx, c.ID)
+}
+
+func (mcr *MemoryContextRepository) Update(ctx context.Context, nc *entities.Context) (*entities.Context, error) {
+	filter := notTrashed(bson.M{
+		"_id":     nc.ID,
+		"version": nc.Version,
+	})
+	nc.Version++
+	nc.ModifiedTime = time.Now().UTC()
+
+	doc, err := mcr.collection.updateOne(filter, contextUpdate(nc))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		mcr.log.Errorf("Error updating context in memory: no document for id %s and version %d", nc.ID, nc.Version-1)
+		return nil, ErrContextVersionMismatch
+	}
+	return decodeContext(doc)
+}
+
+func (mcr *MemoryContextRepository) Delete(ctx context.Context, id string) error {
+	if !mcr.collection.deleteOne(id) {
+		return ErrContextNotFound
+	}
+	_, err := mcr.tokenCounts.deleteMany(bson.M{"contextId": id})
+	return err
+}
+
+func (mcr *MemoryContextRepository) Filter(ctx context.Context, filter interface{}) ([]*entities.Context, error) {
+	return mcr.find(filter, nil, 0)
+}
+
+func (mcr *MemoryContextRepository) find(filter interface{}, sort bson.D, limit int) ([]*entities.Context, error) {
+	docs, err := mcr.collection.find(filter, sort, limit)
+	if err != nil {
+		mcr.log.Errorf("Error finding documents: %v", err)
+		return nil, err
+	}
+	contexts := make([]*entities.Context, 0, len(docs))
+	for _, doc := range docs {
+		c, err := decodeContext(doc)
+		if err != nil {
+			mcr.log.Errorf("Error decoding documents: %v", err)
+			return nil, err
+		}
+		contexts = append(contexts, c)
+	}
+	return contexts, nil
+}
+
+func (mcr *MemoryContextRepository) Query(ctx context.Context, q *query.ContextQuery, page query.Page) (*ContextPage, error) {
+	contexts, err := mcr.find(pageFilter(notTrashed(compileContextQuery(q)), page), pageSort(page), page.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if page.OmitContent {
+		for _, c := range contexts {
+			c.Content = ""
+		}
+	}
+	return newContextPage(contexts, page), nil
+}
+
+// CheckFilterable always passes, the in-memory repository encrypts nothing.
+func (mcr *MemoryContextRepository) CheckFilterable(ctx context.Context, tenantIDs []string) error {
+	return nil
+}
+
+// SweepContentFiles has nothing to do, the in-memory repository keeps the
+// content inline.
+func (mcr *MemoryContextRepository) SweepContentFiles(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (mcr *MemoryContextRepository) Close() {}
+
+func decodeContext(doc bson.M) (*entities.Context, error) {
+	c := &entities.Context{}
+	if err := fromBsonM(doc, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,98 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func newTestLogger(t *testing.T) *logger.Logger {
+	t.Helper()
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatalf("creating logger: %v", err)
+	}
+	return log
+}
+
+func TestMemoryContextRepositoryUpdate(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextRepository(newTestLogger(t))
+
+	if _, err := r.Create(ctx, &entities.Context{ID: "c1", Name: "first", Version: 1, Tags: []string{"a"}}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	updated, err := r.Update(ctx, &entities.Context{ID: "c1", Name: "second", Version: 1})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if updated.Version != 2 || updated.Name != "second" || len(updated.Tags) != 0 {
+		t.Fatalf("unexpected update result: %+v", updated)
+	}
+
+	if _, err := r.Update(ctx, &entities.Context{ID: "c1", Name: "stale", Version: 1}); !errors.Is(err, ErrContextVersionMismatch) {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+	if _, err := r.GetByID(ctx, "missing"); !errors.Is(err, ErrContextNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := r.Delete(ctx, "c1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := r.Delete(ctx, "c1"); !errors.Is(err, ErrContextNotFound) {
+		t.Fatalf("expected not found on second delete, got %v", err)
+	}
+}
+
+func TestUpdateDropsLegacyAccessFields(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextRepository(newTestLogger(t))
+	legacy := bson.M{"_id": "c1", "name": "n", "version": 2, "tenant": bson.A{bson.M{"_id": "t1"}}, "tenants": bson.A{bson.M{"_id": "t2"}}}
+	if err := r.collection.insertOne(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Update(ctx, &entities.Context{ID: "c1", Name: "n", Version: 2, Tenants: []entities.TenantStub{{ID: "t3"}}}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	doc, err := r.collection.findOne(bson.M{"_id": "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := doc["tenants"]; ok {
+		t.Fatalf("the legacy key was kept: %v", doc)
+	}
+	c, err := r.GetByID(ctx, "c1")
+	if err != nil || len(c.Tenants) != 1 || c.Tenants[0].ID != "t3" {
+		t.Fatalf("expected tenant t3, got %+v, %v", c, err)
+	}
+}
+
+func TestMemoryContextHistoryRepositoryFilter(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextHistoryRepository(newTestLogger(t))
+	for _, ch := range []*entities.ContextHistory{
+		{ID: "h1", ContextID: "c1", Version: 1},
+		{ID: "h2", ContextID: "c1", Version: 2},
+		{ID: "h3", ContextID: "c2", Version: 1},
+	} {
+		if _, err := r.Create(ctx, ch); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	list, err := r.Filter(ctx, map[string]interface{}{"contextId": "c1"})
+	if err != nil {
+		t.Fatalf("filter: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 history entries, got %d", len(list))
+	}
+	if _, err := r.GetByID(ctx, "nope"); !errors.Is(err, ErrContextHistoryNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
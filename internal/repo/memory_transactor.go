@@ -0,0 +1,80 @@
+package repo
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memBacked is implemented by the in-memory repositories so that a
+// MemoryTransactor can snapshot and restore their collections.
+type memBacked interface {
+	memStores() []*memCollection
+}
+
+func (mcr *MemoryContextRepository) memStores() []*memCollection {
+	return []*memCollection{mcr.collection, mcr.labelMoves, mcr.tokenCounts}
+}
+
+func (m *MemoryContextHistoryRepository) memStores() []*memCollection {
+	return []*memCollection{m.store.histories, m.store.blobs}
+}
+
+// MemoryTransactor is a Transactor for the in-memory repositories. Transactions
+// are serialized and the participating collections are restored to their
+// previous state when fn returns an error.
+type MemoryTransactor struct {
+	mu          sync.Mutex
+	collections []*memCollection
+}
+
+func NewMemoryTransactor(repos ...memBacked) *MemoryTransactor {
+	mt := &MemoryTransactor{}
+	for _, r := range repos {
+		mt.collections = append(mt.collections, r.memStores()...)
+	}
+	return mt
+}
+
+func (mt *MemoryTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	snapshots := make([]memSnapshot, len(mt.collections))
+	for i, c := range mt.collections {
+		snapshots[i] = c.snapshot()
+	}
+	if err := fn(ctx); err != nil {
+		for i, c := range mt.collections {
+			c.restore(snapshots[i])
+		}
+		return err
+	}
+	return nil
+}
+
+type memSnapshot struct {
+	docs  map[string]bson.M
+	order []string
+}
+
+func (mc *memCollection) snapshot() memSnapshot {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	s := memSnapshot{
+		docs:  make(map[string]bson.M, len(mc.docs)),
+		order: append([]string(nil), mc.order...),
+	}
+	for id, doc := range mc.docs {
+		s.docs[id] = copyDoc(doc)
+	}
+	return s
+}
+
+func (mc *memCollection) restore(s memSnapshot) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.docs = s.docs
+	mc.order = s.order
+}
@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type ContextPage struct {
+	Items      []*entities.Context `json:"items"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+type ContextHistoryPage struct {
+	Items      []*entities.ContextHistory `json:"items"`
+	NextCursor string                     `json:"nextCursor,omitempty"`
+}
+
+// pageSort is the sort document of a page, with _id as the tie breaker.
+func pageSort(p query.Page) bson.D {
+	dir := 1
+	if p.Desc {
+		dir = -1
+	}
+	return bson.D{{Key: string(p.Sort), Value: dir}, {Key: "_id", Value: dir}}
+}
+
+// pageFilter adds the keyset condition selecting the items after p.After to filter.
+func pageFilter(filter bson.M, p query.Page) bson.M {
+	if p.After == nil {
+		return filter
+	}
+	op := "$gt"
+	if p.Desc {
+		op = "$lt"
+	}
+	key := string(p.Sort)
+	after := bson.M{"$or": bson.A{
+		bson.M{key: bson.M{op: p.After.Value}},
+		bson.M{key: p.After.Value, "_id": bson.M{op: p.After.ID}},
+	}}
+	if len(filter) == 0 {
+		return after
+	}
+	return bson.M{"$and": bson.A{filter, after}}
+}
+
+func contextSortValue(c *entities.Context, key query.SortKey) interface{} {
+	switch key {
+	case query.SortCreatedTime:
+		return c.CreatedTime
+	case query.SortName:
+		return c.Name
+	case query.SortVersion:
+		return c.Version
+	default:
+		return c.ModifiedTime
+	}
+}
+
+func historySortValue(ch *entities.ContextHistory, key query.SortKey) interface{} {
+	if key == query.SortCreatedTime {
+		return ch.CreatedTime
+	}
+	return ch.Version
+}
+
+// trimPage drops the extra item fetched to detect a following page and
+// derives the next cursor from the last item kept.
+func trimPage[T any](items []T, p query.Page, position func(T) (interface{}, string)) ([]T, string) {
+	if len(items) <= p.Limit {
+		if items == nil {
+			items = []T{}
+		}
+		return items, ""
+	}
+	items = items[:p.Limit]
+	value, id := position(items[p.Limit-1])
+	return items, p.NewCursor(value, id).Encode()
+}
+
+func newContextPage(items []*entities.Context, p query.Page) *ContextPage {
+	page := &ContextPage{}
+	page.Items, page.NextCursor = trimPage(items, p, func(c *entities.Context) (interface{}, string) {
+		return contextSortValue(c, p.Sort), c.ID
+	})
+	return page
+}
+
+func newContextHistoryPage(items []*entities.ContextHistory, p query.Page) *ContextHistoryPage {
+	page := &ContextHistoryPage{}
+	page.Items, page.NextCursor = trimPage(items, p, func(ch *entities.ContextHistory) (interface{}, string) {
+		return historySortValue(ch, p.Sort), ch.ID
+	})
+	return page
+}
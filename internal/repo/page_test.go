@@ -0,0 +1,104 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestQueryContextsPagination(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextRepository(newTestLogger(t))
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		c := &entities.Context{
+			ID:           fmt.Sprintf("c%d", i),
+			Name:         fmt.Sprintf("n%d", i%3),
+			Version:      1,
+			ModifiedTime: base.Add(time.Duration(i/2) * time.Hour),
+		}
+		if _, err := r.Create(ctx, c); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	for _, sort := range []string{"-modifiedTime", "name", "-version"} {
+		t.Run(sort, func(t *testing.T) {
+			seen := map[string]bool{}
+			values := url.Values{"sort": {sort}, "limit": {"3"}}
+			var prev *entities.Context
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatalf("pagination does not terminate")
+				}
+				page, err := query.ParsePage(values, query.ContextSortKeys, "-modifiedTime")
+				if err != nil {
+					t.Fatalf("parse page: %v", err)
+				}
+				res, err := r.Query(ctx, &query.ContextQuery{}, page)
+				if err != nil {
+					t.Fatalf("query: %v", err)
+				}
+				for _, c := range res.Items {
+					if seen[c.ID] {
+						t.Fatalf("%s returned twice", c.ID)
+					}
+					seen[c.ID] = true
+					if prev != nil && sort == "name" && prev.Name > c.Name {
+						t.Fatalf("%s sorted after %s", c.Name, prev.Name)
+					}
+					if prev != nil && sort == "-modifiedTime" && prev.ModifiedTime.Before(c.ModifiedTime) {
+						t.Fatalf("%v sorted after %v", c.ModifiedTime, prev.ModifiedTime)
+					}
+					prev = c
+				}
+				if res.NextCursor == "" {
+					break
+				}
+				values.Set("cursor", res.NextCursor)
+			}
+			if len(seen) != 7 {
+				t.Fatalf("expected all 7 contexts, got %d", len(seen))
+			}
+		})
+	}
+}
+
+func TestListHistoryByContextID(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemoryContextHistoryRepository(newTestLogger(t))
+	for v := 1; v <= 5; v++ {
+		if _, err := r.Create(ctx, &entities.ContextHistory{ID: fmt.Sprintf("h%d", v), ContextID: "c1", Version: v}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if _, err := r.Create(ctx, &entities.ContextHistory{ID: "other", ContextID: "c2", Version: 1}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	page := query.Page{Sort: query.SortVersion, Desc: true, Limit: 2}
+	first, err := r.ListByContextID(ctx, "c1", page)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(first.Items) != 2 || first.Items[0].Version != 5 || first.NextCursor == "" {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+	page.After, err = query.DecodeCursor(first.NextCursor)
+	if err != nil {
+		t.Fatalf("decode cursor: %v", err)
+	}
+	page.Limit = 10
+	rest, err := r.ListByContextID(ctx, "c1", page)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(rest.Items) != 3 || rest.Items[0].Version != 3 || rest.NextCursor != "" {
+		t.Fatalf("unexpected second page: %+v", rest)
+	}
+}
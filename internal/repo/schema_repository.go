@@ -0,0 +1,280 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrSchemaNotFound = errors.New("schema not found")
+	// ErrSchemaConflict is returned when registering a schema for a kind or a
+	// tag another schema is registered for.
+	ErrSchemaConflict = errors.New("another schema is registered for the kind or tag")
+)
+
+// MetadataSchema is a JSON Schema the metadata of contexts must follow. It
+// applies to the contexts whose metadata names it under schema, and to those
+// of its Kind, per their metadata kind, or carrying its Tag. A kind or a tag
+// has at most one schema.
+type MetadataSchema struct {
+	Name         string            `json:"name" bson:"_id"`
+	Kind         string            `json:"kind,omitempty" bson:"kind,omitempty"`
+	Tag          string            `json:"tag,omitempty" bson:"tag,omitempty"`
+	Description  string            `json:"description,omitempty" bson:"description,omitempty"`
+	Schema       json.RawMessage   `json:"schema" bson:"-"`
+	Version      int               `json:"version" bson:"version"`
+	ModifiedBy   entities.UserStub `json:"modifiedBy,omitempty" bson:"modifiedBy,omitempty"`
+	CreatedTime  time.Time         `json:"createdTime" bson:"createdTime"`
+	ModifiedTime time.Time         `json:"modifiedTime" bson:"modifiedTime"`
+}
+
+// schemaDoc stores the schema as its JSON text, which stays readable in the
+// collection.
+type schemaDoc struct {
+	MetadataSchema `bson:",inline"`
+	Source         string `bson:"schema"`
+}
+
+func (d *schemaDoc) toSchema() *MetadataSchema {
+	s := d.MetadataSchema
+	s.Schema = json.RawMessage(d.Source)
+	return &s
+}
+
+// schemaUpdate writes s over the stored schema of its name, bumping its
+// version.
+func schemaUpdate(s *MetadataSchema, now time.Time) bson.M {
+	set := bson.M{"schema": string(s.Schema), "modifiedBy": s.ModifiedBy, "modifiedTime": now}
+	unset := bson.M{}
+	for field, v := range map[string]string{"kind": s.Kind, "tag": s.Tag, "description": s.Description} {
+		if v == "" {
+			unset[field] = ""
+		} else {
+			set[field] = v
+		}
+	}
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// applicableTo matches the schemas named, registered for kind, or for one of
+// tags.
+func applicableTo(names []string, kind string, tags []string) bson.M {
+	or := bson.A{}
+	if len(names) > 0 {
+		or = append(or, bson.M{"_id": bson.M{"$in": names}})
+	}
+	if kind != "" {
+		or = append(or, bson.M{"kind": kind})
+	}
+	if len(tags) > 0 {
+		or = append(or, bson.M{"tag": bson.M{"$in": tags}})
+	}
+	return bson.M{"$or": or}
+}
+
+var schemaOrder = bson.D{{Key: "_id", Value: 1}}
+
+type SchemaRepository interface {
+	Get(ctx context.Context, name string) (*MetadataSchema, error)
+	List(ctx context.Context) ([]*MetadataSchema, error)
+	// Put registers s, or replaces the schema of its name, and returns it as
+	// stored.
+	Put(ctx context.Context, s *MetadataSchema) (*MetadataSchema, error)
+	Delete(ctx context.Context, name string) error
+	// Applicable returns the schemas among names, and those registered for
+	// kind or for one of tags, sorted by name.
+	Applicable(ctx context.Context, names []string, kind string, tags []string) ([]*MetadataSchema, error)
+}
+
+type MongoSchemaRepository struct {
+	log        *logger.Logger
+	collection *mongo.Collection
+}
+
+func NewSchemaRepository(cfg *config.Config, log *logger.Logger, client mongo.Client) SchemaRepository {
+	return &MongoSchemaRepository{
+		log:        log,
+		collection: client.Database(cfg.Mongo.Database).Collection(SchemasCollection),
+	}
+}
+
+func (msr *MongoSchemaRepository) Get(ctx context.Context, name string) (*MetadataSchema, error) {
+	var d schemaDoc
+	err := msr.collection.FindOne(ctx, bson.M{"_id": name}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrSchemaNotFound
+	}
+	if err != nil {
+		msr.log.Errorf("Error getting schema %s: %v", name, err)
+		return nil, err
+	}
+	return d.toSchema(), nil
+}
+
+func (msr *MongoSchemaRepository) List(ctx context.Context) ([]*MetadataSchema, error) {
+	return msr.find(ctx, bson.M{})
+}
+
+func (msr *MongoSchemaRepository) Put(ctx context.Context, s *MetadataSchema) (*MetadataSchema, error) {
+	now := time.Now()
+	update := schemaUpdate(s, now)
+	update["$setOnInsert"] = bson.M{"createdTime": now}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var d schemaDoc
+	err := msr.collection.FindOneAndUpdate(ctx, bson.M{"_id": s.Name}, update, opts).Decode(&d)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrSchemaConflict
+	}
+	if err != nil {
+		msr.log.Errorf("Error putting schema %s: %v", s.Name, err)
+		return nil, err
+	}
+	return d.toSchema(), nil
+}
+
+func (msr *MongoSchemaRepository) Delete(ctx context.Context, name string) error {
+	res, err := msr.collection.DeleteOne(ctx, bson.M{"_id": name})
+	if err != nil {
+		msr.log.Errorf("Error deleting schema %s: %v", name, err)
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrSchemaNotFound
+	}
+	return nil
+}
+
+func (msr *MongoSchemaRepository) Applicable(ctx context.Context, names []string, kind string, tags []string) ([]*MetadataSchema, error) {
+	filter := applicableTo(names, kind, tags)
+	if len(filter["$or"].(bson.A)) == 0 {
+		return nil, nil
+	}
+	return msr.find(ctx, filter)
+}
+
+func (msr *MongoSchemaRepository) find(ctx context.Context, filter bson.M) ([]*MetadataSchema, error) {
+	cur, err := msr.collection.Find(ctx, filter, options.Find().SetSort(schemaOrder))
+	if err != nil {
+		msr.log.Errorf("Error finding schemas: %v", err)
+		return nil, err
+	}
+	var docs []schemaDoc
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	schemas := make([]*MetadataSchema, 0, len(docs))
+	for i := range docs {
+		schemas = append(schemas, docs[i].toSchema())
+	}
+	return schemas, nil
+}
+
+// MemorySchemaRepository is a SchemaRepository backed by memory, for tests.
+type MemorySchemaRepository struct {
+	collection *memCollection
+}
+
+func NewMemorySchemaRepository() *MemorySchemaRepository {
+	return &MemorySchemaRepository{collection: newMemCollection()}
+}
+
+func (m *MemorySchemaRepository) memStores() []*memCollection {
+	return []*memCollection{m.collection}
+}
+
+func (m *MemorySchemaRepository) Get(ctx context.Context, name string) (*MetadataSchema, error) {
+	doc, err := m.collection.findOne(bson.M{"_id": name})
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrSchemaNotFound
+	}
+	var d schemaDoc
+	if err := fromBsonM(doc, &d); err != nil {
+		return nil, err
+	}
+	return d.toSchema(), nil
+}
+
+func (m *MemorySchemaRepository) List(ctx context.Context) ([]*MetadataSchema, error) {
+	return m.find(bson.M{})
+}
+
+// Put checks the unicity of the kind and the tag itself, which the indexes of
+// the collection ensure in MongoDB.
+func (m *MemorySchemaRepository) Put(ctx context.Context, s *MetadataSchema) (*MetadataSchema, error) {
+	if s.Kind != "" || s.Tag != "" {
+		others, err := m.collection.find(bson.M{"_id": bson.M{"$ne": s.Name}, "$or": bson.A{bson.M{"kind": s.Kind}, bson.M{"tag": s.Tag}}}, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range others {
+			if (s.Kind != "" && o["kind"] == s.Kind) || (s.Tag != "" && o["tag"] == s.Tag) {
+				return nil, ErrSchemaConflict
+			}
+		}
+	}
+	now := time.Now()
+	doc, err := m.collection.updateOne(bson.M{"_id": s.Name}, schemaUpdate(s, now))
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		d := schemaDoc{MetadataSchema: *s, Source: string(s.Schema)}
+		d.Version, d.CreatedTime, d.ModifiedTime = 1, now, now
+		if err := m.collection.insertOne(d); err != nil {
+			return nil, err
+		}
+		return m.Get(ctx, s.Name)
+	}
+	var d schemaDoc
+	if err := fromBsonM(doc, &d); err != nil {
+		return nil, err
+	}
+	return d.toSchema(), nil
+}
+
+func (m *MemorySchemaRepository) Delete(ctx context.Context, name string) error {
+	if !m.collection.deleteOne(name) {
+		return ErrSchemaNotFound
+	}
+	return nil
+}
+
+func (m *MemorySchemaRepository) Applicable(ctx context.Context, names []string, kind string, tags []string) ([]*MetadataSchema, error) {
+	filter := applicableTo(names, kind, tags)
+	if len(filter["$or"].(bson.A)) == 0 {
+		return nil, nil
+	}
+	return m.find(filter)
+}
+
+func (m *MemorySchemaRepository) find(filter bson.M) ([]*MetadataSchema, error) {
+	docs, err := m.collection.find(filter, schemaOrder, 0)
+	if err != nil {
+		return nil, err
+	}
+	schemas := make([]*MetadataSchema, 0, len(docs))
+	for _, doc := range docs {
+		var d schemaDoc
+		if err := fromBsonM(doc, &d); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, d.toSchema())
+	}
+	return schemas, nil
+}
@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+const (
+	transientTransactionError      = "TransientTransactionError"
+	unknownTransactionCommitResult = "UnknownTransactionCommitResult"
+	maxTransactionAttempts         = 5
+)
+
+// Transactor runs fn so that every repository call made with the context it
+// receives commits or aborts together. fn may be called more than once when
+// the transaction is retried, so it must not leak state between attempts.
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type MongoTransactor struct {
+	log    *logger.Logger
+	client *mongo.Client
+}
+
+func NewMongoTransactor(log *logger.Logger, client *mongo.Client) Transactor {
+	return &MongoTransactor{
+		log:    log,
+		client: client,
+	}
+}
+
+func (mt *MongoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	sess, err := mt.client.StartSession()
+	if err != nil {
+		mt.log.Errorf("Error starting mongo session: %v", err)
+		return err
+	}
+	defer sess.EndSession(context.Background())
+
+	txnOpts := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.Majority())
+
+	for attempt := 1; ; attempt++ {
+		err = mongo.WithSession(ctx, sess, func(sc mongo.SessionContext) error {
+			if err := sess.StartTransaction(txnOpts); err != nil {
+				return err
+			}
+			if err := fn(sc); err != nil {
+				_ = sess.AbortTransaction(context.Background())
+				return err
+			}
+			return commitWithRetry(sc, sess)
+		})
+		if err == nil || !hasErrorLabel(err, transientTransactionError) || attempt >= maxTransactionAttempts {
+			return err
+		}
+		mt.log.Errorf("Transient transaction error, retrying (attempt %d of %d): %v", attempt, maxTransactionAttempts, err)
+	}
+}
+
+func commitWithRetry(sc mongo.SessionContext, sess mongo.Session) error {
+	var err error
+	for attempt := 1; attempt <= maxTransactionAttempts; attempt++ {
+		err = sess.CommitTransaction(sc)
+		if err == nil || !hasErrorLabel(err, unknownTransactionCommitResult) {
+			return err
+		}
+	}
+	return err
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var le mongo.LabeledError
+	return errors.As(err, &le) && le.HasErrorLabel(label)
+}
@@ -0,0 +1,158 @@
+package settings
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/codec"
+	"github.com/spf13/viper"
+)
+
+const key = "contexts"
+
+// Settings are the options specific to the context service. They live under
+// the contexts key of the application config, which config.GetConfig must
+// have loaded already.
+type Settings struct {
+	Trash      TrashSettings      `mapstructure:"trash"`
+	History    HistorySettings    `mapstructure:"history"`
+	Storage    StorageSettings    `mapstructure:"storage"`
+	Encryption EncryptionSettings `mapstructure:"encryption"`
+}
+
+type TrashSettings struct {
+	// Retention is how long a context stays in the trash before it is purged.
+	Retention     time.Duration `mapstructure:"retention"`
+	PurgeInterval time.Duration `mapstructure:"purgeInterval"`
+	// PurgeBatch is the number of contexts purged per transaction.
+	PurgeBatch int `mapstructure:"purgeBatch"`
+}
+
+// Validate checks that the purge interval and batch are positive.
+func (t TrashSettings) Validate() error {
+	if t.PurgeInterval <= 0 {
+		return fmt.Errorf("trash purgeInterval must be positive, got %s", t.PurgeInterval)
+	}
+	if t.PurgeBatch <= 0 {
+		return fmt.Errorf("trash purgeBatch must be positive, got %d", t.PurgeBatch)
+	}
+	return nil
+}
+
+// HistorySettings configure the compaction of the context history. The
+// global retention policy applies to every context unless one of its tenants
+// has a policy of its own.
+type HistorySettings struct {
+	Retention       RetentionPolicy         `mapstructure:"retention"`
+	Tenants         []TenantRetentionPolicy `mapstructure:"tenants"`
+	CompactInterval time.Duration           `mapstructure:"compactInterval"`
+	// CompactBatch is the number of contexts whose history is loaded at once.
+	CompactBatch int `mapstructure:"compactBatch"`
+}
+
+// Validate checks that the compact interval and batch are positive.
+func (h HistorySettings) Validate() error {
+	if h.CompactInterval <= 0 {
+		return fmt.Errorf("history compactInterval must be positive, got %s", h.CompactInterval)
+	}
+	if h.CompactBatch <= 0 {
+		return fmt.Errorf("history compactBatch must be positive, got %d", h.CompactBatch)
+	}
+	return nil
+}
+
+// RetentionPolicy decides which versions of a context history are kept. A
+// version is kept when it is one of the last KeepLast versions or younger
+// than KeepDays days. With DailySnapshots the older versions are thinned to
+// the latest one of each day instead of being removed. The zero policy keeps
+// everything.
+type RetentionPolicy struct {
+	KeepLast       int  `mapstructure:"keepLast" json:"keepLast,omitempty"`
+	KeepDays       int  `mapstructure:"keepDays" json:"keepDays,omitempty"`
+	DailySnapshots bool `mapstructure:"dailySnapshots" json:"dailySnapshots,omitempty"`
+}
+
+type TenantRetentionPolicy struct {
+	TenantID        string `mapstructure:"tenantId"`
+	RetentionPolicy `mapstructure:",squash"`
+}
+
+// IsZero reports whether the policy keeps every version.
+func (p RetentionPolicy) IsZero() bool {
+	return p.KeepLast <= 0 && p.KeepDays <= 0 && !p.DailySnapshots
+}
+
+// PolicyFor returns the policy of the first of the tenants that has one, or
+// the global policy.
+func (h HistorySettings) PolicyFor(tenantIDs []string) RetentionPolicy {
+	for _, id := range tenantIDs {
+		for _, t := range h.Tenants {
+			if t.TenantID == id {
+				return t.RetentionPolicy
+			}
+		}
+	}
+	return h.Retention
+}
+
+// StorageSettings configure how the content is stored, per collection.
+type StorageSettings struct {
+	Contexts  CollectionStorage `mapstructure:"contexts"`
+	Histories CollectionStorage `mapstructure:"histories"`
+}
+
+type CollectionStorage struct {
+	// OffloadThreshold is the content size in bytes above which the content
+	// is stored in GridFS rather than in the document. Zero disables it. It
+	// applies to the content once compressed.
+	OffloadThreshold int `mapstructure:"offloadThreshold"`
+	// Compression is the codec compressing the content: none, zstd or snappy.
+	Compression string `mapstructure:"compression"`
+	// CompressThreshold is the content size in bytes above which the content
+	// is compressed.
+	CompressThreshold int `mapstructure:"compressThreshold"`
+}
+
+type EncryptionSettings struct {
+	// KeyringFile is the JSON file holding the tenant keys, see
+	// encryption.Keyring. Nothing is encrypted when it is empty.
+	KeyringFile string `mapstructure:"keyringFile"`
+}
+
+func Default() *Settings {
+	return &Settings{
+		Trash: TrashSettings{
+			Retention:     30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+			PurgeBatch:    100,
+		},
+		History: HistorySettings{
+			CompactInterval: 6 * time.Hour,
+			CompactBatch:    100,
+		},
+		Storage: StorageSettings{
+			Contexts:  CollectionStorage{OffloadThreshold: 4 << 20, CompressThreshold: 1 << 10},
+			Histories: CollectionStorage{OffloadThreshold: 4 << 20, CompressThreshold: 1 << 10},
+		},
+	}
+}
+
+// Load returns the defaults overridden by the values set in the config.
+func Load() (*Settings, error) {
+	s := Default()
+	if err := viper.UnmarshalKey(key, s); err != nil {
+		return nil, err
+	}
+	for name, cs := range map[string]CollectionStorage{"contexts": s.Storage.Contexts, "histories": s.Storage.Histories} {
+		if _, err := codec.Parse(cs.Compression); err != nil {
+			return nil, fmt.Errorf("storage of %s: %w", name, err)
+		}
+	}
+	if err := s.Trash.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.History.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,321 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const MaxBatchSize = 500
+
+type BatchOp string
+
+const (
+	BatchCreate BatchOp = "create"
+	BatchUpdate BatchOp = "update"
+	BatchDelete BatchOp = "delete"
+)
+
+// BatchOperation is one operation of a batch. A create takes Context, which
+// gets a new id unless it has one. An update takes Context with its id and the
+// version it applies to, like UpdateContext. A delete takes ID, and Version
+// when it must only apply to that version.
+type BatchOperation struct {
+	Op      BatchOp           `json:"op"`
+	ID      string            `json:"id,omitempty"`
+	Version int               `json:"version,omitempty"`
+	Context *entities.Context `json:"context,omitempty"`
+}
+
+type BatchStatus string
+
+const (
+	BatchCreated BatchStatus = "created"
+	BatchUpdated BatchStatus = "updated"
+	BatchDeleted BatchStatus = "deleted"
+	BatchFailed  BatchStatus = "failed"
+	// BatchAborted is the status of the operations of an atomic batch that
+	// was rolled back because of another operation.
+	BatchAborted BatchStatus = "aborted"
+)
+
+// BatchErrorCode tells why an operation failed.
+type BatchErrorCode string
+
+const (
+	BatchInvalid         BatchErrorCode = "invalid"
+	BatchNotFound        BatchErrorCode = "not_found"
+	BatchExists          BatchErrorCode = "exists"
+	BatchVersionConflict BatchErrorCode = "version_conflict"
+	BatchInternal        BatchErrorCode = "internal"
+)
+
+// BatchResult reports on the operation at Index. Version is the version it
+// wrote.
+type BatchResult struct {
+	Index   int            `json:"index"`
+	Op      BatchOp        `json:"op"`
+	ID      string         `json:"id,omitempty"`
+	Status  BatchStatus    `json:"status"`
+	Version int            `json:"version,omitempty"`
+	Code    BatchErrorCode `json:"code,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// BatchReport is the outcome of a batch. Committed is false when an atomic
+// batch was rolled back, in which case nothing was written.
+type BatchReport struct {
+	Atomic    bool          `json:"atomic"`
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+var errBatchRolledBack = errors.New("atomic batch rolled back")
+
+// batchItem is an operation of a batch being run.
+type batchItem struct {
+	op     BatchOperation
+	result BatchResult
+	write  *repo.ContextWrite
+	// stored is the version an update or a delete replaces, recorded in the
+	// history once the write applied.
+	stored *repo.StoredContext
+}
+
+func (it *batchItem) fail(code BatchErrorCode, err error) {
+	it.result.Status, it.result.Code, it.result.Error = BatchFailed, code, err.Error()
+}
+
+func (it *batchItem) failed() bool {
+	return it.result.Status == BatchFailed
+}
+
+// BatchContexts runs the operations with one bulk write, recording the
+// replaced versions in the history, and reports on each of them. An atomic
+// batch runs in one transaction and writes nothing unless every operation
+// succeeds. A non-atomic batch runs outside of a transaction, which a failing
+// write would abort: the operations that fail do not hold back the others,
+// and the history of the ones applied is written after them. A context may
+// only be the target of one operation of a batch.
+func (cs contextService) BatchContexts(ctx context.Context, ops []BatchOperation, atomic bool, by entities.UserStub) (*BatchReport, error) {
+	if len(ops) == 0 || len(ops) > MaxBatchSize {
+		return nil, fmt.Errorf("%w: a batch takes 1 to %d operations, got %d", ErrInvalidInput, MaxBatchSize, len(ops))
+	}
+	var items []*batchItem
+	var err error
+	if atomic {
+		err = cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+			items = prepareBatch(ops)
+			if anyFailed(items) {
+				return errBatchRolledBack
+			}
+			return cs.runBatch(ctx, items, true, by)
+		})
+	} else {
+		items = prepareBatch(ops)
+		err = cs.runBatch(ctx, items, false, by)
+	}
+	report := &BatchReport{Atomic: atomic, Committed: err == nil}
+	if errors.Is(err, errBatchRolledBack) {
+		for _, it := range items {
+			if !it.failed() {
+				it.result.Status, it.result.Version = BatchAborted, 0
+			}
+		}
+	} else if err != nil {
+		cs.log.Errorf("Error running a batch of %d operations: %v", len(ops), err)
+		return nil, err
+	}
+	var written []*entities.Context
+	for _, it := range items {
+		report.Results = append(report.Results, it.result)
+		if it.result.Status == BatchCreated || it.result.Status == BatchUpdated {
+			c := *it.write.Context
+			c.Version = it.result.Version
+			written = append(written, &c)
+		}
+	}
+	cs.recordTokens(ctx, written...)
+	return report, nil
+}
+
+// prepareBatch validates the operations on their own.
+func prepareBatch(ops []BatchOperation) []*batchItem {
+	items := make([]*batchItem, len(ops))
+	seen := map[string]bool{}
+	now := time.Now()
+	for i, op := range ops {
+		it := &batchItem{op: op, result: BatchResult{Index: i, Op: op.Op}}
+		items[i] = it
+		switch op.Op {
+		case BatchCreate:
+			if op.Context == nil || op.Context.Name == "" || op.Context.Content == "" {
+				it.fail(BatchInvalid, errors.New("a create needs a context with a name and a content"))
+				continue
+			}
+			c := *op.Context
+			if c.ID == "" {
+				c.ID = primitive.NewObjectID().Hex()
+			}
+			c.IsActive, c.Version, c.CreatedTime, c.ModifiedTime = true, 1, now, now
+			it.write = &repo.ContextWrite{Kind: repo.WriteCreate, Context: &c}
+		case BatchUpdate:
+			if op.Context == nil || op.Context.ID == "" || op.Context.Version == 0 {
+				it.fail(BatchInvalid, errors.New("an update needs a context with its id and version"))
+				continue
+			}
+			c := *op.Context
+			it.write = &repo.ContextWrite{Kind: repo.WriteUpdate, Context: &c}
+		case BatchDelete:
+			if op.ID == "" {
+				it.fail(BatchInvalid, errors.New("a delete needs an id"))
+				continue
+			}
+			it.write = &repo.ContextWrite{Kind: repo.WriteTrash, Context: &entities.Context{ID: op.ID, Version: op.Version}}
+		default:
+			it.fail(BatchInvalid, fmt.Errorf("unknown operation %q", op.Op))
+			continue
+		}
+		it.result.ID = it.write.Context.ID
+		if seen[it.result.ID] {
+			it.fail(BatchInvalid, errors.New("context is the target of another operation of the batch"))
+			it.write = nil
+			continue
+		}
+		seen[it.result.ID] = true
+	}
+	return items
+}
+
+func anyFailed(items []*batchItem) bool {
+	for _, it := range items {
+		if it.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// runBatch must run inside a transaction when atomic.
+func (cs contextService) runBatch(ctx context.Context, items []*batchItem, atomic bool, by entities.UserStub) error {
+	var ids []string
+	for _, it := range items {
+		if !it.failed() {
+			ids = append(ids, it.result.ID)
+		}
+	}
+	stored, err := cs.contextRepository.FindByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*repo.StoredContext, len(stored))
+	for _, sc := range stored {
+		byID[sc.ID] = sc
+	}
+
+	var writes []repo.ContextWrite
+	var written []*batchItem
+	for _, it := range items {
+		if it.failed() {
+			continue
+		}
+		sc := byID[it.result.ID]
+		switch it.write.Kind {
+		case repo.WriteCreate:
+			if sc != nil {
+				it.fail(BatchExists, repo.ErrContextExists)
+				continue
+			}
+		case repo.WriteUpdate, repo.WriteTrash:
+			if sc == nil || sc.DeletedAt != nil {
+				it.fail(BatchNotFound, repo.ErrContextNotFound)
+				continue
+			}
+			expected := it.write.Context.Version
+			if expected != 0 && expected != sc.Version {
+				it.fail(BatchVersionConflict, repo.ErrContextVersionMismatch)
+				continue
+			}
+			if it.write.Kind == repo.WriteTrash {
+				c := sc.Context
+				it.write.Context, it.write.By = &c, by
+			}
+			it.stored = sc
+		}
+		if it.write.Kind != repo.WriteTrash {
+			if err := cs.checkMetadata(ctx, it.write.Context); errors.Is(err, ErrInvalidInput) {
+				it.fail(BatchInvalid, err)
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		writes = append(writes, *it.write)
+		written = append(written, it)
+	}
+	if atomic && anyFailed(items) {
+		return errBatchRolledBack
+	}
+
+	errs, err := cs.contextRepository.BulkWrite(ctx, writes)
+	if err != nil {
+		return err
+	}
+	var replaced []*entities.Context
+	var marks []*repo.StoredContext
+	for i, it := range written {
+		switch {
+		case errs[i] == nil:
+		case errors.Is(errs[i], repo.ErrContextExists):
+			it.fail(BatchExists, errs[i])
+		case errors.Is(errs[i], repo.ErrContextVersionMismatch):
+			it.fail(BatchVersionConflict, errs[i])
+		default:
+			it.fail(BatchInternal, errs[i])
+		}
+		if it.failed() {
+			continue
+		}
+		it.result.Version = writes[i].Context.Version
+		switch it.write.Kind {
+		case repo.WriteCreate:
+			it.result.Status = BatchCreated
+		case repo.WriteUpdate:
+			it.result.Status = BatchUpdated
+		case repo.WriteTrash:
+			it.result.Status = BatchDeleted
+		}
+		if it.stored != nil {
+			replaced = append(replaced, &it.stored.Context)
+			marks = append(marks, it.stored)
+		}
+	}
+	if atomic && anyFailed(items) {
+		return errBatchRolledBack
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
+	histories, err := cs.contextHistoryService.AddHistoryForContexts(ctx, replaced)
+	if err != nil {
+		return err
+	}
+	for i, sc := range marks {
+		if sc.RevertOf > 0 {
+			if err := cs.contextHistoryService.MarkRevert(ctx, histories[i].ID, sc.RevertOf); err != nil {
+				return err
+			}
+		}
+		if len(sc.Variables) > 0 {
+			if err := cs.contextHistoryService.SetVariables(ctx, histories[i].ID, sc.Variables); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
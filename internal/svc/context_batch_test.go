@@ -0,0 +1,177 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// batchFixture creates c1 and c2, both at version 1.
+func batchFixture(t *testing.T, failHistory bool) *testEnv {
+	t.Helper()
+	env := newTestEnv(t, failHistory)
+	for _, id := range []string{"c1", "c2"} {
+		if _, err := env.svc.CreateContext(context.Background(), &entities.Context{ID: id, Name: id, Content: "v1"}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	return env
+}
+
+func mixedBatch() []BatchOperation {
+	return []BatchOperation{
+		{Op: BatchCreate, Context: &entities.Context{ID: "c3", Name: "three", Content: "new"}},
+		{Op: BatchUpdate, Context: &entities.Context{ID: "c1", Name: "c1", Content: "v2", Version: 1}},
+		{Op: BatchDelete, ID: "c2", Version: 1},
+	}
+}
+
+func summarize(report *BatchReport) string {
+	var parts []string
+	for _, r := range report.Results {
+		s := fmt.Sprintf("%s:%s", r.ID, r.Status)
+		if r.Code != "" {
+			s += "/" + string(r.Code)
+		}
+		if r.Version != 0 {
+			s += fmt.Sprintf("@%d", r.Version)
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestBatchContexts(t *testing.T) {
+	ctx := context.Background()
+	env := batchFixture(t, false)
+	report, err := env.svc.BatchContexts(ctx, mixedBatch(), false, entities.UserStub{ID: "u1"})
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if got := summarize(report); !report.Committed || got != "c3:created@1 c1:updated@2 c2:deleted@2" {
+		t.Fatalf("unexpected report: %v %s", report.Committed, got)
+	}
+	if c, err := env.svc.GetContextByID(ctx, "c1"); err != nil || c.Content != "v2" || c.Version != 2 {
+		t.Fatalf("c1 not updated: %+v, %v", c, err)
+	}
+	if _, err := env.svc.GetContextByID(ctx, "c2"); !errors.Is(err, repo.ErrContextNotFound) {
+		t.Fatalf("c2 must be trashed, got %v", err)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 1 || h[0].Content != "v1" {
+		t.Fatalf("the replaced version of c1 must be in the history: %v", h)
+	}
+	if h := env.historyFor(t, "c2"); len(h) != 1 {
+		t.Fatalf("the deleted version of c2 must be in the history: %v", h)
+	}
+}
+
+func TestBatchContextsReportsFailures(t *testing.T) {
+	env := batchFixture(t, false)
+	ops := append(mixedBatch(),
+		BatchOperation{Op: BatchUpdate, Context: &entities.Context{ID: "c9", Name: "x", Content: "x", Version: 1}},
+		BatchOperation{Op: BatchCreate, Context: &entities.Context{ID: "c1", Name: "x", Content: "x"}},
+		BatchOperation{Op: BatchDelete, ID: "c3"},
+		BatchOperation{Op: "rename", ID: "c4"},
+	)
+	ops[1].Context.Version = 7
+	report, err := env.svc.BatchContexts(context.Background(), ops, false, entities.UserStub{})
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	want := "c3:created@1 c1:failed/version_conflict c2:deleted@2 c9:failed/not_found c1:failed/invalid c3:failed/invalid :failed/invalid"
+	if got := summarize(report); !report.Committed || got != want {
+		t.Fatalf("unexpected report:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestAtomicBatchRollsBack(t *testing.T) {
+	ctx := context.Background()
+	for name, tc := range map[string]struct {
+		ops  []BatchOperation
+		want string
+	}{
+		"conflict": {
+			ops:  append(mixedBatch(), BatchOperation{Op: BatchDelete, ID: "c9"}),
+			want: "c3:aborted c1:aborted c2:aborted c9:failed/not_found",
+		},
+		"invalid": {
+			ops:  append(mixedBatch(), BatchOperation{Op: BatchCreate}),
+			want: "c3:aborted c1:aborted c2:aborted :failed/invalid",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := batchFixture(t, false)
+			report, err := env.svc.BatchContexts(ctx, tc.ops, true, entities.UserStub{})
+			if err != nil {
+				t.Fatalf("batch: %v", err)
+			}
+			if got := summarize(report); report.Committed || got != tc.want {
+				t.Fatalf("unexpected report: %v %s", report.Committed, got)
+			}
+			if _, err := env.svc.GetContextByID(ctx, "c3"); !errors.Is(err, repo.ErrContextNotFound) {
+				t.Fatalf("c3 must not be created, got %v", err)
+			}
+			if c, _ := env.svc.GetContextByID(ctx, "c1"); c.Version != 1 {
+				t.Fatalf("c1 must not be updated: %+v", c)
+			}
+		})
+	}
+
+	env := batchFixture(t, true)
+	if _, err := env.svc.BatchContexts(ctx, mixedBatch(), true, entities.UserStub{}); !errors.Is(err, errHistoryDown) {
+		t.Fatalf("expected errHistoryDown, got %v", err)
+	}
+	if c, _ := env.svc.GetContextByID(ctx, "c2"); c == nil || c.Version != 1 {
+		t.Fatalf("c2 must not be deleted when its history fails: %+v", c)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 0 {
+		t.Fatalf("the history must be rolled back: %v", h)
+	}
+}
+
+// noTransactor fails every transaction.
+type noTransactor struct{}
+
+func (noTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return errors.New("no transaction expected")
+}
+
+func TestNonAtomicBatchRunsWithoutTransaction(t *testing.T) {
+	ctx := context.Background()
+	env := batchFixture(t, false)
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chSvc := NewContextHistoryService(log, env.chRepo)
+	cs := NewContextService(log, env.cRepo, chSvc, noTransactor{}, env.sRepo, tokenizer.NewApproximate())
+	ops := append(mixedBatch(), BatchOperation{Op: BatchCreate, Context: &entities.Context{ID: "c1", Name: "x", Content: "x"}})
+	report, err := cs.BatchContexts(ctx, ops, false, entities.UserStub{})
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if got := summarize(report); !report.Committed || got != "c3:created@1 c1:updated@2 c2:deleted@2 c1:failed/invalid" {
+		t.Fatalf("unexpected report: %v %s", report.Committed, got)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 1 || h[0].Content != "v1" {
+		t.Fatalf("the replaced version of c1 must be in the history: %v", h)
+	}
+	if _, err := cs.BatchContexts(ctx, mixedBatch(), true, entities.UserStub{}); err == nil {
+		t.Fatalf("an atomic batch must run in a transaction")
+	}
+}
+
+func TestBatchContextsSize(t *testing.T) {
+	env := newTestEnv(t, false)
+	if _, err := env.svc.BatchContexts(context.Background(), nil, false, entities.UserStub{}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput, got %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+var ErrNothingToMerge = errors.New("branch has nothing to merge")
+
+// MainBranch is how merges label the main line of a context. No branch may
+// take its name.
+const MainBranch = "main"
+
+// refName is the syntax of the names of branches and labels, which are stored
+// as field names.
+var refName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// BranchContext is a branch and the context as of its head, with the token
+// count of its content.
+type BranchContext struct {
+	Branch  *repo.Branch      `json:"branch"`
+	Context *entities.Context `json:"context"`
+	Tokens  *repo.TokenCount  `json:"tokens,omitempty"`
+}
+
+func validateBranchName(name string) error {
+	if name == MainBranch || !refName.MatchString(name) {
+		return fmt.Errorf("%w: branch names are up to 64 letters, digits, - and _, and not %q", ErrInvalidInput, MainBranch)
+	}
+	return nil
+}
+
+func (cs contextService) ListBranches(ctx context.Context, cid string) ([]*repo.Branch, error) {
+	return cs.contextRepository.ListBranches(ctx, cid)
+}
+
+func (cs contextService) findBranch(ctx context.Context, cid, name string) (*repo.Branch, error) {
+	branches, err := cs.contextRepository.ListBranches(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range branches {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return nil, repo.ErrBranchNotFound
+}
+
+// branchVersion returns the context as of a version of the branch. The
+// branch holds a copy of its base version, so that it does not depend on the
+// history of the main line.
+func (cs contextService) branchVersion(ctx context.Context, cid string, b *repo.Branch, version int) (*entities.Context, error) {
+	ch, err := cs.contextHistoryService.GetBranchVersion(ctx, cid, b.Name, version)
+	if err != nil {
+		return nil, err
+	}
+	return historyContext(ch), nil
+}
+
+// CreateBranch starts a branch from a version of the main line of cid, the
+// current one when version is 0. The versions of the branch number on from
+// it.
+func (cs contextService) CreateBranch(ctx context.Context, cid, name string, version int, by entities.UserStub) (*repo.Branch, error) {
+	if err := validateBranchName(name); err != nil {
+		return nil, err
+	}
+	from := query.VersionRef{Version: version, Current: version == 0}
+	var b *repo.Branch
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		base, err := cs.resolveVersion(ctx, cid, from)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		b = &repo.Branch{
+			Name:         name,
+			BaseVersion:  base.info.Version,
+			Head:         base.info.Version,
+			User:         by,
+			CreatedTime:  now,
+			ModifiedTime: now,
+		}
+		if err := cs.contextRepository.CreateBranch(ctx, cid, b); err != nil {
+			return err
+		}
+		_, err = cs.contextHistoryService.AddBranchVersion(ctx, name, base.context)
+		return err
+	})
+	if err != nil {
+		cs.log.Errorf("Error creating branch %s of context %s: %v", name, cid, err)
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetBranch returns the branch with the context as of its head.
+func (cs contextService) GetBranch(ctx context.Context, cid, name string) (*BranchContext, error) {
+	b, err := cs.findBranch(ctx, cid, name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cs.branchVersion(ctx, cid, b, b.Head)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := cs.versionTokens(ctx, name, []*entities.Context{c})
+	if err != nil {
+		return nil, err
+	}
+	return &BranchContext{Branch: b, Context: c, Tokens: counts[0]}, nil
+}
+
+func (cs contextService) GetBranchVersions(ctx context.Context, cid, name string, page query.Page) (*repo.ContextHistoryPage, error) {
+	if _, err := cs.findBranch(ctx, cid, name); err != nil {
+		return nil, err
+	}
+	return cs.contextHistoryService.GetBranchVersions(ctx, cid, name, page)
+}
+
+// CommitToBranch adds c as the next version of the branch. Like UpdateContext
+// it applies to a version, the head of the branch here, and fails with
+// repo.ErrContextVersionMismatch when the branch has moved on; a head of 0
+// skips the check. The name, description, content, tags and metadata come
+// from c, the ownership of the context from the head.
+func (cs contextService) CommitToBranch(ctx context.Context, cid, name string, c *entities.Context, head int, by entities.UserStub) (*BranchContext, error) {
+	var bc *BranchContext
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		b, err := cs.findBranch(ctx, cid, name)
+		if err != nil {
+			return err
+		}
+		if head != 0 && head != b.Head {
+			return repo.ErrContextVersionMismatch
+		}
+		nc, err := cs.branchVersion(ctx, cid, b, b.Head)
+		if err != nil {
+			return err
+		}
+		nc.Name, nc.Description, nc.Content, nc.Tags, nc.Metadata = c.Name, c.Description, c.Content, c.Tags, c.Metadata
+		if by != (entities.UserStub{}) {
+			nc.User = by
+		}
+		nc.Version = b.Head + 1
+		nc.ModifiedTime = time.Now()
+		if err := cs.checkMetadata(ctx, nc); err != nil {
+			return err
+		}
+		if _, err := cs.contextHistoryService.AddBranchVersion(ctx, name, nc); err != nil {
+			return err
+		}
+		prev := *b
+		b.Head, b.ModifiedTime = nc.Version, nc.ModifiedTime
+		if err := cs.contextRepository.UpdateBranch(ctx, cid, b, prev.Head); err != nil {
+			return err
+		}
+		bc = &BranchContext{Branch: b, Context: nc}
+		return nil
+	})
+	if err != nil {
+		cs.log.Errorf("Error committing to branch %s of context %s: %v", name, cid, err)
+		return nil, err
+	}
+	bc.Tokens = cs.tokenCount(name, bc.Context)
+	cs.putTokenCounts(ctx, []*repo.TokenCount{bc.Tokens})
+	return bc, nil
+}
+
+// DeleteBranch deletes the branch and its versions. What was merged of it
+// stays in the main line.
+func (cs contextService) DeleteBranch(ctx context.Context, cid, name string) error {
+	return cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := cs.contextRepository.DeleteBranch(ctx, cid, name); err != nil {
+			return err
+		}
+		_, err := cs.contextHistoryService.DeleteBranchVersions(ctx, cid, name)
+		return err
+	})
+}
+
+// MergeBranch merges the head of the branch into the main line of cid, three
+// ways against their common ancestor: the version of the branch last merged,
+// or its base. The merge writes a new version of the context, recording the
+// replaced one in the history, unless it has conflicts. Those are reported in
+// the result, along with the content carrying conflict markers, and nothing
+// is written; resolution, when given, is then the merged context as resolved
+// by the caller, whose name, description, content, tags and metadata are
+// written instead. expectedVersion, when set, is the version of the context
+// the merge applies to.
+func (cs contextService) MergeBranch(ctx context.Context, cid, name string, expectedVersion int, resolution *entities.Context) (*MergeResult, error) {
+	var result *MergeResult
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		b, err := cs.findBranch(ctx, cid, name)
+		if err != nil {
+			return err
+		}
+		ancestor := b.BaseVersion
+		if b.MergedHead > 0 {
+			ancestor = b.MergedHead
+		}
+		if b.Head == ancestor {
+			return ErrNothingToMerge
+		}
+		base, err := cs.branchVersion(ctx, cid, b, ancestor)
+		if err != nil {
+			return err
+		}
+		theirs, err := cs.branchVersion(ctx, cid, b, b.Head)
+		if err != nil {
+			return err
+		}
+		ours, err := cs.contextRepository.GetByID(ctx, cid)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != 0 && ours.Version != expectedVersion {
+			return repo.ErrContextVersionMismatch
+		}
+
+		merged, conflicts := mergeContexts(base, ours, theirs, name)
+		result = &MergeResult{Branch: b, Context: merged, Conflicts: conflicts}
+		if resolution != nil {
+			merged.Name, merged.Description, merged.Content = resolution.Name, resolution.Description, resolution.Content
+			merged.Tags, merged.Metadata = resolution.Tags, resolution.Metadata
+		} else if len(conflicts) > 0 {
+			return nil
+		}
+		if err := cs.checkMetadata(ctx, merged); err != nil {
+			return err
+		}
+
+		nc, err := cs.updateWithHistory(ctx, merged)
+		if err != nil {
+			return err
+		}
+		head := b.Head
+		b.MergedHead, b.MergedVersion, b.ModifiedTime = b.Head, nc.Version, time.Now()
+		if err := cs.contextRepository.UpdateBranch(ctx, cid, b, head); err != nil {
+			return err
+		}
+		result.Context, result.Merged = nc, true
+		return nil
+	})
+	if err != nil {
+		cs.log.Errorf("Error merging branch %s of context %s: %v", name, cid, err)
+		return nil, err
+	}
+	if result.Merged {
+		cs.recordTokens(ctx, result.Context)
+	}
+	return result, nil
+}
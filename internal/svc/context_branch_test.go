@@ -0,0 +1,178 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+const prompt = "You are a support agent.\nBe polite.\nCite your sources.\n"
+
+// branchFixture creates c1 at version 1 and branch draft from it.
+func branchFixture(t *testing.T) *testEnv {
+	t.Helper()
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	c := &entities.Context{ID: "c1", Name: "support", Content: prompt, Metadata: map[string]interface{}{"owner": "ops", "tone": "formal"}}
+	if _, err := env.svc.CreateContext(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	b, err := env.svc.CreateBranch(ctx, "c1", "draft", 0, entities.UserStub{ID: "u1"})
+	if err != nil {
+		t.Fatalf("create branch: %v", err)
+	}
+	if b.BaseVersion != 1 || b.Head != 1 {
+		t.Fatalf("unexpected branch: %+v", b)
+	}
+	return env
+}
+
+func commit(t *testing.T, env *testEnv, edit func(c *entities.Context)) *BranchContext {
+	t.Helper()
+	ctx := context.Background()
+	bc, err := env.svc.GetBranch(ctx, "c1", "draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := *bc.Context
+	edit(&c)
+	bc, err = env.svc.CommitToBranch(ctx, "c1", "draft", &c, bc.Branch.Head, entities.UserStub{})
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	return bc
+}
+
+func updateMain(t *testing.T, env *testEnv, edit func(c *entities.Context)) {
+	t.Helper()
+	ctx := context.Background()
+	cur, _ := env.svc.GetContextByID(ctx, "c1")
+	edit(cur)
+	if _, err := env.svc.UpdateContext(ctx, cur); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBranchCommits(t *testing.T) {
+	ctx := context.Background()
+	env := branchFixture(t)
+	bc := commit(t, env, func(c *entities.Context) { c.Content += "Keep it short.\n" })
+	if bc.Branch.Head != 2 || bc.Context.Version != 2 {
+		t.Fatalf("unexpected head: %+v", bc.Branch)
+	}
+	if _, err := env.svc.CommitToBranch(ctx, "c1", "draft", bc.Context, 1, entities.UserStub{}); !errors.Is(err, repo.ErrContextVersionMismatch) {
+		t.Fatalf("a commit on a stale head must fail, got %v", err)
+	}
+	if c, _ := env.svc.GetContextByID(ctx, "c1"); c.Version != 1 || c.Content != prompt {
+		t.Fatalf("commits must leave the main line alone: %+v", c)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 2 {
+		t.Fatalf("the branch versions must be in the history: %d entries", len(h))
+	}
+	page, err := env.svc.GetBranchVersions(ctx, "c1", "draft", query.Page{Sort: query.SortVersion, Desc: true, Limit: 10})
+	if err != nil || len(page.Items) != 2 || page.Items[0].Version != 2 {
+		t.Fatalf("unexpected branch versions: %+v, %v", page, err)
+	}
+
+	updateMain(t, env, func(c *entities.Context) { c.Name = "support v2" })
+	if h, err := env.chRepo.GetByVersion(ctx, "c1", 2); err == nil {
+		t.Fatalf("the main line must not see the branch versions: %+v", h)
+	}
+
+	if _, err := env.svc.CreateBranch(ctx, "c1", "draft", 0, entities.UserStub{}); !errors.Is(err, repo.ErrBranchExists) {
+		t.Fatalf("expected ErrBranchExists, got %v", err)
+	}
+	if _, err := env.svc.CreateBranch(ctx, "c1", "main", 0, entities.UserStub{}); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput, got %v", err)
+	}
+	if err := env.svc.DeleteBranch(ctx, "c1", "draft"); err != nil {
+		t.Fatalf("delete branch: %v", err)
+	}
+	if _, err := env.svc.GetBranch(ctx, "c1", "draft"); !errors.Is(err, repo.ErrBranchNotFound) {
+		t.Fatalf("expected ErrBranchNotFound, got %v", err)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 1 {
+		t.Fatalf("the branch versions must go with the branch: %d entries", len(h))
+	}
+}
+
+func TestMergeBranch(t *testing.T) {
+	ctx := context.Background()
+	env := branchFixture(t)
+	commit(t, env, func(c *entities.Context) {
+		c.Content = strings.Replace(c.Content, "Be polite.", "Be warm and polite.", 1)
+		c.Metadata["tone"] = "friendly"
+		c.Tags = []string{"draft"}
+	})
+	updateMain(t, env, func(c *entities.Context) {
+		c.Content += "Never share internal links.\n"
+		c.Metadata["owner"] = "support"
+	})
+
+	result, err := env.svc.MergeBranch(ctx, "c1", "draft", 2, nil)
+	if err != nil || !result.Merged || len(result.Conflicts) != 0 {
+		t.Fatalf("merge: %+v, %v", result, err)
+	}
+	want := "You are a support agent.\nBe warm and polite.\nCite your sources.\nNever share internal links.\n"
+	c := result.Context
+	if c.Version != 3 || c.Content != want || c.Metadata["tone"] != "friendly" || c.Metadata["owner"] != "support" || len(c.Tags) != 1 {
+		t.Fatalf("unexpected merge: %+v", c)
+	}
+	if result.Branch.MergedHead != 2 || result.Branch.MergedVersion != 3 {
+		t.Fatalf("the merge must be recorded on the branch: %+v", result.Branch)
+	}
+	if _, err := env.svc.MergeBranch(ctx, "c1", "draft", 0, nil); !errors.Is(err, ErrNothingToMerge) {
+		t.Fatalf("expected ErrNothingToMerge, got %v", err)
+	}
+
+	// the next merge is based on the version merged, not on the base
+	commit(t, env, func(c *entities.Context) { c.Content = "Greet the customer.\n" + c.Content })
+	result, err = env.svc.MergeBranch(ctx, "c1", "draft", 0, nil)
+	if err != nil || !result.Merged || result.Context.Content != "Greet the customer.\n"+want {
+		t.Fatalf("second merge: %+v, %v", result, err)
+	}
+}
+
+func TestMergeBranchConflicts(t *testing.T) {
+	ctx := context.Background()
+	env := branchFixture(t)
+	commit(t, env, func(c *entities.Context) {
+		c.Content = strings.Replace(c.Content, "Be polite.", "Be warm.", 1)
+		c.Metadata["tone"] = "friendly"
+	})
+	updateMain(t, env, func(c *entities.Context) {
+		c.Content = strings.Replace(c.Content, "Be polite.", "Be brief.", 1)
+		c.Metadata["tone"] = "terse"
+	})
+
+	result, err := env.svc.MergeBranch(ctx, "c1", "draft", 0, nil)
+	if err != nil || result.Merged {
+		t.Fatalf("the merge must report its conflicts: %+v, %v", result, err)
+	}
+	var fields []string
+	for _, c := range result.Conflicts {
+		fields = append(fields, c.Field)
+	}
+	if strings.Join(fields, " ") != "content metadata.tone" {
+		t.Fatalf("unexpected conflicts: %v", fields)
+	}
+	if !strings.Contains(result.Context.Content, "<<<<<<< main\nBe brief.\n||||||| base\nBe polite.\n=======\nBe warm.\n>>>>>>> draft\n") {
+		t.Fatalf("the content must carry conflict markers: %q", result.Context.Content)
+	}
+	if c, _ := env.svc.GetContextByID(ctx, "c1"); c.Version != 2 {
+		t.Fatalf("a conflicted merge must not write: %+v", c)
+	}
+
+	resolution := *result.Context
+	resolution.Content = strings.Replace(prompt, "Be polite.", "Be warm and brief.", 1)
+	resolution.Metadata = map[string]interface{}{"owner": "ops", "tone": "friendly"}
+	result, err = env.svc.MergeBranch(ctx, "c1", "draft", 2, &resolution)
+	if err != nil || !result.Merged || result.Context.Content != resolution.Content || result.Context.Version != 3 {
+		t.Fatalf("resolved merge: %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,269 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/diff"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+const diffContextLines = 3
+
+// ContextDiff is the difference between two versions of a context. Content
+// and Description hold unified diffs, empty when the field did not change.
+type ContextDiff struct {
+	ContextID   string        `json:"contextId"`
+	From        VersionInfo   `json:"from"`
+	To          VersionInfo   `json:"to"`
+	Content     string        `json:"content,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Fields      []FieldChange `json:"fields"`
+
+	fromLines, toLines []string
+}
+
+type VersionInfo struct {
+	Version   int       `json:"version"`
+	HistoryID string    `json:"historyId,omitempty"`
+	Current   bool      `json:"current,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// FieldChange describes the change of a structured field: From and To for
+// scalars and metadata entries, Added and Removed for lists.
+type FieldChange struct {
+	Field   string      `json:"field"`
+	From    interface{} `json:"from,omitempty"`
+	To      interface{} `json:"to,omitempty"`
+	Added   []string    `json:"added,omitempty"`
+	Removed []string    `json:"removed,omitempty"`
+}
+
+// version is a context as it was at some version, whether it comes from the
+// history or is the live document.
+type version struct {
+	info    VersionInfo
+	context *entities.Context
+}
+
+func (cs contextService) DiffContext(ctx context.Context, cid string, from, to query.VersionRef) (*ContextDiff, error) {
+	a, err := cs.resolveVersion(ctx, cid, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := cs.resolveVersion(ctx, cid, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffVersions(cid, a, b), nil
+}
+
+// resolveVersion finds the context as it was at the given version. The
+// latest version lives in the context itself, the older ones in the history.
+func (cs contextService) resolveVersion(ctx context.Context, cid string, ref query.VersionRef) (*version, error) {
+	if ref.HistoryID != "" {
+		ch, err := cs.contextHistoryService.GetContextHistoryByID(ctx, ref.HistoryID)
+		if err != nil {
+			return nil, err
+		}
+		if ch.ContextID != cid {
+			return nil, repo.ErrContextHistoryNotFound
+		}
+		return historyVersion(ch), nil
+	}
+	if !ref.Current {
+		ch, err := cs.contextHistoryService.GetContextHistoryByVersion(ctx, cid, ref.Version)
+		if err == nil {
+			return historyVersion(ch), nil
+		}
+		if !errors.Is(err, repo.ErrContextHistoryNotFound) {
+			return nil, err
+		}
+	}
+	c, err := cs.contextRepository.GetByID(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if !ref.Current && c.Version != ref.Version {
+		return nil, repo.ErrContextHistoryNotFound
+	}
+	return &version{
+		info:    VersionInfo{Version: c.Version, Current: true, Time: c.ModifiedTime},
+		context: c,
+	}, nil
+}
+
+func historyVersion(ch *entities.ContextHistory) *version {
+	return &version{
+		info:    VersionInfo{Version: ch.Version, HistoryID: ch.ID, Time: ch.CreatedTime},
+		context: historyContext(ch),
+	}
+}
+
+// historyContext returns the context as recorded by the history entry.
+func historyContext(ch *entities.ContextHistory) *entities.Context {
+	return &entities.Context{
+		ID:            ch.ContextID,
+		Name:          ch.Name,
+		Description:   ch.Description,
+		Content:       ch.Content,
+		Organizations: ch.Organizations,
+		Tenants:       ch.Tenants,
+		Groups:        ch.Groups,
+		User:          ch.User,
+		ModifiedTime:  ch.CreatedTime,
+		IsActive:      ch.IsActive,
+		Version:       ch.Version,
+		Tags:          ch.Tags,
+		Metadata:      ch.Metadata,
+	}
+}
+
+func diffVersions(cid string, a, b *version) *ContextDiff {
+	from, to := a.context, b.context
+	d := &ContextDiff{
+		ContextID: cid,
+		From:      a.info,
+		To:        b.info,
+		Fields:    []FieldChange{},
+		fromLines: fieldLines(from),
+		toLines:   fieldLines(to),
+	}
+	d.Content = diff.Unified(a.label("content"), b.label("content"), diff.Lines(from.Content, to.Content), diffContextLines)
+	d.Description = diff.Unified(a.label("description"), b.label("description"), diff.Lines(from.Description, to.Description), diffContextLines)
+
+	if from.Name != to.Name {
+		d.Fields = append(d.Fields, FieldChange{Field: "name", From: from.Name, To: to.Name})
+	}
+	if from.IsActive != to.IsActive {
+		d.Fields = append(d.Fields, FieldChange{Field: "isActive", From: from.IsActive, To: to.IsActive})
+	}
+	d.Fields = appendSetChange(d.Fields, "tags", from.Tags, to.Tags)
+	d.Fields = appendSetChange(d.Fields, "organization", organizationIDs(from), organizationIDs(to))
+	d.Fields = appendSetChange(d.Fields, "tenant", tenantIDs(from), tenantIDs(to))
+	d.Fields = appendSetChange(d.Fields, "group", groupIDs(from), groupIDs(to))
+	for _, k := range metadataKeys(from.Metadata, to.Metadata) {
+		av, aok := from.Metadata[k]
+		bv, bok := to.Metadata[k]
+		if aok != bok || !reflect.DeepEqual(av, bv) {
+			d.Fields = append(d.Fields, FieldChange{Field: "metadata." + k, From: av, To: bv})
+		}
+	}
+	return d
+}
+
+func (v *version) label(field string) string {
+	return fmt.Sprintf("%s@v%d", field, v.info.Version)
+}
+
+// Unified renders the whole diff as unified-diff text. The structured fields
+// are compared as one "field: value" line each.
+func (d *ContextDiff) Unified() string {
+	var sb strings.Builder
+	sb.WriteString(d.Description)
+	sb.WriteString(d.Content)
+	from := fmt.Sprintf("fields@v%d", d.From.Version)
+	to := fmt.Sprintf("fields@v%d", d.To.Version)
+	sb.WriteString(diff.Unified(from, to, diff.Compute(d.fromLines, d.toLines), diffContextLines))
+	return sb.String()
+}
+
+func appendSetChange(changes []FieldChange, field string, from, to []string) []FieldChange {
+	added, removed := setDifference(to, from), setDifference(from, to)
+	if len(added) == 0 && len(removed) == 0 {
+		return changes
+	}
+	return append(changes, FieldChange{Field: field, Added: added, Removed: removed})
+}
+
+// setDifference returns the sorted values of a missing from b.
+func setDifference(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, v := range b {
+		in[v] = true
+	}
+	var out []string
+	for _, v := range a {
+		if !in[v] {
+			out = append(out, v)
+			in[v] = true
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func organizationIDs(c *entities.Context) []string {
+	ids := make([]string, 0, len(c.Organizations))
+	for _, o := range c.Organizations {
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+func tenantIDs(c *entities.Context) []string {
+	ids := make([]string, 0, len(c.Tenants))
+	for _, t := range c.Tenants {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func groupIDs(c *entities.Context) []string {
+	ids := make([]string, 0, len(c.Groups))
+	for _, g := range c.Groups {
+		ids = append(ids, g.ID)
+	}
+	return ids
+}
+
+func metadataKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fieldLines renders the structured fields of c one value per line, in a
+// stable order, for the text diff.
+func fieldLines(c *entities.Context) []string {
+	lines := []string{
+		fmt.Sprintf("name: %s\n", c.Name),
+		fmt.Sprintf("isActive: %t\n", c.IsActive),
+	}
+	list := func(field string, values []string) {
+		sorted := append([]string(nil), values...)
+		sort.Strings(sorted)
+		for _, v := range sorted {
+			lines = append(lines, fmt.Sprintf("%s: %s\n", field, v))
+		}
+	}
+	list("tags", c.Tags)
+	list("organization", organizationIDs(c))
+	list("tenant", tenantIDs(c))
+	list("group", groupIDs(c))
+	for _, k := range metadataKeys(c.Metadata, nil) {
+		raw, err := json.Marshal(c.Metadata[k])
+		if err != nil {
+			raw = []byte(fmt.Sprint(c.Metadata[k]))
+		}
+		lines = append(lines, fmt.Sprintf("metadata.%s: %s\n", k, raw))
+	}
+	return lines
+}
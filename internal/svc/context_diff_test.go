@@ -0,0 +1,68 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestDiffContextAgainstCurrent(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	created, err := env.svc.CreateContext(ctx, &entities.Context{
+		ID:       "c1",
+		Name:     "n",
+		Content:  "line one\nline two\n",
+		IsActive: true,
+		Tags:     []string{"a", "b"},
+		Tenants:  []entities.TenantStub{{ID: "t1"}},
+		Metadata: map[string]interface{}{"model": "small", "temperature": 0.2},
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	update := *created
+	update.Content = "line one\nline 2\n"
+	update.Tags = []string{"b", "c"}
+	update.Metadata = map[string]interface{}{"model": "large", "temperature": 0.2}
+	if _, err := env.svc.UpdateContext(ctx, &update); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	d, err := env.svc.DiffContext(ctx, "c1", query.VersionRef{Version: 1}, query.VersionRef{Current: true})
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if d.From.Version != 1 || d.From.HistoryID == "" || d.To.Version != 2 || !d.To.Current {
+		t.Fatalf("unexpected versions: %+v -> %+v", d.From, d.To)
+	}
+	if !strings.Contains(d.Content, "-line two\n+line 2\n") || d.Description != "" {
+		t.Fatalf("unexpected text diffs: %q %q", d.Content, d.Description)
+	}
+	want := map[string]FieldChange{
+		"tags":           {Field: "tags", Added: []string{"c"}, Removed: []string{"a"}},
+		"metadata.model": {Field: "metadata.model", From: "small", To: "large"},
+	}
+	if len(d.Fields) != len(want) {
+		t.Fatalf("unexpected field changes: %+v", d.Fields)
+	}
+	for _, fc := range d.Fields {
+		w, ok := want[fc.Field]
+		if !ok || w.From != fc.From || w.To != fc.To || strings.Join(w.Added, ",") != strings.Join(fc.Added, ",") ||
+			strings.Join(w.Removed, ",") != strings.Join(fc.Removed, ",") {
+			t.Fatalf("unexpected change of %s: %+v", fc.Field, fc)
+		}
+	}
+	if text := d.Unified(); !strings.Contains(text, "+tags: c\n") || !strings.Contains(text, "--- content@v1\n") {
+		t.Fatalf("unexpected unified text:\n%s", text)
+	}
+
+	if _, err := env.svc.DiffContext(ctx, "c1", query.VersionRef{Version: 5}, query.VersionRef{Current: true}); !errors.Is(err, repo.ErrContextHistoryNotFound) {
+		t.Fatalf("expected an unknown version to be not found, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxLineageDepth bounds the walks of the fork tree, in case an import left a
+// cycle in it.
+const maxLineageDepth = 100
+
+// ForkOptions name the fork; the empty ones keep the name and description of
+// the version forked.
+type ForkOptions struct {
+	Name        string
+	Description string
+	User        entities.UserStub
+}
+
+// ContextLineage is the fork tree around a context: the contexts it descends
+// from, nearest first, and the contexts descending from it, a generation at a
+// time. The forkedFrom of each descendant names its parent. The ancestors stop
+// at the first one deleted, whose id the forkedFrom of the last one still
+// gives.
+type ContextLineage struct {
+	Context     *repo.ForkedContext   `json:"context"`
+	Ancestors   []*repo.ForkedContext `json:"ancestors"`
+	Descendants []*repo.ForkedContext `json:"descendants"`
+}
+
+// ForkContext creates a new context copying a version of cid, the current one
+// by default, with the variables it declares, and recording it as its origin.
+func (cs contextService) ForkContext(ctx context.Context, cid string, from query.VersionRef, opts ForkOptions) (*repo.ForkedContext, error) {
+	source, err := cs.resolveVersion(ctx, cid, from)
+	if err != nil {
+		return nil, err
+	}
+	c := *source.context
+	c.ID = primitive.NewObjectID().Hex()
+	if opts.Name != "" {
+		c.Name = opts.Name
+	}
+	if opts.Description != "" {
+		c.Description = opts.Description
+	}
+	if opts.User != (entities.UserStub{}) {
+		c.User = opts.User
+	}
+	c.IsActive = true
+	c.Version = 1
+	c.CreatedTime = time.Now()
+	c.ModifiedTime = c.CreatedTime
+	if err := cs.checkMetadata(ctx, &c); err != nil {
+		return nil, err
+	}
+	var fc *repo.ForkedContext
+	err = cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		vars, err := cs.versionVariables(ctx, cid, source.info.Version)
+		if err != nil {
+			return err
+		}
+		fc, err = cs.contextRepository.Fork(ctx, &c, repo.ForkOrigin{ContextID: cid, Version: source.info.Version})
+		if err != nil || len(vars) == 0 {
+			return err
+		}
+		return cs.contextRepository.SetVariables(ctx, fc.ID, fc.Version, vars)
+	})
+	if err != nil {
+		cs.log.Errorf("Error forking context %s at version %d: %v", cid, source.info.Version, err)
+		return nil, err
+	}
+	cs.recordTokens(ctx, &fc.Context)
+	return fc, nil
+}
+
+// ListForks returns the contexts forked from cid, without the forks of
+// those; see GetLineage for the whole tree.
+func (cs contextService) ListForks(ctx context.Context, cid string) ([]*repo.ForkedContext, error) {
+	if _, err := cs.contextRepository.GetByID(ctx, cid); err != nil {
+		return nil, err
+	}
+	return cs.contextRepository.ListForks(ctx, []string{cid})
+}
+
+// GetLineage returns the lineage of cid, the contexts without their content.
+func (cs contextService) GetLineage(ctx context.Context, cid string) (*ContextLineage, error) {
+	fc, err := cs.contextRepository.GetForkedByID(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	fc.Content = ""
+	lineage := &ContextLineage{Context: fc, Ancestors: []*repo.ForkedContext{}, Descendants: []*repo.ForkedContext{}}
+
+	seen := map[string]bool{cid: true}
+	for origin := fc.ForkedFrom; origin != nil && !seen[origin.ContextID] && len(lineage.Ancestors) < maxLineageDepth; {
+		ancestor, err := cs.contextRepository.GetForkedByID(ctx, origin.ContextID)
+		if errors.Is(err, repo.ErrContextNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		seen[ancestor.ID] = true
+		ancestor.Content = ""
+		lineage.Ancestors = append(lineage.Ancestors, ancestor)
+		origin = ancestor.ForkedFrom
+	}
+
+	generation := []string{cid}
+	for depth := 0; len(generation) > 0 && depth < maxLineageDepth; depth++ {
+		forks, err := cs.contextRepository.ListForks(ctx, generation)
+		if err != nil {
+			return nil, err
+		}
+		generation = generation[:0]
+		for _, f := range forks {
+			if seen[f.ID] {
+				continue
+			}
+			seen[f.ID] = true
+			lineage.Descendants = append(lineage.Descendants, f)
+			generation = append(generation, f.ID)
+		}
+	}
+	return lineage, nil
+}
@@ -0,0 +1,104 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func forkIDs(forks []*repo.ForkedContext) string {
+	var names []string
+	for _, f := range forks {
+		names = append(names, f.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestForkContext(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "base", Name: "base", Content: "v1", Tags: []string{"persona"}}); err != nil {
+		t.Fatal(err)
+	}
+	cur, _ := env.svc.GetContextByID(ctx, "base")
+	cur.Content = "v2"
+	if _, err := env.svc.UpdateContext(ctx, cur); err != nil {
+		t.Fatal(err)
+	}
+
+	fork, err := env.svc.ForkContext(ctx, "base", query.VersionRef{Version: 1}, ForkOptions{Name: "support"})
+	if err != nil {
+		t.Fatalf("fork: %v", err)
+	}
+	if fork.ID == "base" || fork.Name != "support" || fork.Content != "v1" || fork.Version != 1 || len(fork.Tags) != 1 {
+		t.Fatalf("unexpected fork: %+v", fork)
+	}
+	if fork.ForkedFrom == nil || *fork.ForkedFrom != (repo.ForkOrigin{ContextID: "base", Version: 1}) {
+		t.Fatalf("unexpected origin: %+v", fork.ForkedFrom)
+	}
+
+	current, err := env.svc.ForkContext(ctx, "base", query.VersionRef{Current: true}, ForkOptions{})
+	if err != nil || current.Content != "v2" || current.ForkedFrom.Version != 2 || current.Name != "base" {
+		t.Fatalf("unexpected fork of the current version: %+v, %v", current, err)
+	}
+
+	if _, err := env.svc.ForkContext(ctx, "base", query.VersionRef{Version: 9}, ForkOptions{}); !errors.Is(err, repo.ErrContextHistoryNotFound) {
+		t.Fatalf("expected ErrContextHistoryNotFound, got %v", err)
+	}
+}
+
+func TestGetLineage(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "root", Name: "root", Content: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	fork := func(from, name string) string {
+		t.Helper()
+		fc, err := env.svc.ForkContext(ctx, from, query.VersionRef{Current: true}, ForkOptions{Name: name})
+		if err != nil {
+			t.Fatalf("fork %s: %v", name, err)
+		}
+		return fc.ID
+	}
+	a := fork("root", "a")
+	fork("root", "b")
+	a1 := fork(a, "a1")
+	fork(a1, "a1x")
+	fork(a, "a2")
+
+	lineage, err := env.svc.GetLineage(ctx, a)
+	if err != nil {
+		t.Fatalf("lineage: %v", err)
+	}
+	if got := forkIDs(lineage.Ancestors); got != "root" {
+		t.Fatalf("ancestors: %s", got)
+	}
+	if got := forkIDs(lineage.Descendants); got != "a1 a2 a1x" {
+		t.Fatalf("descendants: %s", got)
+	}
+	if lineage.Context.Content != "" || lineage.Descendants[0].Content != "" {
+		t.Fatal("the lineage must leave the content out")
+	}
+
+	forks, err := env.svc.ListForks(ctx, "root")
+	if err != nil || forkIDs(forks) != "a b" {
+		t.Fatalf("forks of root: %s, %v", forkIDs(forks), err)
+	}
+
+	if _, err := env.svc.DeleteContext(ctx, a, 0, entities.UserStub{}); err != nil {
+		t.Fatal(err)
+	}
+	lineage, err = env.svc.GetLineage(ctx, a1)
+	if err != nil {
+		t.Fatalf("lineage: %v", err)
+	}
+	if len(lineage.Ancestors) != 0 || lineage.Context.ForkedFrom.ContextID != a {
+		t.Fatalf("the ancestors must stop at a deleted one: %s", forkIDs(lineage.Ancestors))
+	}
+}
@@ -4,17 +4,36 @@ import (
 	"context"
 	"time"
 
+	"github.com/mangudaigb/context-service/internal/query"
 	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/templating"
 	"github.com/mangudaigb/dhauli-base/logger"
 	"github.com/mangudaigb/dhauli-base/types/entities"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type ContextHistoryService interface {
 	GetContextHistoryByID(ctx context.Context, id string) (*entities.ContextHistory, error)
+	GetContextHistoryByVersion(ctx context.Context, cid string, version int) (*entities.ContextHistory, error)
 	AddHistoryForContext(ctx context.Context, c *entities.Context) (*entities.ContextHistory, error)
-	GetHistoryForContextId(ctx context.Context, cid string) ([]*entities.ContextHistory, error)
+	// AddHistoryForContexts records the given versions of distinct contexts.
+	AddHistoryForContexts(ctx context.Context, cs []*entities.Context) ([]*entities.ContextHistory, error)
+	// ImportHistory stores a history entry as given, keeping its id and
+	// creation time.
+	ImportHistory(ctx context.Context, ch *entities.ContextHistory) (*entities.ContextHistory, error)
+	GetHistoryForContextId(ctx context.Context, cid string, page query.Page) (*repo.ContextHistoryPage, error)
+	DeleteHistoryForContexts(ctx context.Context, cids []string) (int64, error)
+	MarkRevert(ctx context.Context, id string, of int) error
+	// GetVariables returns the variables version of the context cid declared.
+	GetVariables(ctx context.Context, cid string, version int) ([]templating.Variable, error)
+	// SetVariables records the variables the version of the history entry
+	// declared.
+	SetVariables(ctx context.Context, id string, vars []templating.Variable) error
+	// AddBranchVersion records c as a version of the branch of its context.
+	AddBranchVersion(ctx context.Context, branch string, c *entities.Context) (*entities.ContextHistory, error)
+	GetBranchVersion(ctx context.Context, cid, branch string, version int) (*entities.ContextHistory, error)
+	GetBranchVersions(ctx context.Context, cid, branch string, page query.Page) (*repo.ContextHistoryPage, error)
+	DeleteBranchVersions(ctx context.Context, cid, branch string) (int64, error)
 }
 
 type contextHistoryService struct {
@@ -33,8 +52,34 @@ func (chs contextHistoryService) GetContextHistoryByID(ctx context.Context, id s
 	return chs.contextHistoryRepository.GetByID(ctx, id)
 }
 
+func (chs contextHistoryService) GetContextHistoryByVersion(ctx context.Context, cid string, version int) (*entities.ContextHistory, error) {
+	return chs.contextHistoryRepository.GetByVersion(ctx, cid, version)
+}
+
 func (chs contextHistoryService) AddHistoryForContext(ctx context.Context, c *entities.Context) (*entities.ContextHistory, error) {
-	ch := &entities.ContextHistory{
+	create, err := chs.contextHistoryRepository.Create(ctx, historyOf(c))
+	if err != nil {
+		chs.log.Errorf("Error creating context history: %v for id: %s", err, c.ID)
+		return nil, err
+	}
+	return create, nil
+}
+
+func (chs contextHistoryService) AddHistoryForContexts(ctx context.Context, cs []*entities.Context) ([]*entities.ContextHistory, error) {
+	list := make([]*entities.ContextHistory, len(cs))
+	for i, c := range cs {
+		list[i] = historyOf(c)
+	}
+	if err := chs.contextHistoryRepository.CreateMany(ctx, list); err != nil {
+		chs.log.Errorf("Error creating the history of %d contexts: %v", len(cs), err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// historyOf is the history entry recording the version c.
+func historyOf(c *entities.Context) *entities.ContextHistory {
+	return &entities.ContextHistory{
 		ID:            primitive.NewObjectID().Hex(),
 		ContextID:     c.ID,
 		Name:          c.Name,
@@ -50,20 +95,82 @@ func (chs contextHistoryService) AddHistoryForContext(ctx context.Context, c *en
 		Tags:          c.Tags,
 		Metadata:      c.Metadata,
 	}
-	create, err := chs.contextHistoryRepository.Create(ctx, ch)
+}
+
+func (chs contextHistoryService) ImportHistory(ctx context.Context, ch *entities.ContextHistory) (*entities.ContextHistory, error) {
+	created, err := chs.contextHistoryRepository.Create(ctx, ch)
 	if err != nil {
-		chs.log.Errorf("Error creating context history: %v for id: %s", err, c.ID)
+		chs.log.Errorf("Error importing context history %s: %v", ch.ID, err)
 		return nil, err
 	}
-	return create, nil
+	return created, nil
 }
 
-func (chs contextHistoryService) GetHistoryForContextId(ctx context.Context, cid string) ([]*entities.ContextHistory, error) {
-	filter := bson.M{"context_id": cid}
-	list, err := chs.contextHistoryRepository.Filter(ctx, filter)
+func (chs contextHistoryService) GetHistoryForContextId(ctx context.Context, cid string, page query.Page) (*repo.ContextHistoryPage, error) {
+	list, err := chs.contextHistoryRepository.ListByContextID(ctx, cid, page)
 	if err != nil {
 		chs.log.Errorf("Error getting history for context id: %s with err: %v", cid, err)
 		return nil, err
 	}
 	return list, nil
 }
+
+func (chs contextHistoryService) DeleteHistoryForContexts(ctx context.Context, cids []string) (int64, error) {
+	n, err := chs.contextHistoryRepository.DeleteByContextIDs(ctx, cids)
+	if err != nil {
+		chs.log.Errorf("Error deleting history for %d contexts: %v", len(cids), err)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (chs contextHistoryService) MarkRevert(ctx context.Context, id string, of int) error {
+	if err := chs.contextHistoryRepository.SetRevertOf(ctx, id, of); err != nil {
+		chs.log.Errorf("Error marking context history %s as a revert of version %d: %v", id, of, err)
+		return err
+	}
+	return nil
+}
+
+func (chs contextHistoryService) GetVariables(ctx context.Context, cid string, version int) ([]templating.Variable, error) {
+	return chs.contextHistoryRepository.GetVariables(ctx, cid, version)
+}
+
+func (chs contextHistoryService) SetVariables(ctx context.Context, id string, vars []templating.Variable) error {
+	if err := chs.contextHistoryRepository.SetVariables(ctx, id, vars); err != nil {
+		chs.log.Errorf("Error setting the variables of context history %s: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+func (chs contextHistoryService) AddBranchVersion(ctx context.Context, branch string, c *entities.Context) (*entities.ContextHistory, error) {
+	ch, err := chs.contextHistoryRepository.CreateOnBranch(ctx, branch, historyOf(c))
+	if err != nil {
+		chs.log.Errorf("Error adding version %d to branch %s of context %s: %v", c.Version, branch, c.ID, err)
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (chs contextHistoryService) GetBranchVersion(ctx context.Context, cid, branch string, version int) (*entities.ContextHistory, error) {
+	return chs.contextHistoryRepository.GetBranchVersion(ctx, cid, branch, version)
+}
+
+func (chs contextHistoryService) GetBranchVersions(ctx context.Context, cid, branch string, page query.Page) (*repo.ContextHistoryPage, error) {
+	list, err := chs.contextHistoryRepository.ListBranchVersions(ctx, cid, branch, page)
+	if err != nil {
+		chs.log.Errorf("Error listing the versions of branch %s of context %s: %v", branch, cid, err)
+		return nil, err
+	}
+	return list, nil
+}
+
+func (chs contextHistoryService) DeleteBranchVersions(ctx context.Context, cid, branch string) (int64, error) {
+	n, err := chs.contextHistoryRepository.DeleteBranch(ctx, cid, branch)
+	if err != nil {
+		chs.log.Errorf("Error deleting the versions of branch %s of context %s: %v", branch, cid, err)
+		return 0, err
+	}
+	return n, nil
+}
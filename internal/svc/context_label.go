@@ -0,0 +1,151 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LabelMoveOptions qualify a label move: Expected, when set, is the version
+// the label must point at for the move to apply, and Reason is recorded with
+// the move.
+type LabelMoveOptions struct {
+	Expected int
+	Reason   string
+	User     entities.UserStub
+}
+
+func validateLabelName(name string) error {
+	if !refName.MatchString(name) {
+		return fmt.Errorf("%w: label names are up to 64 letters, digits, - and _", ErrInvalidInput)
+	}
+	return nil
+}
+
+func (cs contextService) ListLabels(ctx context.Context, cid string) ([]*repo.Label, error) {
+	return cs.contextRepository.ListLabels(ctx, cid)
+}
+
+func (cs contextService) findLabel(ctx context.Context, cid, name string) (*repo.Label, error) {
+	labels, err := cs.contextRepository.ListLabels(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		if l.Name == name {
+			return l, nil
+		}
+	}
+	return nil, repo.ErrLabelNotFound
+}
+
+// MoveLabel points the label of cid at a version of its main line, the current
+// one when version is 0, setting the label when it does not exist. Unless the
+// label already points there, the move is recorded.
+func (cs contextService) MoveLabel(ctx context.Context, cid, name string, version int, opts LabelMoveOptions) (*repo.Label, error) {
+	if err := validateLabelName(name); err != nil {
+		return nil, err
+	}
+	var l *repo.Label
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		from := 0
+		prev, err := cs.findLabel(ctx, cid, name)
+		switch {
+		case err == nil:
+			from = prev.Version
+		case !errors.Is(err, repo.ErrLabelNotFound):
+			return err
+		}
+		if opts.Expected != 0 && opts.Expected != from {
+			return repo.ErrContextVersionMismatch
+		}
+		to, err := cs.resolveVersion(ctx, cid, query.VersionRef{Version: version, Current: version == 0})
+		if err != nil {
+			return err
+		}
+		if prev != nil && prev.Version == to.info.Version {
+			l = prev
+			return nil
+		}
+		now := time.Now()
+		l = &repo.Label{Name: name, Version: to.info.Version, MovedBy: opts.User, MovedTime: now}
+		if err := cs.contextRepository.MoveLabel(ctx, cid, l, from); err != nil {
+			return err
+		}
+		return cs.contextRepository.AddLabelMove(ctx, &repo.LabelMove{
+			ID:        primitive.NewObjectID().Hex(),
+			ContextID: cid,
+			Label:     name,
+			From:      from,
+			To:        l.Version,
+			Reason:    opts.Reason,
+			By:        opts.User,
+			Time:      now,
+		})
+	})
+	if err != nil {
+		cs.log.Errorf("Error moving label %s of context %s: %v", name, cid, err)
+		return nil, err
+	}
+	return l, nil
+}
+
+// RemoveLabel removes the label of cid, recording the move. The version it
+// pointed at is left to the retention from then on.
+func (cs contextService) RemoveLabel(ctx context.Context, cid, name string, opts LabelMoveOptions) error {
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		l, err := cs.findLabel(ctx, cid, name)
+		if err != nil {
+			return err
+		}
+		if opts.Expected != 0 && opts.Expected != l.Version {
+			return repo.ErrContextVersionMismatch
+		}
+		if err := cs.contextRepository.RemoveLabel(ctx, cid, name, l.Version); err != nil {
+			return err
+		}
+		return cs.contextRepository.AddLabelMove(ctx, &repo.LabelMove{
+			ID:        primitive.NewObjectID().Hex(),
+			ContextID: cid,
+			Label:     name,
+			From:      l.Version,
+			Reason:    opts.Reason,
+			By:        opts.User,
+			Time:      time.Now(),
+		})
+	})
+	if err != nil {
+		cs.log.Errorf("Error removing label %s of context %s: %v", name, cid, err)
+	}
+	return err
+}
+
+// ListLabelMoves returns the recorded moves of the label of cid, of all its
+// labels when name is empty, newest first. The moves of removed labels are
+// kept.
+func (cs contextService) ListLabelMoves(ctx context.Context, cid, name string) ([]*repo.LabelMove, error) {
+	if _, err := cs.contextRepository.ListLabels(ctx, cid); err != nil {
+		return nil, err
+	}
+	return cs.contextRepository.ListLabelMoves(ctx, cid, name)
+}
+
+// GetContextByLabel returns the context as of the version its label points
+// at, from the history unless it is the current one.
+func (cs contextService) GetContextByLabel(ctx context.Context, cid, name string) (*entities.Context, error) {
+	l, err := cs.findLabel(ctx, cid, name)
+	if err != nil {
+		return nil, err
+	}
+	v, err := cs.resolveVersion(ctx, cid, query.VersionRef{Version: l.Version})
+	if err != nil {
+		return nil, err
+	}
+	return v.context, nil
+}
@@ -0,0 +1,122 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// labelFixture creates c1 at version 3, its content telling the version.
+func labelFixture(t *testing.T) *testEnv {
+	t.Helper()
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "support", Content: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"v2", "v3"} {
+		updateMain(t, env, func(c *entities.Context) { c.Content = content })
+	}
+	return env
+}
+
+func TestMoveLabel(t *testing.T) {
+	ctx := context.Background()
+	env := labelFixture(t)
+	ops := entities.UserStub{ID: "ops"}
+
+	if _, err := env.svc.MoveLabel(ctx, "c1", "prod", 2, LabelMoveOptions{User: ops, Reason: "release"}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if _, err := env.svc.MoveLabel(ctx, "c1", "staging", 0, LabelMoveOptions{}); err != nil {
+		t.Fatalf("set current: %v", err)
+	}
+	for label, want := range map[string]string{"prod": "v2", "staging": "v3"} {
+		c, err := env.svc.GetContextByLabel(ctx, "c1", label)
+		if err != nil || c.Content != want {
+			t.Fatalf("%s: expected %s, got %+v, %v", label, want, c, err)
+		}
+	}
+
+	if _, err := env.svc.MoveLabel(ctx, "c1", "prod", 3, LabelMoveOptions{Expected: 1}); !errors.Is(err, repo.ErrContextVersionMismatch) {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+	l, err := env.svc.MoveLabel(ctx, "c1", "prod", 3, LabelMoveOptions{Expected: 2, User: ops})
+	if err != nil || l.Version != 3 {
+		t.Fatalf("move: %+v, %v", l, err)
+	}
+	if _, err := env.svc.MoveLabel(ctx, "c1", "prod", 3, LabelMoveOptions{}); err != nil {
+		t.Fatalf("move in place: %v", err)
+	}
+	if err := env.svc.RemoveLabel(ctx, "c1", "staging", LabelMoveOptions{}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := env.svc.GetContextByLabel(ctx, "c1", "staging"); !errors.Is(err, repo.ErrLabelNotFound) {
+		t.Fatalf("expected ErrLabelNotFound, got %v", err)
+	}
+
+	moves, err := env.svc.ListLabelMoves(ctx, "c1", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != 2 || moves[0].From != 2 || moves[0].To != 3 || moves[1].From != 0 || moves[1].Reason != "release" || moves[1].By != ops {
+		t.Fatalf("unexpected moves: %+v", moves)
+	}
+	if all, _ := env.svc.ListLabelMoves(ctx, "c1", ""); len(all) != 4 {
+		t.Fatalf("expected 4 moves in all, got %d", len(all))
+	}
+}
+
+func TestMoveLabelErrors(t *testing.T) {
+	ctx := context.Background()
+	env := labelFixture(t)
+	for name, tc := range map[string]struct {
+		cid, label string
+		version    int
+		want       error
+	}{
+		"bad name":        {"c1", "prod.eu", 1, ErrInvalidInput},
+		"unknown version": {"c1", "prod", 9, repo.ErrContextHistoryNotFound},
+		"unknown context": {"c9", "prod", 1, repo.ErrContextNotFound},
+	} {
+		if _, err := env.svc.MoveLabel(ctx, tc.cid, tc.label, tc.version, LabelMoveOptions{}); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+	if moves, _ := env.svc.ListLabelMoves(ctx, "c1", ""); len(moves) != 0 {
+		t.Fatalf("failed moves must not be recorded: %+v", moves)
+	}
+}
+
+func TestRetentionKeepsLabelledVersions(t *testing.T) {
+	ctx := context.Background()
+	env := labelFixture(t)
+	if _, err := env.svc.MoveLabel(ctx, "c1", "prod", 1, LabelMoveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hrs := NewHistoryRetentionService(log, env.chRepo, env.cRepo, repo.NewMemoryTransactor(env.cRepo, env.chRepo), settings.HistorySettings{}).(*historyRetentionService)
+	hrs.now = func() time.Time { return time.Now().AddDate(1, 0, 0) }
+
+	report, err := hrs.Compact(ctx, &settings.RetentionPolicy{KeepLast: 1}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.RemovedVersions != 0 {
+		t.Fatalf("expected the labelled version to be kept, removed %d", report.RemovedVersions)
+	}
+	c, err := env.svc.GetContextByLabel(ctx, "c1", "prod")
+	if err != nil || c.Content != "v1" {
+		t.Fatalf("expected v1, got %+v, %v", c, err)
+	}
+}
@@ -0,0 +1,123 @@
+package svc
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/mangudaigb/context-service/internal/diff"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// MergeResult is the outcome of a merge. Merged is false when it had
+// conflicts and nothing was written; Context is then the merge as far as it
+// went, its content carrying conflict markers and the conflicting fields
+// keeping the value of the main line.
+type MergeResult struct {
+	Merged    bool              `json:"merged"`
+	Branch    *repo.Branch      `json:"branch"`
+	Context   *entities.Context `json:"context"`
+	Conflicts []MergeConflict   `json:"conflicts,omitempty"`
+}
+
+// MergeConflict is a change made differently on both sides of a merge. Field
+// is a field of the context, metadata.<key> for a metadata entry, whose
+// absence on a side shows as null. The conflicts of the content are its
+// regions, Line being the line of the conflict markers in the merged content.
+type MergeConflict struct {
+	Field  string      `json:"field"`
+	Line   int         `json:"line,omitempty"`
+	Base   interface{} `json:"base"`
+	Ours   interface{} `json:"ours"`
+	Theirs interface{} `json:"theirs"`
+}
+
+// mergeContexts merges the changes turning base into theirs, the branch, into
+// ours, the main line. The content merges line by line, the metadata entry by
+// entry, the other editable fields as a whole.
+func mergeContexts(base, ours, theirs *entities.Context, branch string) (*entities.Context, []MergeConflict) {
+	merged := *ours
+	var conflicts []MergeConflict
+
+	content, regions := diff.Merge3(base.Content, ours.Content, theirs.Content, MainBranch, branch)
+	merged.Content = content
+	for _, r := range regions {
+		conflicts = append(conflicts, MergeConflict{Field: "content", Line: r.Line, Base: r.Base, Ours: r.Ours, Theirs: r.Theirs})
+	}
+
+	field := func(name string, b, o, t interface{}) interface{} {
+		v, ok := merge3(b, o, t)
+		if !ok {
+			conflicts = append(conflicts, MergeConflict{Field: name, Base: b, Ours: o, Theirs: t})
+		}
+		return v
+	}
+	merged.Name = field("name", base.Name, ours.Name, theirs.Name).(string)
+	merged.Description = field("description", base.Description, ours.Description, theirs.Description).(string)
+	merged.Tags = field("tags", base.Tags, ours.Tags, theirs.Tags).([]string)
+
+	keys := map[string]bool{}
+	for _, m := range []map[string]interface{}{base.Metadata, ours.Metadata, theirs.Metadata} {
+		for k := range m {
+			keys[k] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	var metadata map[string]interface{}
+	for _, k := range sorted {
+		b, inBase := base.Metadata[k]
+		o, inOurs := ours.Metadata[k]
+		t, inTheirs := theirs.Metadata[k]
+		v, ok := merge3(entry{b, inBase}, entry{o, inOurs}, entry{t, inTheirs})
+		if !ok {
+			conflicts = append(conflicts, MergeConflict{Field: "metadata." + k, Base: b, Ours: o, Theirs: t})
+		}
+		if e := v.(entry); e.present {
+			if metadata == nil {
+				metadata = map[string]interface{}{}
+			}
+			metadata[k] = e.value
+		}
+	}
+	merged.Metadata = metadata
+	return &merged, conflicts
+}
+
+// entry is a metadata entry, absent from a side unless present.
+type entry struct {
+	value   interface{}
+	present bool
+}
+
+// merge3 takes the side that changed, ours when both made the same change.
+// It reports false, along with ours, when they made different changes.
+func merge3(base, ours, theirs interface{}) (interface{}, bool) {
+	switch {
+	case same(ours, theirs), same(theirs, base):
+		return ours, true
+	case same(ours, base):
+		return theirs, true
+	default:
+		return ours, false
+	}
+}
+
+// same compares values as stored, where empty slices and maps are left out.
+func same(a, b interface{}) bool {
+	return reflect.DeepEqual(emptyAsNil(a), emptyAsNil(b))
+}
+
+func emptyAsNil(v interface{}) interface{} {
+	if e, ok := v.(entry); ok {
+		return entry{emptyAsNil(e.value), e.present}
+	}
+	rv := reflect.ValueOf(v)
+	if (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Map) && rv.Len() == 0 {
+		return nil
+	}
+	return v
+}
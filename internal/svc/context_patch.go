@@ -0,0 +1,111 @@
+package svc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/mangudaigb/context-service/internal/patch"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+var ErrReadOnlyField = errors.New("field cannot be patched")
+
+// readOnlyFields are maintained by the service, a patch may not change them.
+var readOnlyFields = map[string]bool{
+	"id":           true,
+	"version":      true,
+	"createdTime":  true,
+	"modifiedTime": true,
+}
+
+// PatchContext applies p to the JSON representation of the current version of
+// the context and writes the fields it changed, leaving the others as they are
+// stored. A patch changing nothing writes no new version. Like RevertContext,
+// it fails with repo.ErrContextVersionMismatch when expectedVersion is set and
+// the context has moved on.
+func (cs contextService) PatchContext(ctx context.Context, id string, expectedVersion int, p patch.Patch) (*entities.Context, error) {
+	var nc *entities.Context
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		oc, err := cs.contextRepository.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != 0 && oc.Version != expectedVersion {
+			return repo.ErrContextVersionMismatch
+		}
+		patched, fields, err := applyPatch(oc, p)
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			nc = oc
+			return nil
+		}
+		if err := cs.checkMetadata(ctx, patched); err != nil {
+			return err
+		}
+		if _, err := cs.snapshot(ctx, id); err != nil {
+			return err
+		}
+		nc, err = cs.contextRepository.Patch(ctx, patched, fields)
+		if err != nil {
+			cs.log.Errorf("Error patching context %s: %v", id, err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cs.recordTokens(ctx, nc)
+	return nc, nil
+}
+
+// applyPatch returns the patched context and the fields the patch changed, by
+// their JSON names, which the stored documents share.
+func applyPatch(c *entities.Context, p patch.Patch) (*entities.Context, []string, error) {
+	before, err := json.Marshal(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := p.Apply(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	var patched entities.Context
+	dec := json.NewDecoder(bytes.NewReader(after))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
+		return nil, nil, fmt.Errorf("%w: the patched context is invalid: %v", patch.ErrCannotApply, err)
+	}
+
+	var beforeFields, afterFields map[string]interface{}
+	if err := json.Unmarshal(before, &beforeFields); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(after, &afterFields); err != nil {
+		return nil, nil, err
+	}
+	var changed []string
+	for f := range afterFields {
+		if _, ok := beforeFields[f]; !ok {
+			beforeFields[f] = nil
+		}
+	}
+	for f, v := range beforeFields {
+		if reflect.DeepEqual(v, afterFields[f]) {
+			continue
+		}
+		if readOnlyFields[f] {
+			return nil, nil, fmt.Errorf("%w: %s", ErrReadOnlyField, f)
+		}
+		changed = append(changed, f)
+	}
+	sort.Strings(changed)
+	return &patched, changed, nil
+}
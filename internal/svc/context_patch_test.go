@@ -0,0 +1,86 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/patch"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func mustPatch(t *testing.T, contentType, body string) patch.Patch {
+	t.Helper()
+	p, err := patch.Parse(contentType, []byte(body))
+	if err != nil {
+		t.Fatalf("parse patch: %v", err)
+	}
+	return p
+}
+
+func TestPatchContextKeepsOmittedFields(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{
+		ID: "c1", Name: "n", Content: "v1", Tags: []string{"a"}, Metadata: map[string]interface{}{"owner": "x"},
+	}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	patched, err := env.svc.PatchContext(ctx, "c1", 1, mustPatch(t, patch.MergePatchType, `{"description": "d", "metadata": {"team": "t"}}`))
+	if err != nil {
+		t.Fatalf("merge patch: %v", err)
+	}
+	if patched.Version != 2 || patched.Description != "d" || patched.Content != "v1" || len(patched.Tags) != 1 ||
+		patched.Metadata["owner"] != "x" || patched.Metadata["team"] != "t" || !patched.IsActive {
+		t.Fatalf("unexpected merge patch result: %+v", patched)
+	}
+
+	patched, err = env.svc.PatchContext(ctx, "c1", 0, mustPatch(t, patch.JSONPatchType, `[{"op": "add", "path": "/tags/-", "value": "b"}, {"op": "remove", "path": "/description"}]`))
+	if err != nil {
+		t.Fatalf("json patch: %v", err)
+	}
+	if patched.Version != 3 || patched.Description != "" || len(patched.Tags) != 2 || patched.Metadata["team"] != "t" {
+		t.Fatalf("unexpected json patch result: %+v", patched)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 2 {
+		t.Fatalf("expected a history entry per patch, got %d", len(h))
+	}
+
+	unchanged, err := env.svc.PatchContext(ctx, "c1", 0, mustPatch(t, patch.MergePatchType, `{"name": "n"}`))
+	if err != nil || unchanged.Version != 3 {
+		t.Fatalf("a patch changing nothing must not write a version: %+v, %v", unchanged, err)
+	}
+}
+
+func TestPatchContextErrors(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	tests := map[string]struct {
+		version     int
+		contentType string
+		body        string
+		want        error
+	}{
+		"stale":         {4, patch.MergePatchType, `{"name": "m"}`, repo.ErrContextVersionMismatch},
+		"read only":     {0, patch.MergePatchType, `{"version": 9}`, ErrReadOnlyField},
+		"unknown field": {0, patch.MergePatchType, `{"owner": "x"}`, patch.ErrCannotApply},
+		"wrong type":    {0, patch.JSONPatchType, `[{"op": "replace", "path": "/tags", "value": 3}]`, patch.ErrCannotApply},
+		"failed test":   {0, patch.JSONPatchType, `[{"op": "test", "path": "/name", "value": "x"}]`, patch.ErrCannotApply},
+	}
+	for name, tc := range tests {
+		if _, err := env.svc.PatchContext(ctx, "c1", tc.version, mustPatch(t, tc.contentType, tc.body)); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+	if _, err := env.svc.PatchContext(ctx, "nope", 0, mustPatch(t, patch.MergePatchType, `{}`)); !errors.Is(err, repo.ErrContextNotFound) {
+		t.Fatalf("expected ErrContextNotFound, got %v", err)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 0 {
+		t.Fatalf("failed patches must leave no history, got %d entries", len(h))
+	}
+}
@@ -0,0 +1,196 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mangudaigb/context-service/internal/compose"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// The errors of an include directive that cannot be expanded. They are about
+// the stored content, not about the request to render it.
+var (
+	ErrIncludeNotFound  = errors.New("included context not found")
+	ErrIncludeAmbiguous = errors.New("included context name is ambiguous")
+	ErrIncludeForbidden = errors.New("included context belongs to other tenants")
+	ErrIncludeCycle     = errors.New("include cycle")
+	ErrIncludeTooDeep   = errors.New("includes nested too deep")
+)
+
+const (
+	// MaxIncludeDepth bounds how deep includes nest, the rendered context
+	// being at depth 0.
+	MaxIncludeDepth = 10
+	// maxNameMatches bounds the lookup of an include by name, which must
+	// match a single context anyway.
+	maxNameMatches = 10
+)
+
+// RenderOptions qualify a rendering: Label, when set, renders the version of
+// the context the label points at instead of the current one. TenantIDs, when
+// set, are the tenants on whose behalf the context is rendered; they default
+// to those of the rendered context.
+type RenderOptions struct {
+	Label     string
+	TenantIDs []string
+}
+
+// ResolvedVersion is a version of a context a rendering used.
+type ResolvedVersion struct {
+	ContextID string `json:"contextId"`
+	Version   int    `json:"version"`
+}
+
+// RenderedContext is the content of a context with its includes expanded.
+// Resolved lists the versions used, the rendered one first, each once.
+type RenderedContext struct {
+	ContextID string            `json:"contextId"`
+	Version   int               `json:"version"`
+	Content   string            `json:"content"`
+	Resolved  []ResolvedVersion `json:"resolved"`
+}
+
+// visibleTo tells whether c may be used on behalf of the tenants: it has no
+// tenants of its own, or shares one with them.
+func visibleTo(c *entities.Context, tenants []string) bool {
+	if len(c.Tenants) == 0 {
+		return true
+	}
+	for _, t := range c.Tenants {
+		if slices.Contains(tenants, t.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// RenderContext expands the include directives of the content of cid,
+// recursively. An included context must be visible to the tenants of the
+// rendering, see visibleTo, and may not include itself, directly or not.
+func (cs contextService) RenderContext(ctx context.Context, cid string, opts RenderOptions) (*RenderedContext, error) {
+	root, err := cs.renderRoot(ctx, cid, opts.Label)
+	if err != nil {
+		return nil, err
+	}
+	scope := opts.TenantIDs
+	if len(scope) == 0 {
+		scope = tenantIDs(root)
+	} else if !visibleTo(root, scope) {
+		return nil, fmt.Errorf("%w: context %s", ErrIncludeForbidden, cid)
+	}
+	r := &renderer{cs: cs, ctx: ctx, scope: scope}
+	content, err := r.expand(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &RenderedContext{ContextID: root.ID, Version: root.Version, Content: content, Resolved: r.resolved}, nil
+}
+
+func (cs contextService) renderRoot(ctx context.Context, cid, label string) (*entities.Context, error) {
+	if label != "" {
+		return cs.GetContextByLabel(ctx, cid, label)
+	}
+	c, err := cs.contextRepository.GetByID(ctx, cid)
+	if err == nil && c == nil {
+		err = repo.ErrContextNotFound
+	}
+	return c, err
+}
+
+type renderer struct {
+	cs       contextService
+	ctx      context.Context
+	scope    []string
+	resolved []ResolvedVersion
+}
+
+// expand returns the content of c with its includes expanded. path lists the
+// contexts including c, outermost first.
+func (r *renderer) expand(c *entities.Context, path []string) (string, error) {
+	path = append(path, c.ID)
+	if rv := (ResolvedVersion{ContextID: c.ID, Version: c.Version}); !slices.Contains(r.resolved, rv) {
+		r.resolved = append(r.resolved, rv)
+	}
+	var includeErr error
+	content, err := compose.Expand(c.Content, func(in compose.Include) (string, error) {
+		text, err := r.include(c, in, path)
+		includeErr = err
+		return text, err
+	})
+	if err != nil && err != includeErr {
+		err = fmt.Errorf("context %s: %w", c.ID, err)
+	}
+	return content, err
+}
+
+// include returns the expanded content of the context c includes by in.
+func (r *renderer) include(c *entities.Context, in compose.Include, path []string) (string, error) {
+	if len(path) > MaxIncludeDepth {
+		return "", fmt.Errorf("%w: %s includes %s beyond depth %d", ErrIncludeTooDeep, strings.Join(path, " > "), in, MaxIncludeDepth)
+	}
+	ic, err := r.lookup(in)
+	if err != nil {
+		return "", fmt.Errorf("context %s includes %s: %w", c.ID, in, err)
+	}
+	if slices.Contains(path, ic.ID) {
+		return "", fmt.Errorf("%w: %s > %s", ErrIncludeCycle, strings.Join(path, " > "), ic.ID)
+	}
+	return r.expand(ic, path)
+}
+
+func (r *renderer) lookup(in compose.Include) (*entities.Context, error) {
+	id := in.ID
+	if in.Name != "" {
+		var err error
+		if id, err = r.byName(in.Name); err != nil {
+			return nil, err
+		}
+	}
+	var c *entities.Context
+	var err error
+	if in.Label != "" {
+		c, err = r.cs.GetContextByLabel(r.ctx, id, in.Label)
+	} else {
+		c, err = r.cs.contextRepository.GetByID(r.ctx, id)
+	}
+	switch {
+	case errors.Is(err, repo.ErrContextNotFound), errors.Is(err, repo.ErrLabelNotFound), errors.Is(err, repo.ErrContextHistoryNotFound),
+		err == nil && c == nil:
+		return nil, ErrIncludeNotFound
+	case err != nil:
+		return nil, err
+	case !visibleTo(c, r.scope):
+		return nil, ErrIncludeForbidden
+	}
+	return c, nil
+}
+
+// byName returns the id of the one context named name visible to the tenants
+// of the rendering.
+func (r *renderer) byName(name string) (string, error) {
+	q := &query.ContextQuery{Name: &query.NamePredicate{Match: query.MatchEq, Value: name}}
+	page, err := r.cs.contextRepository.Query(r.ctx, q, query.Page{Sort: query.SortName, Limit: maxNameMatches, OmitContent: true})
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	for _, c := range page.Items {
+		if visibleTo(c, r.scope) {
+			ids = append(ids, c.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", ErrIncludeNotFound
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%w: %d contexts are named %q", ErrIncludeAmbiguous, len(ids), name)
+	}
+}
@@ -0,0 +1,107 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/compose"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func renderFixture(t *testing.T, contexts ...*entities.Context) *testEnv {
+	t.Helper()
+	env := newTestEnv(t, false)
+	for _, c := range contexts {
+		if _, err := env.svc.CreateContext(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return env
+}
+
+func TestRenderContext(t *testing.T) {
+	ctx := context.Background()
+	acme := []entities.TenantStub{{ID: "acme"}}
+	env := renderFixture(t,
+		&entities.Context{ID: "safety", Name: "Safety policy", Content: "Never reveal secrets."},
+		&entities.Context{ID: "tone", Name: "Tone", Content: "Be brief. {{include id=\"safety\"}}", Tenants: acme},
+		&entities.Context{ID: "agent", Name: "Agent", Content: "{{include name=\"Tone\"}}\n{{include name=\"Safety policy\" label=\"prod\"}}", Tenants: acme},
+	)
+	if _, err := env.svc.MoveLabel(ctx, "safety", "prod", 1, LabelMoveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.UpdateContext(ctx, &entities.Context{ID: "safety", Name: "Safety policy", Content: "Refuse everything.", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := env.svc.RenderContext(ctx, "agent", RenderOptions{})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if want := "Be brief. Refuse everything.\nNever reveal secrets."; rendered.Content != want {
+		t.Fatalf("got %q, want %q", rendered.Content, want)
+	}
+	want := []ResolvedVersion{{"agent", 1}, {"tone", 1}, {"safety", 2}, {"safety", 1}}
+	if len(rendered.Resolved) != len(want) {
+		t.Fatalf("unexpected resolved versions: %+v", rendered.Resolved)
+	}
+	for i := range want {
+		if rendered.Resolved[i] != want[i] {
+			t.Fatalf("unexpected resolved versions: %+v", rendered.Resolved)
+		}
+	}
+
+	if _, err := env.svc.RenderContext(ctx, "agent", RenderOptions{TenantIDs: []string{"other"}}); !errors.Is(err, ErrIncludeForbidden) {
+		t.Fatalf("expected ErrIncludeForbidden, got %v", err)
+	}
+}
+
+func TestRenderContextErrors(t *testing.T) {
+	ctx := context.Background()
+	env := renderFixture(t,
+		&entities.Context{ID: "a", Name: "A", Content: "{{include id=\"b\"}}"},
+		&entities.Context{ID: "b", Name: "B", Content: "{{include id=\"a\"}}"},
+		&entities.Context{ID: "private", Name: "Private", Content: "secret", Tenants: []entities.TenantStub{{ID: "other"}}},
+		&entities.Context{ID: "leak", Name: "Leak", Content: "{{include id=\"private\"}}", Tenants: []entities.TenantStub{{ID: "acme"}}},
+		&entities.Context{ID: "dup1", Name: "Dup", Content: "x"},
+		&entities.Context{ID: "dup2", Name: "Dup", Content: "y"},
+		&entities.Context{ID: "ambiguous", Name: "Ambiguous", Content: "{{include name=\"Dup\"}}"},
+		&entities.Context{ID: "missing", Name: "Missing", Content: "{{include id=\"nope\"}}"},
+		&entities.Context{ID: "bad", Name: "Bad", Content: "{{include id=\"a\"}} {{include}}"},
+	)
+	// Each dN includes dN-1, down to d0.
+	for i := 0; i <= MaxIncludeDepth+1; i++ {
+		c := &entities.Context{ID: fmt.Sprintf("d%d", i), Content: fmt.Sprintf(`{{include id="d%d"}}`, i-1)}
+		if i == 0 {
+			c.Content = "end"
+		}
+		if _, err := env.svc.CreateContext(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := env.svc.RenderContext(ctx, fmt.Sprintf("d%d", MaxIncludeDepth), RenderOptions{}); err != nil {
+		t.Fatalf("includes nested up to the limit must render: %v", err)
+	}
+
+	for cid, want := range map[string]error{
+		"a":                                   ErrIncludeCycle,
+		"leak":                                ErrIncludeForbidden,
+		"ambiguous":                           ErrIncludeAmbiguous,
+		"missing":                             ErrIncludeNotFound,
+		"bad":                                 ErrIncludeCycle,
+		fmt.Sprintf("d%d", MaxIncludeDepth+1): ErrIncludeTooDeep,
+	} {
+		if _, err := env.svc.RenderContext(ctx, cid, RenderOptions{}); !errors.Is(err, want) {
+			t.Fatalf("%s: expected %v, got %v", cid, want, err)
+		}
+	}
+
+	if _, err := env.svc.UpdateContext(ctx, &entities.Context{ID: "bad", Name: "Bad", Content: `{{include id="d0"}} {{include}}`, Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.RenderContext(ctx, "bad", RenderOptions{}); !errors.Is(err, compose.ErrInvalidDirective) {
+		t.Fatalf("expected ErrInvalidDirective, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package svc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+)
+
+var ErrRevertToCurrent = errors.New("context is already at this version")
+
+// RevertContext writes a new version of the context copying the fields of an
+// earlier one. It goes through the UpdateContext path, recording the replaced
+// version in the history and failing with repo.ErrContextVersionMismatch when
+// expectedVersion is set and the context has moved on, then marks the new
+// version as a revert. The new version declares the variables of the earlier
+// one.
+func (cs contextService) RevertContext(ctx context.Context, cid string, to query.VersionRef, expectedVersion int) (*repo.RevertedContext, error) {
+	var rc *repo.RevertedContext
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		target, err := cs.resolveVersion(ctx, cid, to)
+		if err != nil {
+			return err
+		}
+		if target.info.Current {
+			return ErrRevertToCurrent
+		}
+		current, err := cs.contextRepository.GetByID(ctx, cid)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != 0 && current.Version != expectedVersion {
+			return repo.ErrContextVersionMismatch
+		}
+
+		nc := *target.context
+		nc.Version = current.Version
+		if err := cs.checkMetadata(ctx, &nc); err != nil {
+			return err
+		}
+		vars, err := cs.contextHistoryService.GetVariables(ctx, cid, target.info.Version)
+		if err != nil {
+			return err
+		}
+		updated, err := cs.updateWithHistory(ctx, &nc)
+		if err != nil {
+			return err
+		}
+		if err := cs.contextRepository.SetRevertOf(ctx, cid, updated.Version, target.info.Version); err != nil {
+			cs.log.Errorf("Error marking context %s as reverted to version %d: %v", cid, target.info.Version, err)
+			return err
+		}
+		if err := cs.contextRepository.SetVariables(ctx, cid, updated.Version, vars); err != nil {
+			return err
+		}
+		rc = &repo.RevertedContext{Context: *updated, RevertOf: target.info.Version}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cs.recordTokens(ctx, &rc.Context)
+	return rc, nil
+}
@@ -0,0 +1,62 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestRevertContext(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	created, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1", Tags: []string{"a"}})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	update := *created
+	update.Content = "v2"
+	update.Tags = []string{"b"}
+	if _, err := env.svc.UpdateContext(ctx, &update); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	if _, err := env.svc.RevertContext(ctx, "c1", query.VersionRef{Version: 1}, 1); !errors.Is(err, repo.ErrContextVersionMismatch) {
+		t.Fatalf("expected a stale revert to fail, got %v", err)
+	}
+	if _, err := env.svc.RevertContext(ctx, "c1", query.VersionRef{Version: 2}, 0); !errors.Is(err, ErrRevertToCurrent) {
+		t.Fatalf("expected a revert to the current version to fail, got %v", err)
+	}
+
+	reverted, err := env.svc.RevertContext(ctx, "c1", query.VersionRef{Version: 1}, 2)
+	if err != nil {
+		t.Fatalf("revert: %v", err)
+	}
+	if reverted.Version != 3 || reverted.RevertOf != 1 || reverted.Content != "v1" || len(reverted.Tags) != 1 || reverted.Tags[0] != "a" {
+		t.Fatalf("unexpected reverted context: %+v", reverted)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 2 {
+		t.Fatalf("expected the reverted version in the history, got %d entries", len(h))
+	}
+
+	// the marker moves to the history once the revert is superseded
+	next := reverted.Context
+	next.Content = "v4"
+	if _, err := env.svc.UpdateContext(ctx, &next); err != nil {
+		t.Fatalf("update after revert: %v", err)
+	}
+	current, err := env.cRepo.GetRevertedByID(ctx, "c1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if current.RevertOf != 0 {
+		t.Fatalf("expected the update to clear the revert marker, got %d", current.RevertOf)
+	}
+	doc, err := env.chRepo.Filter(ctx, map[string]interface{}{"contextId": "c1", "version": 3, "revertOf": 1})
+	if err != nil || len(doc) != 1 {
+		t.Fatalf("expected the history of version 3 to keep the revert marker, got %v %v", doc, err)
+	}
+}
@@ -0,0 +1,146 @@
+package svc
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+const (
+	highlightPre    = "<em>"
+	highlightPost   = "</em>"
+	snippetRadius   = 60
+	maxContentSnips = 2
+)
+
+type Highlight struct {
+	Field    string   `json:"field"`
+	Snippets []string `json:"snippets"`
+}
+
+type SearchResult struct {
+	Context    *entities.Context `json:"context"`
+	Score      float64           `json:"score"`
+	Highlights []Highlight       `json:"highlights,omitempty"`
+}
+
+func (cs contextService) SearchContexts(ctx context.Context, sq *query.SearchQuery) ([]*SearchResult, error) {
+	if err := sq.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cs.contextRepository.CheckFilterable(ctx, sq.TenantIDs); err != nil {
+		return nil, err
+	}
+	hits, err := cs.contextRepository.Search(ctx, sq)
+	if err != nil {
+		cs.log.Errorf("Error searching contexts: %v", err)
+		return nil, err
+	}
+	terms := query.SearchTerms(sq.Text)
+	results := make([]*SearchResult, 0, len(hits))
+	for _, hit := range hits {
+		results = append(results, &SearchResult{
+			Context:    hit.Context,
+			Score:      hit.Score,
+			Highlights: highlights(hit.Context, terms),
+		})
+	}
+	return results, nil
+}
+
+func highlights(c *entities.Context, terms []string) []Highlight {
+	var out []Highlight
+	for _, f := range []struct {
+		name  string
+		text  string
+		limit int
+	}{
+		{"name", c.Name, 1},
+		{"description", c.Description, 1},
+		{"content", c.Content, maxContentSnips},
+	} {
+		if snippets := snippets(f.text, terms, f.limit); len(snippets) > 0 {
+			out = append(out, Highlight{Field: f.name, Snippets: snippets})
+		}
+	}
+	return out
+}
+
+type span struct {
+	start, end int
+}
+
+// termSpans returns the byte ranges of the whole words of text that are one of terms.
+func termSpans(text string, terms []string) []span {
+	var spans []span
+	start := -1
+	for i, r := range text + " " {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			w := strings.ToLower(text[start:i])
+			for _, t := range terms {
+				if w == t {
+					spans = append(spans, span{start, i})
+					break
+				}
+			}
+			start = -1
+		}
+	}
+	return spans
+}
+
+// snippets cuts up to limit windows of text around the matched terms, with
+// every match inside a window wrapped in highlight markers.
+func snippets(text string, terms []string, limit int) []string {
+	spans := termSpans(text, terms)
+	var out []string
+	for i := 0; i < len(spans) && len(out) < limit; {
+		from := runeBoundary(text, spans[i].start-snippetRadius, false)
+		to := runeBoundary(text, spans[i].end+snippetRadius, true)
+
+		var b strings.Builder
+		if from > 0 {
+			b.WriteString("…")
+		}
+		pos := from
+		for ; i < len(spans) && spans[i].end <= to; i++ {
+			b.WriteString(text[pos:spans[i].start])
+			b.WriteString(highlightPre)
+			b.WriteString(text[spans[i].start:spans[i].end])
+			b.WriteString(highlightPost)
+			pos = spans[i].end
+		}
+		b.WriteString(text[pos:to])
+		if to < len(text) {
+			b.WriteString("…")
+		}
+		out = append(out, strings.TrimSpace(b.String()))
+	}
+	return out
+}
+
+// runeBoundary clamps i to text and moves it onto the start of a rune.
+func runeBoundary(text string, i int, forward bool) int {
+	if i <= 0 {
+		return 0
+	}
+	if i >= len(text) {
+		return len(text)
+	}
+	for i > 0 && i < len(text) && !utf8.RuneStart(text[i]) {
+		if forward {
+			i++
+		} else {
+			i--
+		}
+	}
+	return i
+}
@@ -0,0 +1,96 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestSnippets(t *testing.T) {
+	text := strings.Repeat("filler ", 20) + "the Refund policy applies to refunds. " + strings.Repeat("tail ", 30)
+	got := snippets(text, []string{"refund"}, 2)
+	if len(got) != 1 {
+		t.Fatalf("expected a single snippet, got %v", got)
+	}
+	s := got[0]
+	if !strings.HasPrefix(s, "…") || !strings.HasSuffix(s, "…") {
+		t.Fatalf("expected an elided snippet, got %q", s)
+	}
+	if !strings.Contains(s, "the <em>Refund</em> policy applies to refunds.") {
+		t.Fatalf("expected only the whole word to be highlighted, got %q", s)
+	}
+}
+
+func TestSnippetsMultiByte(t *testing.T) {
+	text := strings.Repeat("é", 100) + " café " + strings.Repeat("ü", 100)
+	got := snippets(text, []string{"café"}, 1)
+	if len(got) != 1 || !strings.Contains(got[0], "<em>café</em>") {
+		t.Fatalf("unexpected snippet %v", got)
+	}
+	if !strings.HasPrefix(got[0], "…") {
+		t.Fatalf("expected an elided snippet, got %q", got[0])
+	}
+}
+
+// encryptedTenantRepository reports the tenant acme, and every tenant when
+// none is named, as encrypted.
+type encryptedTenantRepository struct {
+	*repo.MemoryContextRepository
+}
+
+func (r encryptedTenantRepository) CheckFilterable(ctx context.Context, tenantIDs []string) error {
+	if len(tenantIDs) == 0 {
+		return repo.ErrEncryptedFilter
+	}
+	for _, id := range tenantIDs {
+		if id == "acme" {
+			return repo.ErrEncryptedFilter
+		}
+	}
+	return nil
+}
+
+func TestEncryptedTenantsRefuseSearchAndMetadataFilters(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	cs := env.svc.(*contextService)
+	cs.contextRepository = encryptedTenantRepository{env.cRepo}
+	if _, err := cs.CreateContext(ctx, &entities.Context{ID: "c1", Name: "refunds", Tenants: []entities.TenantStub{{ID: "other"}},
+		Metadata: map[string]interface{}{"kind": "policy"}}); err != nil {
+		t.Fatal(err)
+	}
+	byKind := []query.MetadataPredicate{{Key: "kind", Op: query.MetadataEq, Values: []string{"policy"}}}
+	page := query.Page{Sort: query.SortVersion, Limit: 10}
+
+	for name, q := range map[string]*query.ContextQuery{
+		"unscoped":         {Metadata: byKind},
+		"encrypted tenant": {TenantIDs: []string{"acme"}, Metadata: byKind},
+	} {
+		if _, err := cs.FilterContexts(ctx, q, page); !errors.Is(err, query.ErrInvalidQuery) {
+			t.Fatalf("filter %s: expected an invalid query, got %v", name, err)
+		}
+		if _, err := cs.ListTrash(ctx, q, page); !errors.Is(err, query.ErrInvalidQuery) {
+			t.Fatalf("trash %s: expected an invalid query, got %v", name, err)
+		}
+	}
+	if _, err := cs.SearchContexts(ctx, &query.SearchQuery{Text: "refunds"}); !errors.Is(err, query.ErrInvalidQuery) {
+		t.Fatalf("expected an unscoped search to be refused, got %v", err)
+	}
+
+	list, err := cs.FilterContexts(ctx, &query.ContextQuery{TenantIDs: []string{"other"}, Metadata: byKind}, page)
+	if err != nil || len(list.Items) != 1 {
+		t.Fatalf("expected the clear tenant to be filtered, got %v, %v", list, err)
+	}
+	if _, err := cs.FilterContexts(ctx, &query.ContextQuery{}, page); err != nil {
+		t.Fatalf("a listing without metadata filter must pass, got %v", err)
+	}
+	hits, err := cs.SearchContexts(ctx, &query.SearchQuery{Text: "refunds", TenantIDs: []string{"other"}})
+	if err != nil || len(hits) != 1 {
+		t.Fatalf("expected the clear tenant to be searched, got %v, %v", hits, err)
+	}
+}
@@ -3,9 +3,14 @@ package svc
 import (
 	"context"
 	"errors"
+	"io"
 	"time"
 
+	"github.com/mangudaigb/context-service/internal/patch"
+	"github.com/mangudaigb/context-service/internal/query"
 	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/templating"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
 	"github.com/mangudaigb/dhauli-base/logger"
 	"github.com/mangudaigb/dhauli-base/types/entities"
 )
@@ -18,21 +23,62 @@ type ContextService interface {
 	CreateContext(ctx context.Context, c *entities.Context) (*entities.Context, error)
 	GetContextByID(ctx context.Context, id string) (*entities.Context, error)
 	UpdateContext(ctx context.Context, c *entities.Context) (*entities.Context, error)
-	DeleteContext(ctx context.Context, id string) (*entities.Context, error)
-	FilterContexts(ctx context.Context, filter interface{}) ([]*entities.Context, error)
+	PatchContext(ctx context.Context, id string, expectedVersion int, p patch.Patch) (*entities.Context, error)
+	DeleteContext(ctx context.Context, id string, expectedVersion int, by entities.UserStub) (*repo.TrashedContext, error)
+	RestoreContext(ctx context.Context, id string) (*entities.Context, error)
+	ListTrash(ctx context.Context, q *query.ContextQuery, page query.Page) (*repo.TrashPage, error)
+	PurgeTrash(ctx context.Context, before time.Time, batch int) (int, error)
+	SweepContentFiles(ctx context.Context) (int, error)
+	FilterContexts(ctx context.Context, q *query.ContextQuery, page query.Page) (*repo.ContextPage, error)
+	SearchContexts(ctx context.Context, sq *query.SearchQuery) ([]*SearchResult, error)
+	DiffContext(ctx context.Context, cid string, from, to query.VersionRef) (*ContextDiff, error)
+	RevertContext(ctx context.Context, cid string, to query.VersionRef, expectedVersion int) (*repo.RevertedContext, error)
+	ForkContext(ctx context.Context, cid string, from query.VersionRef, opts ForkOptions) (*repo.ForkedContext, error)
+	ListForks(ctx context.Context, cid string) ([]*repo.ForkedContext, error)
+	GetLineage(ctx context.Context, cid string) (*ContextLineage, error)
+	ListBranches(ctx context.Context, cid string) ([]*repo.Branch, error)
+	CreateBranch(ctx context.Context, cid, name string, version int, by entities.UserStub) (*repo.Branch, error)
+	GetBranch(ctx context.Context, cid, name string) (*BranchContext, error)
+	GetBranchVersions(ctx context.Context, cid, name string, page query.Page) (*repo.ContextHistoryPage, error)
+	CommitToBranch(ctx context.Context, cid, name string, c *entities.Context, head int, by entities.UserStub) (*BranchContext, error)
+	DeleteBranch(ctx context.Context, cid, name string) error
+	MergeBranch(ctx context.Context, cid, name string, expectedVersion int, resolution *entities.Context) (*MergeResult, error)
+	ListLabels(ctx context.Context, cid string) ([]*repo.Label, error)
+	MoveLabel(ctx context.Context, cid, name string, version int, opts LabelMoveOptions) (*repo.Label, error)
+	RemoveLabel(ctx context.Context, cid, name string, opts LabelMoveOptions) error
+	ListLabelMoves(ctx context.Context, cid, name string) ([]*repo.LabelMove, error)
+	GetContextByLabel(ctx context.Context, cid, name string) (*entities.Context, error)
+	RenderContext(ctx context.Context, cid string, opts RenderOptions) (*RenderedContext, error)
+	GetVariables(ctx context.Context, cid string) (*repo.VersionVariables, error)
+	SetVariables(ctx context.Context, cid string, expectedVersion int, vars []templating.Variable) (*repo.VersionVariables, error)
+	RenderTemplate(ctx context.Context, cid string, values map[string]interface{}, opts RenderOptions) (*RenderedContext, error)
+	CountTokens(ctx context.Context, contexts []*entities.Context) ([]*CountedContext, error)
+	CountHistoryTokens(ctx context.Context, branch string, entries []*entities.ContextHistory) ([]*CountedHistory, error)
+	FitContext(ctx context.Context, cid string, budget int, opts FitOptions) (*FittedContext, error)
+	BatchContexts(ctx context.Context, ops []BatchOperation, atomic bool, by entities.UserStub) (*BatchReport, error)
+	ExportContexts(ctx context.Context, w io.Writer, q *query.ContextQuery, withHistory bool) error
+	ImportContexts(ctx context.Context, r io.Reader, q *query.ContextQuery, policy ImportPolicy) (*ImportReport, error)
 }
 
 type contextService struct {
 	log                   *logger.Logger
 	contextHistoryService ContextHistoryService
 	contextRepository     repo.ContextRepository
+	transactor            repo.Transactor
+	schemas               repo.SchemaRepository
+	compiled              *schemaCache
+	tokenizer             tokenizer.Tokenizer
 }
 
-func NewContextService(log *logger.Logger, repo repo.ContextRepository, chs ContextHistoryService) ContextService {
+func NewContextService(log *logger.Logger, repo repo.ContextRepository, chs ContextHistoryService, tx repo.Transactor, schemas repo.SchemaRepository, tok tokenizer.Tokenizer) ContextService {
 	return &contextService{
 		log:                   log,
 		contextRepository:     repo,
 		contextHistoryService: chs,
+		transactor:            tx,
+		schemas:               schemas,
+		compiled:              newSchemaCache(),
+		tokenizer:             tok,
 	}
 }
 
@@ -41,6 +87,9 @@ func (cs contextService) CreateContext(ctx context.Context, c *entities.Context)
 		cs.log.Errorf("Invalid input: context ID is empty")
 		return nil, ErrInvalidInput
 	}
+	if err := cs.checkMetadata(ctx, c); err != nil {
+		return nil, err
+	}
 	c.IsActive = true
 	c.Version = 1
 	c.CreatedTime = time.Now()
@@ -49,6 +98,7 @@ func (cs contextService) CreateContext(ctx context.Context, c *entities.Context)
 	if err != nil {
 		return nil, err
 	}
+	cs.recordTokens(ctx, createdContext)
 	return createdContext, nil
 }
 
@@ -60,17 +110,31 @@ func (cs contextService) GetContextByID(ctx context.Context, id string) (*entiti
 	return c, nil
 }
 
+// UpdateContext snapshots the stored context into its history and applies the
+// version-checked update in a single transaction.
 func (cs contextService) UpdateContext(ctx context.Context, c *entities.Context) (*entities.Context, error) {
-	oc, err := cs.contextRepository.GetByID(ctx, c.ID)
-	if err != nil {
-		cs.log.Errorf("Error getting context for ID: %s with err: %v", c.ID, err)
+	if err := cs.checkMetadata(ctx, c); err != nil {
 		return nil, err
 	}
-	_, err = cs.contextHistoryService.AddHistoryForContext(ctx, oc)
+	var nc *entities.Context
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		update := *c
+		var err error
+		nc, err = cs.updateWithHistory(ctx, &update)
+		return err
+	})
 	if err != nil {
-		cs.log.Errorf("Error adding history for context: %v", err)
+		return nil, err
 	}
+	cs.recordTokens(ctx, nc)
+	return nc, nil
+}
 
+// updateWithHistory must run inside a transaction.
+func (cs contextService) updateWithHistory(ctx context.Context, c *entities.Context) (*entities.Context, error) {
+	if _, err := cs.snapshot(ctx, c.ID); err != nil {
+		return nil, err
+	}
 	nc, err := cs.contextRepository.Update(ctx, c)
 	if err != nil {
 		cs.log.Errorf("Error updating context: %v", err)
@@ -79,24 +143,56 @@ func (cs contextService) UpdateContext(ctx context.Context, c *entities.Context)
 	return nc, nil
 }
 
-func (cs contextService) DeleteContext(ctx context.Context, id string) (*entities.Context, error) {
-	c, err := cs.contextRepository.GetByID(ctx, id)
+// snapshot records the current version of the context in its history, with
+// its revert marker and variables, before it gets replaced, and returns it. It
+// must run inside a transaction.
+func (cs contextService) snapshot(ctx context.Context, id string) (*repo.RevertedContext, error) {
+	oc, err := cs.contextRepository.GetRevertedByID(ctx, id)
 	if err != nil {
+		cs.log.Errorf("Error getting context for ID: %s with err: %v", id, err)
 		return nil, err
 	}
-	c.IsActive = false
-	uc, err := cs.contextRepository.Update(ctx, c)
+	ch, err := cs.contextHistoryService.AddHistoryForContext(ctx, &oc.Context)
 	if err != nil {
+		cs.log.Errorf("Error adding history for context: %v", err)
 		return nil, err
 	}
-	return uc, nil
+	if oc.RevertOf > 0 {
+		if err := cs.contextHistoryService.MarkRevert(ctx, ch.ID, oc.RevertOf); err != nil {
+			return nil, err
+		}
+	}
+	if len(oc.Variables) > 0 {
+		if err := cs.contextHistoryService.SetVariables(ctx, ch.ID, oc.Variables); err != nil {
+			return nil, err
+		}
+	}
+	return oc, nil
 }
 
-func (cs contextService) FilterContexts(ctx context.Context, filter interface{}) ([]*entities.Context, error) {
-	contexts, err := cs.contextRepository.Filter(ctx, filter)
+func (cs contextService) FilterContexts(ctx context.Context, q *query.ContextQuery, page query.Page) (*repo.ContextPage, error) {
+	if q == nil {
+		q = &query.ContextQuery{}
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cs.checkMetadataFilter(ctx, q); err != nil {
+		return nil, err
+	}
+	contexts, err := cs.contextRepository.Query(ctx, q, page)
 	if err != nil {
 		cs.log.Errorf("Error filtering contexts: %v", err)
 		return nil, err
 	}
 	return contexts, nil
 }
+
+// checkMetadataFilter refuses the metadata predicates of q when they could
+// reach encrypted contexts, which they would never match.
+func (cs contextService) checkMetadataFilter(ctx context.Context, q *query.ContextQuery) error {
+	if len(q.Metadata) == 0 {
+		return nil
+	}
+	return cs.contextRepository.CheckFilterable(ctx, q.TenantIDs)
+}
@@ -0,0 +1,152 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+var errHistoryDown = errors.New("history unavailable")
+
+// failingHistoryRepository fails every Create and CreateMany after the wrapped repository has stored the entries.
+type failingHistoryRepository struct {
+	*repo.MemoryContextHistoryRepository
+}
+
+func (f failingHistoryRepository) Create(ctx context.Context, ch *entities.ContextHistory) (*entities.ContextHistory, error) {
+	if _, err := f.MemoryContextHistoryRepository.Create(ctx, ch); err != nil {
+		return nil, err
+	}
+	return nil, errHistoryDown
+}
+
+func (f failingHistoryRepository) CreateMany(ctx context.Context, chs []*entities.ContextHistory) error {
+	if err := f.MemoryContextHistoryRepository.CreateMany(ctx, chs); err != nil {
+		return err
+	}
+	return errHistoryDown
+}
+
+type testEnv struct {
+	svc    ContextService
+	cRepo  *repo.MemoryContextRepository
+	chRepo *repo.MemoryContextHistoryRepository
+	sRepo  *repo.MemorySchemaRepository
+}
+
+func newTestEnv(t *testing.T, failHistory bool) *testEnv {
+	t.Helper()
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatalf("creating logger: %v", err)
+	}
+	cRepo := repo.NewMemoryContextRepository(log)
+	chRepo := repo.NewMemoryContextHistoryRepository(log)
+	var historyRepo repo.ContextHistoryRepository = chRepo
+	if failHistory {
+		historyRepo = failingHistoryRepository{chRepo}
+	}
+	chSvc := NewContextHistoryService(log, historyRepo)
+	sRepo := repo.NewMemorySchemaRepository()
+	return &testEnv{
+		svc:    NewContextService(log, cRepo, chSvc, repo.NewMemoryTransactor(cRepo, chRepo, sRepo), sRepo, tokenizer.NewApproximate()),
+		cRepo:  cRepo,
+		chRepo: chRepo,
+		sRepo:  sRepo,
+	}
+}
+
+func (env *testEnv) historyFor(t *testing.T, cid string) []*entities.ContextHistory {
+	t.Helper()
+	list, err := env.chRepo.Filter(context.Background(), map[string]interface{}{"contextId": cid})
+	if err != nil {
+		t.Fatalf("listing history: %v", err)
+	}
+	return list
+}
+
+func TestUpdateContextRollsBackWhenHistoryFails(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, true)
+	created, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	update := *created
+	update.Content = "v2"
+	if _, err := env.svc.UpdateContext(ctx, &update); !errors.Is(err, errHistoryDown) {
+		t.Fatalf("expected the history error, got %v", err)
+	}
+
+	stored, err := env.cRepo.GetByID(ctx, "c1")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if stored.Version != 1 || stored.Content != "v1" {
+		t.Fatalf("update should have been rolled back, got %+v", stored)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 0 {
+		t.Fatalf("history should have been rolled back, got %d entries", len(h))
+	}
+}
+
+func TestUpdateContextVersionMismatchLeavesNoHistory(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	stale := &entities.Context{ID: "c1", Name: "n", Content: "v2", Version: 7}
+	if _, err := env.svc.UpdateContext(ctx, stale); !errors.Is(err, repo.ErrContextVersionMismatch) {
+		t.Fatalf("expected a version mismatch, got %v", err)
+	}
+	if stale.Version != 7 {
+		t.Fatalf("caller's context should not be modified, got version %d", stale.Version)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 0 {
+		t.Fatalf("expected no orphan history, got %d entries", len(h))
+	}
+}
+
+func TestDeleteContextRecordsHistory(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	deleted, err := env.svc.DeleteContext(ctx, "c1", 0, entities.UserStub{ID: "u1"})
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if deleted.IsActive || deleted.Version != 2 || deleted.DeletedBy.ID != "u1" {
+		t.Fatalf("unexpected deleted context: %+v", deleted)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 1 || !h[0].IsActive {
+		t.Fatalf("expected a snapshot of the active context, got %+v", h)
+	}
+}
+
+func TestDeleteContextExpectedVersion(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := env.svc.DeleteContext(ctx, "c1", 2, entities.UserStub{}); !errors.Is(err, repo.ErrContextVersionMismatch) {
+		t.Fatalf("expected a version mismatch, got %v", err)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 0 {
+		t.Fatalf("expected no orphan history, got %d entries", len(h))
+	}
+	if _, err := env.svc.DeleteContext(ctx, "c1", 1, entities.UserStub{}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+}
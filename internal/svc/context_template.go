@@ -0,0 +1,101 @@
+package svc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/templating"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// GetVariables returns the variables the current version of cid declares.
+func (cs contextService) GetVariables(ctx context.Context, cid string) (*repo.VersionVariables, error) {
+	vv, err := cs.contextRepository.GetVariables(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if vv.Variables == nil {
+		vv.Variables = []templating.Variable{}
+	}
+	return vv, nil
+}
+
+// SetVariables replaces the variables cid declares. The declarations belong
+// to the versions of cid: setting them writes a new version, recording the
+// replaced one in the history with its own, and fails with
+// repo.ErrContextVersionMismatch when expectedVersion is set and the context
+// has moved on.
+func (cs contextService) SetVariables(ctx context.Context, cid string, expectedVersion int, vars []templating.Variable) (*repo.VersionVariables, error) {
+	if err := templating.Validate(vars); err != nil {
+		return nil, err
+	}
+	var nc *entities.Context
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		current, err := cs.contextRepository.GetByID(ctx, cid)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != 0 && current.Version != expectedVersion {
+			return repo.ErrContextVersionMismatch
+		}
+		if nc, err = cs.updateWithHistory(ctx, current); err != nil {
+			return err
+		}
+		return cs.contextRepository.SetVariables(ctx, cid, nc.Version, vars)
+	})
+	if err != nil {
+		cs.log.Errorf("Error setting the variables of context %s: %v", cid, err)
+		return nil, err
+	}
+	cs.recordTokens(ctx, nc)
+	if vars == nil {
+		vars = []templating.Variable{}
+	}
+	return &repo.VersionVariables{Version: nc.Version, Variables: vars}, nil
+}
+
+// versionVariables returns the variables version of cid declares, which the
+// context keeps for its current version and the history for the others.
+func (cs contextService) versionVariables(ctx context.Context, cid string, version int) ([]templating.Variable, error) {
+	vv, err := cs.contextRepository.GetVariables(ctx, cid)
+	if err == nil && vv.Version == version {
+		return vv.Variables, nil
+	}
+	if err != nil && !errors.Is(err, repo.ErrContextNotFound) {
+		return nil, err
+	}
+	return cs.contextHistoryService.GetVariables(ctx, cid, version)
+}
+
+// RenderTemplate renders cid like RenderContext, then substitutes the values
+// into its placeholders and those of the contexts it includes. Each version
+// rendered brings the variables it declares, those of cid first: an included
+// context need not have its placeholders declared again by cid, and a
+// declaration of cid wins over one of the same name in an include. Every
+// placeholder must be declared, and the values must fit the declarations, see
+// templating.Render.
+func (cs contextService) RenderTemplate(ctx context.Context, cid string, values map[string]interface{}, opts RenderOptions) (*RenderedContext, error) {
+	rendered, err := cs.RenderContext(ctx, cid, opts)
+	if err != nil {
+		return nil, err
+	}
+	var vars []templating.Variable
+	declared := map[string]bool{}
+	for _, rv := range rendered.Resolved {
+		declarations, err := cs.versionVariables(ctx, rv.ContextID, rv.Version)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range declarations {
+			if !declared[v.Name] {
+				declared[v.Name] = true
+				vars = append(vars, v)
+			}
+		}
+	}
+	if rendered.Content, err = templating.Render(rendered.Content, vars, values); err != nil {
+		return nil, err
+	}
+	return rendered, nil
+}
@@ -0,0 +1,105 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/templating"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	ctx := context.Background()
+	env := renderFixture(t,
+		&entities.Context{ID: "tone", Name: "Tone", Content: "Answer in a {{tone}} tone."},
+		&entities.Context{ID: "agent", Name: "Agent", Content: "Help {{customer}}. {{include id=\"tone\"}}"},
+	)
+	vv, err := env.svc.SetVariables(ctx, "agent", 0, []templating.Variable{
+		{Name: "customer", Type: templating.String, Required: true},
+		{Name: "tone", Type: templating.String, Default: "formal"},
+	})
+	if err != nil || len(vv.Variables) != 2 || vv.Version != 2 {
+		t.Fatalf("set variables: %+v, %v", vv, err)
+	}
+
+	rendered, err := env.svc.RenderTemplate(ctx, "agent", map[string]interface{}{"customer": "Ada"}, RenderOptions{})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if rendered.Content != "Help Ada. Answer in a formal tone." || len(rendered.Resolved) != 2 {
+		t.Fatalf("unexpected rendering: %+v", rendered)
+	}
+
+	if _, err := env.svc.RenderTemplate(ctx, "agent", map[string]interface{}{"region": "eu"}, RenderOptions{}); !errors.Is(err, templating.ErrInvalidValues) {
+		t.Fatalf("expected ErrInvalidValues, got %v", err)
+	}
+	if _, err := env.svc.RenderTemplate(ctx, "tone", nil, RenderOptions{}); !errors.Is(err, templating.ErrUndeclared) {
+		t.Fatalf("expected ErrUndeclared, got %v", err)
+	}
+	if _, err := env.svc.SetVariables(ctx, "agent", 0, []templating.Variable{{Name: "tone", Type: "colour"}}); !errors.Is(err, templating.ErrInvalidDeclaration) {
+		t.Fatalf("expected ErrInvalidDeclaration, got %v", err)
+	}
+
+	if vv, err := env.svc.SetVariables(ctx, "agent", 0, nil); err != nil || len(vv.Variables) != 0 {
+		t.Fatalf("clear variables: %+v, %v", vv, err)
+	}
+}
+
+func TestTemplateVariablesAreVersioned(t *testing.T) {
+	ctx := context.Background()
+	env := renderFixture(t,
+		&entities.Context{ID: "tone", Name: "Tone", Content: "Answer in a {{tone}} tone."},
+		&entities.Context{ID: "agent", Name: "Agent", Content: "Help {{customer}}. {{include id=\"tone\"}}"},
+	)
+	if _, err := env.svc.SetVariables(ctx, "tone", 0, []templating.Variable{{Name: "tone", Type: templating.String, Default: "formal"}}); err != nil {
+		t.Fatal(err)
+	}
+	vv, err := env.svc.SetVariables(ctx, "agent", 1, []templating.Variable{{Name: "customer", Type: templating.String, Required: true}})
+	if err != nil || vv.Version != 2 {
+		t.Fatalf("set variables: %+v, %v", vv, err)
+	}
+	if _, err := env.chRepo.GetByVersion(ctx, "agent", 1); err != nil {
+		t.Fatalf("the replaced version must be in the history: %v", err)
+	}
+
+	rendered, err := env.svc.RenderTemplate(ctx, "agent", map[string]interface{}{"customer": "Ada"}, RenderOptions{})
+	if err != nil {
+		t.Fatalf("an include brings its own declarations: %v", err)
+	}
+	if rendered.Content != "Help Ada. Answer in a formal tone." {
+		t.Fatalf("unexpected rendering: %q", rendered.Content)
+	}
+
+	if _, err := env.svc.MoveLabel(ctx, "agent", "prod", 2, LabelMoveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.SetVariables(ctx, "agent", 2, []templating.Variable{{Name: "customer", Type: templating.String, Default: "there"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.SetVariables(ctx, "agent", 2, nil); !errors.Is(err, repo.ErrContextVersionMismatch) {
+		t.Fatalf("expected ErrContextVersionMismatch, got %v", err)
+	}
+	if rendered, err := env.svc.RenderTemplate(ctx, "agent", nil, RenderOptions{}); err != nil || rendered.Content != "Help there. Answer in a formal tone." {
+		t.Fatalf("current declarations: %+v, %v", rendered, err)
+	}
+	if _, err := env.svc.RenderTemplate(ctx, "agent", nil, RenderOptions{Label: "prod"}); !errors.Is(err, templating.ErrInvalidValues) {
+		t.Fatalf("the labelled version must render with its own declarations, got %v", err)
+	}
+
+	if _, err := env.svc.RevertContext(ctx, "agent", query.VersionRef{Version: 2}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if vv, err := env.svc.GetVariables(ctx, "agent"); err != nil || vv.Version != 4 || !vv.Variables[0].Required {
+		t.Fatalf("a revert must bring back the declarations of its version: %+v, %v", vv, err)
+	}
+	fc, err := env.svc.ForkContext(ctx, "agent", query.VersionRef{Version: 3}, ForkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vv, err := env.svc.GetVariables(ctx, fc.ID); err != nil || len(vv.Variables) != 1 || vv.Variables[0].Default != "there" {
+		t.Fatalf("a fork must declare the variables of its version: %+v, %v", vv, err)
+	}
+}
@@ -0,0 +1,218 @@
+package svc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// CountedContext is a context with the token count of its content.
+type CountedContext struct {
+	*entities.Context
+	Tokens *repo.TokenCount `json:"tokens,omitempty"`
+}
+
+// CountedHistory is a history entry with the token count of its content.
+type CountedHistory struct {
+	*entities.ContextHistory
+	Tokens *repo.TokenCount `json:"tokens,omitempty"`
+}
+
+// CountedHistoryPage is a page of history entries with their token counts.
+type CountedHistoryPage struct {
+	Items      []*CountedHistory `json:"items"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+// CountedPage is a page of contexts with their token counts.
+type CountedPage struct {
+	Items      []*CountedContext `json:"items"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+// FitOptions qualify a fit: Strategy defaults to tokenizer.Head, Label, when
+// set, fits the version of the context the label points at instead of the
+// current one, and Priorities are the priorities of the sections by title
+// under tokenizer.Sections.
+type FitOptions struct {
+	Strategy   tokenizer.Strategy
+	Label      string
+	Priorities map[string]int
+}
+
+// FittedContext is the content of a version of a context cut down to Budget
+// tokens of Tokenizer.
+type FittedContext struct {
+	ContextID string             `json:"contextId"`
+	Version   int                `json:"version"`
+	Tokenizer string             `json:"tokenizer"`
+	Budget    int                `json:"budget"`
+	Strategy  tokenizer.Strategy `json:"strategy"`
+	tokenizer.Fitted
+}
+
+// CountTokens returns the contexts with the token counts of their versions.
+// The counts that are not stored yet are computed, from the stored contents
+// of the contexts loaded without theirs, and stored. As with recordTokens, a
+// failure to store them does not fail the count.
+func (cs contextService) CountTokens(ctx context.Context, contexts []*entities.Context) ([]*CountedContext, error) {
+	versions := make(map[string]int, len(contexts))
+	for _, c := range contexts {
+		versions[c.ID] = c.Version
+	}
+	counts, err := cs.contextRepository.GetTokenCounts(ctx, cs.tokenizer.Name(), versions)
+	if err != nil {
+		return nil, err
+	}
+	var unloaded []string
+	for _, c := range contexts {
+		if _, ok := counts[c.ID]; !ok && c.Content == "" {
+			unloaded = append(unloaded, c.ID)
+		}
+	}
+	stored := map[string]*entities.Context{}
+	if len(unloaded) > 0 {
+		found, err := cs.contextRepository.FindByIDs(ctx, unloaded)
+		if err != nil {
+			return nil, err
+		}
+		for _, sc := range found {
+			stored[sc.ID] = &sc.Context
+		}
+	}
+	counted := make([]*CountedContext, len(contexts))
+	var missing []*repo.TokenCount
+	for i, c := range contexts {
+		tc, ok := counts[c.ID]
+		if !ok {
+			content := c
+			if c.Content == "" {
+				content = stored[c.ID]
+			}
+			// a context written since it was read is left without a count
+			if content != nil && content.Version == c.Version {
+				tc = cs.tokenCount("", content)
+				missing = append(missing, tc)
+			}
+		}
+		counted[i] = &CountedContext{Context: c, Tokens: tc}
+	}
+	cs.putTokenCounts(ctx, missing)
+	return counted, nil
+}
+
+// CountHistoryTokens returns history entries of one context, versions of its
+// main line or, when branch is set, of the branch, with their token counts.
+// Like CountTokens, it computes and stores the counts missing.
+func (cs contextService) CountHistoryTokens(ctx context.Context, branch string, entries []*entities.ContextHistory) ([]*CountedHistory, error) {
+	versions := make([]*entities.Context, len(entries))
+	for i, ch := range entries {
+		versions[i] = historyContext(ch)
+	}
+	counts, err := cs.versionTokens(ctx, branch, versions)
+	if err != nil {
+		return nil, err
+	}
+	counted := make([]*CountedHistory, len(entries))
+	for i, ch := range entries {
+		counted[i] = &CountedHistory{ContextHistory: ch, Tokens: counts[i]}
+	}
+	return counted, nil
+}
+
+// versionTokens returns the token counts of versions of a context, of its
+// branch when branch is set, computing and storing the counts missing. The
+// versions listed without their content are loaded from the history.
+func (cs contextService) versionTokens(ctx context.Context, branch string, versions []*entities.Context) ([]*repo.TokenCount, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	cid := versions[0].ID
+	numbers := make([]int, len(versions))
+	for i, c := range versions {
+		numbers[i] = c.Version
+	}
+	counts, err := cs.contextRepository.GetVersionTokenCounts(ctx, cs.tokenizer.Name(), cid, branch, numbers)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*repo.TokenCount, len(versions))
+	var missing []*repo.TokenCount
+	for i, c := range versions {
+		tc, ok := counts[c.Version]
+		if !ok {
+			if c.Content == "" {
+				ch, err := cs.historyVersion(ctx, cid, branch, c.Version)
+				if errors.Is(err, repo.ErrContextHistoryNotFound) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				c = historyContext(ch)
+			}
+			tc = cs.tokenCount(branch, c)
+			missing = append(missing, tc)
+		}
+		out[i] = tc
+	}
+	cs.putTokenCounts(ctx, missing)
+	return out, nil
+}
+
+func (cs contextService) historyVersion(ctx context.Context, cid, branch string, version int) (*entities.ContextHistory, error) {
+	if branch == "" {
+		return cs.contextHistoryService.GetContextHistoryByVersion(ctx, cid, version)
+	}
+	return cs.contextHistoryService.GetBranchVersion(ctx, cid, branch, version)
+}
+
+func (cs contextService) tokenCount(branch string, c *entities.Context) *repo.TokenCount {
+	return repo.NewTokenCount(c.ID, branch, c.Version, cs.tokenizer.Name(), tokenizer.Count(cs.tokenizer, c.Content))
+}
+
+// recordTokens stores the token counts of versions of the main line just
+// written.
+func (cs contextService) recordTokens(ctx context.Context, contexts ...*entities.Context) {
+	counts := make([]*repo.TokenCount, 0, len(contexts))
+	for _, c := range contexts {
+		counts = append(counts, cs.tokenCount("", c))
+	}
+	cs.putTokenCounts(ctx, counts)
+}
+
+// putTokenCounts stores counts. A failure is only logged: it fails neither
+// the write nor the read the counts come with, the counts missing are made up
+// for when next read.
+func (cs contextService) putTokenCounts(ctx context.Context, counts []*repo.TokenCount) {
+	if err := cs.contextRepository.PutTokenCounts(ctx, counts); err != nil {
+		cs.log.Errorf("Error recording token counts: %v", err)
+	}
+}
+
+// FitContext returns the content of the context cut down to budget tokens
+// under the strategy of opts, see tokenizer.Fit.
+func (cs contextService) FitContext(ctx context.Context, cid string, budget int, opts FitOptions) (*FittedContext, error) {
+	if opts.Strategy == "" {
+		opts.Strategy = tokenizer.Head
+	}
+	c, err := cs.renderRoot(ctx, cid, opts.Label)
+	if err != nil {
+		return nil, err
+	}
+	fitted, err := tokenizer.Fit(cs.tokenizer, c.Content, budget, opts.Strategy, opts.Priorities)
+	if err != nil {
+		return nil, err
+	}
+	return &FittedContext{
+		ContextID: c.ID,
+		Version:   c.Version,
+		Tokenizer: cs.tokenizer.Name(),
+		Budget:    budget,
+		Strategy:  opts.Strategy,
+		Fitted:    *fitted,
+	}, nil
+}
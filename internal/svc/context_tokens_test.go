@@ -0,0 +1,213 @@
+package svc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestTokenCounts(t *testing.T) {
+	ctx := context.Background()
+	env := renderFixture(t, &entities.Context{ID: "c1", Name: "C1", Content: "Hello, world!"})
+	name := tokenizer.NewApproximate().Name()
+
+	counts, err := env.cRepo.GetTokenCounts(ctx, name, map[string]int{"c1": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc := counts["c1"]; tc == nil || tc.Tokens != 4 || tc.Version != 1 {
+		t.Fatalf("expected 4 tokens recorded at creation, got %+v", tc)
+	}
+	if _, err := env.svc.UpdateContext(ctx, &entities.Context{ID: "c1", Name: "C1", Content: "Hello", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	counts, err = env.cRepo.GetTokenCounts(ctx, name, map[string]int{"c1": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc := counts["c1"]; tc == nil || tc.Tokens != 1 {
+		t.Fatalf("expected 1 token recorded at update, got %+v", tc)
+	}
+
+	// A version written without its count gets it on read.
+	missing := &entities.Context{ID: "c2", Version: 3, Content: "one two three"}
+	counted, err := env.svc.CountTokens(ctx, []*entities.Context{missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc := counted[0].Tokens; tc == nil || tc.Tokens != 3 || tc.Tokenizer != name {
+		t.Fatalf("unexpected count %+v", tc)
+	}
+	counts, err = env.cRepo.GetTokenCounts(ctx, name, map[string]int{"c2": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["c2"] == nil {
+		t.Fatal("expected the computed count to be stored")
+	}
+	counted, err = env.svc.CountTokens(ctx, []*entities.Context{{ID: "c3", Version: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counted[0].Tokens != nil {
+		t.Fatalf("expected no count without content, got %+v", counted[0].Tokens)
+	}
+}
+
+// failingCounts fails to store token counts.
+type failingCounts struct {
+	repo.ContextRepository
+}
+
+func (failingCounts) PutTokenCounts(ctx context.Context, counts []*repo.TokenCount) error {
+	return errors.New("token counts unavailable")
+}
+
+func TestCountTokensOfListings(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	tok := tokenizer.NewApproximate()
+	// written without its count, and listed without its content
+	if _, err := env.cRepo.Create(ctx, &entities.Context{ID: "c1", Name: "C1", Content: "one two three", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	cs := env.svc.(*contextService)
+	cs.contextRepository = failingCounts{env.cRepo}
+	counted, err := cs.CountTokens(ctx, []*entities.Context{{ID: "c1", Version: 1}})
+	if err != nil {
+		t.Fatalf("a count that cannot be stored must not fail the read: %v", err)
+	}
+	if tc := counted[0].Tokens; tc == nil || tc.Tokens != tokenizer.Count(tok, "one two three") {
+		t.Fatalf("expected the count of the stored content, got %+v", tc)
+	}
+	counted, err = cs.CountTokens(ctx, []*entities.Context{{ID: "c1", Version: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counted[0].Tokens != nil {
+		t.Fatalf("a version that is not stored must not be counted, got %+v", counted[0].Tokens)
+	}
+}
+
+func TestTokenCountsOfEveryVersion(t *testing.T) {
+	ctx := context.Background()
+	env := branchFixture(t)
+	tok := tokenizer.NewApproximate()
+	stored := func(cid, branch string, version int) int {
+		t.Helper()
+		counts, err := env.cRepo.GetVersionTokenCounts(ctx, tok.Name(), cid, branch, []int{version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[version] == nil {
+			t.Fatalf("no count stored for version %d of %s %q", version, cid, branch)
+		}
+		return counts[version].Tokens
+	}
+
+	bc := commit(t, env, func(c *entities.Context) { c.Content = "Be brief." })
+	if bc.Tokens == nil || stored("c1", "draft", 2) != tokenizer.Count(tok, "Be brief.") {
+		t.Fatalf("a commit must record the count of the branch version, got %+v", bc.Tokens)
+	}
+	if stored("c1", "", 1) != tokenizer.Count(tok, prompt) {
+		t.Fatal("a commit must not replace the count of the main line version")
+	}
+	merged, err := env.svc.MergeBranch(ctx, "c1", "draft", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored("c1", "", merged.Context.Version) != tokenizer.Count(tok, "Be brief.") {
+		t.Fatal("a merge must record the count of the version written")
+	}
+	if _, err := env.svc.DeleteContext(ctx, "c1", 0, entities.UserStub{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := env.svc.RestoreContext(ctx, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored("c1", "", restored.Version)
+
+	page, err := env.svc.(*contextService).contextHistoryService.GetHistoryForContextId(ctx, "c1", query.Page{Sort: query.SortVersion, Limit: 10, OmitContent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted, err := env.svc.CountHistoryTokens(ctx, "", page.Items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range counted {
+		want := tokenizer.Count(tok, "Be brief.")
+		if ch.Version == 1 {
+			want = tokenizer.Count(tok, prompt)
+		}
+		if ch.Tokens == nil || ch.Tokens.Tokens != want {
+			t.Fatalf("version %d: expected %d tokens, got %+v", ch.Version, want, ch.Tokens)
+		}
+	}
+}
+
+func TestImportReplacesTokenCounts(t *testing.T) {
+	ctx := context.Background()
+	export := exportFixture(t)
+	env := newTestEnv(t, false)
+	tok := tokenizer.NewApproximate()
+	stale := &entities.Context{ID: "c1", Name: "one", Content: "a much longer content than the one imported", Tenants: acme}
+	if _, err := env.svc.CreateContext(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.ImportContexts(ctx, bytes.NewReader(export), acmeQuery(), ImportOverwrite); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := env.cRepo.GetVersionTokenCounts(ctx, tok.Name(), "c1", "", []int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for version, content := range map[int]string{1: "v1", 2: "v2", 3: "v3"} {
+		if tc := counts[version]; tc == nil || tc.Tokens != tokenizer.Count(tok, content) {
+			t.Fatalf("version %d: expected the count of the imported content, got %+v", version, tc)
+		}
+	}
+}
+
+func TestFitContext(t *testing.T) {
+	ctx := context.Background()
+	env := renderFixture(t, &entities.Context{ID: "c1", Name: "C1", Content: "# A\none two\n# B\nthree four five\n"})
+	if _, err := env.svc.MoveLabel(ctx, "c1", "prod", 1, LabelMoveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.UpdateContext(ctx, &entities.Context{ID: "c1", Name: "C1", Content: "short", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	fitted, err := env.svc.FitContext(ctx, "c1", 2, FitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fitted.Version != 2 || fitted.Strategy != tokenizer.Head || fitted.Content != "short" || fitted.Truncated {
+		t.Fatalf("unexpected fit %+v", fitted)
+	}
+	fitted, err = env.svc.FitContext(ctx, "c1", 8, FitOptions{Strategy: tokenizer.Sections, Label: "prod", Priorities: map[string]int{"A": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fitted.Version != 1 || fitted.Content != "# A\none two\n" || len(fitted.Dropped) != 1 || fitted.Dropped[0] != "B" {
+		t.Fatalf("unexpected fit %+v", fitted)
+	}
+
+	if _, err := env.svc.FitContext(ctx, "c1", 5, FitOptions{Strategy: "middle"}); !errors.Is(err, tokenizer.ErrInvalidFit) {
+		t.Fatalf("expected ErrInvalidFit, got %v", err)
+	}
+	if _, err := env.svc.FitContext(ctx, "nope", 5, FitOptions{}); !errors.Is(err, repo.ErrContextNotFound) {
+		t.Fatalf("expected ErrContextNotFound, got %v", err)
+	}
+	if _, err := env.svc.FitContext(ctx, "c1", 5, FitOptions{Label: "staging"}); !errors.Is(err, repo.ErrLabelNotFound) {
+		t.Fatalf("expected ErrLabelNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,366 @@
+package svc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// An export is NDJSON: one TransferRecord per line, each context followed by
+// its history entries, oldest first, when they are exported. An import reads
+// the same format.
+
+type RecordKind string
+
+const (
+	RecordContext RecordKind = "context"
+	RecordHistory RecordKind = "history"
+	// RecordError ends an export that failed after it started streaming.
+	RecordError RecordKind = "error"
+)
+
+type TransferRecord struct {
+	Kind    RecordKind               `json:"kind"`
+	Context *entities.Context        `json:"context,omitempty"`
+	History *entities.ContextHistory `json:"history,omitempty"`
+	Error   string                   `json:"error,omitempty"`
+}
+
+// ImportPolicy decides what happens to an imported context whose id is taken.
+type ImportPolicy string
+
+const (
+	ImportSkip ImportPolicy = "skip"
+	// ImportOverwrite replaces the stored context and its history.
+	ImportOverwrite ImportPolicy = "overwrite"
+	// ImportNewID imports the context and its history under a new id.
+	ImportNewID ImportPolicy = "new-id"
+	// ImportFail stops the import at the first taken id.
+	ImportFail ImportPolicy = "fail"
+)
+
+func ParseImportPolicy(s string) (ImportPolicy, error) {
+	switch p := ImportPolicy(s); p {
+	case "":
+		return ImportFail, nil
+	case ImportSkip, ImportOverwrite, ImportNewID, ImportFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: unknown import policy %q", ErrInvalidInput, s)
+	}
+}
+
+type ImportStatus string
+
+const (
+	ImportCreated     ImportStatus = "created"
+	ImportOverwritten ImportStatus = "overwritten"
+	ImportSkipped     ImportStatus = "skipped"
+	// ImportRejected is the status of the records that are invalid or
+	// outside the scope of the import.
+	ImportRejected ImportStatus = "rejected"
+	ImportFailed   ImportStatus = "failed"
+)
+
+// ImportResult reports on one context record and the history following it.
+// Record counts the context records from 1.
+type ImportResult struct {
+	Record     int          `json:"record"`
+	ID         string       `json:"id,omitempty"`
+	ImportedID string       `json:"importedId,omitempty"`
+	Status     ImportStatus `json:"status"`
+	Histories  int          `json:"histories,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// ImportReport is the outcome of an import. Aborted is set when it stopped
+// early, on a taken id under ImportFail or on malformed input; the records
+// before were imported.
+type ImportReport struct {
+	Counts  map[ImportStatus]int `json:"counts"`
+	Results []ImportResult       `json:"results"`
+	Aborted bool                 `json:"aborted,omitempty"`
+}
+
+var (
+	ErrUnscopedTransfer = errors.New("exports and imports must be scoped to at least one tenant")
+	ErrImportConflict   = errors.New("a context with this id exists already")
+)
+
+const transferPageSize = query.MaxPageSize
+
+func validateTransferScope(q *query.ContextQuery) error {
+	if q == nil || len(q.TenantIDs) == 0 {
+		return ErrUnscopedTransfer
+	}
+	return q.Validate()
+}
+
+// ExportContexts writes the contexts matching q as NDJSON to w, each followed
+// by its history when withHistory is set. Nothing is written when q is not
+// scoped to a tenant.
+func (cs contextService) ExportContexts(ctx context.Context, w io.Writer, q *query.ContextQuery, withHistory bool) error {
+	if err := validateTransferScope(q); err != nil {
+		return err
+	}
+	if err := cs.checkMetadataFilter(ctx, q); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	page := query.Page{Sort: query.SortCreatedTime, Limit: transferPageSize}
+	for {
+		list, err := cs.contextRepository.Query(ctx, q, page)
+		if err != nil {
+			cs.log.Errorf("Error exporting contexts: %v", err)
+			return err
+		}
+		for _, c := range list.Items {
+			if err := enc.Encode(TransferRecord{Kind: RecordContext, Context: c}); err != nil {
+				return err
+			}
+			if withHistory {
+				if err := cs.exportHistory(ctx, enc, c.ID); err != nil {
+					return err
+				}
+			}
+		}
+		if list.NextCursor == "" {
+			return nil
+		}
+		if page.After, err = query.DecodeCursor(list.NextCursor); err != nil {
+			return err
+		}
+	}
+}
+
+func (cs contextService) exportHistory(ctx context.Context, enc *json.Encoder, cid string) error {
+	page := query.Page{Sort: query.SortVersion, Limit: transferPageSize}
+	for {
+		list, err := cs.contextHistoryService.GetHistoryForContextId(ctx, cid, page)
+		if err != nil {
+			return err
+		}
+		for _, ch := range list.Items {
+			if err := enc.Encode(TransferRecord{Kind: RecordHistory, History: ch}); err != nil {
+				return err
+			}
+		}
+		if list.NextCursor == "" {
+			return nil
+		}
+		if page.After, err = query.DecodeCursor(list.NextCursor); err != nil {
+			return err
+		}
+	}
+}
+
+// importRecord is a context record with the history records following it.
+type importRecord struct {
+	number    int
+	context   *entities.Context
+	histories []*entities.ContextHistory
+}
+
+// ImportContexts reads an export from r and imports each context matching q,
+// together with its history, in a transaction of its own, and records the
+// token counts of the versions imported. A context whose id
+// is taken is handled as policy says; a taken id outside the scope of q is
+// never overwritten.
+func (cs contextService) ImportContexts(ctx context.Context, r io.Reader, q *query.ContextQuery, policy ImportPolicy) (*ImportReport, error) {
+	if err := validateTransferScope(q); err != nil {
+		return nil, err
+	}
+	report := &ImportReport{Counts: map[ImportStatus]int{}}
+	add := func(res ImportResult) {
+		report.Results = append(report.Results, res)
+		report.Counts[res.Status]++
+	}
+
+	dec := json.NewDecoder(r)
+	var pending *importRecord
+	flush := func() bool {
+		if pending == nil {
+			return true
+		}
+		res := cs.importOne(ctx, pending, q, policy)
+		add(res)
+		pending = nil
+		return !(res.Status == ImportFailed && policy == ImportFail)
+	}
+	number := 0
+	for {
+		var rec TransferRecord
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			report.Aborted = !flush()
+			return report, nil
+		}
+		var malformed error
+		switch {
+		case err != nil:
+			malformed = err
+		case rec.Kind == RecordContext && rec.Context != nil:
+			if !flush() {
+				report.Aborted = true
+				return report, nil
+			}
+			number++
+			pending = &importRecord{number: number, context: rec.Context}
+			continue
+		case rec.Kind == RecordHistory && rec.History != nil && pending != nil:
+			pending.histories = append(pending.histories, rec.History)
+			continue
+		case rec.Kind == RecordHistory && rec.History != nil:
+			malformed = errors.New("history record before any context record")
+		default:
+			malformed = fmt.Errorf("unexpected %q record", rec.Kind)
+		}
+		// the stream cannot be trusted past a malformed record, not even the
+		// record it belongs to
+		res := ImportResult{Record: number + 1, Status: ImportFailed, Error: "malformed input: " + malformed.Error()}
+		if pending != nil {
+			res.Record, res.ID = pending.number, pending.context.ID
+		}
+		add(res)
+		report.Aborted = true
+		return report, nil
+	}
+}
+
+func (cs contextService) importOne(ctx context.Context, rec *importRecord, q *query.ContextQuery, policy ImportPolicy) ImportResult {
+	c := *rec.context
+	res := ImportResult{Record: rec.number, ID: c.ID}
+	if err := validateImport(&c, rec.histories); err != nil {
+		res.Status, res.Error = ImportRejected, err.Error()
+		return res
+	}
+	if ok, err := repo.MatchContextQuery(q, &c); err != nil || !ok {
+		res.Status, res.Error = ImportRejected, "context is outside the scope of the import"
+		return res
+	}
+	if err := cs.checkMetadata(ctx, &c); err != nil {
+		res.Status, res.Error = ImportRejected, err.Error()
+		if !errors.As(err, new(*MetadataError)) {
+			res.Status = ImportFailed
+		}
+		return res
+	}
+
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		res.Status = ImportCreated
+		existing, err := cs.storedContext(ctx, c.ID)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			switch policy {
+			case ImportSkip:
+				res.Status = ImportSkipped
+				return nil
+			case ImportNewID:
+				c.ID = primitive.NewObjectID().Hex()
+				res.ImportedID = c.ID
+			case ImportOverwrite:
+				if ok, err := repo.MatchContextQuery(q, existing); err != nil || !ok {
+					return fmt.Errorf("%w, outside the scope of the import", ErrImportConflict)
+				}
+				if err := cs.contextRepository.Delete(ctx, c.ID); err != nil {
+					return err
+				}
+				if _, err := cs.contextHistoryService.DeleteHistoryForContexts(ctx, []string{c.ID}); err != nil {
+					return err
+				}
+				res.Status = ImportOverwritten
+			default:
+				return ErrImportConflict
+			}
+		}
+		if _, err := cs.contextRepository.Create(ctx, &c); err != nil {
+			return err
+		}
+		for _, h := range rec.histories {
+			ch := *h
+			ch.ContextID = c.ID
+			if ch.ID == "" || res.ImportedID != "" {
+				ch.ID = primitive.NewObjectID().Hex()
+			}
+			if _, err := cs.contextHistoryService.ImportHistory(ctx, &ch); err != nil {
+				return err
+			}
+		}
+		res.Histories = len(rec.histories)
+		return nil
+	})
+	if err != nil {
+		cs.log.Errorf("Error importing context %s: %v", rec.context.ID, err)
+		res.Status, res.Error, res.ImportedID, res.Histories = ImportFailed, err.Error(), "", 0
+		return res
+	}
+	if res.Status != ImportSkipped {
+		versions := []*entities.Context{&c}
+		for _, h := range rec.histories {
+			v := historyContext(h)
+			v.ID = c.ID
+			versions = append(versions, v)
+		}
+		cs.recordTokens(ctx, versions...)
+	}
+	return res
+}
+
+// storedContext returns the context stored under id, in the trash or not, nil
+// when there is none.
+func (cs contextService) storedContext(ctx context.Context, id string) (*entities.Context, error) {
+	c, err := cs.contextRepository.GetByID(ctx, id)
+	if err == nil {
+		return c, nil
+	}
+	if !errors.Is(err, repo.ErrContextNotFound) {
+		return nil, err
+	}
+	tc, err := cs.contextRepository.GetTrashedByID(ctx, id)
+	if errors.Is(err, repo.ErrContextNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tc.Context, nil
+}
+
+// validateImport checks an imported context and its history, filling in what
+// an older export may lack, and orders the history by version.
+func validateImport(c *entities.Context, histories []*entities.ContextHistory) error {
+	if c.ID == "" {
+		return errors.New("context has no id")
+	}
+	if c.Version < 1 {
+		c.Version = 1
+	}
+	now := time.Now()
+	if c.CreatedTime.IsZero() {
+		c.CreatedTime = now
+	}
+	if c.ModifiedTime.IsZero() {
+		c.ModifiedTime = c.CreatedTime
+	}
+	sort.SliceStable(histories, func(i, j int) bool { return histories[i].Version < histories[j].Version })
+	for _, h := range histories {
+		if h.ContextID != "" && h.ContextID != c.ID {
+			return fmt.Errorf("history %s belongs to context %s", h.ID, h.ContextID)
+		}
+		if h.Version < 1 || h.Version >= c.Version {
+			return fmt.Errorf("history %s has version %d, not below the context version %d", h.ID, h.Version, c.Version)
+		}
+	}
+	return nil
+}
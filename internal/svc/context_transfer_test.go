@@ -0,0 +1,146 @@
+package svc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+var acme = []entities.TenantStub{{ID: "acme"}}
+
+func acmeQuery() *query.ContextQuery {
+	return &query.ContextQuery{TenantIDs: []string{"acme"}}
+}
+
+// exportFixture creates two acme contexts, one with two versions of history,
+// and one context of another tenant, and exports acme with history.
+func exportFixture(t *testing.T) []byte {
+	t.Helper()
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	for _, c := range []*entities.Context{
+		{ID: "c1", Name: "one", Content: "v1", Tenants: acme},
+		{ID: "c2", Name: "two", Content: "x", Tenants: acme},
+		{ID: "c3", Name: "three", Content: "y", Tenants: []entities.TenantStub{{ID: "other"}}},
+	} {
+		if _, err := env.svc.CreateContext(ctx, c); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	for _, content := range []string{"v2", "v3"} {
+		cur, _ := env.svc.GetContextByID(ctx, "c1")
+		cur.Content = content
+		if _, err := env.svc.UpdateContext(ctx, cur); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := env.svc.ExportContexts(ctx, &buf, acmeQuery(), true); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportContexts(t *testing.T) {
+	var kinds []string
+	for _, line := range strings.Split(strings.TrimSpace(string(exportFixture(t))), "\n") {
+		var rec TransferRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		switch rec.Kind {
+		case RecordContext:
+			kinds = append(kinds, rec.Context.ID)
+		case RecordHistory:
+			kinds = append(kinds, rec.History.ContextID+"@"+string(rune('0'+rec.History.Version)))
+		}
+	}
+	if got := strings.Join(kinds, " "); got != "c1 c1@1 c1@2 c2" {
+		t.Fatalf("unexpected export: %s", got)
+	}
+
+	env := newTestEnv(t, false)
+	if err := env.svc.ExportContexts(context.Background(), &bytes.Buffer{}, &query.ContextQuery{}, false); !errors.Is(err, ErrUnscopedTransfer) {
+		t.Fatalf("expected ErrUnscopedTransfer, got %v", err)
+	}
+}
+
+func TestImportContexts(t *testing.T) {
+	ctx := context.Background()
+	export := exportFixture(t)
+	env := newTestEnv(t, false)
+
+	report, err := env.svc.ImportContexts(ctx, bytes.NewReader(export), acmeQuery(), ImportFail)
+	if err != nil || report.Aborted || report.Counts[ImportCreated] != 2 {
+		t.Fatalf("first import: %+v, %v", report, err)
+	}
+	c1, err := env.svc.GetContextByID(ctx, "c1")
+	if err != nil || c1.Content != "v3" || c1.Version != 3 {
+		t.Fatalf("unexpected imported context: %+v, %v", c1, err)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 2 {
+		t.Fatalf("expected the imported history, got %d entries", len(h))
+	}
+
+	report, _ = env.svc.ImportContexts(ctx, bytes.NewReader(export), acmeQuery(), ImportFail)
+	if !report.Aborted || len(report.Results) != 1 || report.Results[0].Status != ImportFailed {
+		t.Fatalf("expected the import to stop at c1: %+v", report)
+	}
+
+	report, _ = env.svc.ImportContexts(ctx, bytes.NewReader(export), acmeQuery(), ImportSkip)
+	if report.Counts[ImportSkipped] != 2 {
+		t.Fatalf("expected every context skipped: %+v", report)
+	}
+
+	report, _ = env.svc.ImportContexts(ctx, bytes.NewReader(export), acmeQuery(), ImportNewID)
+	if report.Counts[ImportCreated] != 2 || report.Results[0].ImportedID == "" {
+		t.Fatalf("expected new ids: %+v", report)
+	}
+	if h := env.historyFor(t, report.Results[0].ImportedID); len(h) != 2 {
+		t.Fatalf("expected the history under the new id, got %d entries", len(h))
+	}
+
+	c1.Content = "local"
+	if _, err := env.svc.UpdateContext(ctx, c1); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	report, _ = env.svc.ImportContexts(ctx, bytes.NewReader(export), acmeQuery(), ImportOverwrite)
+	if report.Counts[ImportOverwritten] != 2 {
+		t.Fatalf("expected both overwritten: %+v", report)
+	}
+	if c1, _ = env.svc.GetContextByID(ctx, "c1"); c1.Content != "v3" {
+		t.Fatalf("expected the imported content back, got %q", c1.Content)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 2 {
+		t.Fatalf("expected the local history replaced, got %d entries", len(h))
+	}
+}
+
+func TestImportContextsRejects(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	input := strings.Join([]string{
+		`{"kind":"context","context":{"id":"o1","name":"n","tenant":[{"id":"other"}],"version":1}}`,
+		`{"kind":"context","context":{"id":"a1","name":"n","tenant":[{"id":"acme"}],"version":1}}`,
+		`{"kind":"history","history":{"id":"h1","contextId":"a1","version":4}}`,
+		`{"kind":"context","context":{"id":"a2","name":"n","tenant":[{"id":"acme"}],"version":1}}`,
+		`{"kind":"context", "context": `,
+	}, "\n")
+	report, err := env.svc.ImportContexts(ctx, strings.NewReader(input), acmeQuery(), ImportSkip)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	var statuses []string
+	for _, r := range report.Results {
+		statuses = append(statuses, r.ID+":"+string(r.Status))
+	}
+	if got := strings.Join(statuses, " "); got != "o1:rejected a1:rejected a2:failed" || !report.Aborted {
+		t.Fatalf("unexpected report: %s, %+v", got, report)
+	}
+}
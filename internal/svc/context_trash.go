@@ -0,0 +1,121 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// DeleteContext moves the context to the trash, recording its last state in
+// the history in the same transaction. Like RevertContext, it fails with
+// repo.ErrContextVersionMismatch when expectedVersion is set and the context
+// has moved on.
+func (cs contextService) DeleteContext(ctx context.Context, id string, expectedVersion int, by entities.UserStub) (*repo.TrashedContext, error) {
+	var tc *repo.TrashedContext
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		oc, err := cs.snapshot(ctx, id)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != 0 && oc.Version != expectedVersion {
+			return repo.ErrContextVersionMismatch
+		}
+		tc, err = cs.contextRepository.Trash(ctx, &oc.Context, by)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// RestoreContext takes the context out of the trash as a new version. Like
+// any write, it fails with a MetadataError when the metadata of the context
+// does not follow the schemas registered since it was trashed.
+func (cs contextService) RestoreContext(ctx context.Context, id string) (*entities.Context, error) {
+	var c *entities.Context
+	err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		tc, err := cs.contextRepository.GetTrashedByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := cs.checkMetadata(ctx, &tc.Context); err != nil {
+			return err
+		}
+		ch, err := cs.contextHistoryService.AddHistoryForContext(ctx, &tc.Context)
+		if err != nil {
+			cs.log.Errorf("Error adding history for context: %v", err)
+			return err
+		}
+		if len(tc.Variables) > 0 {
+			if err := cs.contextHistoryService.SetVariables(ctx, ch.ID, tc.Variables); err != nil {
+				return err
+			}
+		}
+		c, err = cs.contextRepository.Restore(ctx, &tc.Context)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cs.recordTokens(ctx, c)
+	return c, nil
+}
+
+func (cs contextService) ListTrash(ctx context.Context, q *query.ContextQuery, page query.Page) (*repo.TrashPage, error) {
+	if q == nil {
+		q = &query.ContextQuery{}
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cs.checkMetadataFilter(ctx, q); err != nil {
+		return nil, err
+	}
+	list, err := cs.contextRepository.ListTrash(ctx, q, page)
+	if err != nil {
+		cs.log.Errorf("Error listing the trash: %v", err)
+		return nil, err
+	}
+	return list, nil
+}
+
+// PurgeTrash permanently removes the contexts trashed before the given time,
+// together with their history, batch contexts per transaction, batch being
+// positive. It returns the number of contexts removed.
+func (cs contextService) PurgeTrash(ctx context.Context, before time.Time, batch int) (int, error) {
+	if batch <= 0 {
+		return 0, fmt.Errorf("%w: the purge batch must be positive, got %d", ErrInvalidInput, batch)
+	}
+	purged := 0
+	for {
+		var ids []string
+		err := cs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			ids, err = cs.contextRepository.PurgeTrashed(ctx, before, batch)
+			if err != nil || len(ids) == 0 {
+				return err
+			}
+			_, err = cs.contextHistoryService.DeleteHistoryForContexts(ctx, ids)
+			return err
+		})
+		if err != nil {
+			cs.log.Errorf("Error purging the trash: %v", err)
+			return purged, err
+		}
+		purged += len(ids)
+		if len(ids) < batch {
+			return purged, nil
+		}
+	}
+}
+
+// SweepContentFiles removes the offloaded content left behind by the
+// contexts and history entries that were updated or purged.
+func (cs contextService) SweepContentFiles(ctx context.Context) (int, error) {
+	return cs.contextRepository.SweepContentFiles(ctx)
+}
@@ -0,0 +1,147 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+func TestTrashedContextIsHiddenUntilRestored(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := env.svc.DeleteContext(ctx, "c1", 0, entities.UserStub{ID: "u1"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, err := env.svc.GetContextByID(ctx, "c1"); !errors.Is(err, repo.ErrContextNotFound) {
+		t.Fatalf("expected a trashed context to be hidden, got %v", err)
+	}
+	trash, err := env.svc.ListTrash(ctx, nil, query.Page{Sort: query.SortDeletedAt, Desc: true, Limit: 10})
+	if err != nil {
+		t.Fatalf("list trash: %v", err)
+	}
+	if len(trash.Items) != 1 || trash.Items[0].ID != "c1" {
+		t.Fatalf("expected c1 in the trash, got %+v", trash.Items)
+	}
+
+	restored, err := env.svc.RestoreContext(ctx, "c1")
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if !restored.IsActive || restored.Version != 3 {
+		t.Fatalf("unexpected restored context: %+v", restored)
+	}
+	if _, err := env.svc.GetContextByID(ctx, "c1"); err != nil {
+		t.Fatalf("get after restore: %v", err)
+	}
+	if h := env.historyFor(t, "c1"); len(h) != 2 {
+		t.Fatalf("expected a history entry per transition, got %d", len(h))
+	}
+}
+
+func TestPurgeTrashRemovesExpiredContextsAndHistory(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: id, Name: id, Content: "v1"}); err != nil {
+			t.Fatalf("create %s: %v", id, err)
+		}
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if _, err := env.svc.DeleteContext(ctx, id, 0, entities.UserStub{}); err != nil {
+			t.Fatalf("delete %s: %v", id, err)
+		}
+	}
+
+	n, err := env.svc.PurgeTrash(ctx, time.Now().Add(time.Minute), 1)
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 purged contexts, got %d", n)
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if h := env.historyFor(t, id); len(h) != 0 {
+			t.Fatalf("expected the history of %s to be purged, got %d entries", id, len(h))
+		}
+	}
+	if _, err := env.svc.GetContextByID(ctx, "c3"); err != nil {
+		t.Fatalf("untrashed context should survive the purge: %v", err)
+	}
+}
+
+func TestPurgeTrashRejectsEmptyBatch(t *testing.T) {
+	env := newTestEnv(t, false)
+	if _, err := env.svc.PurgeTrash(context.Background(), time.Now(), 0); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected ErrInvalidInput, got %v", err)
+	}
+	for name, s := range map[string]settings.TrashSettings{
+		"no interval": {PurgeBatch: 10},
+		"no batch":    {PurgeInterval: time.Hour},
+	} {
+		if _, err := NewTrashPurger(nil, env.svc, repo.NewMemoryLeaseRepository(), s); err == nil {
+			t.Fatalf("%s: expected the settings to be refused", name)
+		}
+	}
+}
+
+func TestTrashPurgerHoldsTheLease(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "c1", Content: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.DeleteContext(ctx, "c1", 0, entities.UserStub{}); err != nil {
+		t.Fatal(err)
+	}
+	// times are stored to the millisecond
+	time.Sleep(2 * time.Millisecond)
+	leases := repo.NewMemoryLeaseRepository()
+	purger, err := NewTrashPurger(log, env.svc, leases, settings.TrashSettings{PurgeInterval: time.Hour, PurgeBatch: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed := func() int {
+		page, err := env.svc.ListTrash(ctx, nil, query.Page{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(page.Items)
+	}
+
+	if held, err := leases.Acquire(ctx, trashPurgeJob, "other replica", time.Hour); err != nil || !held {
+		t.Fatalf("acquire: %v, %v", held, err)
+	}
+	stopped, stop := context.WithCancel(ctx)
+	stop()
+	purger.Run(stopped)
+	if n := trashed(); n != 1 {
+		t.Fatalf("the purger must not run while another replica holds the lease, %d trashed", n)
+	}
+
+	if err := leases.Release(ctx, trashPurgeJob, "other replica"); err != nil {
+		t.Fatal(err)
+	}
+	purger.Run(stopped)
+	if n := trashed(); n != 0 {
+		t.Fatalf("the purger must run once it holds the lease, %d trashed", n)
+	}
+	if held, err := leases.Acquire(ctx, trashPurgeJob, "other replica", time.Hour); err != nil || !held {
+		t.Fatalf("the purger must release the lease when it stops: %v, %v", held, err)
+	}
+}
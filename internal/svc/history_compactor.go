@@ -0,0 +1,88 @@
+package svc
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const meterName = "github.com/mangudaigb/context-service/internal/svc"
+
+// historyCompactionJob names the lease of the history compactor.
+const historyCompactionJob = "history_compaction"
+
+// HistoryCompactor periodically removes the history versions the retention
+// policies do not keep. Every replica runs one; the lease of the job lets a
+// single one of them compact at a time. Its metrics go to the global meter
+// provider.
+type HistoryCompactor struct {
+	log      *logger.Logger
+	hrSvc    HistoryRetentionService
+	lease    *jobLease
+	interval time.Duration
+
+	runs      metric.Int64Counter
+	removed   metric.Int64Counter
+	reclaimed metric.Int64Counter
+}
+
+func NewHistoryCompactor(log *logger.Logger, hrSvc HistoryRetentionService, leases repo.LeaseRepository, s settings.HistorySettings) (*HistoryCompactor, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	meter := otel.Meter(meterName)
+	runs, err := meter.Int64Counter("context_history.compaction.runs",
+		metric.WithDescription("Number of history compaction passes, by result."))
+	if err != nil {
+		return nil, err
+	}
+	removed, err := meter.Int64Counter("context_history.compaction.removed_versions",
+		metric.WithDescription("Number of history versions removed by the compaction."))
+	if err != nil {
+		return nil, err
+	}
+	reclaimed, err := meter.Int64Counter("context_history.compaction.reclaimed_bytes",
+		metric.WithDescription("Size of the history versions removed by the compaction."),
+		metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryCompactor{
+		log:       log,
+		hrSvc:     hrSvc,
+		lease:     newJobLease(leases, historyCompactionJob, s.CompactInterval),
+		interval:  s.CompactInterval,
+		runs:      runs,
+		removed:   removed,
+		reclaimed: reclaimed,
+	}, nil
+}
+
+// Run compacts once right away and then every compact interval until ctx is
+// done, when the replica holds the lease.
+func (hc *HistoryCompactor) Run(ctx context.Context) {
+	runLeased(ctx, hc.log, hc.lease, hc.interval, hc.compact)
+}
+
+func (hc *HistoryCompactor) compact(ctx context.Context) {
+	report, err := hc.hrSvc.Compact(ctx, nil, false)
+	// a failed pass may still have removed the versions of its first batches
+	hc.removed.Add(ctx, int64(report.RemovedVersions))
+	hc.reclaimed.Add(ctx, report.ReclaimedBytes)
+	if err != nil {
+		hc.runs.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "error")))
+		hc.log.Errorf("Error compacting the context history: %v", err)
+		return
+	}
+	hc.runs.Add(ctx, 1, metric.WithAttributes(attribute.String("result", "ok")))
+	if report.RemovedVersions > 0 {
+		hc.log.Infof("Compacted the history of %d contexts, removed %d versions, reclaimed %d bytes",
+			report.Contexts, report.RemovedVersions, report.ReclaimedBytes)
+	}
+}
@@ -0,0 +1,263 @@
+package svc
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// HistoryRetentionService applies the retention policies to the context
+// history. A nil policy stands for the configured one. The versions of the
+// branches are left alone, they go with their branch, and so are the versions
+// labels point at.
+type HistoryRetentionService interface {
+	PreviewContext(ctx context.Context, cid string, p *settings.RetentionPolicy) (*RetentionPreview, error)
+	Compact(ctx context.Context, p *settings.RetentionPolicy, dryRun bool) (*CompactionReport, error)
+}
+
+// RetentionPreview lists the versions of a context history a policy removes.
+type RetentionPreview struct {
+	ContextID      string                   `json:"contextId"`
+	Policy         settings.RetentionPolicy `json:"policy"`
+	Kept           int                      `json:"kept"`
+	Removed        []RemovedVersion         `json:"removed"`
+	ReclaimedBytes int64                    `json:"reclaimedBytes"`
+}
+
+type RemovedVersion struct {
+	ID          string    `json:"id"`
+	Version     int       `json:"version"`
+	CreatedTime time.Time `json:"createdTime"`
+	Bytes       int64     `json:"bytes"`
+}
+
+// CompactionReport sums up a compaction pass over every context history.
+type CompactionReport struct {
+	DryRun          bool  `json:"dryRun"`
+	Contexts        int   `json:"contexts"`
+	RemovedVersions int   `json:"removedVersions"`
+	ReclaimedBytes  int64 `json:"reclaimedBytes"`
+}
+
+type historyRetentionService struct {
+	log        *logger.Logger
+	repo       repo.ContextHistoryRepository
+	contexts   repo.ContextRepository
+	transactor repo.Transactor
+	settings   settings.HistorySettings
+	now        func() time.Time
+}
+
+func NewHistoryRetentionService(log *logger.Logger, repo repo.ContextHistoryRepository, contexts repo.ContextRepository, tx repo.Transactor, s settings.HistorySettings) HistoryRetentionService {
+	return &historyRetentionService{
+		log:        log,
+		repo:       repo,
+		contexts:   contexts,
+		transactor: tx,
+		settings:   s,
+		now:        time.Now,
+	}
+}
+
+func (hrs historyRetentionService) PreviewContext(ctx context.Context, cid string, p *settings.RetentionPolicy) (*RetentionPreview, error) {
+	histories, err := hrs.repo.Filter(ctx, repo.MainLine(bson.M{"contextId": cid}))
+	if err != nil {
+		hrs.log.Errorf("Error loading history for context id: %s with err: %v", cid, err)
+		return nil, err
+	}
+	if len(histories) == 0 {
+		return nil, repo.ErrContextHistoryNotFound
+	}
+	pinned, err := hrs.contexts.LabelledVersions(ctx, []string{cid})
+	if err != nil {
+		return nil, err
+	}
+	preview := hrs.plan(cid, histories, pinned[cid], p)
+	if err := hrs.measure(ctx, preview); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// Compact walks through every context history, batch contexts at a time, and
+// removes the versions their policy does not keep. The versions of a batch
+// are removed in one transaction, since removing them rewrites the deltas of
+// the versions left and releases their blobs.
+func (hrs historyRetentionService) Compact(ctx context.Context, p *settings.RetentionPolicy, dryRun bool) (*CompactionReport, error) {
+	report := &CompactionReport{DryRun: dryRun}
+	batch := hrs.settings.CompactBatch
+	if batch <= 0 {
+		batch = settings.Default().History.CompactBatch
+	}
+	after := ""
+	for {
+		cids, err := hrs.repo.ContextIDs(ctx, after, batch)
+		if err != nil {
+			return report, err
+		}
+		if len(cids) == 0 {
+			return report, nil
+		}
+		after = cids[len(cids)-1]
+
+		histories, err := hrs.repo.Filter(ctx, repo.MainLine(bson.M{"contextId": bson.M{"$in": cids}}))
+		if err != nil {
+			hrs.log.Errorf("Error loading history for %d contexts: %v", len(cids), err)
+			return report, err
+		}
+		pinned, err := hrs.contexts.LabelledVersions(ctx, cids)
+		if err != nil {
+			return report, err
+		}
+		byContext := make(map[string][]*entities.ContextHistory, len(cids))
+		for _, ch := range histories {
+			byContext[ch.ContextID] = append(byContext[ch.ContextID], ch)
+		}
+		var ids []string
+		var reclaimed int64
+		previews := make([]*RetentionPreview, 0, len(cids))
+		for _, cid := range cids {
+			previews = append(previews, hrs.plan(cid, byContext[cid], pinned[cid], p))
+		}
+		if err := hrs.measure(ctx, previews...); err != nil {
+			return report, err
+		}
+		for _, preview := range previews {
+			reclaimed += preview.ReclaimedBytes
+			for _, rv := range preview.Removed {
+				ids = append(ids, rv.ID)
+			}
+		}
+		if !dryRun && len(ids) > 0 {
+			err := hrs.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+				_, err := hrs.repo.DeleteByIDs(ctx, ids)
+				return err
+			})
+			if err != nil {
+				hrs.log.Errorf("Error removing %d expired history versions: %v", len(ids), err)
+				return report, err
+			}
+		}
+		report.Contexts += len(cids)
+		report.RemovedVersions += len(ids)
+		report.ReclaimedBytes += reclaimed
+	}
+}
+
+// plan lists the versions the policy removes, short of the pinned ones.
+func (hrs historyRetentionService) plan(cid string, histories []*entities.ContextHistory, pinned []int, p *settings.RetentionPolicy) *RetentionPreview {
+	policy := hrs.policyFor(histories, p)
+	removed := unpinned(expiredVersions(policy, histories, hrs.now()), pinned)
+	preview := &RetentionPreview{
+		ContextID: cid,
+		Policy:    policy,
+		Kept:      len(histories) - len(removed),
+		Removed:   make([]RemovedVersion, 0, len(removed)),
+	}
+	for _, ch := range removed {
+		preview.Removed = append(preview.Removed, RemovedVersion{
+			ID:          ch.ID,
+			Version:     ch.Version,
+			CreatedTime: ch.CreatedTime,
+		})
+	}
+	return preview
+}
+
+// measure sets the bytes of the versions the previews remove to their stored
+// size, deltas, shared blobs and offloaded files included, which is what
+// removing them reclaims short of the index entries.
+func (hrs historyRetentionService) measure(ctx context.Context, previews ...*RetentionPreview) error {
+	var ids []string
+	for _, preview := range previews {
+		for _, rv := range preview.Removed {
+			ids = append(ids, rv.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sizes, err := hrs.repo.StoredSizes(ctx, ids)
+	if err != nil {
+		hrs.log.Errorf("Error measuring %d history versions: %v", len(ids), err)
+		return err
+	}
+	for _, preview := range previews {
+		preview.ReclaimedBytes = 0
+		for i := range preview.Removed {
+			rv := &preview.Removed[i]
+			rv.Bytes = sizes[rv.ID]
+			preview.ReclaimedBytes += rv.Bytes
+		}
+	}
+	return nil
+}
+
+// policyFor picks the policy of the tenants of the latest version, since the
+// tenants of a context may have changed over time.
+func (hrs historyRetentionService) policyFor(histories []*entities.ContextHistory, p *settings.RetentionPolicy) settings.RetentionPolicy {
+	if p != nil {
+		return *p
+	}
+	var latest *entities.ContextHistory
+	for _, ch := range histories {
+		if latest == nil || ch.Version > latest.Version {
+			latest = ch
+		}
+	}
+	var tenantIDs []string
+	if latest != nil {
+		for _, t := range latest.Tenants {
+			tenantIDs = append(tenantIDs, t.ID)
+		}
+	}
+	return hrs.settings.PolicyFor(tenantIDs)
+}
+
+// expiredVersions returns the versions of a single context history the
+// policy does not keep, newest first. A day counts as snapshotted as soon as
+// one of its versions is kept, whatever the rule that kept it.
+func expiredVersions(p settings.RetentionPolicy, histories []*entities.ContextHistory, now time.Time) []*entities.ContextHistory {
+	if p.IsZero() {
+		return nil
+	}
+	sorted := make([]*entities.ContextHistory, len(histories))
+	copy(sorted, histories)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version > sorted[j].Version })
+
+	horizon := now.AddDate(0, 0, -p.KeepDays)
+	snapshotted := make(map[string]bool)
+	var expired []*entities.ContextHistory
+	for i, ch := range sorted {
+		day := ch.CreatedTime.UTC().Format(time.DateOnly)
+		keep := i < p.KeepLast ||
+			(p.KeepDays > 0 && ch.CreatedTime.After(horizon)) ||
+			(p.DailySnapshots && !snapshotted[day])
+		if keep {
+			snapshotted[day] = true
+			continue
+		}
+		expired = append(expired, ch)
+	}
+	return expired
+}
+
+func unpinned(histories []*entities.ContextHistory, pinned []int) []*entities.ContextHistory {
+	if len(pinned) == 0 {
+		return histories
+	}
+	kept := histories[:0]
+	for _, ch := range histories {
+		if !slices.Contains(pinned, ch.Version) {
+			kept = append(kept, ch)
+		}
+	}
+	return kept
+}
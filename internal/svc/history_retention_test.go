@@ -0,0 +1,198 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+var retentionNow = time.Date(2025, 6, 30, 12, 0, 0, 0, time.UTC)
+
+// versions builds one history entry per creation time, oldest first.
+func versions(cid string, created ...time.Time) []*entities.ContextHistory {
+	histories := make([]*entities.ContextHistory, 0, len(created))
+	for i, t := range created {
+		histories = append(histories, &entities.ContextHistory{
+			ID:          cid + "-" + string(rune('a'+i)),
+			ContextID:   cid,
+			Content:     "content",
+			Version:     i + 1,
+			CreatedTime: t,
+		})
+	}
+	return histories
+}
+
+func expiredIDs(p settings.RetentionPolicy, histories []*entities.ContextHistory) []string {
+	var ids []string
+	for _, ch := range expiredVersions(p, histories, retentionNow) {
+		ids = append(ids, ch.ID)
+	}
+	return ids
+}
+
+func TestExpiredVersions(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2025, 6, d, h, 0, 0, 0, time.UTC) }
+	histories := versions("c", day(1, 8), day(1, 9), day(2, 8), day(2, 9), day(29, 8), day(30, 8))
+
+	cases := []struct {
+		name   string
+		policy settings.RetentionPolicy
+		want   []string
+	}{
+		{"zero policy keeps everything", settings.RetentionPolicy{}, nil},
+		{"keep last", settings.RetentionPolicy{KeepLast: 4}, []string{"c-b", "c-a"}},
+		{"keep days", settings.RetentionPolicy{KeepDays: 7}, []string{"c-d", "c-c", "c-b", "c-a"}},
+		{"daily snapshots", settings.RetentionPolicy{KeepDays: 7, DailySnapshots: true}, []string{"c-c", "c-a"}},
+		{"kept version counts as the snapshot of its day", settings.RetentionPolicy{KeepLast: 3, DailySnapshots: true}, []string{"c-c", "c-a"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := expiredIDs(tc.policy, histories)
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("expected %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func newRetentionEnv(t *testing.T, s settings.HistorySettings) (*historyRetentionService, *repo.MemoryContextHistoryRepository) {
+	t.Helper()
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatalf("creating logger: %v", err)
+	}
+	chRepo := repo.NewMemoryContextHistoryRepository(log)
+	cRepo := repo.NewMemoryContextRepository(log)
+	hrs := NewHistoryRetentionService(log, chRepo, cRepo, repo.NewMemoryTransactor(cRepo, chRepo), s).(*historyRetentionService)
+	hrs.now = func() time.Time { return retentionNow }
+	return hrs, chRepo
+}
+
+func TestCompactAppliesTenantPolicies(t *testing.T) {
+	ctx := context.Background()
+	hrs, chRepo := newRetentionEnv(t, settings.HistorySettings{
+		Retention:    settings.RetentionPolicy{KeepLast: 1},
+		Tenants:      []settings.TenantRetentionPolicy{{TenantID: "t2", RetentionPolicy: settings.RetentionPolicy{KeepLast: 2}}},
+		CompactBatch: 1,
+	})
+	old := retentionNow.AddDate(0, -1, 0)
+	for _, cid := range []string{"c1", "c2"} {
+		for _, ch := range versions(cid, old, old, old) {
+			if cid == "c2" {
+				ch.Tenants = []entities.TenantStub{{ID: "t2"}}
+			}
+			if _, err := chRepo.Create(ctx, ch); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+		}
+	}
+
+	preview, err := hrs.Compact(ctx, nil, true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if preview.Contexts != 2 || preview.RemovedVersions != 3 || preview.ReclaimedBytes == 0 {
+		t.Fatalf("unexpected dry run report: %+v", preview)
+	}
+	if all, _ := chRepo.Filter(ctx, map[string]interface{}{}); len(all) != 6 {
+		t.Fatalf("dry run should not remove anything, %d versions left", len(all))
+	}
+
+	report, err := hrs.Compact(ctx, nil, false)
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if *report != (CompactionReport{Contexts: 2, RemovedVersions: 3, ReclaimedBytes: preview.ReclaimedBytes}) {
+		t.Fatalf("report differs from the dry run: %+v", report)
+	}
+	for cid, want := range map[string]int{"c1": 1, "c2": 2} {
+		left, _ := chRepo.Filter(ctx, map[string]interface{}{"contextId": cid})
+		if len(left) != want {
+			t.Fatalf("expected %d versions left for %s, got %d", want, cid, len(left))
+		}
+	}
+}
+
+// failingDeleteRepository fails every DeleteByIDs after the wrapped repository has removed the entries.
+type failingDeleteRepository struct {
+	*repo.MemoryContextHistoryRepository
+}
+
+func (f failingDeleteRepository) DeleteByIDs(ctx context.Context, ids []string) (int64, error) {
+	if _, err := f.MemoryContextHistoryRepository.DeleteByIDs(ctx, ids); err != nil {
+		return 0, err
+	}
+	return 0, errHistoryDown
+}
+
+func TestCompactRollsBackAFailedBatch(t *testing.T) {
+	ctx := context.Background()
+	hrs, chRepo := newRetentionEnv(t, settings.HistorySettings{Retention: settings.RetentionPolicy{KeepLast: 1}, CompactBatch: 10})
+	old := retentionNow.AddDate(0, -1, 0)
+	for _, ch := range versions("c1", old, old, old) {
+		if _, err := chRepo.Create(ctx, ch); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	hrs.repo = failingDeleteRepository{chRepo}
+	if _, err := hrs.Compact(ctx, nil, false); !errors.Is(err, errHistoryDown) {
+		t.Fatalf("expected the deletion to fail, got %v", err)
+	}
+	if all, _ := chRepo.Filter(ctx, map[string]interface{}{}); len(all) != 3 {
+		t.Fatalf("expected the failed batch to be rolled back, %d versions left", len(all))
+	}
+}
+
+func TestHistoryCompactorHoldsTheLease(t *testing.T) {
+	ctx := context.Background()
+	s := settings.HistorySettings{Retention: settings.RetentionPolicy{KeepLast: 1}, CompactInterval: time.Hour, CompactBatch: 10}
+	hrs, chRepo := newRetentionEnv(t, s)
+	leases := repo.NewMemoryLeaseRepository()
+	if _, err := NewHistoryCompactor(hrs.log, hrs, leases, settings.HistorySettings{CompactBatch: 10}); err == nil {
+		t.Fatalf("a compactor without interval must be refused")
+	}
+	compactor, err := NewHistoryCompactor(hrs.log, hrs, leases, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := retentionNow.AddDate(0, -1, 0)
+	for _, ch := range versions("c1", old, old, old) {
+		if _, err := chRepo.Create(ctx, ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	left := func() int {
+		all, _ := chRepo.Filter(ctx, map[string]interface{}{"contextId": "c1"})
+		return len(all)
+	}
+
+	if held, err := leases.Acquire(ctx, historyCompactionJob, "other replica", time.Hour); err != nil || !held {
+		t.Fatalf("acquire: %v, %v", held, err)
+	}
+	stopped, stop := context.WithCancel(ctx)
+	stop()
+	compactor.Run(stopped)
+	if n := left(); n != 3 {
+		t.Fatalf("the compactor must not run while another replica holds the lease, %d versions left", n)
+	}
+	if err := leases.Release(ctx, historyCompactionJob, "other replica"); err != nil {
+		t.Fatal(err)
+	}
+	compactor.Run(stopped)
+	if n := left(); n != 1 {
+		t.Fatalf("the compactor must run once it holds the lease, %d versions left", n)
+	}
+}
@@ -0,0 +1,63 @@
+package svc
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+// leaseGrace is how long a lease outlives the interval of its job, for the
+// replica holding it to renew it on its next run.
+const leaseGrace = time.Minute
+
+// jobLease keeps a periodic job to one replica at a time. The replica holding
+// the lease renews it on each run; when it stops, another one takes the job
+// over once the lease has expired. A run lasting longer than the interval of
+// the job may overlap with the run of a replica taking it over.
+type jobLease struct {
+	leases repo.LeaseRepository
+	job    string
+	owner  string
+	ttl    time.Duration
+}
+
+func newJobLease(leases repo.LeaseRepository, job string, interval time.Duration) *jobLease {
+	host, _ := os.Hostname()
+	return &jobLease{
+		leases: leases,
+		job:    job,
+		owner:  host + "/" + uuid.NewString(),
+		ttl:    interval + leaseGrace,
+	}
+}
+
+// runLeased runs the job right away and then every interval until ctx is
+// done, each time only when the replica holds the lease. It releases the
+// lease on its way out.
+func runLeased(ctx context.Context, log *logger.Logger, lease *jobLease, interval time.Duration, run func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer func() {
+		if err := lease.leases.Release(context.Background(), lease.job, lease.owner); err != nil {
+			log.Errorf("Error releasing the lease of job %s: %v", lease.job, err)
+		}
+	}()
+	for {
+		held, err := lease.leases.Acquire(ctx, lease.job, lease.owner, lease.ttl)
+		if err != nil {
+			log.Errorf("Error acquiring the lease of job %s: %v", lease.job, err)
+		}
+		if held {
+			run(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
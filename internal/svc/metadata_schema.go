@@ -0,0 +1,362 @@
+package svc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/jsonschema"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The metadata entries choosing the schemas of a context, besides its tags:
+// schema names the schema it declares to follow, kind is the kind of context
+// it is.
+const (
+	SchemaMetadataKey = "schema"
+	KindMetadataKey   = "kind"
+)
+
+const (
+	// MaxViolations bounds the contexts a violation report lists.
+	MaxViolations = 1000
+	// violationsPageSize is the page size of the scan of a violation report.
+	violationsPageSize = 200
+)
+
+var schemaName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// MetadataViolation is a value of the metadata of a context that does not
+// follow Schema, at the JSON Pointer Path into the metadata.
+type MetadataViolation struct {
+	Schema  string `json:"schema"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// MetadataError is returned for a context whose metadata does not follow its
+// schemas. It wraps ErrInvalidInput.
+type MetadataError struct {
+	Violations []MetadataViolation
+}
+
+func (e *MetadataError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = fmt.Sprintf("%s: %s", v.Schema, jsonschema.Error{Path: v.Path, Message: v.Message})
+	}
+	return "metadata does not follow its schemas: " + strings.Join(parts, "; ")
+}
+
+func (e *MetadataError) Unwrap() error {
+	return ErrInvalidInput
+}
+
+// schemaCache keeps the compiled schemas by name, compiling a schema again
+// when its source changes.
+type schemaCache struct {
+	mu     sync.Mutex
+	byName map[string]compiledSchema
+}
+
+type compiledSchema struct {
+	source json.RawMessage
+	schema *jsonschema.Schema
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{byName: map[string]compiledSchema{}}
+}
+
+func (sc *schemaCache) compile(s *repo.MetadataSchema) (*jsonschema.Schema, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if c, ok := sc.byName[s.Name]; ok && bytes.Equal(c.source, s.Schema) {
+		return c.schema, nil
+	}
+	schema, err := jsonschema.Compile(s.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s: %w", s.Name, err)
+	}
+	sc.byName[s.Name] = compiledSchema{source: s.Schema, schema: schema}
+	return schema, nil
+}
+
+// validate returns the violations of the metadata against schemas.
+func (sc *schemaCache) validate(schemas []*repo.MetadataSchema, metadata map[string]interface{}) ([]MetadataViolation, error) {
+	doc := jsonValue(metadata)
+	if metadata == nil {
+		doc = map[string]interface{}{}
+	}
+	var violations []MetadataViolation
+	for _, s := range schemas {
+		schema, err := sc.compile(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range schema.Validate(doc) {
+			violations = append(violations, MetadataViolation{Schema: s.Name, Path: e.Path, Message: e.Message})
+		}
+	}
+	return violations, nil
+}
+
+// jsonValue converts metadata as decoded from JSON or from bson to the values
+// encoding/json decodes, which the schemas validate.
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = jsonValue(e)
+		}
+		return m
+	case bson.M:
+		return jsonValue(map[string]interface{}(t))
+	case bson.D:
+		m := make(map[string]interface{}, len(t))
+		for _, e := range t {
+			m[e.Key] = jsonValue(e.Value)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(t))
+		for i, e := range t {
+			list[i] = jsonValue(e)
+		}
+		return list
+	case bson.A:
+		return jsonValue([]interface{}(t))
+	case nil, string, bool, float64:
+		return t
+	case int:
+		return float64(t)
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case primitive.DateTime:
+		return t.Time().UTC().Format(time.RFC3339Nano)
+	}
+	var out interface{}
+	if b, err := json.Marshal(v); err == nil && json.Unmarshal(b, &out) == nil {
+		return out
+	}
+	return fmt.Sprint(v)
+}
+
+// declaredSchema returns the schema the metadata declares, "" for none.
+func declaredSchema(metadata map[string]interface{}) (string, bool) {
+	v, ok := metadata[SchemaMetadataKey]
+	if !ok {
+		return "", true
+	}
+	name, ok := v.(string)
+	return name, ok
+}
+
+func metadataKind(metadata map[string]interface{}) string {
+	kind, _ := metadata[KindMetadataKey].(string)
+	return kind
+}
+
+// metadataViolations returns the violations of the metadata of c against the
+// schemas it follows: the one its metadata declares, which must exist, the
+// one of its kind, and those of its tags.
+func metadataViolations(ctx context.Context, schemas repo.SchemaRepository, cache *schemaCache, c *entities.Context) ([]MetadataViolation, error) {
+	declared, ok := declaredSchema(c.Metadata)
+	if !ok {
+		return []MetadataViolation{{Path: "/" + SchemaMetadataKey, Message: "must be the name of a schema"}}, nil
+	}
+	var names []string
+	if declared != "" {
+		names = append(names, declared)
+	}
+	applicable, err := schemas.Applicable(ctx, names, metadataKind(c.Metadata), c.Tags)
+	if err != nil {
+		return nil, err
+	}
+	violations, err := cache.validate(applicable, c.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	known := slices.ContainsFunc(applicable, func(s *repo.MetadataSchema) bool { return s.Name == declared })
+	if declared != "" && !known {
+		violations = append(violations, MetadataViolation{Schema: declared, Path: "/" + SchemaMetadataKey, Message: "is not a registered schema"})
+	}
+	return violations, nil
+}
+
+// checkMetadata fails with a MetadataError when the metadata of c does not
+// follow its schemas.
+func (cs contextService) checkMetadata(ctx context.Context, c *entities.Context) error {
+	violations, err := metadataViolations(ctx, cs.schemas, cs.compiled, c)
+	if err != nil {
+		cs.log.Errorf("Error validating the metadata of context %s: %v", c.ID, err)
+		return err
+	}
+	if len(violations) > 0 {
+		return &MetadataError{Violations: violations}
+	}
+	return nil
+}
+
+// ContextViolations are the violations of the metadata of a context against
+// a schema.
+type ContextViolations struct {
+	ContextID  string              `json:"contextId"`
+	Name       string              `json:"name"`
+	Version    int                 `json:"version"`
+	Violations []MetadataViolation `json:"violations"`
+}
+
+// ViolationReport lists the contexts a schema applies to whose current
+// metadata does not follow it. Truncated tells that there are more than the
+// report lists.
+type ViolationReport struct {
+	Schema    string              `json:"schema"`
+	Version   int                 `json:"version"`
+	Scanned   int                 `json:"scanned"`
+	Contexts  []ContextViolations `json:"contexts"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+type SchemaService interface {
+	ListSchemas(ctx context.Context) ([]*repo.MetadataSchema, error)
+	GetSchema(ctx context.Context, name string) (*repo.MetadataSchema, error)
+	// PutSchema registers s or replaces the schema of its name. The contexts
+	// written before are not checked against it, see Violations.
+	PutSchema(ctx context.Context, s *repo.MetadataSchema) (*repo.MetadataSchema, error)
+	DeleteSchema(ctx context.Context, name string) error
+	Violations(ctx context.Context, name string, limit int) (*ViolationReport, error)
+}
+
+type schemaService struct {
+	log       *logger.Logger
+	schemas   repo.SchemaRepository
+	contexts  repo.ContextRepository
+	compiled  *schemaCache
+	pageLimit int
+}
+
+func NewSchemaService(log *logger.Logger, schemas repo.SchemaRepository, contexts repo.ContextRepository) SchemaService {
+	return &schemaService{
+		log:       log,
+		schemas:   schemas,
+		contexts:  contexts,
+		compiled:  newSchemaCache(),
+		pageLimit: violationsPageSize,
+	}
+}
+
+func (ss *schemaService) ListSchemas(ctx context.Context) ([]*repo.MetadataSchema, error) {
+	return ss.schemas.List(ctx)
+}
+
+func (ss *schemaService) GetSchema(ctx context.Context, name string) (*repo.MetadataSchema, error) {
+	return ss.schemas.Get(ctx, name)
+}
+
+func (ss *schemaService) PutSchema(ctx context.Context, s *repo.MetadataSchema) (*repo.MetadataSchema, error) {
+	if !schemaName.MatchString(s.Name) {
+		return nil, fmt.Errorf("%w: %q is not a name of up to 128 letters, digits, ., _ and -", ErrInvalidInput, s.Name)
+	}
+	if s.Kind != "" && s.Tag != "" {
+		return nil, fmt.Errorf("%w: a schema is registered for a kind or for a tag, not both", ErrInvalidInput)
+	}
+	if _, err := ss.compiled.compile(s); err != nil {
+		return nil, err
+	}
+	return ss.schemas.Put(ctx, s)
+}
+
+func (ss *schemaService) DeleteSchema(ctx context.Context, name string) error {
+	return ss.schemas.Delete(ctx, name)
+}
+
+// Violations checks the current version of the contexts the schema applies to
+// against it, reporting up to limit contexts that do not follow it. The
+// contexts of the tenants with a key are not checked: their metadata is
+// encrypted and the kind and schema filters never match it.
+func (ss *schemaService) Violations(ctx context.Context, name string, limit int) (*ViolationReport, error) {
+	if limit <= 0 || limit > MaxViolations {
+		limit = MaxViolations
+	}
+	s, err := ss.schemas.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	report := &ViolationReport{Schema: s.Name, Version: s.Version, Contexts: []ContextViolations{}}
+	seen := map[string]bool{}
+	for _, q := range schemaQueries(s) {
+		done, err := ss.scan(ctx, s, q, limit, seen, report)
+		if err != nil {
+			ss.log.Errorf("Error listing the violations of schema %s: %v", name, err)
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return report, nil
+}
+
+// schemaQueries select the contexts s applies to, which may overlap.
+func schemaQueries(s *repo.MetadataSchema) []*query.ContextQuery {
+	qs := []*query.ContextQuery{{Metadata: []query.MetadataPredicate{{Key: SchemaMetadataKey, Op: query.MetadataEq, Values: []string{s.Name}}}}}
+	if s.Kind != "" {
+		qs = append(qs, &query.ContextQuery{Metadata: []query.MetadataPredicate{{Key: KindMetadataKey, Op: query.MetadataEq, Values: []string{s.Kind}}}})
+	}
+	if s.Tag != "" {
+		qs = append(qs, &query.ContextQuery{TagsAny: []string{s.Tag}})
+	}
+	return qs
+}
+
+// scan adds the contexts matching q that violate s to the report, and tells
+// when the report is full.
+func (ss *schemaService) scan(ctx context.Context, s *repo.MetadataSchema, q *query.ContextQuery, limit int, seen map[string]bool, report *ViolationReport) (bool, error) {
+	page := query.Page{Sort: query.SortCreatedTime, Limit: ss.pageLimit, OmitContent: true}
+	for {
+		list, err := ss.contexts.Query(ctx, q, page)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range list.Items {
+			if seen[c.ID] {
+				continue
+			}
+			seen[c.ID] = true
+			report.Scanned++
+			violations, err := ss.compiled.validate([]*repo.MetadataSchema{s}, c.Metadata)
+			if err != nil {
+				return false, err
+			}
+			if len(violations) == 0 {
+				continue
+			}
+			if len(report.Contexts) == limit {
+				report.Truncated = true
+				return true, nil
+			}
+			report.Contexts = append(report.Contexts, ContextViolations{ContextID: c.ID, Name: c.Name, Version: c.Version, Violations: violations})
+		}
+		if list.NextCursor == "" {
+			return false, nil
+		}
+		if page.After, err = query.DecodeCursor(list.NextCursor); err != nil {
+			return false, err
+		}
+	}
+}
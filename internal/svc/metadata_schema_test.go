@@ -0,0 +1,270 @@
+package svc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mangudaigb/context-service/internal/jsonschema"
+	"github.com/mangudaigb/context-service/internal/patch"
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/dhauli-base/config"
+	"github.com/mangudaigb/dhauli-base/logger"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+const personaSchema = `{"type": "object", "required": ["audience"], "properties": {"audience": {"enum": ["internal", "external"]}}}`
+
+func putSchema(t *testing.T, ss SchemaService, s *repo.MetadataSchema) *repo.MetadataSchema {
+	t.Helper()
+	put, err := ss.PutSchema(context.Background(), s)
+	if err != nil {
+		t.Fatalf("put schema %s: %v", s.Name, err)
+	}
+	return put
+}
+
+func newSchemaService(t *testing.T, env *testEnv) *schemaService {
+	t.Helper()
+	log, err := logger.NewLogger(&config.Config{})
+	if err != nil {
+		t.Fatalf("creating logger: %v", err)
+	}
+	return NewSchemaService(log, env.sRepo, env.cRepo).(*schemaService)
+}
+
+func metadataError(t *testing.T, err error) []MetadataViolation {
+	t.Helper()
+	var merr *MetadataError
+	if !errors.As(err, &merr) || !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected a MetadataError, got %v", err)
+	}
+	return merr.Violations
+}
+
+func TestMetadataValidation(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	ss := newSchemaService(t, env)
+	putSchema(t, ss, &repo.MetadataSchema{Name: "persona", Kind: "persona", Schema: json.RawMessage(personaSchema)})
+	putSchema(t, ss, &repo.MetadataSchema{Name: "owned", Tag: "prod", Schema: json.RawMessage(`{"required": ["owner"]}`)})
+	putSchema(t, ss, &repo.MetadataSchema{Name: "versioned", Schema: json.RawMessage(`{"properties": {"rev": {"type": "integer"}}}`)})
+
+	c := &entities.Context{ID: "c1", Name: "n", Content: "v1", Tags: []string{"prod"}, Metadata: map[string]interface{}{"kind": "persona", "audience": "everyone"}}
+	want := []MetadataViolation{
+		{Schema: "owned", Path: "/owner", Message: "is required"},
+		{Schema: "persona", Path: "/audience", Message: `must be one of ["internal","external"]`},
+	}
+	if _, err := env.svc.CreateContext(ctx, c); !reflect.DeepEqual(metadataError(t, err), want) {
+		t.Fatalf("got %v, want %v", err, want)
+	}
+
+	c.Metadata = map[string]interface{}{"kind": "persona", "audience": "internal", "owner": "ada", "schema": "versioned", "rev": 1.0}
+	created, err := env.svc.CreateContext(ctx, c)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	update := *created
+	update.Metadata = map[string]interface{}{"kind": "persona", "audience": "internal", "owner": "ada", "schema": "versioned", "rev": "two"}
+	if _, err := env.svc.UpdateContext(ctx, &update); !reflect.DeepEqual(metadataError(t, err), []MetadataViolation{{Schema: "versioned", Path: "/rev", Message: "must be of type integer"}}) {
+		t.Fatalf("unexpected update error: %v", err)
+	}
+	update.Metadata["schema"] = "missing"
+	update.Metadata["rev"] = 2.0
+	if _, err := env.svc.UpdateContext(ctx, &update); !reflect.DeepEqual(metadataError(t, err), []MetadataViolation{{Schema: "missing", Path: "/schema", Message: "is not a registered schema"}}) {
+		t.Fatalf("unexpected update error: %v", err)
+	}
+
+	p := mustPatch(t, patch.MergePatchType, `{"metadata": {"audience": null}}`)
+	if _, err := env.svc.PatchContext(ctx, "c1", 0, p); !reflect.DeepEqual(metadataError(t, err), []MetadataViolation{{Schema: "persona", Path: "/audience", Message: "is required"}}) {
+		t.Fatalf("unexpected patch error: %v", err)
+	}
+	if stored, _ := env.cRepo.GetByID(ctx, "c1"); stored.Version != 1 {
+		t.Fatalf("a rejected write must not apply, at version %d", stored.Version)
+	}
+
+	report, err := env.svc.BatchContexts(ctx, []BatchOperation{
+		{Op: BatchCreate, Context: &entities.Context{Name: "a", Content: "a", Metadata: map[string]interface{}{"kind": "persona"}}},
+		{Op: BatchCreate, Context: &entities.Context{Name: "b", Content: "b", Metadata: map[string]interface{}{"kind": "persona", "audience": "external"}}},
+	}, false, entities.UserStub{})
+	if err != nil {
+		t.Fatalf("batch: %v", err)
+	}
+	if r := report.Results; r[0].Status != BatchFailed || r[0].Code != BatchInvalid || r[1].Status != BatchCreated {
+		t.Fatalf("unexpected batch results: %+v", r)
+	}
+}
+
+// TestMetadataValidationOnWritePaths registers a schema after writing
+// versions, trashed contexts and branch heads it does not accept, and expects
+// every path writing them back to refuse.
+func TestMetadataValidationOnWritePaths(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	valid := map[string]interface{}{"kind": "persona", "audience": "internal"}
+	invalid := map[string]interface{}{"kind": "persona", "audience": "everyone"}
+
+	c1, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c1", Name: "n", Content: "v1", Metadata: invalid, Tenants: acme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := *c1
+	update.Content, update.Metadata = "v2", valid
+	if _, err := env.svc.UpdateContext(ctx, &update); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "c2", Name: "n", Content: "x", Metadata: invalid}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.svc.DeleteContext(ctx, "c2", 0, entities.UserStub{}); err != nil {
+		t.Fatal(err)
+	}
+	for branch, md := range map[string]map[string]interface{}{"draft": valid, "bad": invalid} {
+		if _, err := env.svc.CreateBranch(ctx, "c1", branch, 0, entities.UserStub{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := env.svc.CommitToBranch(ctx, "c1", branch, &entities.Context{Name: "n", Content: "v3", Metadata: md}, 0, entities.UserStub{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putSchema(t, newSchemaService(t, env), &repo.MetadataSchema{Name: "persona", Kind: "persona", Schema: json.RawMessage(personaSchema)})
+
+	writes := map[string]func() error{
+		"revert": func() error {
+			_, err := env.svc.RevertContext(ctx, "c1", query.VersionRef{Version: 1}, 0)
+			return err
+		},
+		"fork": func() error {
+			_, err := env.svc.ForkContext(ctx, "c1", query.VersionRef{Version: 1}, ForkOptions{})
+			return err
+		},
+		"branch commit": func() error {
+			_, err := env.svc.CommitToBranch(ctx, "c1", "draft", &entities.Context{Name: "n", Content: "v4", Metadata: invalid}, 0, entities.UserStub{})
+			return err
+		},
+		"merge": func() error {
+			_, err := env.svc.MergeBranch(ctx, "c1", "bad", 0, nil)
+			return err
+		},
+		"merge resolution": func() error {
+			_, err := env.svc.MergeBranch(ctx, "c1", "draft", 0, &entities.Context{Name: "n", Content: "v3", Metadata: invalid})
+			return err
+		},
+		"restore": func() error {
+			_, err := env.svc.RestoreContext(ctx, "c2")
+			return err
+		},
+	}
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			metadataError(t, write())
+			if stored, _ := env.cRepo.GetByID(ctx, "c1"); stored.Version != 2 {
+				t.Fatalf("a rejected write must not apply, c1 at version %d", stored.Version)
+			}
+		})
+	}
+
+	var export bytes.Buffer
+	if err := json.NewEncoder(&export).Encode(TransferRecord{Kind: RecordContext, Context: &entities.Context{ID: "c3", Name: "n", Content: "x", Metadata: invalid, Tenants: acme}}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := env.svc.ImportContexts(ctx, &export, acmeQuery(), ImportFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := report.Results; len(r) != 1 || r[0].Status != ImportRejected {
+		t.Fatalf("expected the import to be rejected, got %+v", r)
+	}
+	if _, err := env.cRepo.GetByID(ctx, "c3"); !errors.Is(err, repo.ErrContextNotFound) {
+		t.Fatalf("a rejected import must not be stored, got %v", err)
+	}
+}
+
+func TestPutSchemaErrors(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	ss := newSchemaService(t, env)
+	first := putSchema(t, ss, &repo.MetadataSchema{Name: "persona", Kind: "persona", Schema: json.RawMessage(`{}`)})
+	if first.Version != 1 {
+		t.Fatalf("unexpected version %d", first.Version)
+	}
+
+	if _, err := ss.PutSchema(ctx, &repo.MetadataSchema{Name: "other", Kind: "persona", Schema: json.RawMessage(`{}`)}); !errors.Is(err, repo.ErrSchemaConflict) {
+		t.Fatalf("expected ErrSchemaConflict, got %v", err)
+	}
+	if _, err := ss.PutSchema(ctx, &repo.MetadataSchema{Name: "other", Schema: json.RawMessage(`{"type": "date"}`)}); !errors.Is(err, jsonschema.ErrInvalidSchema) {
+		t.Fatalf("expected ErrInvalidSchema, got %v", err)
+	}
+	for _, s := range []*repo.MetadataSchema{
+		{Name: "a b", Schema: json.RawMessage(`{}`)},
+		{Name: "both", Kind: "k", Tag: "t", Schema: json.RawMessage(`{}`)},
+	} {
+		if _, err := ss.PutSchema(ctx, s); !errors.Is(err, ErrInvalidInput) {
+			t.Fatalf("%s: expected ErrInvalidInput, got %v", s.Name, err)
+		}
+	}
+
+	second := putSchema(t, ss, &repo.MetadataSchema{Name: "persona", Tag: "persona", Schema: json.RawMessage(`{"type": "object"}`)})
+	if second.Version != 2 || second.Kind != "" || second.Tag != "persona" || string(second.Schema) != `{"type": "object"}` || !second.CreatedTime.Equal(first.CreatedTime) {
+		t.Fatalf("unexpected replacement: %+v", second)
+	}
+	if err := ss.DeleteSchema(ctx, "persona"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.GetSchema(ctx, "persona"); !errors.Is(err, repo.ErrSchemaNotFound) {
+		t.Fatalf("expected ErrSchemaNotFound, got %v", err)
+	}
+}
+
+func TestViolations(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t, false)
+	ss := newSchemaService(t, env)
+	ss.pageLimit = 2
+	putSchema(t, ss, &repo.MetadataSchema{Name: "persona", Kind: "persona", Schema: json.RawMessage(`{}`)})
+	for i, audience := range []string{"internal", "everyone", "external", "", "nobody"} {
+		md := map[string]interface{}{"kind": "persona"}
+		if audience != "" {
+			md["audience"] = audience
+		}
+		c := &entities.Context{ID: fmt.Sprintf("p%d", i), Name: "p", Content: "c", Metadata: md}
+		if i == 4 {
+			c.Metadata = map[string]interface{}{"schema": "persona", "kind": "agent", "audience": audience}
+		}
+		if _, err := env.svc.CreateContext(ctx, c); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if _, err := env.svc.CreateContext(ctx, &entities.Context{ID: "other", Name: "o", Content: "c", Metadata: map[string]interface{}{"kind": "agent"}}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	putSchema(t, ss, &repo.MetadataSchema{Name: "persona", Kind: "persona", Schema: json.RawMessage(personaSchema)})
+	report, err := ss.Violations(ctx, "persona", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, cv := range report.Contexts {
+		ids = append(ids, cv.ContextID)
+	}
+	if report.Version != 2 || report.Scanned != 5 || report.Truncated || !reflect.DeepEqual(ids, []string{"p4", "p1", "p3"}) {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if v := report.Contexts[2].Violations; len(v) != 1 || v[0].Path != "/audience" || v[0].Message != "is required" {
+		t.Fatalf("unexpected violations: %+v", v)
+	}
+
+	if report, err = ss.Violations(ctx, "persona", 2); err != nil || len(report.Contexts) != 2 || !report.Truncated {
+		t.Fatalf("unexpected truncated report: %+v, %v", report, err)
+	}
+	if _, err := ss.Violations(ctx, "missing", 0); !errors.Is(err, repo.ErrSchemaNotFound) {
+		t.Fatalf("expected ErrSchemaNotFound, got %v", err)
+	}
+}
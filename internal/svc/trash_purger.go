@@ -0,0 +1,62 @@
+package svc
+
+import (
+	"context"
+	"time"
+
+	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
+	"github.com/mangudaigb/dhauli-base/logger"
+)
+
+// trashPurgeJob names the lease of the trash purger.
+const trashPurgeJob = "trash_purge"
+
+// TrashPurger periodically purges the contexts that stayed in the trash
+// longer than the retention period, then sweeps the content files left
+// unreferenced. Every replica runs one; the lease of the job lets a single
+// one of them purge at a time.
+type TrashPurger struct {
+	log      *logger.Logger
+	cSvc     ContextService
+	lease    *jobLease
+	settings settings.TrashSettings
+}
+
+func NewTrashPurger(log *logger.Logger, cSvc ContextService, leases repo.LeaseRepository, s settings.TrashSettings) (*TrashPurger, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &TrashPurger{
+		log:      log,
+		cSvc:     cSvc,
+		lease:    newJobLease(leases, trashPurgeJob, s.PurgeInterval),
+		settings: s,
+	}, nil
+}
+
+// Run purges once right away and then every purge interval until ctx is
+// done, when the replica holds the lease.
+func (tp *TrashPurger) Run(ctx context.Context) {
+	runLeased(ctx, tp.log, tp.lease, tp.settings.PurgeInterval, tp.purge)
+}
+
+func (tp *TrashPurger) purge(ctx context.Context) {
+	before := time.Now().UTC().Add(-tp.settings.Retention)
+	n, err := tp.cSvc.PurgeTrash(ctx, before, tp.settings.PurgeBatch)
+	if err != nil {
+		tp.log.Errorf("Error purging contexts trashed before %s: %v", before.Format(time.RFC3339), err)
+		return
+	}
+	if n > 0 {
+		tp.log.Infof("Purged %d contexts trashed before %s", n, before.Format(time.RFC3339))
+	}
+	files, err := tp.cSvc.SweepContentFiles(ctx)
+	if err != nil {
+		tp.log.Errorf("Error sweeping the content files: %v", err)
+		return
+	}
+	if files > 0 {
+		tp.log.Infof("Removed %d unreferenced content files", files)
+	}
+}
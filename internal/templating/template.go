@@ -0,0 +1,238 @@
+// Package templating substitutes variables into context content. A
+// placeholder is a variable name in double braces, {{tone}} or {{ tone }};
+// there are no expressions, functions or control structures, and the
+// substituted values are not scanned again, so that rendering cannot do more
+// than insert the given values. Anything else in double braces is left as is.
+package templating
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidDeclaration is returned for variable declarations that are
+	// not well formed.
+	ErrInvalidDeclaration = errors.New("invalid variable declaration")
+	// ErrInvalidValues is wrapped by the ValuesError of a rendering.
+	ErrInvalidValues = errors.New("invalid variable values")
+	// ErrUndeclared is returned for content using variables it does not
+	// declare.
+	ErrUndeclared = errors.New("undeclared variables")
+)
+
+type Type string
+
+const (
+	String  Type = "string"
+	Number  Type = "number"
+	Integer Type = "integer"
+	Boolean Type = "boolean"
+)
+
+// Variable declares a variable of the content. A variable that is not
+// required and has no default renders as the empty string when no value is
+// given.
+type Variable struct {
+	Name        string      `json:"name" bson:"name"`
+	Type        Type        `json:"type" bson:"type"`
+	Required    bool        `json:"required,omitempty" bson:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty" bson:"default,omitempty"`
+	Description string      `json:"description,omitempty" bson:"description,omitempty"`
+}
+
+var (
+	variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+	placeholder  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// Validate checks a set of declarations: well formed names, each declared
+// once, known types, and defaults of the type of their variable, which may
+// not be required. No variable may be named include, which starts the include
+// directives of the compose package.
+func Validate(vars []Variable) error {
+	seen := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		if !variableName.MatchString(v.Name) || v.Name == "include" {
+			return fmt.Errorf("%w: %q is not a name of up to 64 letters, digits and _, other than include", ErrInvalidDeclaration, v.Name)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("%w: %s is declared twice", ErrInvalidDeclaration, v.Name)
+		}
+		seen[v.Name] = true
+		switch v.Type {
+		case String, Number, Integer, Boolean:
+		default:
+			return fmt.Errorf("%w: %s has unknown type %q", ErrInvalidDeclaration, v.Name, v.Type)
+		}
+		if v.Default == nil {
+			continue
+		}
+		if v.Required {
+			return fmt.Errorf("%w: %s is required and cannot have a default", ErrInvalidDeclaration, v.Name)
+		}
+		if _, err := format(v.Type, v.Default); err != nil {
+			return fmt.Errorf("%w: default of %s: %v", ErrInvalidDeclaration, v.Name, err)
+		}
+	}
+	return nil
+}
+
+// Placeholders returns the names of the variables content uses, sorted.
+func Placeholders(content string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, m := range placeholder.FindAllStringSubmatch(content, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValuesError tells what is wrong with the values of a rendering, each list
+// sorted by variable name.
+type ValuesError struct {
+	Missing []string          `json:"missing,omitempty"`
+	Unknown []string          `json:"unknown,omitempty"`
+	Invalid map[string]string `json:"invalid,omitempty"`
+}
+
+func (e *ValuesError) Error() string {
+	var parts []string
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Unknown) > 0 {
+		parts = append(parts, "unknown "+strings.Join(e.Unknown, ", "))
+	}
+	names := make([]string, 0, len(e.Invalid))
+	for name := range e.Invalid {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name+" "+e.Invalid[name])
+	}
+	return ErrInvalidValues.Error() + ": " + strings.Join(parts, "; ")
+}
+
+func (e *ValuesError) Unwrap() error {
+	return ErrInvalidValues
+}
+
+// resolve checks values against the declarations and returns the values of
+// every declared variable as rendered, defaults included.
+func resolve(vars []Variable, values map[string]interface{}) (map[string]string, error) {
+	verr := &ValuesError{}
+	declared := make(map[string]bool, len(vars))
+	resolved := make(map[string]string, len(vars))
+	for _, v := range vars {
+		declared[v.Name] = true
+		value, ok := values[v.Name]
+		if !ok || value == nil {
+			value = v.Default
+		}
+		if value == nil {
+			if v.Required {
+				verr.Missing = append(verr.Missing, v.Name)
+			}
+			resolved[v.Name] = ""
+			continue
+		}
+		s, err := format(v.Type, value)
+		if err != nil {
+			if verr.Invalid == nil {
+				verr.Invalid = map[string]string{}
+			}
+			verr.Invalid[v.Name] = err.Error()
+			continue
+		}
+		resolved[v.Name] = s
+	}
+	for name := range values {
+		if !declared[name] {
+			verr.Unknown = append(verr.Unknown, name)
+		}
+	}
+	if len(verr.Missing)+len(verr.Unknown)+len(verr.Invalid) > 0 {
+		sort.Strings(verr.Missing)
+		sort.Strings(verr.Unknown)
+		return nil, verr
+	}
+	return resolved, nil
+}
+
+// Render substitutes the values into the placeholders of content, which may
+// only use declared variables.
+func Render(content string, vars []Variable, values map[string]interface{}) (string, error) {
+	declared := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		declared[v.Name] = true
+	}
+	var undeclared []string
+	for _, name := range Placeholders(content) {
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	if len(undeclared) > 0 {
+		return "", fmt.Errorf("%w: %s", ErrUndeclared, strings.Join(undeclared, ", "))
+	}
+	resolved, err := resolve(vars, values)
+	if err != nil {
+		return "", err
+	}
+	return placeholder.ReplaceAllStringFunc(content, func(m string) string {
+		return resolved[placeholder.FindStringSubmatch(m)[1]]
+	}), nil
+}
+
+// format renders a value of type t. Numbers come as float64 from JSON, and
+// as the integer types from bson.
+func format(t Type, value interface{}) (string, error) {
+	switch t {
+	case String:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case Boolean:
+		if b, ok := value.(bool); ok {
+			return strconv.FormatBool(b), nil
+		}
+	case Number, Integer:
+		f, ok := toFloat(value)
+		if !ok {
+			break
+		}
+		if t == Integer {
+			if f != math.Trunc(f) || math.IsInf(f, 0) {
+				return "", errors.New("must be an integer")
+			}
+			return strconv.FormatInt(int64(f), 10), nil
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("must be a %s", t)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, !math.IsNaN(n)
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
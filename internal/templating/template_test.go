@@ -0,0 +1,68 @@
+package templating
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var vars = []Variable{
+	{Name: "customer", Type: String, Required: true},
+	{Name: "tone", Type: String, Default: "formal"},
+	{Name: "max_words", Type: Integer, Default: 200.0},
+	{Name: "temperature", Type: Number},
+	{Name: "cite", Type: Boolean},
+}
+
+func TestRender(t *testing.T) {
+	content := "Help {{customer}} in a {{ tone }} tone, in {{max_words}} words, citing: {{cite}}.{{temperature}} {{ .Exec \"rm\" }} {{not-a-name}}"
+	got, err := Render(content, vars, map[string]interface{}{"customer": "{{tone}}", "cite": true, "temperature": 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Help {{tone}} in a formal tone, in 200 words, citing: true.0.5 {{ .Exec \"rm\" }} {{not-a-name}}"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	_, err := Render("{{customer}}", vars, map[string]interface{}{"max_words": 2.5, "colour": "red", "cite": "yes"})
+	var verr *ValuesError
+	if !errors.As(err, &verr) || !errors.Is(err, ErrInvalidValues) {
+		t.Fatalf("expected a ValuesError, got %v", err)
+	}
+	want := &ValuesError{
+		Missing: []string{"customer"},
+		Unknown: []string{"colour"},
+		Invalid: map[string]string{"max_words": "must be an integer", "cite": "must be a boolean"},
+	}
+	if !reflect.DeepEqual(verr, want) {
+		t.Fatalf("got %+v, want %+v", verr, want)
+	}
+	if err.Error() != "invalid variable values: missing customer; unknown colour; cite must be a boolean; max_words must be an integer" {
+		t.Fatalf("unexpected message: %v", err)
+	}
+
+	if _, err := Render("{{customer}} {{region}} {{city}}", vars, nil); !errors.Is(err, ErrUndeclared) || err.Error() != "undeclared variables: city, region" {
+		t.Fatalf("expected the undeclared variables, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(vars); err != nil {
+		t.Fatal(err)
+	}
+	for name, decls := range map[string][]Variable{
+		"bad name":         {{Name: "max-words", Type: Integer}},
+		"reserved name":    {{Name: "include", Type: String}},
+		"twice":            {{Name: "a", Type: String}, {Name: "a", Type: Number}},
+		"unknown type":     {{Name: "a", Type: "date"}},
+		"required default": {{Name: "a", Type: String, Required: true, Default: "x"}},
+		"default type":     {{Name: "a", Type: Boolean, Default: "yes"}},
+	} {
+		if err := Validate(decls); !errors.Is(err, ErrInvalidDeclaration) {
+			t.Fatalf("%s: expected ErrInvalidDeclaration, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package tokenizer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidFit = errors.New("invalid fit")
+
+// Strategy is how Fit cuts content that exceeds the budget.
+type Strategy string
+
+const (
+	// Head keeps the first tokens.
+	Head Strategy = "head"
+	// Tail keeps the last tokens.
+	Tail Strategy = "tail"
+	// Sections drops whole sections, see Fit.
+	Sections Strategy = "sections"
+)
+
+// Fitted is content cut down to a budget. Dropped lists the titles of the
+// sections the Sections strategy dropped, in the order it dropped them, the
+// text before the first heading being titled "".
+type Fitted struct {
+	Content        string   `json:"content"`
+	Tokens         int      `json:"tokens"`
+	OriginalTokens int      `json:"originalTokens"`
+	Truncated      bool     `json:"truncated"`
+	Dropped        []string `json:"droppedSections,omitempty"`
+}
+
+// Fit cuts content down to budget tokens of t. The Sections strategy splits
+// the content at its markdown headings and drops the sections of lowest
+// priority first, the later of equal ones first, priorities being given by
+// section title and defaulting to 0; it keeps the order of the remaining
+// sections, and cuts the last one standing like Head if it still exceeds the
+// budget.
+func Fit(t Tokenizer, content string, budget int, s Strategy, priorities map[string]int) (*Fitted, error) {
+	if budget <= 0 {
+		return nil, fmt.Errorf("%w: the budget must be a positive number of tokens", ErrInvalidFit)
+	}
+	tokens := t.Split(content)
+	fitted := &Fitted{Content: content, Tokens: len(tokens), OriginalTokens: len(tokens)}
+	switch s {
+	case Head, Tail:
+	case Sections:
+		if len(tokens) > budget {
+			fitted.Content, fitted.Dropped = dropSections(t, content, budget, priorities)
+			tokens = t.Split(fitted.Content)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown strategy %q, use %s, %s or %s", ErrInvalidFit, s, Head, Tail, Sections)
+	}
+	if len(tokens) > budget {
+		if s == Tail {
+			tokens = tokens[len(tokens)-budget:]
+		} else {
+			tokens = tokens[:budget]
+		}
+		fitted.Content = strings.Join(tokens, "")
+	}
+	fitted.Tokens = len(tokens)
+	fitted.Truncated = fitted.Tokens < fitted.OriginalTokens
+	return fitted, nil
+}
+
+type section struct {
+	title    string
+	text     string
+	tokens   int
+	priority int
+}
+
+// dropSections returns the content of the sections kept within budget, but
+// one, and the titles of those dropped.
+func dropSections(t Tokenizer, content string, budget int, priorities map[string]int) (string, []string) {
+	secs := splitSections(content)
+	total := 0
+	for _, sec := range secs {
+		sec.tokens = Count(t, sec.text)
+		sec.priority = priorities[sec.title]
+		total += sec.tokens
+	}
+	var dropped []string
+	for total > budget && len(secs) > 1 {
+		victim := 0
+		for i, sec := range secs {
+			if sec.priority <= secs[victim].priority {
+				victim = i
+			}
+		}
+		total -= secs[victim].tokens
+		dropped = append(dropped, secs[victim].title)
+		secs = append(secs[:victim], secs[victim+1:]...)
+	}
+	var b strings.Builder
+	for _, sec := range secs {
+		b.WriteString(sec.text)
+	}
+	return b.String(), dropped
+}
+
+var (
+	heading = regexp.MustCompile(`^ {0,3}#{1,6}[ \t]+(.*?)[ \t#]*$`)
+	fence   = regexp.MustCompile("^ {0,3}(```|~~~)")
+)
+
+// splitSections splits content at the lines of its markdown headings, which
+// start a section each, leaving out the lines of fenced code blocks. The text
+// before the first heading is a section titled "" when it is not empty.
+func splitSections(content string) []*section {
+	var secs []*section
+	title, start, at := "", 0, 0
+	inFence := false
+	for _, line := range strings.SplitAfter(content, "\n") {
+		bare := strings.TrimRight(line, "\r\n")
+		if fence.MatchString(bare) {
+			inFence = !inFence
+		}
+		if m := heading.FindStringSubmatch(bare); m != nil && !inFence {
+			if at > start {
+				secs = append(secs, &section{title: title, text: content[start:at]})
+			}
+			title, start = m[1], at
+		}
+		at += len(line)
+	}
+	if at > start {
+		secs = append(secs, &section{title: title, text: content[start:at]})
+	}
+	return secs
+}
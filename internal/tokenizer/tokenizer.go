@@ -0,0 +1,132 @@
+// Package tokenizer measures content in model tokens and cuts it down to a
+// token budget. Tokenizers are pluggable; Approximate, the built-in one, needs
+// no vocabulary nor network and approaches the counts of the BPE tokenizers
+// of the common models on English prose and code.
+package tokenizer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer splits text into tokens.
+type Tokenizer interface {
+	// Name identifies the tokenizer, and the version of its rules, in the
+	// counts it made.
+	Name() string
+	// Split returns the tokens of text, which concatenate back to text.
+	Split(text string) []string
+}
+
+// Count returns the number of tokens of text.
+func Count(t Tokenizer, text string) int {
+	return len(t.Split(text))
+}
+
+const (
+	// wholeWordLetters is the length up to which a word is taken for a
+	// single token, as the common words are in the BPE vocabularies.
+	wholeWordLetters = 7
+	// lettersPerToken is the length of the pieces longer words split into.
+	lettersPerToken = 5
+	// digitsPerToken is the length of the pieces numbers split into.
+	digitsPerToken = 3
+)
+
+// Approximate mimics the pre-tokenization of the BPE tokenizers: a space
+// joins the word, number or symbol after it, words of up to 7 letters are one
+// token and longer ones one every 5 letters, numbers one every 3 digits,
+// ideographs and other symbols one each, a newline one, and a run of other
+// whitespace one.
+type Approximate struct{}
+
+func NewApproximate() Approximate {
+	return Approximate{}
+}
+
+func (Approximate) Name() string {
+	return "approx-bpe-1"
+}
+
+func (Approximate) Split(text string) []string {
+	var tokens []string
+	for i := 0; i < len(text); {
+		start := i
+		r, w := utf8.DecodeRuneInString(text[i:])
+		if r == ' ' {
+			if next, nw := utf8.DecodeRuneInString(text[i+1:]); i+1 < len(text) && !unicode.IsSpace(next) {
+				i++
+				r, w = next, nw
+			}
+		}
+		switch {
+		case r == '\n':
+			i += w
+		case unicode.IsSpace(r):
+			i = spaceRun(text, i)
+		case isIdeograph(r):
+			i += w
+		case unicode.IsLetter(r):
+			end := run(text, i, isWordRune, 0)
+			if utf8.RuneCountInString(text[i:end]) <= wholeWordLetters {
+				i = end
+				break
+			}
+			i = run(text, i, isWordRune, lettersPerToken)
+			tokens = append(tokens, text[start:i])
+			for i < end {
+				start = i
+				i = run(text, i, isWordRune, lettersPerToken)
+				tokens = append(tokens, text[start:i])
+			}
+			continue
+		case unicode.IsDigit(r):
+			end := run(text, i, unicode.IsDigit, 0)
+			i = run(text, i, unicode.IsDigit, digitsPerToken)
+			tokens = append(tokens, text[start:i])
+			for i < end {
+				start = i
+				i = run(text, i, unicode.IsDigit, digitsPerToken)
+				tokens = append(tokens, text[start:i])
+			}
+			continue
+		default:
+			i += w
+		}
+		tokens = append(tokens, text[start:i])
+	}
+	return tokens
+}
+
+// run returns the end of the run of runes satisfying in from i, stopping
+// after max runes when max is not 0.
+func run(text string, i int, in func(rune) bool, max int) int {
+	for n := 0; i < len(text) && (max == 0 || n < max); n++ {
+		r, w := utf8.DecodeRuneInString(text[i:])
+		if !in(r) || isIdeograph(r) {
+			break
+		}
+		i += w
+	}
+	return i
+}
+
+// spaceRun returns the end of the whitespace other than newlines from i,
+// leaving out the last space when it starts the next token.
+func spaceRun(text string, i int) int {
+	end := run(text, i, func(r rune) bool { return r != '\n' && unicode.IsSpace(r) }, 0)
+	if end < len(text) && end-i > 1 && text[end-1] == ' ' && text[end] != '\n' {
+		end--
+	}
+	return end
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r)
+}
+
+// isIdeograph tells whether r is of a script written without spaces, whose
+// runes get a token each.
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai)
+}
@@ -0,0 +1,66 @@
+package tokenizer
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApproximateSplit(t *testing.T) {
+	text := "Hello, world!\n  indented 12345 tokenization 中文"
+	got := NewApproximate().Split(text)
+	want := []string{"Hello", ",", " world", "!", "\n", " ", " inden", "ted", " 123", "45", " token", "izati", "on", " 中", "文"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if strings.Join(got, "") != text {
+		t.Fatalf("the tokens do not concatenate back to the text")
+	}
+	for _, text := range []string{"", " ", "a  ", "\xff\xfe x", "  \n\t\tb"} {
+		if joined := strings.Join(NewApproximate().Split(text), ""); joined != text {
+			t.Errorf("%q split and joined back is %q", text, joined)
+		}
+	}
+}
+
+const prompt = "Intro line.\n" +
+	"# Rules\nBe nice.\n" +
+	"# Examples\nQ: hi\n```\n# not a heading\n```\n" +
+	"# Notes\nextra words here\n"
+
+func TestFit(t *testing.T) {
+	tok := NewApproximate()
+	if n := Count(tok, prompt); n != 39 {
+		t.Fatalf("unexpected count %d", n)
+	}
+	priorities := map[string]int{"Rules": 2, "Examples": 1}
+	for name, tc := range map[string]struct {
+		strategy Strategy
+		budget   int
+		want     Fitted
+	}{
+		"head":     {Head, 3, Fitted{Content: "Intro line.", Tokens: 3, Truncated: true}},
+		"tail":     {Tail, 3, Fitted{Content: " words here\n", Tokens: 3, Truncated: true}},
+		"fits":     {Head, 39, Fitted{Content: prompt, Tokens: 39}},
+		"sections": {Sections, 30, Fitted{Content: prompt[12:70], Tokens: 28, Truncated: true, Dropped: []string{"Notes", ""}}},
+		"one left": {Sections, 20, Fitted{Content: "# Rules\nBe nice.\n", Tokens: 7, Truncated: true, Dropped: []string{"Notes", "", "Examples"}}},
+		"cut last": {Sections, 5, Fitted{Content: "# Rules\nBe nice", Tokens: 5, Truncated: true, Dropped: []string{"Notes", "", "Examples"}}},
+	} {
+		tc.want.OriginalTokens = 39
+		got, err := Fit(tok, prompt, tc.budget, tc.strategy, priorities)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", name, *got, tc.want)
+		}
+	}
+
+	if _, err := Fit(tok, prompt, 0, Head, nil); !errors.Is(err, ErrInvalidFit) {
+		t.Fatalf("expected ErrInvalidFit for a zero budget, got %v", err)
+	}
+	if _, err := Fit(tok, prompt, 10, "middle", nil); !errors.Is(err, ErrInvalidFit) {
+		t.Fatalf("expected ErrInvalidFit for an unknown strategy, got %v", err)
+	}
+}
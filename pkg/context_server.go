@@ -9,9 +9,12 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mangudaigb/context-service/internal/encryption"
 	"github.com/mangudaigb/context-service/internal/handler"
 	"github.com/mangudaigb/context-service/internal/repo"
+	"github.com/mangudaigb/context-service/internal/settings"
 	"github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
 	"github.com/mangudaigb/dhauli-base/config"
 	"github.com/mangudaigb/dhauli-base/consumer"
 	"github.com/mangudaigb/dhauli-base/db"
@@ -26,39 +29,82 @@ type HttpServer struct {
 }
 
 type ContextServer struct {
-	log *logger.Logger
-	cfg *config.Config
-	tr  trace.Tracer
+	log      *logger.Logger
+	cfg      *config.Config
+	settings *settings.Settings
+	tr       trace.Tracer
 }
 
-func NewContextServer(cfg *config.Config, tr trace.Tracer, log *logger.Logger) *ContextServer {
+func NewContextServer(cfg *config.Config, set *settings.Settings, tr trace.Tracer, log *logger.Logger) *ContextServer {
 	return &ContextServer{
-		log: log,
-		cfg: cfg,
-		tr:  tr,
+		log:      log,
+		cfg:      cfg,
+		settings: set,
+		tr:       tr,
 	}
 }
 
-func SetupRouter(log *logger.Logger, cSvc svc.ContextService, chSvc svc.ContextHistoryService) *gin.Engine {
+func SetupRouter(log *logger.Logger, cSvc svc.ContextService, chSvc svc.ContextHistoryService, hrSvc svc.HistoryRetentionService, sSvc svc.SchemaService) *gin.Engine {
 	r := gin.Default()
 	cHandler := handler.NewContextHandler(log, cSvc)
-	chHandler := handler.NewContextHistoryHandler(log, chSvc)
+	chHandler := handler.NewContextHistoryHandler(log, chSvc, cSvc)
+	hrHandler := handler.NewHistoryRetentionHandler(log, hrSvc)
+	sHandler := handler.NewSchemaHandler(log, sSvc)
+
+	r.GET("/contexts:action", cHandler.ContextsAction)
+	r.POST("/contexts:action", cHandler.ContextsAction)
 
 	contextRoutes := r.Group("/contexts")
 	{
 		contextRoutes.GET("/", cHandler.GetContextByFilter)
+		contextRoutes.GET("/search", cHandler.SearchContexts)
+		contextRoutes.GET("/trash", cHandler.ListTrash)
+		contextRoutes.GET("/history-retention", hrHandler.PreviewRetention)
 		contextRoutes.GET("/:cid", cHandler.GetContext)
 		contextRoutes.POST("/", cHandler.CreateContext)
-		contextRoutes.PATCH("/:cid", cHandler.UpdateContext) // Using PATCH for partial updates
+		contextRoutes.PATCH("/:cid", cHandler.UpdateContext) // merge patch, JSON patch, or the whole context as JSON
 		contextRoutes.DELETE("/:cid", cHandler.DeleteContext)
+		contextRoutes.POST("/:cid/restore", cHandler.RestoreContext)
+		contextRoutes.GET("/:cid/diff", cHandler.DiffContext)
+		contextRoutes.POST("/:cid/revert", cHandler.RevertContext)
+		contextRoutes.POST("/:cid/fork", cHandler.ForkContext)
+		contextRoutes.GET("/:cid/forks", cHandler.ListForks)
+		contextRoutes.GET("/:cid/lineage", cHandler.GetLineage)
+		contextRoutes.GET("/:cid/branches", cHandler.ListBranches)
+		contextRoutes.POST("/:cid/branches", cHandler.CreateBranch)
+		contextRoutes.GET("/:cid/branches/:branch", cHandler.GetBranch)
+		contextRoutes.DELETE("/:cid/branches/:branch", cHandler.DeleteBranch)
+		contextRoutes.GET("/:cid/branches/:branch/versions", cHandler.GetBranchVersions)
+		contextRoutes.POST("/:cid/branches/:branch/commits", cHandler.CommitToBranch)
+		contextRoutes.POST("/:cid/branches/:branch/merge", cHandler.MergeBranch)
+		contextRoutes.GET("/:cid/labels", cHandler.ListLabels)
+		contextRoutes.PUT("/:cid/labels/:label", cHandler.MoveLabel)
+		contextRoutes.DELETE("/:cid/labels/:label", cHandler.RemoveLabel)
+		contextRoutes.GET("/:cid/labels/:label/moves", cHandler.ListLabelMoves)
+		contextRoutes.GET("/:cid/label-moves", cHandler.ListLabelMoves)
+		contextRoutes.GET("/:cid/rendered", cHandler.GetRenderedContext)
+		contextRoutes.POST("/:cid/render", cHandler.RenderTemplate)
+		contextRoutes.GET("/:cid/variables", cHandler.GetVariables)
+		contextRoutes.PUT("/:cid/variables", cHandler.SetVariables)
+		contextRoutes.POST("/:cid/fit", cHandler.FitContext)
 
-		contextHistoryRoutes := r.Group("/:cid/context-histories")
+		contextHistoryRoutes := contextRoutes.Group("/:cid/context-histories")
 		{
 			contextHistoryRoutes.GET("/", chHandler.GetContextHistoryForContextID)
+			contextHistoryRoutes.GET("/retention", hrHandler.PreviewContextRetention)
 			contextHistoryRoutes.GET("/:hid", chHandler.GetContextHistoryItem)
 		}
 	}
 
+	schemaRoutes := r.Group("/schemas")
+	{
+		schemaRoutes.GET("/", sHandler.ListSchemas)
+		schemaRoutes.GET("/:name", sHandler.GetSchema)
+		schemaRoutes.PUT("/:name", sHandler.PutSchema)
+		schemaRoutes.DELETE("/:name", sHandler.DeleteSchema)
+		schemaRoutes.GET("/:name/violations", sHandler.ListViolations)
+	}
+
 	return r
 }
 
@@ -67,12 +113,34 @@ func (s *ContextServer) Start() {
 	if err != nil {
 		s.log.Fatalf("Error creating mongo client: %v", err)
 	}
-	var cRepo = repo.NewContextRepository(s.cfg, s.log, *mongoClient.Client, "context")
-	var chRepo = repo.NewContextHistoryRepository(s.cfg, s.log, *mongoClient.Client, "context_history")
+	enc, err := encryption.LoadEncryptor(s.settings.Encryption.KeyringFile)
+	if err != nil {
+		s.log.Fatalf("Error loading the keyring: %v", err)
+	}
+	var cRepo = repo.NewContextRepository(s.cfg, s.log, *mongoClient.Client, repo.ContextsCollection, s.settings.Storage.Contexts, enc)
+	var chRepo = repo.NewContextHistoryRepository(s.cfg, s.log, *mongoClient.Client, repo.ContextHistoriesCollection, s.settings.Storage.Histories, enc)
+	var sRepo = repo.NewSchemaRepository(s.cfg, s.log, *mongoClient.Client)
+	var leases = repo.NewLeaseRepository(s.cfg, s.log, *mongoClient.Client)
+	var transactor = repo.NewMongoTransactor(s.log, mongoClient.Client)
 	var chSvc = svc.NewContextHistoryService(s.log, chRepo)
-	var cSvc = svc.NewContextService(s.log, cRepo, chSvc)
+	var cSvc = svc.NewContextService(s.log, cRepo, chSvc, transactor, sRepo, tokenizer.NewApproximate())
+	var hrSvc = svc.NewHistoryRetentionService(s.log, chRepo, cRepo, transactor, s.settings.History)
+	var sSvc = svc.NewSchemaService(s.log, sRepo, cRepo)
 
-	router := SetupRouter(s.log, cSvc, chSvc)
+	router := SetupRouter(s.log, cSvc, chSvc, hrSvc, sSvc)
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	purger, err := svc.NewTrashPurger(s.log, cSvc, leases, s.settings.Trash)
+	if err != nil {
+		s.log.Fatalf("Error creating the trash purger: %v", err)
+	}
+	go purger.Run(jobsCtx)
+	compactor, err := svc.NewHistoryCompactor(s.log, hrSvc, leases, s.settings.History)
+	if err != nil {
+		s.log.Fatalf("Error creating the history compactor: %v", err)
+	}
+	go compactor.Run(jobsCtx)
 
 	serverAddr := fmt.Sprintf(":%d", s.cfg.Server.Port)
 
@@ -1,9 +1,136 @@
 package requests
 
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mangudaigb/context-service/internal/query"
+	"github.com/mangudaigb/context-service/internal/svc"
+	"github.com/mangudaigb/context-service/internal/tokenizer"
+	"github.com/mangudaigb/dhauli-base/types/entities"
+)
+
+// ContextRequest creates or deletes a context. The metadata of a created
+// context must follow its schemas. ExpectedVersion, when set on a
+// delete, is the version the caller saw; the delete fails if the context has
+// moved on since.
 type ContextRequest struct {
-	ID          string   `json:"id,omitempty"`
-	Name        string   `json:"name" binding:"required"`
-	Description string   `json:"description,omitempty"`
-	Content     string   `json:"content" binding:"required"`
-	Tags        []string `json:"tags,omitempty"`
+	ID              string                 `json:"id,omitempty"`
+	Name            string                 `json:"name" binding:"required"`
+	Description     string                 `json:"description,omitempty"`
+	Content         string                 `json:"content" binding:"required"`
+	Tags            []string               `json:"tags,omitempty"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	User            entities.UserStub      `json:"user,omitempty"`
+	ExpectedVersion int                    `json:"expectedVersion,omitempty"`
+}
+
+// RevertRequest designates the version to revert a context to, by history ID
+// or by version number. ExpectedVersion, when set, is the version the caller
+// expects the context to be at.
+type RevertRequest struct {
+	ID              string `json:"id,omitempty"`
+	HistoryID       string `json:"historyId,omitempty"`
+	Version         int    `json:"version,omitempty"`
+	ExpectedVersion int    `json:"expectedVersion,omitempty"`
+}
+
+func (r RevertRequest) Target() (query.VersionRef, error) {
+	switch {
+	case r.HistoryID != "" && r.Version != 0:
+		return query.VersionRef{}, fmt.Errorf("%w: give either a history id or a version", query.ErrInvalidQuery)
+	case r.HistoryID != "":
+		return query.VersionRef{HistoryID: r.HistoryID}, nil
+	case r.Version > 0:
+		return query.VersionRef{Version: r.Version}, nil
+	default:
+		return query.VersionRef{}, fmt.Errorf("%w: a history id or a positive version is required", query.ErrInvalidQuery)
+	}
+}
+
+// ForkRequest forks a context at the version designated by history ID or by
+// version number, the current version when neither is given. Name and
+// Description, when set, replace those of the version forked.
+type ForkRequest struct {
+	HistoryID   string            `json:"historyId,omitempty"`
+	Version     int               `json:"version,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Description string            `json:"description,omitempty"`
+	User        entities.UserStub `json:"user,omitempty"`
+}
+
+func (r ForkRequest) Source() (query.VersionRef, error) {
+	if r.HistoryID == "" && r.Version == 0 {
+		return query.VersionRef{Current: true}, nil
+	}
+	return RevertRequest{HistoryID: r.HistoryID, Version: r.Version}.Target()
+}
+
+// BranchRequest starts a branch from a version of the main line, the current
+// one when Version is 0.
+type BranchRequest struct {
+	Name    string `json:"name" binding:"required"`
+	Version int    `json:"version,omitempty"`
+}
+
+// MergeRequest merges a branch into the main line. ExpectedVersion, when set,
+// is the version of the context the merge applies to. Resolution, when set,
+// is the merged context as resolved by the caller after a merge reported
+// conflicts.
+type MergeRequest struct {
+	ExpectedVersion int               `json:"expectedVersion,omitempty"`
+	Resolution      *entities.Context `json:"resolution,omitempty"`
+}
+
+// BatchRequest runs operations on several contexts at once. When Atomic is
+// set, either every operation applies or none does.
+type BatchRequest struct {
+	Atomic     bool                 `json:"atomic,omitempty"`
+	Operations []svc.BatchOperation `json:"operations" binding:"required"`
+	User       entities.UserStub    `json:"user,omitempty"`
+}
+
+// LabelRequest points a label at a version of the main line, the current one
+// when Version is 0. From, when set, is the version the label must point at
+// for the move to apply. Reason is recorded with the move.
+type LabelRequest struct {
+	Version int    `json:"version,omitempty"`
+	From    int    `json:"from,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// GetRequest reads a context, as of the version its label points at when
+// Label is set.
+type GetRequest struct {
+	ID    string `json:"id"`
+	Label string `json:"label,omitempty"`
+}
+
+// RenderRequest renders a context with the values of its variables. Label and
+// TenantIDs qualify the rendering like the query parameters of GET
+// /contexts/:cid/rendered. ID is only read from messages, HTTP requests name
+// the context in their path.
+type RenderRequest struct {
+	ID        string                 `json:"id,omitempty"`
+	Label     string                 `json:"label,omitempty"`
+	TenantIDs []string               `json:"tenantIds,omitempty"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+// SchemaRequest registers a JSON Schema for the metadata of contexts, for
+// those of a kind, those carrying a tag, or only those declaring it.
+type SchemaRequest struct {
+	Kind        string          `json:"kind,omitempty"`
+	Tag         string          `json:"tag,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema" binding:"required"`
+}
+
+// FitRequest qualifies the fit of a context to a token budget: the strategy,
+// head by default, the label of the version to fit, and the priorities of the
+// sections by title for the sections strategy.
+type FitRequest struct {
+	Strategy   tokenizer.Strategy `json:"strategy,omitempty"`
+	Label      string             `json:"label,omitempty"`
+	Priorities map[string]int     `json:"priorities,omitempty"`
 }